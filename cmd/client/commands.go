@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+type command struct {
+	summary string
+	run     func(args []string, logger *utils.Logger) error
+}
+
+var commands = map[string]command{
+	"import":   {"convert a wg-quick .conf file into a KryptX config", runImport},
+	"dns":      {"show which resolver answers a name (test <name> [type])", runDNS},
+	"exec":     {"run a command through the tunnel (or around it with -bypass)", runExec},
+	"keys":     {"generate the key pair or show the public key to register", runKeys},
+	"leaktest": {"check DNS, IPv6, STUN and other traffic for leaks around the tunnel", runLeakTest},
+	"lockdown": {"block all traffic but the VPN from boot on (enable, disable, status)", runLockdown},
+	"servers":  {"list, probe or pick the configured servers", runServers},
+	"recover":  {"undo network changes left behind by a crashed session", runRecover},
+}
+
+func runCommand(name string, args []string, logger *utils.Logger) error {
+	cmd, ok := commands[name]
+	if !ok {
+		printCommands()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd.run(args, logger)
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+}
+
+func loadConfig() (*config.Config, error) {
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading config: %w", err)
+	}
+	return cfg, nil
+}
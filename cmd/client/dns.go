@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+// runDNS shows with "test <name> [type]" which resolver the DNS rules send
+// a name to and what it answers, or which blocklist blocks it.
+func runDNS(args []string, logger *utils.Logger) error {
+	if len(args) < 2 || len(args) > 3 || args[0] != "test" {
+		return errors.New("usage: kryptx dns test <name> [type]")
+	}
+
+	qtype := dns.TypeA
+	if len(args) == 3 {
+		var ok bool
+		if qtype, ok = dns.StringToType[strings.ToUpper(args[2])]; !ok {
+			return fmt.Errorf("unknown record type %q", args[2])
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	lookup, err := network.LookupDNS(ctx, cfg, args[1], qtype, logger)
+	if lookup == nil {
+		return err
+	}
+
+	rule := "none, the default resolvers"
+	if lookup.Rule != "" {
+		rule = lookup.Rule
+	}
+	fmt.Printf("Rule:     %s\n", rule)
+	if lookup.Blocked != "" {
+		fmt.Printf("Blocked:  by %s\n", lookup.Blocked)
+	} else {
+		fmt.Printf("Resolver: %s\n", lookup.Upstream)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp := lookup.Response
+	fmt.Printf("Status:   %s in %s\n", dns.RcodeToString[resp.Rcode], lookup.RTT.Round(time.Millisecond))
+	if resp.AuthenticatedData {
+		fmt.Println("DNSSEC:   validated")
+	} else {
+		fmt.Println("DNSSEC:   not validated")
+	}
+	for _, rr := range resp.Answer {
+		fmt.Printf("  %s\n", rr)
+	}
+	return nil
+}
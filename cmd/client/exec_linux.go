@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+// runExec starts a command in the tunnel cgroup, or the bypass one, so it
+// is routed that way whatever the configured app list says. Joining the
+// cgroup needs root; under sudo the command runs as the invoking user.
+func runExec(args []string, logger *utils.Logger) error {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	bypass := flags.Bool("bypass", false, "Run the command around the tunnel instead")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sudo kryptx exec [-bypass] -- <command> [args...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("expected a command to run")
+	}
+
+	path, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if err := network.JoinAppGroup(*bypass); err != nil {
+		return err
+	}
+	if err := dropSudo(); err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, flags.Args(), os.Environ())
+}
+
+// dropSudo switches back to the user that ran sudo, so the command does
+// not run as root just because joining the cgroup had to.
+func dropSudo() error {
+	if os.Getuid() != 0 || os.Getenv("SUDO_UID") == "" {
+		return nil
+	}
+
+	uid, err := strconv.Atoi(os.Getenv("SUDO_UID"))
+	if err != nil {
+		return fmt.Errorf("parsing SUDO_UID: %w", err)
+	}
+	gid, err := strconv.Atoi(os.Getenv("SUDO_GID"))
+	if err != nil {
+		return fmt.Errorf("parsing SUDO_GID: %w", err)
+	}
+
+	// Keep the user's supplementary groups, which desktop programs need
+	// for audio and video devices
+	groups := []int{gid}
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		if ids, err := u.GroupIds(); err == nil {
+			groups = groups[:0]
+			for _, id := range ids {
+				if n, err := strconv.Atoi(id); err == nil {
+					groups = append(groups, n)
+				}
+			}
+		}
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("dropping privileges: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("dropping privileges: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("dropping privileges: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+func runExec(args []string, logger *utils.Logger) error {
+	return fmt.Errorf("per-app split tunneling: %w", network.ErrUnsupported)
+}
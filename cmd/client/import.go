@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+func runImport(args []string, logger *utils.Logger) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	output := flags.String("o", *configPath, "Where to write the KryptX config")
+	force := flags.Bool("force", false, "Overwrite an existing config")
+	add := flags.String("add", "", "Add the file's server under this name to the existing config")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: kryptx import [-o config.yaml] [-force | -add name] <wg0.conf>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected one WireGuard config file")
+	}
+
+	cfg, err := config.LoadWireGuardConfig(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if *add != "" {
+		return addServer(cfg, *add, *output)
+	}
+
+	// Same protections as the shipped example config
+	cfg.Security.KillSwitch = true
+	cfg.Security.DNSLeak = true
+
+	if !*force {
+		if _, err := os.Stat(*output); err == nil {
+			return fmt.Errorf("%s already exists, use -force to overwrite it", *output)
+		}
+	}
+
+	if err := cfg.Save(*output); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %s with %d peer(s) into %s\n", flags.Arg(0), len(cfg.Peers)+1, *output)
+	if len(cfg.Network.PreUp)+len(cfg.Network.PostUp)+len(cfg.Network.PreDown)+len(cfg.Network.PostDown) > 0 {
+		logger.Warning("The file's PreUp/PostUp/PreDown/PostDown hooks were kept but will not be run")
+	}
+	return nil
+}
+
+// addServer merges the server of an imported file into an existing config.
+// The servers share one interface, so the file has to use the same key.
+// Only the server is taken, so files with more peers are refused.
+func addServer(imported *config.Config, name, path string) error {
+	if len(imported.Peers) > 0 {
+		return fmt.Errorf("the file has %d peer(s) besides the server, which -add cannot take; import it on its own", len(imported.Peers))
+	}
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	if imported.Network.PrivateKey != cfg.Network.PrivateKey {
+		return errors.New("the file uses a different private key than the existing config")
+	}
+
+	server := imported.ActiveServer()
+	server.Name = name
+	if err := cfg.AddServer(server); err != nil {
+		return err
+	}
+
+	if err := cfg.Save(path); err != nil {
+		return err
+	}
+
+	fmt.Printf("Added server %s (%s:%d) to %s\n", name, server.Endpoint, server.Port, path)
+	return nil
+}
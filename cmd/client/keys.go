@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"kryptx/internal/config"
+	"kryptx/internal/keys"
+	"kryptx/internal/utils"
+)
+
+func runKeys(args []string, logger *utils.Logger) error {
+	usage := errors.New("usage: kryptx keys gen | pub | show [-private]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "gen":
+		return runKeysGen()
+	case "pub":
+		return runKeysPub()
+	case "show":
+		return runKeysShow(args[1:])
+	default:
+		return usage
+	}
+}
+
+// runKeysGen replaces the client's key pair and prints the new public key,
+// which then has to be registered with the server.
+func runKeysGen() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	private, err := keys.GeneratePrivate()
+	if err != nil {
+		return err
+	}
+	cfg.Network.PrivateKey = private.String()
+
+	if err := cfg.Save(*configPath); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "New key pair saved, register this public key with your server:")
+	fmt.Println(private.PublicKey())
+	return nil
+}
+
+func runKeysPub() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	public, err := publicKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(public)
+	return nil
+}
+
+func runKeysShow(args []string) error {
+	flags := flag.NewFlagSet("keys show", flag.ExitOnError)
+	showPrivate := flags.Bool("private", false, "Also print the private key")
+	flags.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	public, err := publicKey(cfg)
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	fmt.Fprintf(w, "Interface:  %s\n", cfg.Network.Interface)
+	fmt.Fprintf(w, "Public key: %s\n", public)
+	if *showPrivate {
+		fmt.Fprintf(w, "Private key: %s\n", cfg.Network.PrivateKey)
+	} else {
+		fmt.Fprintf(w, "Private key: (hidden, use -private)\n")
+	}
+	for _, server := range cfg.ServerList() {
+		fmt.Fprintf(w, "Server %s: %s (%s)\n", server.Name, server.Endpoint, keyOrUnset(server.PublicKey))
+	}
+	for _, peer := range cfg.Peers {
+		fmt.Fprintf(w, "Peer:       %s\n", peer.PublicKey)
+	}
+	return nil
+}
+
+func publicKey(cfg *config.Config) (keys.Key, error) {
+	private, err := keys.ParsePrivate(cfg.Network.PrivateKey)
+	if err != nil {
+		return keys.Key{}, fmt.Errorf("private key: %w", err)
+	}
+	return private.PublicKey(), nil
+}
+
+func keyOrUnset(key string) string {
+	if key == "" {
+		return "no public key set"
+	}
+	return key
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+// runLeakTest checks the running connection for DNS, IPv6, STUN and other
+// traffic getting out around the tunnel. It fails when something leaks,
+// for scripts to tell.
+func runLeakTest(args []string, logger *utils.Logger) error {
+	flags := flag.NewFlagSet("leaktest", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	stun := flags.String("stun", "", "STUN server to ask, as host:port")
+	ipv6Probe := flags.String("ipv6-probe", "", "DNS server to try IPv6 with, as [address]:port")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: sudo kryptx leaktest [-json] [-stun host:port] [-ipv6-probe [address]:port]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	report := network.RunLeakTest(ctx, cfg, network.LeakTestOptions{
+		STUNServer: *stun,
+		IPv6Probe:  *ipv6Probe,
+	}, logger)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Print(network.FormatLeakReport(report))
+	}
+
+	if report.Leaking() {
+		return errors.New("leaks found")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+// runLockdown manages the always-on mode, in which nothing but the VPN
+// gets out from boot on, whether or not KryptX is running.
+func runLockdown(args []string, logger *utils.Logger) error {
+	if len(args) != 1 {
+		return errors.New("usage: kryptx lockdown enable|disable|status")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "enable":
+		if err := network.EnableLockdown(cfg, logger); err != nil {
+			return err
+		}
+		fmt.Println("Lockdown enabled, traffic is blocked whenever the VPN is not connected")
+		fmt.Println("Run 'kryptx lockdown enable' again after changing servers")
+	case "disable":
+		if err := network.DisableLockdown(cfg); err != nil {
+			return err
+		}
+		fmt.Println("Lockdown disabled")
+	case "status":
+		status := network.GetLockdownStatus(cfg)
+		if status.Err != nil {
+			logger.Warning("%v", status.Err)
+		}
+		fmt.Printf("Enabled:  %s\n", yesNo(status.Enabled))
+		fmt.Printf("At boot:  %s\n", yesNo(status.AtBoot))
+		fmt.Printf("Blocking: %s\n", yesNo(status.Blocking))
+		if status.Session {
+			fmt.Println("A session has the kill switch up")
+		}
+	default:
+		return errors.New("usage: kryptx lockdown enable|disable|status")
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"kryptx/internal/config"
 	"kryptx/internal/gui"
@@ -19,6 +20,7 @@ var (
 	configPath = flag.String("config", "configs/client.yaml", "Config file path")
 	guiMode    = flag.Bool("gui", true, "Run with GUI")
 	verbose    = flag.Bool("v", false, "Verbose logging")
+	serverName = flag.String("server", "", "Name of the server to connect to")
 )
 
 func main() {
@@ -26,6 +28,14 @@ func main() {
 
 	// Initialize logger
 	logger := utils.NewLogger(*verbose)
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:], logger); err != nil {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
 	logger.Info("Starting KryptX VPN Client")
 
 	// Load configuration
@@ -34,6 +44,15 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if *serverName != "" {
+		if err := cfg.SelectServer(*serverName); err != nil {
+			log.Fatalf("Failed to select server: %v", err)
+		}
+	}
+
+	// Undo whatever a crashed session left behind
+	recoverPreviousSession(cfg, logger)
+
 	// Initialize VPN client
 	vpnClient, err := network.NewVPNClient(cfg, logger)
 	if err != nil {
@@ -61,6 +80,40 @@ func main() {
 	} else {
 		// CLI mode
 		fmt.Println("KryptX VPN Client - CLI Mode")
+
+		events, _ := vpnClient.Subscribe()
+		go func() {
+			for event := range events {
+				if event.Err != nil {
+					fmt.Printf("%s: %s (%v)\n", event.To, event.Reason, event.Err)
+				} else {
+					fmt.Printf("%s: %s\n", event.To, event.Reason)
+				}
+			}
+		}()
+
+		failovers, _ := vpnClient.SubscribeFailover()
+		go func() {
+			for event := range failovers {
+				if event.Err != nil {
+					fmt.Printf("Failover from %s failed: %v\n", event.From, event.Err)
+				} else {
+					fmt.Printf("Failed over from %s to %s in %s (%s)\n", event.From, event.To, event.Duration.Round(time.Millisecond), event.Reason)
+				}
+			}
+		}()
+
+		security, _ := vpnClient.SubscribeSecurity()
+		go func() {
+			for event := range security {
+				if event.Restored {
+					fmt.Printf("Kill switch tampered with, rules reapplied: %v\n", event.Err)
+				} else {
+					fmt.Printf("Kill switch tampered with, could not restore it: %v\n", event.Err)
+				}
+			}
+		}()
+
 		if err := vpnClient.Connect(ctx); err != nil {
 			log.Fatalf("Failed to connect: %v", err)
 		}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"kryptx/internal/config"
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+func runRecover(args []string, logger *utils.Logger) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	journal, err := network.OpenJournal(cfg.Network.JournalPath)
+	if err != nil {
+		return err
+	}
+
+	entries := journal.Entries()
+	if len(entries) == 0 {
+		fmt.Println("Nothing to recover")
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("Undoing %s from %s\n", entry.Kind, entry.Time.Format(time.RFC3339))
+	}
+
+	if err := network.Recover(journal, logger); err != nil {
+		return err
+	}
+
+	fmt.Println("Network restored")
+	return nil
+}
+
+// recoverPreviousSession cleans up after a client that was killed while
+// connected, before a new session starts changing the host again.
+func recoverPreviousSession(cfg *config.Config, logger *utils.Logger) {
+	if cfg.Network.JournalPath == "" {
+		return
+	}
+
+	journal, err := network.OpenJournal(cfg.Network.JournalPath)
+	if err != nil {
+		logger.Error("Reading journal: %v", err)
+		return
+	}
+
+	if len(journal.Entries()) == 0 {
+		return
+	}
+
+	logger.Warning("Previous session did not shut down cleanly, restoring network settings")
+	if err := network.Recover(journal, logger); err != nil {
+		logger.Error("Recovery incomplete, run 'kryptx recover' as root: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"kryptx/internal/config"
+	"kryptx/internal/network"
+	"kryptx/internal/utils"
+)
+
+// runServers lists the servers, measures them with "probe", or with
+// "use <name>" stores which one is connected to by default.
+func runServers(args []string, logger *utils.Logger) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		active := cfg.ActiveServer().Name
+		if cfg.AutoSelect() {
+			fmt.Println("The fastest server is picked when connecting")
+			active = ""
+		}
+		for _, server := range cfg.ServerList() {
+			marker := " "
+			if server.Name == active {
+				marker = "*"
+			}
+			fmt.Printf("%s %-16s %s:%d\n", marker, server.Name, server.Endpoint, server.Port)
+		}
+		return nil
+	}
+
+	if len(args) == 1 && args[0] == "probe" {
+		return probeServers(cfg)
+	}
+
+	if len(args) != 2 || args[0] != "use" {
+		return errors.New("usage: kryptx servers [probe | use <name>]")
+	}
+
+	if err := cfg.SelectServer(args[1]); err != nil {
+		return err
+	}
+	if err := cfg.Save(*configPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Now using %s\n", args[1])
+	return nil
+}
+
+func probeServers(cfg *config.Config) error {
+	prober, err := network.NewProber(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	selector := network.NewSelector(prober, cfg.Selection)
+	for _, result := range selector.Rank(ctx, cfg.ServerList()) {
+		if !result.Reachable() {
+			fmt.Printf("  %-16s unreachable (%v)\n", result.Server, result.Err)
+			continue
+		}
+		fmt.Printf("  %-16s %8s  %3.0f%% loss\n", result.Server, result.RTT.Round(time.Millisecond), result.Loss*100)
+	}
+	return nil
+}
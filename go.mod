@@ -4,8 +4,14 @@ go 1.21
 
 require (
     fyne.io/fyne/v2 v2.4.0
+    github.com/godbus/dbus/v5 v5.1.0
+    github.com/miekg/dns v1.1.56
+    github.com/vishvananda/netlink v1.2.1-beta.2
+    golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173
+    golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6
     gopkg.in/yaml.v3 v3.0.1
     golang.org/x/crypto v0.14.0
+    golang.org/x/net v0.16.0
     golang.org/x/sys v0.13.0
 )
 
@@ -21,18 +27,29 @@ require (
     github.com/go-gl/glfw/v3.3/glfw v0.0.0-20221017161538-93cebf72946b // indirect
     github.com/go-text/render v0.0.0-20230619120952-35bccb6164b8 // indirect
     github.com/go-text/typesetting v0.0.0-20230616162802-9c17dd34aa4a // indirect
-    github.com/godbus/dbus/v5 v5.1.0 // indirect
     github.com/gopherjs/gopherjs v1.17.2 // indirect
+    github.com/google/btree v1.0.1 // indirect
+    github.com/google/go-cmp v0.5.9 // indirect
+    github.com/josharian/native v1.1.0 // indirect
     github.com/jsummers/gobmp v0.0.0-20151104160322-e2ba15ffa76e // indirect
+    github.com/mdlayher/genetlink v1.3.2 // indirect
+    github.com/mdlayher/netlink v1.7.2 // indirect
+    github.com/mdlayher/socket v0.4.1 // indirect
     github.com/pmezard/go-difflib v1.0.0 // indirect
     github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c // indirect
     github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef // indirect
     github.com/stretchr/testify v1.8.4 // indirect
     github.com/tevino/abool v1.2.0 // indirect
+    github.com/vishvananda/netns v0.0.4 // indirect
     github.com/yuin/goldmark v1.5.5 // indirect
     golang.org/x/image v0.11.0 // indirect
     golang.org/x/mobile v0.0.0-20230531173138-3c911d8e3eda // indirect
-    golang.org/x/net v0.16.0 // indirect
+    golang.org/x/mod v0.12.0 // indirect
+    golang.org/x/sync v0.3.0 // indirect
     golang.org/x/text v0.13.0 // indirect
+    golang.org/x/time v0.0.0-20220210224613-90d013bbcef8 // indirect
+    golang.org/x/tools v0.13.0 // indirect
+    golang.zx2c4.com/wintun v0.0.0-20230126152724-0fa3db229ce2 // indirect
+    gvisor.dev/gvisor v0.0.0-20230927004350-cbd86285d259 // indirect
     honnef.co/go/js/dom v0.0.0-20210725211120-f030747120f2 // indirect
 )
\ No newline at end of file
@@ -1,41 +1,191 @@
 package config
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"kryptx/internal/keys"
 )
 
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Network  NetworkConfig  `yaml:"network"`
-	Security SecurityConfig `yaml:"security"`
-	GUI      GUIConfig      `yaml:"gui"`
+	Server    ServerConfig    `yaml:"server,omitempty"`
+	Servers   []ServerConfig  `yaml:"servers,omitempty"`
+	Active    string          `yaml:"active_server,omitempty"`
+	Peers     []PeerConfig    `yaml:"peers,omitempty"`
+	Selection SelectionConfig `yaml:"server_selection"`
+	Network   NetworkConfig   `yaml:"network"`
+	Security  SecurityConfig  `yaml:"security"`
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+	GUI       GUIConfig       `yaml:"gui"`
 }
 
+// ServerConfig describes one server to connect through. Only one server
+// is used at a time; AllowedIPs falls back to the network's.
 type ServerConfig struct {
-	Endpoint  string `yaml:"endpoint"`
-	PublicKey string `yaml:"public_key"`
-	Port      int    `yaml:"port"`
+	Name                string   `yaml:"name,omitempty"`
+	Endpoint            string   `yaml:"endpoint"`
+	PublicKey           string   `yaml:"public_key"`
+	PresharedKey        string   `yaml:"preshared_key,omitempty"`
+	Port                int      `yaml:"port"`
+	AllowedIPs          []string `yaml:"allowed_ips,omitempty"`
+	PersistentKeepalive int      `yaml:"persistent_keepalive"`
+}
+
+// UnmarshalYAML applies the defaults for keys missing from a server entry.
+func (s *ServerConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain ServerConfig
+	server := plain{PersistentKeepalive: 25}
+	if err := value.Decode(&server); err != nil {
+		return err
+	}
+	*s = ServerConfig(server)
+	return nil
+}
+
+// PeerConfig is an additional peer brought up next to the server, such as
+// another site reached over the same interface.
+type PeerConfig struct {
+	PublicKey           string   `yaml:"public_key"`
+	PresharedKey        string   `yaml:"preshared_key,omitempty"`
+	Endpoint            string   `yaml:"endpoint,omitempty"`
+	AllowedIPs          []string `yaml:"allowed_ips"`
+	PersistentKeepalive int      `yaml:"persistent_keepalive,omitempty"`
 }
 
+// NetworkConfig describes the tunnel interface. Address takes several
+// comma separated CIDRs, for an IPv4 and an IPv6 address. DisableIPv6
+// turns IPv6 off on the host while connected, so that with a server that
+// does not carry it nothing goes out over IPv6 around the tunnel. DNSMode
+// picks what the resolvers are handed to on Linux; by default the DNS
+// manager finds out itself.
 type NetworkConfig struct {
-	Interface  string   `yaml:"interface"`
-	PrivateKey string   `yaml:"private_key"`
-	Address    string   `yaml:"address"`
-	DNS        []string `yaml:"dns"`
-	AllowedIPs []string `yaml:"allowed_ips"`
-	MTU        int      `yaml:"mtu"`
+	Interface    string   `yaml:"interface"`
+	Backend      string   `yaml:"backend"`
+	PrivateKey   string   `yaml:"private_key"`
+	Address      string   `yaml:"address"`
+	DisableIPv6  bool     `yaml:"disable_ipv6,omitempty"`
+	DNS          []string `yaml:"dns"`
+	DNSSearch    []string `yaml:"dns_search,omitempty"`
+	DNSMode      string   `yaml:"dns_mode,omitempty"`
+	AllowedIPs   []string `yaml:"allowed_ips"`
+	MTU          int      `yaml:"mtu"`
+	ListenPort   int      `yaml:"listen_port,omitempty"`
+	FirewallMark int      `yaml:"fwmark,omitempty"`
+	Table        string   `yaml:"table,omitempty"`
+	PreUp        []string `yaml:"pre_up,omitempty"`
+	PostUp       []string `yaml:"post_up,omitempty"`
+	PreDown      []string `yaml:"pre_down,omitempty"`
+	PostDown     []string `yaml:"post_down,omitempty"`
+	JournalPath  string   `yaml:"journal_path"`
+
+	SplitTunnel SplitTunnelConfig `yaml:"split_tunnel"`
+	DNSProxy    DNSProxyConfig    `yaml:"dns_proxy"`
+	DNSRules    []DNSRule         `yaml:"dns_rules,omitempty"`
+}
+
+// SplitTunnelConfig narrows down what goes through the tunnel. Entries are
+// addresses, CIDRs or host names; a host name also covers its subdomains
+// once they are seen in a DNS answer. With Include set only those
+// destinations use the tunnel, Exclude sends destinations around it.
+//
+// AppMode does the same per application on Linux: "include" sends only
+// the Apps through the tunnel, "exclude" lets them bypass it. Apps are
+// executable names or paths, or systemd units such as "steam.service".
+type SplitTunnelConfig struct {
+	Include []string      `yaml:"include,omitempty"`
+	Exclude []string      `yaml:"exclude,omitempty"`
+	Refresh time.Duration `yaml:"refresh"`
+	AppMode string        `yaml:"app_mode,omitempty"`
+	Apps    []string      `yaml:"apps,omitempty"`
+}
+
+// DNSProxyConfig runs a resolver on the host while connected, which the
+// system is pointed at instead of the DNS servers. It caches answers and
+// forwards through the tunnel to the Upstreams, in order of preference:
+// "https://" URLs for DNS over HTTPS, "tls://host[:port]" for DNS over
+// TLS or plain addresses. Without any it forwards to the DNS servers.
+// Listen is the address to serve on, on port 53; on Linux it defaults to
+// 127.0.0.153, except with systemd-resolved, which is handed the tunnel
+// address instead. Queries from other hosts are dropped either way.
+type DNSProxyConfig struct {
+	Enabled   bool     `yaml:"enabled"`
+	Listen    string   `yaml:"listen,omitempty"`
+	Upstreams []string `yaml:"upstreams,omitempty"`
+	CacheSize int      `yaml:"cache_size,omitempty"`
+}
+
+// DNSRule sends the lookups for a domain and its subdomains to servers of
+// its own, such as the internal DNS of a company network reached through
+// the VPN. A leading "*." is allowed and changes nothing. Servers take the
+// same forms as the proxy upstreams; the rules are applied by the DNS
+// proxy, which runs whenever there are any.
+type DNSRule struct {
+	Domain  string   `yaml:"domain"`
+	Servers []string `yaml:"servers"`
 }
 
+// SecurityConfig toggles the leak protection. With AllowLAN the kill
+// switch lets through traffic to LANNetworks, or to the private and
+// link-local ranges when that is empty.
 type SecurityConfig struct {
-	KillSwitch    bool   `yaml:"kill_switch"`
-	DNSLeak       bool   `yaml:"dns_leak_protection"`
-	EncryptConfig bool   `yaml:"encrypt_config"`
-	VaultPassword string `yaml:"vault_password"`
+	KillSwitch    bool     `yaml:"kill_switch"`
+	AllowLAN      bool     `yaml:"allow_lan"`
+	LANNetworks   []string `yaml:"lan_networks,omitempty"`
+	DNSLeak       bool     `yaml:"dns_leak_protection"`
+	EncryptConfig bool     `yaml:"encrypt_config"`
+	VaultPassword string   `yaml:"vault_password"`
+
+	Blocklists BlocklistConfig `yaml:"blocklists"`
+	LeakTest   LeakTestConfig  `yaml:"leak_test"`
+}
+
+// LeakTestConfig points the leak test at other servers than the public
+// ones, such as those of a test network: a STUN server as host:port and
+// a DNS server reachable by IPv6 as [address]:port. The leaktest flags
+// take precedence.
+type LeakTestConfig struct {
+	STUNServer string `yaml:"stun_server,omitempty"`
+	IPv6Probe  string `yaml:"ipv6_probe,omitempty"`
+}
+
+// BlocklistConfig has the DNS proxy, which it turns on, refuse the names on
+// ad, tracker and malware lists. Lists are files or http(s) URLs, fetched
+// through the tunnel and again every Refresh, in hosts format ("0.0.0.0
+// ads.example") or with one domain per line. A domain blocks its
+// subdomains too, save those under Allow. Response is "nxdomain" or
+// "zero", for 0.0.0.0 and :: answers.
+type BlocklistConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Lists    []string      `yaml:"lists"`
+	Allow    []string      `yaml:"allow,omitempty"`
+	Response string        `yaml:"response"`
+	Refresh  time.Duration `yaml:"refresh"`
+}
+
+// SelectionConfig controls how servers are probed when active_server is
+// "auto". Method is handshake, icmp or udp.
+type SelectionConfig struct {
+	Method   string        `yaml:"method"`
+	Attempts int           `yaml:"attempts"`
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+type ReconnectConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	Failover         bool          `yaml:"failover"`
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout"`
+	InitialBackoff   time.Duration `yaml:"initial_backoff"`
+	MaxBackoff       time.Duration `yaml:"max_backoff"`
+	MaxAttempts      int           `yaml:"max_attempts"`
+	MaxDuration      time.Duration `yaml:"max_duration"`
 }
 
 type GUIConfig struct {
@@ -50,37 +200,233 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("reading config file: %w", err)
 	}
 
-	var config Config
+	config := defaultConfig()
 	if err := yaml.Unmarshal(data, &config); err != nil {
 		return nil, fmt.Errorf("parsing config: %w", err)
 	}
 
-	// Generate private key if not present
+	config.Network.PrivateKey, err = config.openSecret(config.Network.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+
+	// Generate private key if not present. It has to be kept, or the
+	// public key registered with the server changes on every start.
 	if config.Network.PrivateKey == "" {
-		key, err := generatePrivateKey()
+		key, err := keys.GeneratePrivate()
 		if err != nil {
 			return nil, fmt.Errorf("generating private key: %w", err)
 		}
-		config.Network.PrivateKey = key
+		config.Network.PrivateKey = key.String()
+
+		if err := config.savePrivateKey(path, data); err != nil {
+			return nil, fmt.Errorf("saving generated private key: %w", err)
+		}
+	}
+
+	if err := config.validateServers(); err != nil {
+		return nil, err
+	}
+	if err := config.validateKeys(); err != nil {
+		return nil, err
+	}
+	if response := config.Security.Blocklists.Response; response != "nxdomain" && response != "zero" {
+		return nil, fmt.Errorf("security.blocklists.response: %q is neither nxdomain nor zero", response)
 	}
 
 	return &config, nil
 }
 
-func generatePrivateKey() (string, error) {
-	key := make([]byte, 32)
-	_, err := rand.Read(key)
-	if err != nil {
-		return "", err
+// validateKeys checks every key in the config, so that a mistyped key is
+// reported when loading rather than as a failed handshake later. Empty
+// public keys are left for the connect to reject.
+func (c *Config) validateKeys() error {
+	if _, err := keys.ParsePrivate(c.Network.PrivateKey); err != nil {
+		return fmt.Errorf("network.private_key: %w", err)
+	}
+
+	check := func(field, value string, parse func(string) (keys.Key, error)) error {
+		if value == "" {
+			return nil
+		}
+		if _, err := parse(value); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		return nil
+	}
+
+	for _, server := range c.ServerList() {
+		if err := check(fmt.Sprintf("server %s public_key", server.Name), server.PublicKey, keys.ParsePublic); err != nil {
+			return err
+		}
+		if err := check(fmt.Sprintf("server %s preshared_key", server.Name), server.PresharedKey, keys.Parse); err != nil {
+			return err
+		}
+	}
+	for i, peer := range c.Peers {
+		if err := check(fmt.Sprintf("peers[%d].public_key", i), peer.PublicKey, keys.ParsePublic); err != nil {
+			return err
+		}
+		if err := check(fmt.Sprintf("peers[%d].preshared_key", i), peer.PresharedKey, keys.Parse); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// defaultConfig holds the values used for keys missing from the file.
+func defaultConfig() Config {
+	return Config{
+		Selection: SelectionConfig{
+			Method:   "handshake",
+			Attempts: 3,
+			Timeout:  time.Second,
+			CacheTTL: 5 * time.Minute,
+		},
+		Network: NetworkConfig{
+			JournalPath: defaultJournalPath(),
+			SplitTunnel: SplitTunnelConfig{
+				Refresh: 5 * time.Minute,
+			},
+		},
+		Security: SecurityConfig{
+			Blocklists: BlocklistConfig{
+				Response: "nxdomain",
+				Refresh:  24 * time.Hour,
+			},
+		},
+		Reconnect: ReconnectConfig{
+			Enabled:          true,
+			Failover:         true,
+			HandshakeTimeout: 3 * time.Minute,
+			InitialBackoff:   time.Second,
+			MaxBackoff:       time.Minute,
+			MaxDuration:      15 * time.Minute,
+		},
+	}
+}
+
+// defaultJournalPath is where the client records the changes it makes to
+// the host, so they can be undone after a crash.
+func defaultJournalPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "KryptX", "journal.json")
 	}
-	return base64.StdEncoding.EncodeToString(key), nil
+	return "/var/lib/kryptx/journal.json"
 }
 
+// Save writes the config, sealing the private key through the vault when
+// config encryption is enabled.
 func (c *Config) Save(path string) error {
-	data, err := yaml.Marshal(c)
+	stored := *c
+	privateKey, err := c.sealSecret(c.Network.PrivateKey)
+	if err != nil {
+		return err
+	}
+	stored.Network.PrivateKey = privateKey
+
+	data, err := yaml.Marshal(&stored)
 	if err != nil {
 		return fmt.Errorf("marshaling config: %w", err)
 	}
 
 	return os.WriteFile(path, data, 0600)
 }
+
+// savePrivateKey writes the private key into the file at path, which held
+// data. Only the private_key value is touched, so the user's layout and
+// comments stay as they were.
+func (c *Config) savePrivateKey(path string, data []byte) error {
+	privateKey, err := c.sealSecret(c.Network.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parsing config: %w", err)
+	}
+
+	var root *yaml.Node
+	if len(doc.Content) > 0 {
+		root = doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return fmt.Errorf("config is not a mapping")
+		}
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	quoted := strconv.Quote(privateKey)
+
+	_, network := mappingEntry(root, "network")
+	_, value := mappingEntry(network, "private_key")
+	switch {
+	case value != nil:
+		// Replace the existing value where it stands
+		line := lines[value.Line-1]
+		start := value.Column - 1
+		end := scalarEnd(line, start, value.Style)
+		lines[value.Line-1] = line[:start] + quoted + line[end:]
+	case network != nil && network.Kind == yaml.MappingNode && len(network.Content) > 0:
+		// Add it as the first entry of the network section
+		first := network.Content[0]
+		entry := strings.Repeat(" ", first.Column-1) + "private_key: " + quoted + "\n"
+		lines = append(lines[:first.Line-1], append([]string{entry}, lines[first.Line-1:]...)...)
+	case network != nil:
+		return fmt.Errorf("network is not a mapping")
+	default:
+		if n := len(lines); n > 0 && lines[n-1] != "" && !strings.HasSuffix(lines[n-1], "\n") {
+			lines[n-1] += "\n"
+		}
+		lines = append(lines, "network:\n  private_key: "+quoted+"\n")
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0600)
+}
+
+// mappingEntry returns the key and value nodes of key in mapping, or nils.
+func mappingEntry(mapping *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i], mapping.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+// scalarEnd returns the offset just past the single-line scalar that starts
+// at start in line.
+func scalarEnd(line string, start int, style yaml.Style) int {
+	switch {
+	case style&yaml.DoubleQuotedStyle != 0:
+		for i := start + 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1
+			}
+		}
+	case style&yaml.SingleQuotedStyle != 0:
+		for i := start + 1; i < len(line); i++ {
+			if line[i] == '\'' {
+				if i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1
+			}
+		}
+	default:
+		rest := strings.TrimRight(line[start:], "\r\n")
+		if i := strings.Index(rest, " #"); i >= 0 {
+			rest = rest[:i]
+		}
+		return start + len(strings.TrimRight(rest, " \t"))
+	}
+	return len(strings.TrimRight(line, "\r\n"))
+}
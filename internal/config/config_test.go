@@ -0,0 +1,99 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigGeneratesKey(t *testing.T) {
+	const original = `# My VPN
+server:
+  endpoint: "vpn.example.net" # the one in Stockholm
+  public_key: "1WYsJ6TpKGudgp5RGfJreiKPAUQHpGeR8fPnSSTozCI="
+  port: 51820
+
+network:
+  interface: "kryptx0"
+  private_key: "" # generated on first start
+  address: "10.0.0.2/24"
+`
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Network.PrivateKey == "" {
+		t.Fatal("no private key generated")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := string(data)
+
+	// Only the key changed: the comments are kept and no defaults added
+	want := strings.Replace(original, `private_key: ""`, `private_key: "`+cfg.Network.PrivateKey+`"`, 1)
+	if saved != want {
+		t.Errorf("saved config:\n%s\nwant:\n%s", saved, want)
+	}
+
+	// And it is the key used from then on
+	again, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig again: %v", err)
+	}
+	if again.Network.PrivateKey != cfg.Network.PrivateKey {
+		t.Error("a different key was generated on the second load")
+	}
+}
+
+func TestLoadConfigAddsMissingKey(t *testing.T) {
+	const original = "server:\n  endpoint: vpn.example.net\n  public_key: 1WYsJ6TpKGudgp5RGfJreiKPAUQHpGeR8fPnSSTozCI=\n  port: 51820\n"
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := original + "network:\n  private_key: \"" + cfg.Network.PrivateKey + "\"\n"
+	if string(data) != want {
+		t.Errorf("saved config:\n%s\nwant:\n%s", data, want)
+	}
+}
+
+func TestLoadConfigKeyInNetworkSection(t *testing.T) {
+	const original = "server:\n  endpoint: vpn.example.net\n  public_key: 1WYsJ6TpKGudgp5RGfJreiKPAUQHpGeR8fPnSSTozCI=\n\nnetwork:\n    interface: kryptx0 # ours\n"
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(original, "network:\n", "network:\n    private_key: \""+cfg.Network.PrivateKey+"\"\n", 1)
+	if string(data) != want {
+		t.Errorf("saved config:\n%s\nwant:\n%s", data, want)
+	}
+}
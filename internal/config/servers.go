@@ -0,0 +1,121 @@
+package config
+
+import "fmt"
+
+const (
+	// DefaultServerName names the server of a config that only has the
+	// single server section.
+	DefaultServerName = "default"
+
+	// AutoServer as active_server leaves the choice to the latency probes.
+	AutoServer = "auto"
+)
+
+// ServerList returns the configured servers with their defaults filled in.
+// The single server section counts as one server named "default".
+func (c *Config) ServerList() []ServerConfig {
+	servers := c.Servers
+	if len(servers) == 0 {
+		servers = []ServerConfig{c.Server}
+	}
+
+	list := make([]ServerConfig, len(servers))
+	for i, server := range servers {
+		if server.Name == "" && len(servers) == 1 {
+			server.Name = DefaultServerName
+		}
+		if len(server.AllowedIPs) == 0 {
+			server.AllowedIPs = c.Network.AllowedIPs
+		}
+		list[i] = server
+	}
+	return list
+}
+
+// ServerByName looks up a server by name.
+func (c *Config) ServerByName(name string) (ServerConfig, bool) {
+	for _, server := range c.ServerList() {
+		if server.Name == name {
+			return server, true
+		}
+	}
+	return ServerConfig{}, false
+}
+
+// AutoSelect reports whether the server is to be picked by latency.
+func (c *Config) AutoSelect() bool {
+	return c.Active == AutoServer
+}
+
+// ActiveServer returns the server selected by active_server, or the first
+// one when none is selected or the choice is left to the probes.
+func (c *Config) ActiveServer() ServerConfig {
+	if c.Active != "" {
+		if server, ok := c.ServerByName(c.Active); ok {
+			return server
+		}
+	}
+	return c.ServerList()[0]
+}
+
+// SelectServer makes the named server the active one, or hands the choice
+// to the latency probes for AutoServer.
+func (c *Config) SelectServer(name string) error {
+	if name == AutoServer {
+		c.Active = name
+		return nil
+	}
+	if _, ok := c.ServerByName(name); !ok {
+		return fmt.Errorf("no server named %q", name)
+	}
+	c.Active = name
+	return nil
+}
+
+func (c *Config) validateServers() error {
+	if len(c.Servers) > 0 && c.Server.Endpoint != "" {
+		return fmt.Errorf("use either server or servers, not both")
+	}
+
+	seen := map[string]bool{}
+	for i, server := range c.ServerList() {
+		if server.Name == "" {
+			return fmt.Errorf("servers[%d]: name is required when there is more than one server", i)
+		}
+		if server.Name == AutoServer {
+			return fmt.Errorf("servers[%d]: %q is reserved", i, AutoServer)
+		}
+		if seen[server.Name] {
+			return fmt.Errorf("servers[%d]: duplicate name %q", i, server.Name)
+		}
+		seen[server.Name] = true
+	}
+
+	if c.Active != "" && c.Active != AutoServer && !seen[c.Active] {
+		return fmt.Errorf("active_server: no server named %q", c.Active)
+	}
+	return nil
+}
+
+// AddServer appends a server, first moving a single server section into
+// the list so that both end up named.
+func (c *Config) AddServer(server ServerConfig) error {
+	if server.Name == "" || server.Name == AutoServer {
+		return fmt.Errorf("server needs a name other than %q", AutoServer)
+	}
+	if _, ok := c.ServerByName(server.Name); ok {
+		return fmt.Errorf("a server named %q already exists", server.Name)
+	}
+
+	if len(c.Servers) == 0 && c.Server.Endpoint != "" {
+		existing := c.Server
+		if existing.Name == "" {
+			existing.Name = DefaultServerName
+		}
+		c.Servers = []ServerConfig{existing}
+		c.Server = ServerConfig{}
+	}
+
+	c.Servers = append(c.Servers, server)
+	return nil
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"kryptx/internal/security"
+)
+
+// Secrets sealed by the vault are stored with this prefix so that they can
+// sit in the same fields as plain values.
+const vaultPrefix = "vault:"
+
+// vaultPassword prefers the environment, so that the password does not
+// have to be stored next to what it protects.
+func (c *Config) vaultPassword() string {
+	if password := os.Getenv("KRYPTX_VAULT_PASSWORD"); password != "" {
+		return password
+	}
+	return c.Security.VaultPassword
+}
+
+// sealSecret encrypts value when config encryption is enabled and a vault
+// password is available. Without a password the value is stored as is,
+// relying on the file's permissions.
+func (c *Config) sealSecret(value string) (string, error) {
+	password := c.vaultPassword()
+	if !c.Security.EncryptConfig || password == "" || value == "" || strings.HasPrefix(value, vaultPrefix) {
+		return value, nil
+	}
+
+	sealed, err := security.NewVault(password).Encrypt([]byte(value))
+	if err != nil {
+		return "", fmt.Errorf("encrypting secret: %w", err)
+	}
+	return vaultPrefix + sealed, nil
+}
+
+func (c *Config) openSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, vaultPrefix) {
+		return value, nil
+	}
+
+	password := c.vaultPassword()
+	if password == "" {
+		return "", fmt.Errorf("secret is encrypted but no vault password is set (KRYPTX_VAULT_PASSWORD)")
+	}
+
+	plain, err := security.NewVault(password).Decrypt(strings.TrimPrefix(value, vaultPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decrypting secret: %w", err)
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadWireGuardConfig reads a wg-quick style .conf file, as handed out by
+// most VPN providers.
+func LoadWireGuardConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading WireGuard config: %w", err)
+	}
+	defer f.Close()
+
+	return ParseWireGuardConfig(f)
+}
+
+// ParseWireGuardConfig turns a wg-quick .conf file into a Config. The
+// first peer with an endpoint becomes the server; any other peers are kept
+// in Peers. Settings that only KryptX knows about keep their defaults.
+func ParseWireGuardConfig(r io.Reader) (*Config, error) {
+	config := defaultConfig()
+	config.Network.Interface = "kryptx0"
+
+	var (
+		peers   []PeerConfig
+		section string
+		lineNo  int
+	)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				peers = append(peers, PeerConfig{})
+			default:
+				return nil, fmt.Errorf("line %d: unknown section [%s]", lineNo, section)
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case "interface":
+			err = parseInterfaceKey(&config.Network, key, value)
+		case "peer":
+			err = parsePeerKey(&peers[len(peers)-1], key, value)
+		default:
+			err = fmt.Errorf("%s outside of a section", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading WireGuard config: %w", err)
+	}
+
+	if config.Network.PrivateKey == "" {
+		return nil, fmt.Errorf("missing PrivateKey in [Interface]")
+	}
+
+	server := -1
+	for i, peer := range peers {
+		if peer.PublicKey == "" {
+			return nil, fmt.Errorf("peer %d: missing PublicKey", i+1)
+		}
+		if server < 0 && peer.Endpoint != "" {
+			server = i
+		}
+	}
+	if server < 0 {
+		return nil, fmt.Errorf("no peer with an Endpoint to use as the server")
+	}
+
+	if err := config.setServer(peers[server]); err != nil {
+		return nil, err
+	}
+	config.Peers = append(peers[:server:server], peers[server+1:]...)
+
+	if err := config.validateKeys(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func (c *Config) setServer(peer PeerConfig) error {
+	host, port, err := net.SplitHostPort(peer.Endpoint)
+	if err != nil {
+		return fmt.Errorf("parsing endpoint %q: %w", peer.Endpoint, err)
+	}
+	c.Server.Port, err = strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("parsing endpoint %q: bad port", peer.Endpoint)
+	}
+
+	c.Server.Endpoint = host
+	c.Server.PublicKey = peer.PublicKey
+	c.Server.PresharedKey = peer.PresharedKey
+	c.Server.PersistentKeepalive = peer.PersistentKeepalive
+	c.Network.AllowedIPs = peer.AllowedIPs
+	return nil
+}
+
+func parseInterfaceKey(network *NetworkConfig, key, value string) error {
+	var err error
+
+	switch key {
+	case "privatekey":
+		network.PrivateKey = value
+	case "address":
+		addresses := splitList(value)
+		if network.Address != "" {
+			addresses = append([]string{network.Address}, addresses...)
+		}
+		network.Address = strings.Join(addresses, ", ")
+	case "dns":
+		// Anything that is not an address is a search domain
+		for _, entry := range splitList(value) {
+			if net.ParseIP(entry) != nil {
+				network.DNS = append(network.DNS, entry)
+			} else {
+				network.DNSSearch = append(network.DNSSearch, entry)
+			}
+		}
+	case "mtu":
+		network.MTU, err = strconv.Atoi(value)
+	case "listenport":
+		network.ListenPort, err = strconv.Atoi(value)
+	case "fwmark":
+		if value != "off" {
+			var mark int64
+			mark, err = strconv.ParseInt(value, 0, 32)
+			network.FirewallMark = int(mark)
+		}
+	case "table":
+		network.Table = value
+	case "preup":
+		network.PreUp = append(network.PreUp, value)
+	case "postup":
+		network.PostUp = append(network.PostUp, value)
+	case "predown":
+		network.PreDown = append(network.PreDown, value)
+	case "postdown":
+		network.PostDown = append(network.PostDown, value)
+	case "saveconfig":
+		// Only meaningful to wg-quick itself
+	default:
+		return fmt.Errorf("unknown [Interface] key %q", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", key, err)
+	}
+	return nil
+}
+
+func parsePeerKey(peer *PeerConfig, key, value string) error {
+	switch key {
+	case "publickey":
+		peer.PublicKey = value
+	case "presharedkey":
+		peer.PresharedKey = value
+	case "endpoint":
+		peer.Endpoint = value
+	case "allowedips":
+		peer.AllowedIPs = append(peer.AllowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		if value != "off" {
+			keepalive, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("parsing %s: %w", key, err)
+			}
+			peer.PersistentKeepalive = keepalive
+		}
+	default:
+		return fmt.Errorf("unknown [Peer] key %q", key)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
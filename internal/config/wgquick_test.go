@@ -0,0 +1,140 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWireGuardConfig(t *testing.T) {
+	tests := []struct {
+		file    string
+		server  ServerConfig
+		peers   []PeerConfig
+		network func(*NetworkConfig) []any
+		want    []any
+	}{
+		{
+			file: "provider.conf",
+			server: ServerConfig{
+				Endpoint:  "se-sto-wg-001.example.net",
+				Port:      51820,
+				PublicKey: "1WYsJ6TpKGudgp5RGfJreiKPAUQHpGeR8fPnSSTozCI=",
+			},
+			network: func(n *NetworkConfig) []any {
+				return []any{n.Address, n.DNS, n.DNSSearch, n.AllowedIPs}
+			},
+			want: []any{
+				"10.64.12.7/32, fc00:bbbb:bbbb:bb01::1:c06/128",
+				[]string{"10.64.0.1"},
+				[]string(nil),
+				[]string{"0.0.0.0/0", "::/0"},
+			},
+		},
+		{
+			file: "dualstack-search.conf",
+			server: ServerConfig{
+				Endpoint:            "203.0.113.10",
+				Port:                51820,
+				PublicKey:           "n71Esy8+q32zbYkUFs7hFHRn2pW2zfOI6bTObjiUZAg=",
+				PresharedKey:        "ZM6MhxOCYAh9b3Mkg+fwJ2X6VqSCtnBIcmyxaypdNTU=",
+				PersistentKeepalive: 25,
+			},
+			network: func(n *NetworkConfig) []any {
+				return []any{n.PrivateKey, n.Address, n.DNS, n.DNSSearch, n.MTU, n.AllowedIPs}
+			},
+			want: []any{
+				"GM2ONpFtn08qJ8br9E4ATZ6lPzR5mNbLK7/7KoYdhVY=",
+				"10.8.0.2/24, fd42:42:42::2/64",
+				[]string{"10.8.0.1", "fd42:42:42::1"},
+				[]string{"corp.example", "example.net"},
+				1380,
+				[]string{"0.0.0.0/0", "::/0"},
+			},
+		},
+		{
+			file: "site-to-site.conf",
+			server: ServerConfig{
+				Endpoint:  "198.51.100.7",
+				Port:      51821,
+				PublicKey: "Yu/eGuMBur5sw2ejtoa7UstclftTU7KRVkGDTmkMYGY=",
+			},
+			peers: []PeerConfig{
+				{
+					PublicKey:  "s9OrhCZz9pgJ66fw+/5hIZsEWy3RmoHEpwd+mbgr9WM=",
+					AllowedIPs: []string{"10.20.0.2/32"},
+				},
+				{
+					PublicKey:           "upXvYHiURASd4J0wGj+dr8Kwfrlk4P71K/t2kzdl3wk=",
+					PresharedKey:        "1TopwpVaWZK7JEXahjbyLBcnswEFAjLtR3z6JWMq/Ck=",
+					Endpoint:            "198.51.100.8:51822",
+					AllowedIPs:          []string{"10.40.0.0/16", "10.41.0.0/16"},
+					PersistentKeepalive: 15,
+				},
+			},
+			network: func(n *NetworkConfig) []any {
+				return []any{n.ListenPort, n.FirewallMark, n.Table, n.AllowedIPs}
+			},
+			want: []any{51820, 0xca6c, "off", []string{"10.30.0.0/16"}},
+		},
+		{
+			file: "hooks.conf",
+			server: ServerConfig{
+				Endpoint:  "2001:db8::1",
+				Port:      443,
+				PublicKey: "7XfpQE7fb74qsSsTy5giS0eL5DiHUR5jYqTmZWgF1hE=",
+			},
+			network: func(n *NetworkConfig) []any {
+				return []any{n.Table, n.PostUp, n.PreDown, n.PreUp}
+			},
+			want: []any{
+				"1234",
+				[]string{"iptables -A FORWARD -i %i -j ACCEPT", "ip rule add from 10.9.0.2 table 1234"},
+				[]string{"iptables -D FORWARD -i %i -j ACCEPT"},
+				[]string(nil),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			cfg, err := LoadWireGuardConfig(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatalf("LoadWireGuardConfig: %v", err)
+			}
+
+			if !reflect.DeepEqual(cfg.Server, tt.server) {
+				t.Errorf("server = %+v, want %+v", cfg.Server, tt.server)
+			}
+			if (len(cfg.Peers) > 0 || len(tt.peers) > 0) && !reflect.DeepEqual(cfg.Peers, tt.peers) {
+				t.Errorf("peers = %+v, want %+v", cfg.Peers, tt.peers)
+			}
+			if got := tt.network(&cfg.Network); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("network = %#v, want %#v", got, tt.want)
+			}
+			if cfg.Network.Interface != "kryptx0" {
+				t.Errorf("interface = %q, want kryptx0", cfg.Network.Interface)
+			}
+		})
+	}
+}
+
+func TestParseWireGuardConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"invalid-no-private-key.conf": "missing PrivateKey",
+		"invalid-no-endpoint.conf":    "no peer with an Endpoint",
+		"invalid-section.conf":        "line 4: unknown section [peers]",
+		"invalid-public-key.conf":     "public_key",
+		"invalid-endpoint.conf":       "parsing endpoint",
+	}
+
+	for file, want := range tests {
+		t.Run(file, func(t *testing.T) {
+			_, err := LoadWireGuardConfig(filepath.Join("testdata", file))
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Fatalf("error = %v, want one containing %q", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,303 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+const (
+	defaultBlocklistRefresh = 24 * time.Hour
+	blocklistFetchTimeout   = time.Minute
+	// Lists larger than this are cut short
+	maxBlocklistSize = 64 << 20
+	// TTL of blocked answers, short for unblocking to take effect soon
+	blockedTTL = 60
+)
+
+type BlockConfig struct {
+	// Lists are files or http(s) URLs, see parseBlocklist for the formats
+	Lists []string
+	// Allow are domains never blocked, along with their subdomains
+	Allow []string
+	// ZeroIP answers 0.0.0.0 and :: rather than NXDOMAIN
+	ZeroIP  bool
+	Refresh time.Duration
+}
+
+// ListStats describes one blocklist. Err is why it last failed to load;
+// the domains loaded before are blocked still.
+type ListStats struct {
+	Source  string
+	Domains int
+	Hits    uint64
+	Loaded  time.Time
+	Err     error
+}
+
+type blocklist struct {
+	source string
+	hits   atomic.Uint64
+
+	// guarded by blocker.mu
+	domains []string
+	loaded  time.Time
+	err     error
+}
+
+// blocker answers the queries for names on the blocklists itself. All
+// lists are compiled into one suffix matcher, replaced whole on reload.
+type blocker struct {
+	config BlockConfig
+	logger *utils.Logger
+	lists  []*blocklist
+	allow  *suffixSet
+
+	mu      sync.Mutex
+	matcher atomic.Pointer[suffixSet]
+}
+
+func newBlocker(cfg BlockConfig, logger *utils.Logger) *blocker {
+	b := &blocker{config: cfg, logger: logger, allow: newSuffixSet()}
+	for _, source := range cfg.Lists {
+		b.lists = append(b.lists, &blocklist{source: source})
+	}
+	for _, domain := range cfg.Allow {
+		b.allow.add(normalizeDomain(domain), 0)
+	}
+	b.matcher.Store(newSuffixSet())
+	return b
+}
+
+// run loads the lists now and again every refresh interval until ctx ends.
+func (b *blocker) run(ctx context.Context) {
+	refresh := b.config.Refresh
+	if refresh <= 0 {
+		refresh = defaultBlocklistRefresh
+	}
+
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		b.load(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// load reads every list and compiles them. A list that fails keeps the
+// domains it had.
+func (b *blocker) load(ctx context.Context) error {
+	var failed []string
+	for _, list := range b.lists {
+		domains, err := readBlocklist(ctx, list.source)
+
+		b.mu.Lock()
+		if err != nil {
+			list.err = err
+			failed = append(failed, list.source)
+			b.logger.Warning("Loading blocklist %s: %v", list.source, err)
+		} else {
+			list.domains, list.loaded, list.err = domains, time.Now(), nil
+		}
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	matcher := newSuffixSet()
+	// Later lists do not take over domains from earlier ones, for each
+	// hit to count towards the first list that has it
+	for i := len(b.lists) - 1; i >= 0; i-- {
+		for _, domain := range b.lists[i].domains {
+			matcher.add(domain, i)
+		}
+	}
+	b.mu.Unlock()
+	b.matcher.Store(matcher)
+
+	b.logger.Info("Blocking %d domains from %d lists", matcher.len(), len(b.lists))
+	if len(failed) > 0 {
+		return fmt.Errorf("loading blocklists %s failed", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// block returns the list that has name, unless it is allowed.
+func (b *blocker) block(name string) (*blocklist, bool) {
+	if _, ok := b.allow.match(name); ok {
+		return nil, false
+	}
+	index, ok := b.matcher.Load().match(name)
+	if !ok {
+		return nil, false
+	}
+	return b.lists[index], true
+}
+
+// answer is the reply to a blocked query.
+func (b *blocker) answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	resp.RecursionAvailable = true
+	if !b.config.ZeroIP {
+		resp.Rcode = dns.RcodeNameError
+		return resp
+	}
+
+	// Other types get an empty answer
+	q := req.Question[0]
+	header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockedTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: header, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: header, AAAA: net.IPv6zero})
+	}
+	return resp
+}
+
+func (b *blocker) stats() []ListStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]ListStats, 0, len(b.lists))
+	for _, list := range b.lists {
+		stats = append(stats, ListStats{
+			Source:  list.source,
+			Domains: len(list.domains),
+			Hits:    list.hits.Load(),
+			Loaded:  list.loaded,
+			Err:     list.err,
+		})
+	}
+	return stats
+}
+
+func readBlocklist(ctx context.Context, source string) ([]string, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseBlocklist(f)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+}
+
+// Names hosts files map to loopback addresses for themselves
+var hostsLocalNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseBlocklist reads the domains of a list in hosts format, such as
+// "0.0.0.0 ads.example tracker.example", or with one domain per line,
+// optionally written "*.ads.example" or ".ads.example". Comments start
+// with "#", or "!" as in Adblock lists.
+func parseBlocklist(r io.Reader) ([]string, error) {
+	var domains []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+
+		names := fields[:1]
+		if net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		}
+		for _, name := range names {
+			name = normalizeDomain(name)
+			if hostsLocalNames[name] || !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+				continue
+			}
+			if _, ok := dns.IsDomainName(name); ok {
+				domains = append(domains, name)
+			}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// normalizeDomain lower cases a domain and drops a leading "*." or ".",
+// which mean its subdomains and match those anyway.
+func normalizeDomain(name string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(name), "*"), ".")
+}
+
+// suffixSet matches names against a set of domains, a domain matching its
+// subdomains too, in one map lookup per label.
+type suffixSet struct {
+	// domains maps fully qualified, lower case domains to a value
+	domains map[string]int
+}
+
+func newSuffixSet() *suffixSet {
+	return &suffixSet{domains: map[string]int{}}
+}
+
+func (s *suffixSet) add(domain string, value int) {
+	s.domains[dns.Fqdn(strings.ToLower(domain))] = value
+}
+
+func (s *suffixSet) match(name string) (int, bool) {
+	name = dns.Fqdn(strings.ToLower(name))
+	for name != "" && name != "." {
+		if value, ok := s.domains[name]; ok {
+			return value, true
+		}
+		_, name, _ = strings.Cut(name, ".")
+	}
+	return 0, false
+}
+
+func (s *suffixSet) len() int {
+	return len(s.domains)
+}
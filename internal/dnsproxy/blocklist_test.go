@@ -0,0 +1,228 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		list string
+		want []string
+	}{
+		{
+			name: "hosts format",
+			list: "0.0.0.0 ads.example tracker.example\n127.0.0.1\tmetrics.example # inline\n:: v6.ads.example\n",
+			want: []string{"ads.example", "tracker.example", "metrics.example", "v6.ads.example"},
+		},
+		{
+			name: "domain per line",
+			list: "ads.example\n  Tracker.Example  \nfqdn.example.\n",
+			want: []string{"ads.example", "tracker.example", "fqdn.example."},
+		},
+		{
+			name: "wildcard and leading dot",
+			list: "*.ads.example\n.tracker.example\n",
+			want: []string{"ads.example", "tracker.example"},
+		},
+		{
+			name: "comments",
+			list: "# hosts\n! adblock title\n\n   \nads.example # trailing\n",
+			want: []string{"ads.example"},
+		},
+		{
+			name: "hosts file local names",
+			list: "127.0.0.1 localhost localhost.localdomain\n::1 ip6-localhost ip6-loopback\n" +
+				"255.255.255.255 broadcasthost\n0.0.0.0 0.0.0.0\nff02::1 ip6-allnodes\n0.0.0.0 ads.example\n",
+			want: []string{"ads.example"},
+		},
+		{
+			name: "single labels and invalid names",
+			list: "intranet\n0.0.0.0 router\nbad..example\n",
+			want: nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBlocklist(strings.NewReader(tt.list))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("parseBlocklist = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSuffixSet(t *testing.T) {
+	s := newSuffixSet()
+	s.add("ads.example", 1)
+	s.add("Deep.Tracker.Example.", 2)
+
+	for _, tt := range []struct {
+		name  string
+		value int
+		ok    bool
+	}{
+		{"ads.example", 1, true},
+		{"ads.example.", 1, true},
+		{"x.y.ADS.example", 1, true},
+		{"deep.tracker.example", 2, true},
+		{"a.deep.tracker.example.", 2, true},
+		{"tracker.example", 0, false},
+		{"bads.example", 0, false},
+		{"example", 0, false},
+		{"ads.example.org", 0, false},
+	} {
+		value, ok := s.match(tt.name)
+		if value != tt.value || ok != tt.ok {
+			t.Errorf("match(%q) = %d, %v; want %d, %v", tt.name, value, ok, tt.value, tt.ok)
+		}
+	}
+	if n := s.len(); n != 2 {
+		t.Errorf("len = %d, want 2", n)
+	}
+}
+
+// writeList writes a blocklist file and returns its path.
+func writeList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBlockerBlock(t *testing.T) {
+	dir := t.TempDir()
+	first := writeList(t, dir, "first", "ads.example\nshared.example\n")
+	second := writeList(t, dir, "second", "0.0.0.0 tracker.example shared.example\nok.ads.example\n")
+
+	b := newBlocker(BlockConfig{
+		Lists: []string{first, second},
+		Allow: []string{"*.good.tracker.example", "OK.ads.example."},
+	}, utils.NewLogger(testing.Verbose()))
+	if err := b.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		// list is the source the block is counted against, empty when
+		// the name is not blocked
+		list string
+	}{
+		{"ads.example.", first},
+		{"cdn.ads.example.", first},
+		{"tracker.example.", second},
+		{"x.tracker.example.", second},
+		// Both have it; the first list does
+		{"shared.example.", first},
+		{"www.shared.example.", first},
+		// Allow overrides the lists, with its subdomains
+		{"good.tracker.example.", ""},
+		{"www.good.tracker.example.", ""},
+		{"ok.ads.example.", ""},
+		{"sub.ok.ads.example.", ""},
+		{"example.", ""},
+		{"notads.example.", ""},
+	} {
+		list, blocked := b.block(tt.name)
+		switch {
+		case tt.list == "" && blocked:
+			t.Errorf("%s blocked by %s, want it through", tt.name, list.source)
+		case tt.list != "" && !blocked:
+			t.Errorf("%s not blocked, want it blocked by %s", tt.name, tt.list)
+		case tt.list != "" && list.source != tt.list:
+			t.Errorf("%s blocked by %s, want %s", tt.name, list.source, tt.list)
+		}
+	}
+}
+
+func TestBlockerAnswer(t *testing.T) {
+	question := func(qtype uint16) *dns.Msg {
+		return new(dns.Msg).SetQuestion("ads.example.", qtype)
+	}
+
+	nxdomain := newBlocker(BlockConfig{}, utils.NewLogger(testing.Verbose()))
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+		resp := nxdomain.answer(question(qtype))
+		if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+			t.Errorf("%s: rcode %s with %d answers, want NXDOMAIN", dns.TypeToString[qtype], dns.RcodeToString[resp.Rcode], len(resp.Answer))
+		}
+	}
+
+	zero := newBlocker(BlockConfig{ZeroIP: true}, utils.NewLogger(testing.Verbose()))
+	for _, tt := range []struct {
+		qtype uint16
+		want  net.IP
+	}{
+		{dns.TypeA, net.IPv4zero},
+		{dns.TypeAAAA, net.IPv6zero},
+		{dns.TypeTXT, nil},
+	} {
+		resp := zero.answer(question(tt.qtype))
+		name := dns.TypeToString[tt.qtype]
+		if resp.Rcode != dns.RcodeSuccess || !resp.Response || !resp.RecursionAvailable {
+			t.Errorf("%s: rcode %s, want a NOERROR response", name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		if tt.want == nil {
+			if len(resp.Answer) != 0 {
+				t.Errorf("%s: answers %v, want none", name, resp.Answer)
+			}
+			continue
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%s: answers %v, want one", name, resp.Answer)
+			continue
+		}
+		var got net.IP
+		switch rr := resp.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A
+		case *dns.AAAA:
+			got = rr.AAAA
+		}
+		if !got.Equal(tt.want) || resp.Answer[0].Header().Ttl != blockedTTL {
+			t.Errorf("%s: answer %v, want %s with TTL %d", name, resp.Answer[0], tt.want, blockedTTL)
+		}
+	}
+}
+
+func TestBlockerKeepsFailedList(t *testing.T) {
+	dir := t.TempDir()
+	path := writeList(t, dir, "list", "ads.example\n")
+
+	b := newBlocker(BlockConfig{Lists: []string{path}}, utils.NewLogger(testing.Verbose()))
+	if err := b.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	loaded := b.stats()[0].Loaded
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.load(context.Background()); err == nil {
+		t.Fatal("load succeeded with the list gone")
+	}
+
+	if _, blocked := b.block("ads.example."); !blocked {
+		t.Error("domains of the failed list no longer blocked")
+	}
+	stats := b.stats()[0]
+	if stats.Err == nil || stats.Domains != 1 || !stats.Loaded.Equal(loaded) {
+		t.Errorf("stats = %+v, want the error with the domains loaded before", stats)
+	}
+}
@@ -0,0 +1,142 @@
+package dnsproxy
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answers are kept no longer than this, whatever their TTL
+const maxCacheTTL = 24 * time.Hour
+
+// cacheKey tells queries apart by what changes the answer: the question
+// and whether DNSSEC records (DO) or unvalidated answers (CD) were asked
+// for.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+	cd     bool
+}
+
+func newCacheKey(req *dns.Msg) cacheKey {
+	q := req.Question[0]
+	key := cacheKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     req.CheckingDisabled,
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// cache holds answers up to their TTL, dropping the least recently used
+// ones beyond its size.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		order:   list.New(),
+		entries: map[cacheKey]*list.Element{},
+	}
+}
+
+// get returns a copy of the cached answer, its TTLs counted down by the
+// time it spent in the cache.
+func (c *cache) get(key cacheKey, now time.Time) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl -= elapsed
+			}
+		}
+	}
+	return msg, true
+}
+
+func (c *cache) put(key cacheKey, msg *dns.Msg, now time.Time) {
+	if msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := cacheTTL(msg)
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, msg: msg.Copy(), stored: now, expires: now.Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheTTL is the lowest TTL in msg. Answers without records are cached as
+// long as the SOA of their zone says negative answers may be (RFC 2308).
+func cacheTTL(msg *dns.Msg) time.Duration {
+	ttl := uint32(maxCacheTTL / time.Second)
+	seen := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			seen = true
+			ttl = min(ttl, rr.Header().Ttl)
+			if soa, ok := rr.(*dns.SOA); ok && len(msg.Answer) == 0 {
+				ttl = min(ttl, soa.Minttl)
+			}
+		}
+	}
+	if !seen {
+		return 0
+	}
+	return time.Duration(ttl) * time.Second
+}
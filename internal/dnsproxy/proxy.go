@@ -0,0 +1,345 @@
+// Package dnsproxy is the resolver KryptX runs on the host while connected.
+// It answers from its cache or forwards queries, unchanged, to encrypted
+// upstreams reached through the tunnel. Answers go back as the upstream
+// sent them, so DNSSEC records and the AD bit reach a validating client.
+package dnsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+const (
+	defaultCacheSize = 4096
+	// queryTimeout bounds a query over all upstreams
+	queryTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// Listen is the address to serve DNS on, over UDP and TCP
+	Listen string
+	// Upstreams are tried in order, see newUpstream for their forms
+	Upstreams []string
+	Rules     []Rule
+	CacheSize int
+	// Block turns on the blocklists
+	Block *BlockConfig
+	// Observe is handed the addresses of every answer
+	Observe func(name string, ips []net.IP)
+	// LocalOnly drops queries from other hosts, which keeps a proxy on an
+	// address they can reach, such as the tunnel's, from being an open
+	// resolver to them
+	LocalOnly bool
+}
+
+type Proxy struct {
+	config  Config
+	logger  *utils.Logger
+	router  *router
+	cache   *cache
+	blocker *blocker
+
+	mu      sync.Mutex
+	servers []*dns.Server
+	// local are the addresses of this host, for LocalOnly. Start sets
+	// them before serving, so the handlers read them without mu.
+	local map[string]bool
+	// stopBlocker ends the reloading of the blocklists
+	stopBlocker context.CancelFunc
+}
+
+// New sets up a proxy. Upstreams given by host name are looked up now, with
+// the resolver still in place, since the proxy is about to replace it.
+func New(cfg Config, logger *utils.Logger) (*Proxy, error) {
+	if len(cfg.Upstreams) == 0 {
+		return nil, errors.New("dns proxy: no upstreams configured")
+	}
+
+	router, err := newRouter(cfg.Upstreams, cfg.Rules, logger)
+	if err != nil {
+		return nil, fmt.Errorf("dns proxy: %w", err)
+	}
+
+	size := cfg.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+
+	p := &Proxy{
+		config: cfg,
+		logger: logger,
+		router: router,
+		cache:  newCache(size),
+	}
+	if cfg.Block != nil {
+		p.blocker = newBlocker(*cfg.Block, logger)
+	}
+	return p, nil
+}
+
+// Start listens on the configured address. The sockets are opened before
+// it returns, so that a taken port fails here rather than in the
+// background.
+func (p *Proxy) Start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.servers != nil {
+		return nil
+	}
+
+	if p.config.LocalOnly {
+		local, err := localAddresses()
+		if err != nil {
+			return fmt.Errorf("dns proxy: %w", err)
+		}
+		p.local = local
+	}
+
+	packetConn, err := net.ListenPacket("udp", p.config.Listen)
+	if err != nil {
+		return fmt.Errorf("dns proxy: %w", err)
+	}
+	listener, err := net.Listen("tcp", p.config.Listen)
+	if err != nil {
+		packetConn.Close()
+		return fmt.Errorf("dns proxy: %w", err)
+	}
+
+	p.servers = []*dns.Server{
+		{PacketConn: packetConn, Handler: p},
+		{Listener: listener, Handler: p},
+	}
+	for _, server := range p.servers {
+		go func(server *dns.Server) {
+			if err := server.ActivateAndServe(); err != nil {
+				p.logger.Error("DNS proxy stopped serving: %v", err)
+			}
+		}(server)
+	}
+
+	// Lists fetched from URLs go through the tunnel and may take a while,
+	// so blocking starts once they are in
+	if p.blocker != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		p.stopBlocker = cancel
+		go p.blocker.run(ctx)
+	}
+
+	p.logger.Info("DNS proxy listening on %s, forwarding to %s", p.config.Listen, p.router.defaults)
+	return nil
+}
+
+func (p *Proxy) Stop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for _, server := range p.servers {
+		if err := server.Shutdown(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("dns proxy: %w", err)
+		}
+	}
+	p.servers = nil
+
+	if p.stopBlocker != nil {
+		p.stopBlocker()
+		p.stopBlocker = nil
+	}
+
+	// Kept open, the connections would outlive the tunnel they went by
+	p.router.close()
+	return firstErr
+}
+
+// LoadBlocklists loads the blocklists right away, for a proxy that is not
+// started.
+func (p *Proxy) LoadBlocklists(ctx context.Context) error {
+	if p.blocker == nil {
+		return nil
+	}
+	return p.blocker.load(ctx)
+}
+
+// BlocklistStats returns the state of every blocklist, in the configured
+// order.
+func (p *Proxy) BlocklistStats() []ListStats {
+	if p.blocker == nil {
+		return nil
+	}
+	return p.blocker.stats()
+}
+
+// Addr is the address clients are to send their queries to.
+func (p *Proxy) Addr() string {
+	return p.config.Listen
+}
+
+func (p *Proxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if p.config.LocalOnly && !p.isLocal(w.RemoteAddr()) {
+		p.logger.Debug("DNS proxy: dropping query from %s", w.RemoteAddr())
+		w.Close()
+		return
+	}
+
+	resp := p.answer(req)
+	resp.Compress = true
+
+	// A UDP client gets what fits its buffer, truncated to have it retry
+	// over TCP if that is not all
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+
+	if err := w.WriteMsg(resp); err != nil {
+		p.logger.Debug("DNS proxy reply to %s: %v", w.RemoteAddr(), err)
+	}
+}
+
+// isLocal reports whether a query from addr comes from this host. The
+// addresses are read at Start, when the tunnel's is already there.
+func (p *Proxy) isLocal(addr net.Addr) bool {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	return ip.IsLoopback() || p.local[ip.String()]
+}
+
+func localAddresses() (map[string]bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("listing local addresses: %w", err)
+	}
+
+	local := make(map[string]bool)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			local[ipNet.IP.String()] = true
+		}
+	}
+	return local, nil
+}
+
+func (p *Proxy) answer(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		return new(dns.Msg).SetRcode(req, dns.RcodeFormatError)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+
+	resp, err := p.Resolve(ctx, req)
+	if err != nil {
+		p.logger.Debug("DNS proxy: %s: %v", req.Question[0].Name, err)
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+	// A cached answer may be for the name spelt in another case
+	resp.Id = req.Id
+	resp.Question = req.Question
+	return resp
+}
+
+// Resolve answers req from the blocklists, the cache or the upstreams.
+func (p *Proxy) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if p.blocker != nil {
+		if list, ok := p.blocker.block(req.Question[0].Name); ok {
+			list.hits.Add(1)
+			return p.blocker.answer(req), nil
+		}
+	}
+
+	key := newCacheKey(req)
+	if resp, ok := p.cache.get(key, time.Now()); ok {
+		return resp, nil
+	}
+
+	_, upstreams := p.router.route(req.Question[0].Name)
+	resp, _, err := upstreams.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.cache.put(key, resp, time.Now())
+	p.observe(req.Question[0].Name, resp)
+	return resp, nil
+}
+
+// Lookup is what a query for name gets from the upstreams, asked afresh
+// rather than answered from the cache.
+type Lookup struct {
+	// Rule is the domain of the rule that applied, empty for none
+	Rule string
+	// Blocked is the blocklist that has the name, which is then not
+	// looked up
+	Blocked  string
+	Upstream string
+	Response *dns.Msg
+	RTT      time.Duration
+}
+
+// Lookup queries for name the way the proxy would, with DNSSEC records
+// asked for, and tells which upstream answered. Where the upstreams fail,
+// the error comes with what is known of the lookup.
+func (p *Proxy) Lookup(ctx context.Context, name string, qtype uint16) (*Lookup, error) {
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+
+	rule, upstreams := p.router.route(req.Question[0].Name)
+	lookup := &Lookup{Rule: rule, Upstream: upstreams.String()}
+
+	if p.blocker != nil {
+		if list, ok := p.blocker.block(req.Question[0].Name); ok {
+			lookup.Blocked = list.source
+			lookup.Response = p.blocker.answer(req)
+			return lookup, nil
+		}
+	}
+
+	start := time.Now()
+	resp, answered, err := upstreams.exchange(ctx, req)
+	lookup.RTT = time.Since(start)
+	if err != nil {
+		return lookup, err
+	}
+	lookup.Upstream = answered.String()
+	lookup.Response = resp
+	return lookup, nil
+}
+
+func (p *Proxy) observe(name string, resp *dns.Msg) {
+	if p.config.Observe == nil {
+		return
+	}
+
+	var ips []net.IP
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	if len(ips) > 0 {
+		p.config.Observe(strings.TrimSuffix(name, "."), ips)
+	}
+}
@@ -0,0 +1,329 @@
+package dnsproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+// testWriter is a dns.ResponseWriter that keeps what the handler wrote.
+type testWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+	packed []byte
+	closed bool
+}
+
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 153), Port: 53}
+}
+func (w *testWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *testWriter) Close() error         { w.closed = true; return nil }
+func (w *testWriter) TsigStatus() error    { return nil }
+func (w *testWriter) TsigTimersOnly(bool)  {}
+func (w *testWriter) Hijack()              {}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	w.msg, w.packed = m, packed
+	return nil
+}
+
+func (w *testWriter) Write(b []byte) (int, error) {
+	w.packed = b
+	return len(b), nil
+}
+
+var (
+	udpClient = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	tcpClient = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+)
+
+// newPlainStub serves resolver as plain DNS over UDP and TCP, and returns
+// its address.
+func newPlainStub(t *testing.T, resolver *stubResolver) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	for _, server := range []*dns.Server{
+		{PacketConn: conn, Handler: resolver},
+		{Listener: listener, Handler: resolver},
+	} {
+		server := server
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return conn.LocalAddr().String()
+}
+
+// newTestProxy runs a proxy, not listening itself, in front of a plain DNS
+// stub serving resolver.
+func newTestProxy(t *testing.T, resolver *stubResolver) *Proxy {
+	t.Helper()
+
+	proxy, err := New(Config{Upstreams: []string{newPlainStub(t, resolver)}}, utils.NewLogger(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+func TestCacheTTL(t *testing.T) {
+	c := newCache(16)
+	req := query("example.net")
+	key := newCacheKey(req)
+
+	resp := (&stubResolver{}).answer(req)
+	now := time.Now()
+	c.put(key, resp, now)
+
+	cached, ok := c.get(key, now.Add(100*time.Second))
+	if !ok {
+		t.Fatal("answer not cached")
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl != 200 {
+		t.Errorf("TTL after 100s = %d, want 200", ttl)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("cached answer changed, TTL now %d", ttl)
+	}
+
+	if _, ok := c.get(key, now.Add(300*time.Second)); ok {
+		t.Error("answer still cached past its TTL")
+	}
+}
+
+func TestResolveFromCache(t *testing.T) {
+	resolver := &stubResolver{}
+	proxy := newTestProxy(t, resolver)
+
+	for i := 0; i < 3; i++ {
+		if _, err := proxy.Resolve(context.Background(), query("example.net")); err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+	}
+	if queries := resolver.queries.Load(); queries != 1 {
+		t.Errorf("upstream asked %d times, want once", queries)
+	}
+}
+
+func TestDNSSECPassthrough(t *testing.T) {
+	resolver := &stubResolver{signed: true}
+	proxy := newTestProxy(t, resolver)
+
+	req := query("example.net")
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	w := &testWriter{remote: udpClient}
+	proxy.ServeDNS(w, req)
+
+	if !resolver.do.Load() {
+		t.Error("DO bit did not reach the upstream")
+	}
+	if w.msg == nil || !w.msg.AuthenticatedData {
+		t.Fatalf("answer %v lost the AD bit", w.msg)
+	}
+	var signed bool
+	for _, rr := range w.msg.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			signed = true
+		}
+	}
+	if !signed {
+		t.Error("answer lost its RRSIG")
+	}
+	if opt := w.msg.IsEdns0(); opt == nil || !opt.Do() {
+		t.Error("answer lost the DO bit")
+	}
+
+	// Without DO the answer is a different one, not taken from the cache
+	proxy.ServeDNS(w, query("example.net"))
+	if resolver.do.Load() || resolver.queries.Load() != 2 {
+		t.Error("plain query answered from the DNSSEC one")
+	}
+	if w.msg.AuthenticatedData {
+		t.Error("plain query answered with the AD bit")
+	}
+}
+
+func TestServeDNSTruncation(t *testing.T) {
+	resolver := &stubResolver{records: 60}
+	proxy := newTestProxy(t, resolver)
+
+	// Over UDP without EDNS, 512 bytes is all there is
+	w := &testWriter{remote: udpClient}
+	proxy.ServeDNS(w, query("example.net"))
+	if !w.msg.Truncated || len(w.packed) > dns.MinMsgSize {
+		t.Errorf("UDP answer of %d bytes, truncated %v; want at most %d and TC set", len(w.packed), w.msg.Truncated, dns.MinMsgSize)
+	}
+
+	// EDNS makes room for it all
+	req := query("example.net")
+	req.SetEdns0(4096, false)
+	w = &testWriter{remote: udpClient}
+	proxy.ServeDNS(w, req)
+	if w.msg.Truncated || len(w.msg.Answer) != 60 {
+		t.Errorf("EDNS answer truncated %v with %d records, want all 60", w.msg.Truncated, len(w.msg.Answer))
+	}
+
+	// So does TCP
+	w = &testWriter{remote: tcpClient}
+	proxy.ServeDNS(w, query("example.net"))
+	if w.msg.Truncated || len(w.msg.Answer) != 60 {
+		t.Errorf("TCP answer truncated %v with %d records, want all 60", w.msg.Truncated, len(w.msg.Answer))
+	}
+}
+
+func TestServeDNSLocalOnly(t *testing.T) {
+	proxy := newTestProxy(t, &stubResolver{})
+	proxy.config.LocalOnly = true
+	proxy.local = map[string]bool{"10.8.0.2": true}
+
+	for _, tt := range []struct {
+		remote net.Addr
+		answer bool
+	}{
+		{udpClient, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.8.0.2"), Port: 40000}, true},
+		{&net.UDPAddr{IP: net.ParseIP("::ffff:10.8.0.2"), Port: 40000}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.8.0.1"), Port: 40000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.8.0.1"), Port: 40000}, false},
+	} {
+		w := &testWriter{remote: tt.remote}
+		proxy.ServeDNS(w, query("example.net"))
+		if answered := w.msg != nil; answered != tt.answer {
+			t.Errorf("query from %s answered %v, want %v", tt.remote, answered, tt.answer)
+		}
+	}
+}
+
+func TestProxyStopClosesUpstreams(t *testing.T) {
+	dohResolver := &stubResolver{}
+	doh := newDoHStub(t, dohResolver)
+	stub, dot := newDoTStub(t, &stubResolver{})
+
+	proxy := newTestProxy(t, &stubResolver{})
+	logger := utils.NewLogger(testing.Verbose())
+	proxy.router = &router{
+		defaults: &upstreamList{logger: logger, upstreams: []upstream{doh}},
+		domains:  []string{"corp.example"},
+		rules:    []*upstreamList{{logger: logger, upstreams: []upstream{dot}}},
+		matcher:  newSuffixSet(),
+	}
+	proxy.router.matcher.add("corp.example", 0)
+
+	for _, name := range []string{"example.net", "git.corp.example"} {
+		if _, err := proxy.Lookup(context.Background(), name, dns.TypeA); err != nil {
+			t.Fatalf("Lookup %s: %v", name, err)
+		}
+	}
+	if dohResolver.dohConns.Load() != 1 || len(dot.conns) != 1 {
+		t.Fatalf("%d DoH and %d DoT connections kept, want one each", dohResolver.dohConns.Load(), len(dot.conns))
+	}
+	kept := dot.conns[stub.addr]
+
+	if err := proxy.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept.alive() || len(dot.conns) != 0 {
+		t.Error("DoT connection still open after Stop")
+	}
+	// The server sees the client go in its own time
+	for deadline := time.Now().Add(5 * time.Second); dohResolver.dohConns.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d DoH connections still open after Stop", dohResolver.dohConns.Load())
+		}
+	}
+
+	// Started again, the proxy connects anew
+	if _, err := proxy.Lookup(context.Background(), "git.corp.example", dns.TypeA); err != nil {
+		t.Fatalf("Lookup after Stop: %v", err)
+	}
+	if accepted := stub.accepted.Load(); accepted != 2 {
+		t.Errorf("%d DoT connections, want a second one after Stop", accepted)
+	}
+}
+
+func TestProxyLookup(t *testing.T) {
+	stubs := map[string]*stubResolver{"default": {}, "corp": {}, "lab": {}}
+	defaultAddr, corpAddr, labAddr := newPlainStub(t, stubs["default"]), newPlainStub(t, stubs["corp"]), newPlainStub(t, stubs["lab"])
+	list := writeList(t, t.TempDir(), "ads", "ads.example\nads.corp.example\n")
+
+	proxy, err := New(Config{
+		Upstreams: []string{defaultAddr},
+		Rules: []Rule{
+			{Domain: "*.corp.example", Upstreams: []string{corpAddr}},
+			// The dead one fails over to the stub
+			{Domain: "lab.example", Upstreams: []string{deadAddr(t), labAddr}},
+		},
+		Block: &BlockConfig{Lists: []string{list}},
+	}, utils.NewLogger(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.LoadBlocklists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		want Lookup
+		// asked is the stub that gets the query, empty when none does
+		asked string
+	}{
+		{"example.net", Lookup{Upstream: defaultAddr}, "default"},
+		{"git.corp.example", Lookup{Rule: "corp.example", Upstream: corpAddr}, "corp"},
+		{"corp.example", Lookup{Rule: "corp.example", Upstream: corpAddr}, "corp"},
+		{"host.lab.example", Lookup{Rule: "lab.example", Upstream: labAddr}, "lab"},
+		{"ads.example", Lookup{Upstream: defaultAddr, Blocked: list}, ""},
+		{"ads.corp.example", Lookup{Rule: "corp.example", Upstream: corpAddr, Blocked: list}, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]int32{}
+			for name, stub := range stubs {
+				before[name] = stub.queries.Load()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			lookup, err := proxy.Lookup(ctx, tt.name, dns.TypeA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lookup.Rule != tt.want.Rule || lookup.Upstream != tt.want.Upstream || lookup.Blocked != tt.want.Blocked {
+				t.Errorf("Lookup = rule %q, upstream %q, blocked %q; want rule %q, upstream %q, blocked %q",
+					lookup.Rule, lookup.Upstream, lookup.Blocked, tt.want.Rule, tt.want.Upstream, tt.want.Blocked)
+			}
+
+			wantRcode := dns.RcodeSuccess
+			if tt.want.Blocked != "" {
+				wantRcode = dns.RcodeNameError
+			}
+			if lookup.Response == nil || lookup.Response.Rcode != wantRcode {
+				t.Errorf("response %v, want %s", lookup.Response, dns.RcodeToString[wantRcode])
+			}
+
+			for name, stub := range stubs {
+				if asked := stub.queries.Load() != before[name]; asked != (name == tt.asked) {
+					t.Errorf("%s stub asked: %v, want the query to go to %q", name, asked, tt.asked)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package dnsproxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"kryptx/internal/utils"
+)
+
+// Rule sends the queries for Domain and the names under it to Upstreams
+// rather than the default ones. A leading "*." changes nothing.
+type Rule struct {
+	Domain    string
+	Upstreams []string
+}
+
+// router picks the upstreams for a name: those of the rule with the
+// longest matching domain, or else the default ones.
+type router struct {
+	defaults *upstreamList
+	domains  []string
+	rules    []*upstreamList
+	// matcher maps rule domains to their index in rules
+	matcher *suffixSet
+}
+
+func newRouter(defaults []string, rules []Rule, logger *utils.Logger) (*router, error) {
+	r := &router{matcher: newSuffixSet()}
+
+	var err error
+	if r.defaults, err = newUpstreamList(defaults, logger); err != nil {
+		return nil, err
+	}
+
+	for _, rule := range rules {
+		domain := strings.TrimSuffix(strings.ToLower(strings.TrimPrefix(strings.TrimSpace(rule.Domain), "*.")), ".")
+		if domain == "" {
+			return nil, fmt.Errorf("rule %q: covers every name, configure upstreams instead", rule.Domain)
+		}
+		if len(rule.Upstreams) == 0 {
+			return nil, fmt.Errorf("rule %q: no servers", rule.Domain)
+		}
+		if slices.Contains(r.domains, domain) {
+			return nil, fmt.Errorf("rule %q: domain given twice", rule.Domain)
+		}
+
+		upstreams, err := newUpstreamList(rule.Upstreams, logger)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Domain, err)
+		}
+		r.matcher.add(domain, len(r.rules))
+		r.domains = append(r.domains, domain)
+		r.rules = append(r.rules, upstreams)
+	}
+	return r, nil
+}
+
+// route returns the upstreams for name, along with the domain of the rule
+// that picked them, empty for the defaults.
+func (r *router) route(name string) (string, *upstreamList) {
+	if index, ok := r.matcher.match(name); ok {
+		return r.domains[index], r.rules[index]
+	}
+	return "", r.defaults
+}
+
+// close drops the connections of every upstream.
+func (r *router) close() {
+	r.defaults.close()
+	for _, rule := range r.rules {
+		rule.close()
+	}
+}
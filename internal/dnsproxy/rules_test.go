@@ -0,0 +1,74 @@
+package dnsproxy
+
+import (
+	"strings"
+	"testing"
+
+	"kryptx/internal/utils"
+)
+
+func TestRouterRoute(t *testing.T) {
+	r, err := newRouter([]string{"192.0.2.53"}, []Rule{
+		{Domain: "*.corp.example", Upstreams: []string{"192.0.2.1"}},
+		{Domain: "EU.Corp.Example.", Upstreams: []string{"192.0.2.2", "192.0.2.3"}},
+		{Domain: " lab.example ", Upstreams: []string{"udp://192.0.2.4:5353"}},
+	}, utils.NewLogger(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		rule      string
+		upstreams string
+	}{
+		// "*." covers the domain itself as well
+		{"corp.example.", "corp.example", "192.0.2.1:53"},
+		{"git.corp.example.", "corp.example", "192.0.2.1:53"},
+		{"a.b.corp.example.", "corp.example", "192.0.2.1:53"},
+		// The longest rule wins, whichever came first
+		{"eu.corp.example.", "eu.corp.example", "192.0.2.2:53, 192.0.2.3:53"},
+		{"git.eu.corp.example.", "eu.corp.example", "192.0.2.2:53, 192.0.2.3:53"},
+		{"us.corp.example.", "corp.example", "192.0.2.1:53"},
+		// Trailing dots and case do not matter
+		{"git.corp.example", "corp.example", "192.0.2.1:53"},
+		{"GIT.EU.CORP.EXAMPLE.", "eu.corp.example", "192.0.2.2:53, 192.0.2.3:53"},
+		{"Host.Lab.Example", "lab.example", "192.0.2.4:5353"},
+		// Only whole labels match
+		{"notcorp.example.", "", "192.0.2.53:53"},
+		{"corp.example.org.", "", "192.0.2.53:53"},
+		{"example.", "", "192.0.2.53:53"},
+		{".", "", "192.0.2.53:53"},
+	} {
+		rule, upstreams := r.route(tt.name)
+		if rule != tt.rule || upstreams.String() != tt.upstreams {
+			t.Errorf("route(%q) = %q, %s; want %q, %s", tt.name, rule, upstreams, tt.rule, tt.upstreams)
+		}
+	}
+}
+
+func TestNewRouterRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules []Rule
+		want  string
+	}{
+		{"every name", []Rule{{Domain: "*.", Upstreams: []string{"192.0.2.1"}}}, "covers every name"},
+		{"root", []Rule{{Domain: ".", Upstreams: []string{"192.0.2.1"}}}, "covers every name"},
+		{"no servers", []Rule{{Domain: "corp.example"}}, "no servers"},
+		{
+			"given twice",
+			[]Rule{
+				{Domain: "corp.example", Upstreams: []string{"192.0.2.1"}},
+				{Domain: "*.Corp.Example.", Upstreams: []string{"192.0.2.2"}},
+			},
+			"given twice",
+		},
+		{"plain server by name", []Rule{{Domain: "corp.example", Upstreams: []string{"dns.corp.example"}}}, "take an address"},
+	} {
+		_, err := newRouter([]string{"192.0.2.53"}, tt.rules, utils.NewLogger(testing.Verbose()))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: newRouter = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
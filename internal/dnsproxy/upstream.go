@@ -0,0 +1,478 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	// The largest DNS message there is
+	maxMessageSize = 65535
+	lookupTimeout  = 5 * time.Second
+	// dotIdleTimeout closes a DNS over TLS connection nothing was sent on
+	// for this long
+	dotIdleTimeout = 30 * time.Second
+)
+
+type upstream interface {
+	exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+	// close drops the connections kept to the server; the next exchange
+	// makes new ones
+	close()
+	String() string
+}
+
+// newUpstream parses one of:
+//
+//	https://dns.example/dns-query   DNS over HTTPS
+//	tls://dns.example[:853]         DNS over TLS
+//	[udp://]192.0.2.1[:53]          plain DNS, over TCP when truncated
+//
+// Host names are looked up right away and the addresses pinned; the
+// certificate is still checked against the name.
+func newUpstream(spec string) (upstream, error) {
+	switch {
+	case strings.HasPrefix(spec, "https://"):
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", spec, err)
+		}
+		addrs, err := lookupAddrs(u.Hostname(), portOr(u.Port(), "443"))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", spec, err)
+		}
+		return newDoHUpstream(u, addrs), nil
+
+	case strings.HasPrefix(spec, "tls://"):
+		host, port := splitHostPort(strings.TrimPrefix(spec, "tls://"), "853")
+		addrs, err := lookupAddrs(host, port)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", spec, err)
+		}
+		return newDoTUpstream(spec, addrs, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}), nil
+
+	default:
+		host, port := splitHostPort(strings.TrimPrefix(spec, "udp://"), "53")
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("upstream %q: plain DNS servers take an address", spec)
+		}
+		return &plainUpstream{addr: net.JoinHostPort(host, port)}, nil
+	}
+}
+
+// dohUpstream speaks DNS over HTTPS, RFC 8484, over a connection it keeps.
+type dohUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func newDoHUpstream(u *url.URL, addrs []string) *dohUpstream {
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		// Whatever the URL says, connect to the pinned addresses
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var lastErr error
+			for _, addr := range addrs {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+			}
+			return nil, lastErr
+		},
+		TLSClientConfig:   &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12},
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}
+	return &dohUpstream{url: u.String(), client: &http.Client{Transport: transport}}
+}
+
+func (d *dohUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	// The ID is zero on the wire for the answer to be cacheable by URL
+	query := req.Copy()
+	query.Id = 0
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpResp, err := d.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", d.url, httpResp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(httpResp.Body, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, fmt.Errorf("%s: %w", d.url, err)
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+func (d *dohUpstream) close() {
+	d.client.CloseIdleConnections()
+}
+
+func (d *dohUpstream) String() string {
+	return d.url
+}
+
+// dotUpstream speaks DNS over TLS, RFC 7858. It keeps a connection per
+// address and pipelines the queries on it, matching answers by ID, for
+// the TLS handshake not to be paid on every query.
+type dotUpstream struct {
+	spec   string
+	addrs  []string
+	client *dns.Client
+
+	mu    sync.Mutex
+	conns map[string]*dotConn
+}
+
+func newDoTUpstream(spec string, addrs []string, tlsConfig *tls.Config) *dotUpstream {
+	return &dotUpstream{
+		spec:   spec,
+		addrs:  addrs,
+		client: &dns.Client{Net: "tcp-tls", TLSConfig: tlsConfig},
+		conns:  make(map[string]*dotConn),
+	}
+}
+
+func (d *dotUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var lastErr error
+	for _, addr := range d.addrs {
+		resp, err := d.exchangeAddr(ctx, req, addr)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// exchangeAddr sends req on the connection to addr. A kept connection the
+// server has since closed gets one retry on a new one.
+func (d *dotUpstream) exchangeAddr(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, error) {
+	for attempt := 0; ; attempt++ {
+		conn, fresh, err := d.conn(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.exchange(ctx, req)
+		if err == nil || fresh || attempt > 0 || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+}
+
+// conn returns the live connection to addr, dialing one if there is none.
+func (d *dotUpstream) conn(ctx context.Context, addr string) (*dotConn, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if conn, ok := d.conns[addr]; ok && conn.alive() {
+		return conn, false, nil
+	}
+
+	dnsConn, err := d.client.DialContext(ctx, addr)
+	if err != nil {
+		return nil, false, err
+	}
+	conn := newDoTConn(dnsConn)
+	d.conns[addr] = conn
+	return conn, true, nil
+}
+
+func (d *dotUpstream) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for addr, conn := range d.conns {
+		conn.close(net.ErrClosed)
+		delete(d.conns, addr)
+	}
+}
+
+func (d *dotUpstream) String() string {
+	return d.spec
+}
+
+// dotConn is one DNS over TLS connection with queries in flight on it.
+type dotConn struct {
+	conn *dns.Conn
+	// writeMu serialises the queries on the wire
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	// done is closed, and err set, once the connection is gone
+	done chan struct{}
+	err  error
+}
+
+func newDoTConn(conn *dns.Conn) *dotConn {
+	c := &dotConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dns.Msg),
+		done:    make(chan struct{}),
+	}
+	conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+	go c.read()
+	return c
+}
+
+func (c *dotConn) alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// exchange sends req under an ID of its own on the connection and waits
+// for the answer to it.
+func (c *dotConn) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	query := req.Copy()
+	answer := make(chan *dns.Msg, 1)
+
+	c.mu.Lock()
+	if !c.alive() {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	for {
+		query.Id = dns.Id()
+		if _, taken := c.pending[query.Id]; !taken {
+			break
+		}
+	}
+	c.pending[query.Id] = answer
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, query.Id)
+		c.mu.Unlock()
+	}()
+
+	c.writeMu.Lock()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetWriteDeadline(deadline)
+	err := c.conn.WriteMsg(query)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+
+	select {
+	case resp := <-answer:
+		resp.Id = req.Id
+		return resp, nil
+	case <-c.done:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// read hands the answers to the queries waiting for them, in whatever
+// order the server sends them, until the connection fails or idles out.
+func (c *dotConn) read() {
+	for {
+		resp, err := c.conn.ReadMsg()
+		if err != nil {
+			c.close(err)
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(dotIdleTimeout))
+
+		c.mu.Lock()
+		answer, ok := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		if ok {
+			answer <- resp
+		}
+	}
+}
+
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.alive() {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+type plainUpstream struct {
+	addr string
+}
+
+func (p *plainUpstream) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := (&dns.Client{Net: "udp"}).ExchangeContext(ctx, req, p.addr)
+	if err == nil && resp.Truncated {
+		resp, _, err = (&dns.Client{Net: "tcp"}).ExchangeContext(ctx, req, p.addr)
+	}
+	return resp, err
+}
+
+func (p *plainUpstream) close() {}
+
+func (p *plainUpstream) String() string {
+	return p.addr
+}
+
+// upstreamList fails over from one upstream to the next. The one that
+// answered last is tried first.
+type upstreamList struct {
+	logger    *utils.Logger
+	upstreams []upstream
+
+	mu      sync.Mutex
+	current int
+}
+
+func newUpstreamList(specs []string, logger *utils.Logger) (*upstreamList, error) {
+	l := &upstreamList{logger: logger}
+	for _, spec := range specs {
+		u, err := newUpstream(spec)
+		if err != nil {
+			return nil, err
+		}
+		l.upstreams = append(l.upstreams, u)
+	}
+	return l, nil
+}
+
+// exchange returns the first answer, and the upstream it came from.
+func (l *upstreamList) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, upstream, error) {
+	l.mu.Lock()
+	start := l.current
+	l.mu.Unlock()
+
+	// Each upstream gets its share of the time left, for a dead one not
+	// to use it all up
+	var errs []error
+	for i := range l.upstreams {
+		index := (start + i) % len(l.upstreams)
+		u := l.upstreams[index]
+
+		attemptCtx, cancel := context.WithTimeout(ctx, attemptTimeout(ctx, len(l.upstreams)-i))
+		resp, err := u.exchange(attemptCtx, req)
+		cancel()
+		if err == nil && resp.Rcode == dns.RcodeServerFailure && i < len(l.upstreams)-1 {
+			// SERVFAIL may be this upstream's trouble; a bogus DNSSEC
+			// answer gets it from the next one too
+			err = errors.New("SERVFAIL")
+		}
+		if err != nil {
+			l.logger.Debug("DNS upstream %s: %v", u, err)
+			errs = append(errs, fmt.Errorf("%s: %w", u, err))
+			continue
+		}
+
+		if index != start {
+			l.logger.Info("DNS upstream failed over to %s", u)
+			l.mu.Lock()
+			l.current = index
+			l.mu.Unlock()
+		}
+		return resp, u, nil
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (l *upstreamList) close() {
+	for _, u := range l.upstreams {
+		u.close()
+	}
+}
+
+func (l *upstreamList) String() string {
+	var specs []string
+	for _, u := range l.upstreams {
+		specs = append(specs, u.String())
+	}
+	return strings.Join(specs, ", ")
+}
+
+func attemptTimeout(ctx context.Context, remaining int) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return queryTimeout
+	}
+	return time.Until(deadline) / time.Duration(remaining)
+}
+
+// lookupAddrs resolves host to addresses with port, or takes it as one.
+func lookupAddrs(host, port string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
+
+func splitHostPort(hostport, defaultPort string) (string, string) {
+	if host, port, err := net.SplitHostPort(hostport); err == nil {
+		return host, port
+	}
+	return strings.Trim(hostport, "[]"), defaultPort
+}
+
+func portOr(port, defaultPort string) string {
+	if port == "" {
+		return defaultPort
+	}
+	return port
+}
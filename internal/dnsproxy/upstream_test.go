@@ -0,0 +1,384 @@
+package dnsproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/utils"
+)
+
+// stubResolver answers every query with address records of its own, or
+// with rcode when that is set.
+type stubResolver struct {
+	rcode int
+	// records is how many A records an answer has, one when zero
+	records int
+	// signed answers DNSSEC queries with the AD bit and an RRSIG
+	signed bool
+
+	queries atomic.Int32
+	// do is whether the last query asked for DNSSEC records
+	do atomic.Bool
+	// dohConns counts the connections open to it over DNS over HTTPS
+	dohConns atomic.Int32
+}
+
+func (s *stubResolver) answer(req *dns.Msg) *dns.Msg {
+	s.queries.Add(1)
+
+	resp := new(dns.Msg).SetReply(req)
+	if s.rcode != dns.RcodeSuccess {
+		resp.Rcode = s.rcode
+		return resp
+	}
+
+	name := req.Question[0].Name
+	for i := 0; i < max(s.records, 1); i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, byte(i+1)),
+		})
+	}
+
+	opt := req.IsEdns0()
+	s.do.Store(opt != nil && opt.Do())
+	if opt != nil {
+		resp.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		if opt.Do() && s.signed {
+			resp.AuthenticatedData = true
+			resp.Answer = append(resp.Answer, &dns.RRSIG{
+				Hdr:         dns.RR_Header{Name: name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+				TypeCovered: dns.TypeA,
+				Algorithm:   dns.ECDSAP256SHA256,
+				Labels:      uint8(dns.CountLabel(name)),
+				OrigTtl:     300,
+				Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+				Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+				KeyTag:      12345,
+				SignerName:  name,
+				Signature:   "c2lnbmF0dXJl",
+			})
+		}
+	}
+	return resp
+}
+
+// ServeDNS truncates answers over UDP the way a real server does.
+func (s *stubResolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := s.answer(req)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		resp.Truncate(size)
+	}
+	w.WriteMsg(resp)
+}
+
+// testCertificate is a self-signed certificate for 127.0.0.1, and a pool
+// that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kryptx test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// newDoHStub serves resolver over DNS over HTTPS and returns an upstream
+// for it.
+func newDoHStub(t *testing.T, resolver *stubResolver) *dohUpstream {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		packed, err := resolver.answer(req).Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			resolver.dohConns.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			resolver.dohConns.Add(-1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL + "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+
+	upstream := newDoHUpstream(u, []string{server.Listener.Addr().String()})
+	upstream.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = pool
+	return upstream
+}
+
+// dotStub is a DNS over TLS server that counts the connections made to
+// it and can drop them.
+type dotStub struct {
+	addr     string
+	accepted atomic.Int32
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (s *dotStub) Accept(l net.Listener) (net.Conn, error) {
+	conn, err := l.Accept()
+	if err == nil {
+		s.accepted.Add(1)
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+	}
+	return conn, err
+}
+
+// dropConns closes the connections from the server's side.
+func (s *dotStub) dropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+type countingListener struct {
+	net.Listener
+	stub *dotStub
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	return l.stub.Accept(l.Listener)
+}
+
+// newDoTStub serves resolver over DNS over TLS and returns an upstream
+// for it.
+func newDoTStub(t *testing.T, resolver *stubResolver) (*dotStub, *dotUpstream) {
+	t.Helper()
+
+	cert, pool := testCertificate(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &dotStub{addr: listener.Addr().String()}
+	tlsListener := tls.NewListener(countingListener{listener, stub}, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	server := &dns.Server{Listener: tlsListener, Net: "tcp-tls", Handler: resolver}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	upstream := newDoTUpstream("tls://"+stub.addr, []string{stub.addr}, &tls.Config{ServerName: "127.0.0.1", RootCAs: pool})
+	return stub, upstream
+}
+
+// deadAddr is a local address nothing listens on.
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func query(name string) *dns.Msg {
+	return new(dns.Msg).SetQuestion(dns.Fqdn(name), dns.TypeA)
+}
+
+func TestDoHExchange(t *testing.T) {
+	resolver := &stubResolver{}
+	upstream := newDoHStub(t, resolver)
+
+	req := query("example.net")
+	resp, err := upstream.exchange(context.Background(), req)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Id != req.Id || len(resp.Answer) != 1 {
+		t.Errorf("answer = %v, want one record under ID %d", resp, req.Id)
+	}
+}
+
+func TestDoTPipelining(t *testing.T) {
+	resolver := &stubResolver{}
+	stub, upstream := newDoTStub(t, resolver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := query(string(rune('a'+i)) + ".example.net")
+			resp, err := upstream.exchange(ctx, req)
+			if err == nil && (resp.Id != req.Id || resp.Question[0].Name != req.Question[0].Name) {
+				t.Errorf("query %s got the answer for %s", req.Question[0].Name, resp.Question[0].Name)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+	}
+
+	if accepted := stub.accepted.Load(); accepted != 1 {
+		t.Errorf("%d connections for %d queries, want them all on one", accepted, resolver.queries.Load())
+	}
+
+	// A connection the server closed is replaced
+	stub.dropConns()
+	if _, err := upstream.exchange(ctx, query("example.net")); err != nil {
+		t.Fatalf("exchange after the server closed the connection: %v", err)
+	}
+	if accepted := stub.accepted.Load(); accepted != 2 {
+		t.Errorf("%d connections after the first was closed, want 2", accepted)
+	}
+}
+
+func TestUpstreamListFailover(t *testing.T) {
+	dead := newDoTUpstream("tls://dead", []string{deadAddr(t)}, &tls.Config{ServerName: "127.0.0.1"})
+	resolver := &stubResolver{}
+	list := &upstreamList{
+		logger:    utils.NewLogger(testing.Verbose()),
+		upstreams: []upstream{dead, newDoHStub(t, resolver)},
+	}
+
+	for i := 0; i < 2; i++ {
+		resp, answered, err := list.exchange(context.Background(), query("example.net"))
+		if err != nil {
+			t.Fatalf("exchange: %v", err)
+		}
+		if answered != list.upstreams[1] || len(resp.Answer) != 1 {
+			t.Errorf("answered by %s, want the DoH stub", answered)
+		}
+	}
+
+	// Having answered, the second upstream is now asked first
+	if list.current != 1 {
+		t.Errorf("current upstream = %d, want 1", list.current)
+	}
+}
+
+func TestUpstreamListAllFail(t *testing.T) {
+	list := &upstreamList{
+		logger: utils.NewLogger(testing.Verbose()),
+		upstreams: []upstream{
+			newDoTUpstream("tls://dead", []string{deadAddr(t)}, &tls.Config{ServerName: "127.0.0.1"}),
+			newDoTUpstream("tls://dead2", []string{deadAddr(t)}, &tls.Config{ServerName: "127.0.0.1"}),
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := list.exchange(ctx, query("example.net")); err == nil {
+		t.Fatal("exchange succeeded with no upstream up")
+	}
+}
+
+func TestUpstreamListServfail(t *testing.T) {
+	failing := &stubResolver{rcode: dns.RcodeServerFailure}
+	working := &stubResolver{}
+	_, dot := newDoTStub(t, working)
+	list := &upstreamList{
+		logger:    utils.NewLogger(testing.Verbose()),
+		upstreams: []upstream{newDoHStub(t, failing), dot},
+	}
+
+	resp, answered, err := list.exchange(context.Background(), query("example.net"))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if answered != dot || resp.Rcode != dns.RcodeSuccess {
+		t.Errorf("answer %s from %s, want NOERROR from the DoT stub", dns.RcodeToString[resp.Rcode], answered)
+	}
+	if failing.queries.Load() != 1 {
+		t.Errorf("failing upstream asked %d times, want once", failing.queries.Load())
+	}
+
+	// From the last upstream SERVFAIL is the answer
+	list = &upstreamList{
+		logger:    utils.NewLogger(testing.Verbose()),
+		upstreams: []upstream{newDoHStub(t, failing)},
+	}
+	resp, _, err = list.exchange(context.Background(), query("example.org"))
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode = %s, want SERVFAIL passed on", dns.RcodeToString[resp.Rcode])
+	}
+}
@@ -1,7 +1,9 @@
 package gui
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"time"
 
 	"fyne.io/fyne/v2"
@@ -10,6 +12,7 @@ import (
 	"fyne.io/fyne/v2/widget"
 
 	"kryptx/internal/config"
+	"kryptx/internal/dnsproxy"
 	"kryptx/internal/network"
 	"kryptx/internal/utils"
 )
@@ -21,12 +24,25 @@ type App struct {
 	config    *config.Config
 	logger    *utils.Logger
 
+	// ctx lives as long as the app and bounds what it starts, connecting
+	// included. Widget updates from other goroutines go through updates,
+	// to be made one at a time.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	updates chan func()
+
 	// UI components
 	statusLabel    *widget.Label
 	connectButton  *widget.Button
+	serverSelect   *widget.Select
 	serverLabel    *widget.Label
+	probeButton    *widget.Button
+	leakButton     *widget.Button
 	ipLabel        *widget.Label
 	statsContainer *fyne.Container
+
+	latencyContainer   *fyne.Container
+	blocklistContainer *fyne.Container
 }
 
 func NewApp(vpnClient *network.VPNClient, cfg *config.Config, logger *utils.Logger) *App {
@@ -37,11 +53,15 @@ func NewApp(vpnClient *network.VPNClient, cfg *config.Config, logger *utils.Logg
 		a.Settings().SetTheme(&CyberpunkTheme{})
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &App{
 		app:       a,
 		vpnClient: vpnClient,
 		config:    cfg,
 		logger:    logger,
+		ctx:       ctx,
+		cancel:    cancel,
+		updates:   make(chan func(), 16),
 	}
 }
 
@@ -51,12 +71,39 @@ func (a *App) Run() {
 	a.window.Resize(fyne.NewSize(400, 500))
 	a.window.CenterOnScreen()
 
+	a.app.Lifecycle().SetOnStopped(a.cancel)
+	defer a.cancel()
+
 	a.setupUI()
+	go a.runUpdates()
+	a.watchState()
+	a.watchSecurity()
 	a.startStatusUpdater()
 
 	a.window.ShowAndRun()
 }
 
+// runUpdates makes the widget updates handed to do, in order.
+func (a *App) runUpdates() {
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case update := <-a.updates:
+			update()
+		}
+	}
+}
+
+// do has update made by runUpdates, for goroutines other than the UI's to
+// change widgets without racing each other.
+func (a *App) do(update func()) {
+	select {
+	case a.updates <- update:
+	case <-a.ctx.Done():
+	}
+}
+
 func (a *App) setupUI() {
 	// Header
 	title := widget.NewLabelWithStyle("KryptX VPN", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
@@ -73,16 +120,43 @@ func (a *App) setupUI() {
 	a.connectButton.Importance = widget.HighImportance
 
 	// Server info
-	a.serverLabel = widget.NewLabel(fmt.Sprintf("Server: %s", a.config.Server.Endpoint))
+	names := []string{config.AutoServer}
+	for _, server := range a.vpnClient.Servers() {
+		names = append(names, server.Name)
+	}
+	a.serverSelect = widget.NewSelect(names, nil)
+	a.serverLabel = widget.NewLabel("")
 	a.ipLabel = widget.NewLabel("IP: Not connected")
 
+	active := a.vpnClient.ActiveServer()
+	if a.config.AutoSelect() {
+		a.serverSelect.SetSelected(config.AutoServer)
+	} else {
+		a.serverSelect.SetSelected(active.Name)
+	}
+	a.serverSelect.OnChanged = a.selectServer
+	a.showServer(active)
+
 	serverCard := widget.NewCard("Connection Info", "",
-		container.NewVBox(a.serverLabel, a.ipLabel))
+		container.NewVBox(a.serverSelect, a.serverLabel, a.ipLabel))
+
+	// Server latency
+	a.latencyContainer = container.NewVBox()
+	a.probeButton = widget.NewButton("Test Latency", a.probeServers)
+	latencyCard := widget.NewCard("Servers", "",
+		container.NewVBox(a.latencyContainer, a.probeButton))
 
 	// Stats section
 	a.statsContainer = container.NewVBox()
 	statsCard := widget.NewCard("Statistics", "", a.statsContainer)
 
+	// Blocklist hits
+	a.blocklistContainer = container.NewVBox()
+	blocklistCard := widget.NewCard("Blocklists", "", a.blocklistContainer)
+
+	// Leak test
+	a.leakButton = widget.NewButton("Leak Test", a.runLeakTest)
+
 	// Settings button
 	settingsButton := widget.NewButton("Settings", a.showSettings)
 	settingsButton.Importance = widget.MediumImportance
@@ -95,95 +169,293 @@ func (a *App) setupUI() {
 		a.connectButton,
 		widget.NewSeparator(),
 		serverCard,
+		latencyCard,
 		statsCard,
-		widget.NewSeparator(),
-		settingsButton,
 	)
+	if a.config.Security.Blocklists.Enabled {
+		content.Add(blocklistCard)
+	}
+	content.Add(widget.NewSeparator())
+	content.Add(a.leakButton)
+	content.Add(settingsButton)
 
 	scrollable := container.NewScroll(content)
 	a.window.SetContent(scrollable)
+
+	a.showState(a.vpnClient.State(), a.vpnClient.LastError())
 }
 
-func (a *App) toggleConnection() {
-	if a.vpnClient.IsConnected() {
-		a.disconnect()
-	} else {
-		a.connect()
+func (a *App) selectServer(name string) {
+	if err := a.vpnClient.SelectServer(name); err != nil {
+		a.logger.Error("Selecting server: %v", err)
+
+		// Put the previous choice back without coming here again
+		a.serverSelect.OnChanged = nil
+		a.serverSelect.SetSelected(a.vpnClient.ActiveServer().Name)
+		a.serverSelect.OnChanged = a.selectServer
+		return
 	}
+	a.showServer(a.vpnClient.ActiveServer())
 }
 
-func (a *App) connect() {
-	a.connectButton.SetText("Connecting...")
-	a.connectButton.Disable()
-	a.statusLabel.SetText("Connecting...")
+func (a *App) showServer(server config.ServerConfig) {
+	a.serverLabel.SetText(fmt.Sprintf("Server: %s:%d", server.Endpoint, server.Port))
+}
+
+func (a *App) probeServers() {
+	a.probeButton.Disable()
 
 	go func() {
-		if err := a.vpnClient.Connect(a.app.Driver().AllWindows()[0].Canvas().Context()); err != nil {
-			a.logger.Error("Connection failed: %v", err)
+		ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+		defer cancel()
+		results := a.vpnClient.ProbeServers(ctx)
+
+		a.do(func() {
+			a.showLatencies(results)
+			a.probeButton.Enable()
+		})
+	}()
+}
+
+func (a *App) showLatencies(results []network.ServerLatency) {
+	a.latencyContainer.RemoveAll()
+
+	for _, result := range results {
+		line := fmt.Sprintf("%s: unreachable", result.Server)
+		if result.Reachable() {
+			line = fmt.Sprintf("%s: %s, %.0f%% loss", result.Server, result.RTT.Round(time.Millisecond), result.Loss*100)
+		}
+		a.latencyContainer.Add(widget.NewLabel(line))
+	}
+}
 
-			// Update UI on main thread
-			a.connectButton.SetText("Connect")
-			a.connectButton.Enable()
-			a.statusLabel.SetText("Connection Failed")
+// runLeakTest checks the connection for leaks and shows the report in a
+// window of its own.
+func (a *App) runLeakTest() {
+	a.leakButton.Disable()
+	a.leakButton.SetText("Testing for leaks...")
 
-			// Show error dialog
-			dialog := widget.NewModalPopUp(
-				widget.NewLabel(fmt.Sprintf("Connection failed: %v", err)),
-				a.window.Canvas(),
-			)
-			dialog.Show()
+	go func() {
+		ctx, cancel := context.WithTimeout(a.ctx, 30*time.Second)
+		defer cancel()
+		report := a.vpnClient.LeakTest(ctx, network.LeakTestOptions{})
 
-			time.AfterFunc(3*time.Second, dialog.Hide)
+		title := "No leaks found"
+		if report.Leaking() {
+			title = "Leaks found"
 		}
+
+		a.do(func() {
+			a.leakButton.SetText("Leak Test")
+			a.leakButton.Enable()
+
+			text := widget.NewLabelWithStyle(network.FormatLeakReport(report), fyne.TextAlignLeading, fyne.TextStyle{Monospace: true})
+			reportWindow := a.app.NewWindow("Leak Test")
+			reportWindow.Resize(fyne.NewSize(500, 400))
+			reportWindow.SetContent(container.NewBorder(widget.NewLabelWithStyle(title, fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+				nil, nil, nil, container.NewScroll(text)))
+			reportWindow.Show()
+		})
 	}()
 }
 
-func (a *App) disconnect() {
-	a.connectButton.SetText("Disconnecting...")
-	a.connectButton.Disable()
+func (a *App) toggleConnection() {
+	if a.vpnClient.State() == network.StateDisconnected {
+		a.connect()
+	} else {
+		a.disconnect()
+	}
+}
 
+func (a *App) connect() {
+	go func() {
+		if err := a.vpnClient.Connect(a.ctx); err != nil {
+			a.logger.Error("Connection failed: %v", err)
+			a.showMessage(fmt.Sprintf("Connection failed: %v", err), 3*time.Second)
+		}
+	}()
+}
+
+func (a *App) disconnect() {
 	go func() {
 		if err := a.vpnClient.Disconnect(); err != nil {
 			a.logger.Error("Disconnect failed: %v", err)
 		}
+	}()
+}
 
-		a.connectButton.SetText("Connect")
-		a.connectButton.Enable()
+// watchState keeps the status label and connect button in step with the
+// client's state machine.
+func (a *App) watchState() {
+	events, _ := a.vpnClient.Subscribe()
+
+	go func() {
+		for event := range events {
+			event := event
+			a.do(func() { a.showState(event.To, event.Err) })
+		}
 	}()
 }
 
-func (a *App) updateStatus() {
-	status := a.vpnClient.GetStatus()
+// watchSecurity tells the user when the kill switch had to be restored,
+// or could not be.
+func (a *App) watchSecurity() {
+	events, _ := a.vpnClient.SubscribeSecurity()
 
-	if connected, ok := status["connected"].(bool); ok && connected {
-		a.statusLabel.SetText("Connected")
-		a.connectButton.SetText("Disconnect")
-		a.connectButton.Enable()
+	go func() {
+		for event := range events {
+			text := "Kill switch was tampered with and has been restored"
+			if !event.Restored {
+				text = fmt.Sprintf("Kill switch was tampered with and could not be restored: %v", event.Err)
+			}
 
-		if ip, ok := status["public_ip"].(string); ok {
-			a.ipLabel.SetText(fmt.Sprintf("IP: %s", ip))
+			a.showMessage(text, 5*time.Second)
 		}
+	}()
+}
 
-		// Update stats if available
-		if stats, ok := status["stats"].(map[string]interface{}); ok {
-			a.updateStats(stats)
-		}
+// showMessage pops text up over the main window for a while.
+func (a *App) showMessage(text string, duration time.Duration) {
+	a.do(func() {
+		dialog := widget.NewModalPopUp(widget.NewLabel(text), a.window.Canvas())
+		dialog.Show()
+		time.AfterFunc(duration, func() { a.do(dialog.Hide) })
+	})
+}
+
+func (a *App) showState(state network.State, err error) {
+	// The server can only be changed while the tunnel is down
+	if state == network.StateDisconnected || state == network.StateError {
+		a.serverSelect.Enable()
 	} else {
+		a.serverSelect.Disable()
+	}
+
+	switch state {
+	case network.StateDisconnected:
 		a.statusLabel.SetText("Disconnected")
 		a.connectButton.SetText("Connect")
 		a.connectButton.Enable()
-		a.ipLabel.SetText("IP: Not connected")
-		a.statsContainer.RemoveAll()
+	case network.StateConnecting:
+		a.statusLabel.SetText("Connecting...")
+		a.connectButton.SetText("Connecting...")
+		a.connectButton.Disable()
+	case network.StateConnected:
+		a.statusLabel.SetText("Connected")
+		a.connectButton.SetText("Disconnect")
+		a.connectButton.Enable()
+	case network.StateReconnecting:
+		a.statusLabel.SetText("Reconnecting...")
+		a.connectButton.SetText("Disconnect")
+		a.connectButton.Enable()
+	case network.StateDisconnecting:
+		a.statusLabel.SetText("Disconnecting...")
+		a.connectButton.SetText("Disconnecting...")
+		a.connectButton.Disable()
+	case network.StateError:
+		// The kill switch may still be engaged, so the way out is to
+		// disconnect rather than to connect again.
+		a.statusLabel.SetText("Connection Failed")
+		if err != nil {
+			a.statusLabel.SetText(fmt.Sprintf("Connection Failed: %v", err))
+		}
+		a.connectButton.SetText("Disconnect")
+		a.connectButton.Enable()
 	}
 }
 
-func (a *App) updateStats(stats map[string]interface{}) {
+// updateStatus reads the status from the client and then shows it, which
+// keeps the reading off the updates.
+func (a *App) updateStatus() {
+	status := a.vpnClient.GetStatus()
+	// Connecting may have picked a server automatically
+	server := a.vpnClient.ActiveServer()
+	latencies := a.vpnClient.ServerLatencies()
+	blocklists := a.vpnClient.BlocklistStats()
+
+	a.do(func() {
+		a.showServer(server)
+		a.showLatencies(latencies)
+		a.showBlocklists(blocklists)
+
+		if stats, ok := status["stats"].(*network.ConnectionStats); ok {
+			if ip, ok := status["public_ip"].(string); ok {
+				a.ipLabel.SetText(fmt.Sprintf("IP: %s", ip))
+			}
+			a.updateStats(stats)
+		} else {
+			a.ipLabel.SetText("IP: Not connected")
+			a.statsContainer.RemoveAll()
+		}
+	})
+}
+
+func (a *App) updateStats(stats *network.ConnectionStats) {
 	a.statsContainer.RemoveAll()
 
-	for key, value := range stats {
-		label := widget.NewLabel(fmt.Sprintf("%s: %v", key, value))
-		a.statsContainer.Add(label)
+	handshake := "never"
+	if !stats.LastHandshake.IsZero() {
+		handshake = fmt.Sprintf("%s ago", time.Since(stats.LastHandshake).Round(time.Second))
+	}
+
+	lines := []string{
+		fmt.Sprintf("Received: %s (%s/s)", formatBytes(float64(stats.RxBytes)), formatBytes(stats.Throughput.Rx)),
+		fmt.Sprintf("Sent: %s (%s/s)", formatBytes(float64(stats.TxBytes)), formatBytes(stats.Throughput.Tx)),
+		fmt.Sprintf("Avg 1m/5m/15m down: %s/s, %s/s, %s/s",
+			formatBytes(stats.Rate1m.Rx), formatBytes(stats.Rate5m.Rx), formatBytes(stats.Rate15m.Rx)),
+		fmt.Sprintf("Last handshake: %s", handshake),
+	}
+
+	for _, peer := range stats.Peers {
+		lines = append(lines, fmt.Sprintf("Peer %s: %s, keepalive %s", shortKey(peer.PublicKey), peer.Endpoint, peer.PersistentKeepalive))
+	}
+
+	for _, line := range lines {
+		a.statsContainer.Add(widget.NewLabel(line))
+	}
+}
+
+func (a *App) showBlocklists(stats []dnsproxy.ListStats) {
+	a.blocklistContainer.RemoveAll()
+
+	if len(stats) == 0 {
+		a.blocklistContainer.Add(widget.NewLabel("Not blocking"))
+		return
+	}
+
+	for _, list := range stats {
+		line := fmt.Sprintf("%s: %d hits, %d domains", shortSource(list.Source), list.Hits, list.Domains)
+		if list.Err != nil {
+			line += " (failed to load)"
+		}
+		a.blocklistContainer.Add(widget.NewLabel(line))
+	}
+}
+
+// shortSource keeps the file name of a list's path or URL.
+func shortSource(source string) string {
+	trimmed := strings.TrimRight(source, "/\\")
+	if name := trimmed[strings.LastIndexAny(trimmed, "/\\")+1:]; name != "" {
+		return name
+	}
+	return source
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func shortKey(key string) string {
+	if len(key) > 8 {
+		return key[:8] + "…"
 	}
+	return key
 }
 
 func (a *App) startStatusUpdater() {
@@ -191,8 +463,13 @@ func (a *App) startStatusUpdater() {
 		ticker := time.NewTicker(2 * time.Second)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			a.updateStatus()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				a.updateStatus()
+			}
 		}
 	}()
 }
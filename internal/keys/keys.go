@@ -0,0 +1,122 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// KeyLen is the size of a WireGuard (Curve25519) key.
+const KeyLen = 32
+
+var (
+	ErrInvalidKey = errors.New("invalid key")
+	ErrZeroKey    = errors.New("key is all zeros")
+	ErrWeakKey    = errors.New("public key is a low-order point")
+)
+
+// Key is a Curve25519 private, public or preshared key.
+type Key [KeyLen]byte
+
+// GeneratePrivate returns a new clamped X25519 private key.
+func GeneratePrivate() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, fmt.Errorf("reading random bytes: %w", err)
+	}
+	k.clamp()
+	return k, nil
+}
+
+// GeneratePreshared returns a random symmetric key for PresharedKey.
+func GeneratePreshared() (Key, error) {
+	var k Key
+	if _, err := rand.Read(k[:]); err != nil {
+		return Key{}, fmt.Errorf("reading random bytes: %w", err)
+	}
+	return k, nil
+}
+
+// Parse decodes a base64 key as written in WireGuard configs.
+func Parse(s string) (Key, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return Key{}, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if len(b) != KeyLen {
+		return Key{}, fmt.Errorf("%w: %d bytes, want %d", ErrInvalidKey, len(b), KeyLen)
+	}
+
+	var k Key
+	copy(k[:], b)
+	return k, nil
+}
+
+// ParsePrivate parses a private key. Unclamped keys are accepted, since
+// WireGuard clamps them itself, but the zero key is not.
+func ParsePrivate(s string) (Key, error) {
+	k, err := Parse(s)
+	if err != nil {
+		return Key{}, err
+	}
+	if k.IsZero() {
+		return Key{}, ErrZeroKey
+	}
+	return k, nil
+}
+
+// ParsePublic parses a peer's public key and rejects points no handshake
+// could ever succeed with.
+func ParsePublic(s string) (Key, error) {
+	k, err := Parse(s)
+	if err != nil {
+		return Key{}, err
+	}
+	if k.IsZero() {
+		return Key{}, ErrZeroKey
+	}
+
+	// X25519 fails on low-order points, whatever the scalar
+	probe := Key{1}
+	probe.clamp()
+	if _, err := curve25519.X25519(probe[:], k[:]); err != nil {
+		return Key{}, ErrWeakKey
+	}
+	return k, nil
+}
+
+// PublicKey derives the public key of a private key.
+func (k Key) PublicKey() Key {
+	private := k
+	private.clamp()
+
+	var public Key
+	curve25519.ScalarBaseMult((*[KeyLen]byte)(&public), (*[KeyLen]byte)(&private))
+	return public
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+func (k Key) IsZero() bool {
+	var zero Key
+	return subtle.ConstantTimeCompare(k[:], zero[:]) == 1
+}
+
+// IsClamped reports whether the key is already a valid X25519 scalar.
+func (k Key) IsClamped() bool {
+	clamped := k
+	clamped.clamp()
+	return clamped == k
+}
+
+// clamp applies the bit twiddling from RFC 7748, section 5.
+func (k *Key) clamp() {
+	k[0] &= 248
+	k[31] = (k[31] & 127) | 64
+}
@@ -0,0 +1,157 @@
+package keys
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// hexKey decodes a key written in hex, as the RFCs do.
+func hexKey(t *testing.T, s string) Key {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != KeyLen {
+		t.Fatalf("bad test key %s: %v", s, err)
+	}
+	var k Key
+	copy(k[:], b)
+	return k
+}
+
+func TestPublicKeyRFC7748(t *testing.T) {
+	// RFC 7748, section 6.1. Neither private key is clamped as given.
+	for _, tt := range []struct {
+		name            string
+		private, public string
+	}{
+		{
+			"Alice",
+			"77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a",
+			"8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a",
+		},
+		{
+			"Bob",
+			"5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb",
+			"de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f",
+		},
+	} {
+		private := hexKey(t, tt.private)
+		want := hexKey(t, tt.public)
+
+		if got := private.PublicKey(); got != want {
+			t.Errorf("%s: PublicKey = %x, want %x", tt.name, got, want)
+		}
+
+		// Parsed from a config, the way WireGuard would take it
+		parsed, err := ParsePrivate(private.String())
+		if err != nil {
+			t.Fatalf("%s: ParsePrivate: %v", tt.name, err)
+		}
+		if parsed.IsClamped() {
+			t.Errorf("%s: parsed key clamped, want it as written", tt.name)
+		}
+		if got := parsed.PublicKey(); got != want {
+			t.Errorf("%s: PublicKey of parsed key = %x, want %x", tt.name, got, want)
+		}
+
+		clamped := parsed
+		clamped.clamp()
+		if !clamped.IsClamped() || clamped.PublicKey() != want {
+			t.Errorf("%s: clamping changed the public key", tt.name)
+		}
+
+		if _, err := ParsePublic(want.String()); err != nil {
+			t.Errorf("%s: ParsePublic: %v", tt.name, err)
+		}
+	}
+}
+
+func TestGeneratePrivate(t *testing.T) {
+	seen := map[Key]bool{}
+	for i := 0; i < 64; i++ {
+		k, err := GeneratePrivate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !k.IsClamped() {
+			t.Fatalf("generated key %x not clamped", k)
+		}
+		if k[0]&7 != 0 || k[31]&128 != 0 || k[31]&64 == 0 {
+			t.Fatalf("generated key %x has the wrong bits set", k)
+		}
+		if seen[k] {
+			t.Fatalf("key %x generated twice", k)
+		}
+		seen[k] = true
+
+		if _, err := ParsePrivate(k.String()); err != nil {
+			t.Fatalf("generated key does not parse back: %v", err)
+		}
+	}
+}
+
+func TestIsClamped(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		key  Key
+		want bool
+	}{
+		{"clamped", Key{0: 8, 31: 64}, true},
+		{"low bits", Key{0: 1, 31: 64}, false},
+		{"high bit", Key{31: 128 | 64}, false},
+		{"second highest bit clear", Key{}, false},
+	} {
+		if got := tt.key.IsClamped(); got != tt.want {
+			t.Errorf("%s: IsClamped(%x) = %v, want %v", tt.name, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		key  string
+		want error
+	}{
+		{"empty", "", ErrInvalidKey},
+		{"short", base64.StdEncoding.EncodeToString(make([]byte, KeyLen-1)), ErrInvalidKey},
+		{"long", base64.StdEncoding.EncodeToString(make([]byte, KeyLen+1)), ErrInvalidKey},
+		{"not base64", "not a key!", ErrInvalidKey},
+		{"unpadded", strings.TrimRight(hexKey(t, strings.Repeat("11", KeyLen)).String(), "="), ErrInvalidKey},
+		{"url alphabet", base64.URLEncoding.EncodeToString(append(make([]byte, KeyLen-2), 0xfb, 0xff)), ErrInvalidKey},
+		{"zero", Key{}.String(), ErrZeroKey},
+	} {
+		for _, parse := range []struct {
+			name string
+			fn   func(string) (Key, error)
+		}{
+			{"ParsePrivate", ParsePrivate},
+			{"ParsePublic", ParsePublic},
+		} {
+			k, err := parse.fn(tt.key)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("%s: %s(%q) = %v, want %v", tt.name, parse.name, tt.key, err, tt.want)
+			}
+			if !k.IsZero() {
+				t.Errorf("%s: %s returned %x with the error", tt.name, parse.name, k)
+			}
+		}
+	}
+}
+
+func TestParsePublicLowOrder(t *testing.T) {
+	// Points of small order, from the curve25519 test vectors
+	for _, point := range []string{
+		"0100000000000000000000000000000000000000000000000000000000000000",
+		"e0eb7a7c3b41b8ae1656e3faf19fc46ada098deb9c32b1fd866205165f49b800",
+		"5f9c95bca3508c24b1d0b1559c83ef5b04445cc4581c8e86d8224eddd09f1157",
+		"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	} {
+		if _, err := ParsePublic(hexKey(t, point).String()); !errors.Is(err, ErrWeakKey) {
+			t.Errorf("ParsePublic(%s) = %v, want %v", point, err, ErrWeakKey)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	AppModeOff     = "off"
+	AppModeInclude = "include"
+	AppModeExclude = "exclude"
+
+	// Traffic of the two app cgroups carries these marks, next to the
+	// tunnel's own defaultRouteTable mark, for policy routing to act on.
+	tunnelAppMark = defaultRouteTable + 1
+	bypassAppMark = defaultRouteTable + 2
+
+	// The cgroups for per-app split tunneling, relative to the cgroup v2
+	// root. Programs started with `kryptx exec` join one of them directly.
+	tunnelAppGroup = "kryptx/tunnel"
+	bypassAppGroup = "kryptx/bypass"
+)
+
+// parseAppMode normalizes the app_mode setting, with "" for off.
+func parseAppMode(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case "", AppModeOff:
+		return "", nil
+	case AppModeInclude:
+		return AppModeInclude, nil
+	case AppModeExclude:
+		return AppModeExclude, nil
+	default:
+		return "", fmt.Errorf("unknown split_tunnel.app_mode %q", mode)
+	}
+}
+
+// isUnit tells systemd units, which are matched by their own cgroup, from
+// programs, which are moved into ours.
+func isUnit(app string) bool {
+	for _, suffix := range []string{".service", ".scope", ".slice"} {
+		if strings.HasSuffix(app, suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,305 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+const (
+	// New processes of a listed program are picked up this often. Their
+	// children inherit the cgroup, so only the first launch has to wait.
+	appScanInterval = 2 * time.Second
+)
+
+// appSplit marks the traffic of the app cgroups so that policy routing
+// can send it through or around the tunnel. Listed programs are moved into
+// the cgroup as they start; systemd units are matched in their own.
+type appSplit struct {
+	logger   *utils.Logger
+	iface    string
+	mode     string
+	programs []string
+	units    []string
+
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func newAppSplit(cfg config.SplitTunnelConfig, iface string, logger *utils.Logger) (*appSplit, error) {
+	mode, err := parseAppMode(cfg.AppMode)
+	if err != nil || mode == "" {
+		return nil, err
+	}
+
+	if _, err := cgroupRoot(); err != nil {
+		return nil, err
+	}
+
+	a := &appSplit{logger: logger, iface: iface, mode: mode}
+	for _, app := range cfg.Apps {
+		switch {
+		case isUnit(app) && !strings.Contains(app, "/"):
+			a.units = append(a.units, "system.slice/"+app)
+		case isUnit(app):
+			a.units = append(a.units, strings.TrimPrefix(app, "/"))
+		default:
+			a.programs = append(a.programs, app)
+		}
+	}
+	return a, nil
+}
+
+// group is the cgroup the listed apps go into.
+func (a *appSplit) group() (string, int) {
+	if a.mode == AppModeInclude {
+		return tunnelAppGroup, tunnelAppMark
+	}
+	return bypassAppGroup, bypassAppMark
+}
+
+func (a *appSplit) Apply() error {
+	if err := createAppGroups(); err != nil {
+		return err
+	}
+
+	// Replies to rerouted traffic come back on the other interface, which
+	// the reverse path filter only accepts when it considers the mark
+	if output, err := execCommand("sudo", "sysctl", "-w", "net.ipv4.conf.all.src_valid_mark=1").CombinedOutput(); err != nil {
+		a.logger.Warning("Enabling src_valid_mark: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	rules := a.rules("-A")
+	for i, rule := range rules {
+		if output, err := execCommand(rule[0], rule[1:]...).CombinedOutput(); err != nil {
+			for _, applied := range rules[:i] {
+				execCommand(applied[0], deleteRule(applied[1:])...).Run()
+			}
+			return fmt.Errorf("failed to apply rule %s: %w: %s", strings.Join(rule, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	if len(a.programs) > 0 {
+		ctx, stop := context.WithCancel(context.Background())
+		a.stop = stop
+		a.done = make(chan struct{})
+		go a.watch(ctx)
+	}
+	return nil
+}
+
+func (a *appSplit) Remove() error {
+	if a.stop != nil {
+		a.stop()
+		<-a.done
+		a.stop = nil
+	}
+
+	// Processes stay in the cgroups, which do nothing without the rules
+	for _, rule := range a.rules("-D") {
+		execCommand(rule[0], rule[1:]...).Run()
+	}
+	return nil
+}
+
+// rules marks the traffic of both app cgroups and of the listed units,
+// and masquerades what policy routing moved to another interface than the
+// one its source address was picked for.
+func (a *appSplit) rules(op string) [][]string {
+	_, mark := a.group()
+
+	var rules [][]string
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		markRule := func(group string, mark int) []string {
+			return []string{"sudo", iptables, "-t", "mangle", op, "OUTPUT", "-m", "cgroup", "--path", group,
+				"-j", "MARK", "--set-mark", strconv.Itoa(mark)}
+		}
+
+		rules = append(rules,
+			markRule(tunnelAppGroup, tunnelAppMark),
+			markRule(bypassAppGroup, bypassAppMark),
+		)
+		for _, unit := range a.units {
+			rules = append(rules, markRule(unit, mark))
+		}
+
+		rules = append(rules,
+			[]string{"sudo", iptables, "-t", "nat", op, "POSTROUTING", "-m", "mark", "--mark", strconv.Itoa(tunnelAppMark),
+				"-o", a.iface, "-j", "MASQUERADE"},
+			[]string{"sudo", iptables, "-t", "nat", op, "POSTROUTING", "-m", "mark", "--mark", strconv.Itoa(bypassAppMark),
+				"!", "-o", a.iface, "-j", "MASQUERADE"},
+		)
+	}
+	return rules
+}
+
+func deleteRule(args []string) []string {
+	deleted := append([]string{}, args...)
+	for i, arg := range deleted {
+		if arg == "-A" {
+			deleted[i] = "-D"
+		}
+	}
+	return deleted
+}
+
+// cleanupCommands removes the rules, for the journal.
+func (a *appSplit) cleanupCommands() [][]string {
+	return a.rules("-D")
+}
+
+// killSwitchExemption is the traffic the kill switch has to let out around
+// the tunnel: the bypass cgroup, or in include mode everything except the
+// tunnel cgroup.
+func (a *appSplit) killSwitchExemption() (mark int, invert bool) {
+	if a.mode == AppModeInclude {
+		return tunnelAppMark, true
+	}
+	return bypassAppMark, false
+}
+
+func (a *appSplit) watch(ctx context.Context) {
+	defer close(a.done)
+
+	ticker := time.NewTicker(appScanInterval)
+	defer ticker.Stop()
+
+	for {
+		a.scan()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan moves running instances of the listed programs into the cgroup.
+// Anything already in one of ours, such as a program started with
+// `kryptx exec -bypass`, is left where it is.
+func (a *appSplit) scan() {
+	group, _ := a.group()
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		a.logger.Debug("Listing processes: %v", err)
+		return
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !a.matches(pid) {
+			continue
+		}
+
+		cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err != nil || strings.Contains(string(cgroup), "0::/kryptx/") {
+			continue
+		}
+
+		if err := moveToAppGroup(group, pid); err != nil {
+			a.logger.Debug("Moving process %d into %s: %v", pid, group, err)
+			continue
+		}
+		a.logger.Debug("Moved process %d into %s", pid, group)
+	}
+}
+
+func (a *appSplit) matches(pid int) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		// Kernel threads, or already gone
+		return false
+	}
+	exe = strings.TrimSuffix(exe, " (deleted)")
+
+	comm, _ := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	name := strings.TrimSpace(string(comm))
+
+	for _, program := range a.programs {
+		if strings.HasPrefix(program, "/") {
+			if exe == program {
+				return true
+			}
+			continue
+		}
+		// comm is cut off at 15 characters
+		if filepath.Base(exe) == program || (name != "" && name == truncate(program, 15)) {
+			return true
+		}
+	}
+	return false
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// cgroupRoots are where the cgroup v2 hierarchy is mounted, hybrid setups
+// putting it next to the v1 controllers.
+var cgroupRoots = []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"}
+
+// cgroupRoot finds the cgroup v2 hierarchy.
+func cgroupRoot() (string, error) {
+	for _, root := range cgroupRoots {
+		if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+			return root, nil
+		}
+	}
+	return "", errors.New("per-app split tunneling needs the cgroup v2 hierarchy")
+}
+
+func createAppGroups() error {
+	root, err := cgroupRoot()
+	if err != nil {
+		return err
+	}
+	for _, group := range []string{tunnelAppGroup, bypassAppGroup} {
+		if output, err := execCommand("sudo", "mkdir", "-p", filepath.Join(root, group)).CombinedOutput(); err != nil {
+			return fmt.Errorf("creating cgroup %s: %w: %s", group, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func moveToAppGroup(group string, pid int) error {
+	root, err := cgroupRoot()
+	if err != nil {
+		return err
+	}
+	cmd := execCommand("sudo", "tee", filepath.Join(root, group, "cgroup.procs"))
+	cmd.Stdin = strings.NewReader(strconv.Itoa(pid))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// JoinAppGroup moves the calling process into the tunnel cgroup, or the
+// bypass one, so that whatever it executes next is routed accordingly.
+// The cgroups hang off the root of the hierarchy, so this goes by sudo.
+func JoinAppGroup(bypass bool) error {
+	if err := createAppGroups(); err != nil {
+		return err
+	}
+
+	group := tunnelAppGroup
+	if bypass {
+		group = bypassAppGroup
+	}
+	if err := moveToAppGroup(group, os.Getpid()); err != nil {
+		return fmt.Errorf("joining cgroup %s: %w", group, err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// useCgroupRoot points the cgroup v2 hierarchy into a directory of the
+// test's own.
+func useCgroupRoot(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "cgroup.controllers"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	saved := cgroupRoots
+	cgroupRoots = []string{root}
+	t.Cleanup(func() { cgroupRoots = saved })
+	return root
+}
+
+// useFakeSudo records every command, and runs the file operations on the
+// test's cgroup directory for real, without sudo.
+func useFakeSudo(t *testing.T, run func(call []string) *exec.Cmd) *fakeCommands {
+	t.Helper()
+
+	return useFakeCommands(t, func(call []string) *exec.Cmd {
+		if len(call) > 1 && call[0] == "sudo" && (call[1] == "mkdir" || call[1] == "tee") {
+			return exec.Command(call[1], call[2:]...)
+		}
+		if run != nil {
+			return run(call)
+		}
+		return nil
+	})
+}
+
+// firewallCalls leaves out the cgroups being made.
+func firewallCalls(calls [][]string) [][]string {
+	var kept [][]string
+	for _, call := range calls {
+		if !slices.Contains(call, "mkdir") {
+			kept = append(kept, call)
+		}
+	}
+	return kept
+}
+
+func newTestAppSplit(t *testing.T, mode string, apps ...string) *appSplit {
+	t.Helper()
+
+	a, err := newAppSplit(config.SplitTunnelConfig{AppMode: mode, Apps: apps}, "kxtest0", utils.NewLogger(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// appSplitRules are the rules for one unit with the apps' traffic marked
+// mark, in the order apply adds them.
+func appSplitRules(op, unit string, mark int) [][]string {
+	var rules [][]string
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		mangle := []string{"sudo", iptables, "-t", "mangle", op, "OUTPUT", "-m", "cgroup", "--path"}
+		nat := []string{"sudo", iptables, "-t", "nat", op, "POSTROUTING", "-m", "mark", "--mark"}
+		rules = append(rules,
+			append(slices.Clone(mangle), "kryptx/tunnel", "-j", "MARK", "--set-mark", "51821"),
+			append(slices.Clone(mangle), "kryptx/bypass", "-j", "MARK", "--set-mark", "51822"),
+			append(slices.Clone(mangle), unit, "-j", "MARK", "--set-mark", strconv.Itoa(mark)),
+			append(slices.Clone(nat), "51821", "-o", "kxtest0", "-j", "MASQUERADE"),
+			append(slices.Clone(nat), "51822", "!", "-o", "kxtest0", "-j", "MASQUERADE"),
+		)
+	}
+	return rules
+}
+
+func TestAppSplitRules(t *testing.T) {
+	for _, tt := range []struct {
+		mode, unit string
+		// app is how the unit is listed
+		app  string
+		mark int
+	}{
+		{AppModeExclude, "system.slice/transmission.service", "transmission.service", bypassAppMark},
+		{AppModeInclude, "user.slice/user-1000.slice/app.scope", "/user.slice/user-1000.slice/app.scope", tunnelAppMark},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			useCgroupRoot(t)
+			fake := useFakeSudo(t, nil)
+			a := newTestAppSplit(t, tt.mode, tt.app)
+
+			if err := a.Apply(); err != nil {
+				t.Fatal(err)
+			}
+			want := append([][]string{{"sudo", "sysctl", "-w", "net.ipv4.conf.all.src_valid_mark=1"}}, appSplitRules("-A", tt.unit, tt.mark)...)
+			if got := firewallCalls(fake.calls); !reflect.DeepEqual(got, want) {
+				t.Errorf("Apply ran:\n%q\nwant:\n%q", got, want)
+			}
+
+			removal := appSplitRules("-D", tt.unit, tt.mark)
+			if got := a.cleanupCommands(); !reflect.DeepEqual(got, removal) {
+				t.Errorf("cleanupCommands = %q, want %q", got, removal)
+			}
+
+			fake.calls = nil
+			if err := a.Remove(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fake.calls, removal) {
+				t.Errorf("Remove ran:\n%q\nwant:\n%q", fake.calls, removal)
+			}
+		})
+	}
+}
+
+func TestAppSplitApplyRollback(t *testing.T) {
+	useCgroupRoot(t)
+	fake := useFakeSudo(t, func(call []string) *exec.Cmd {
+		if slices.Contains(call, "ip6tables") && slices.Contains(call, "nat") && slices.Contains(call, "-A") {
+			return shellCommand(`echo "ip6tables: No chain/target/match by that name." >&2; exit 1`)
+		}
+		return nil
+	})
+	a := newTestAppSplit(t, AppModeExclude, "transmission.service")
+
+	err := a.Apply()
+	if err == nil || !strings.Contains(err.Error(), "No chain") {
+		t.Fatalf("Apply = %v, want the failing rule reported", err)
+	}
+
+	// The IPv4 rules and the IPv6 mangle ones went in before the IPv6 nat
+	// rule failed, and came out again
+	unit := "system.slice/transmission.service"
+	want := append(appSplitRules("-A", unit, bypassAppMark)[:9], appSplitRules("-D", unit, bypassAppMark)[:8]...)
+	if calls := firewallCalls(fake.calls)[1:]; !reflect.DeepEqual(calls, want) {
+		t.Errorf("commands run:\n%q\nwant:\n%q", calls, want)
+	}
+}
+
+// startProgram runs a copy of the shell as name, waiting on its input,
+// and returns the path it runs from and its pid.
+func startProgram(t *testing.T, name string) (string, int) {
+	t.Helper()
+
+	shell, err := os.ReadFile("/bin/sh")
+	if err != nil {
+		t.Skip(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, shell, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(path, "-c", "read line")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	// Until the exec went through, the process is still the test's
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", cmd.Process.Pid)); exe == path {
+			return path, cmd.Process.Pid
+		}
+	}
+	t.Fatalf("%s never started", path)
+	return "", 0
+}
+
+func TestAppSplitScan(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		mode    string
+		program func(path string) string
+		group   string
+	}{
+		{"exclude by name", AppModeExclude, filepath.Base, bypassAppGroup},
+		{"include by name", AppModeInclude, filepath.Base, tunnelAppGroup},
+		{"include by path", AppModeInclude, func(path string) string { return path }, tunnelAppGroup},
+		{"other program", AppModeInclude, func(string) string { return "kxnotrunning" }, ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useCgroupRoot(t)
+			fake := useFakeSudo(t, nil)
+			path, pid := startProgram(t, "kxtestapp")
+			a := newTestAppSplit(t, tt.mode, tt.program(path))
+			if err := createAppGroups(); err != nil {
+				t.Fatal(err)
+			}
+
+			a.scan()
+
+			for _, group := range []string{tunnelAppGroup, bypassAppGroup} {
+				procs, _ := os.ReadFile(filepath.Join(root, group, "cgroup.procs"))
+				want := ""
+				if group == tt.group {
+					want = strconv.Itoa(pid)
+				}
+				if string(procs) != want {
+					t.Errorf("%s/cgroup.procs = %q, want %q", group, procs, want)
+				}
+			}
+			for _, call := range fake.calls {
+				if call[0] != "sudo" {
+					t.Errorf("%q run without sudo", call)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinAppGroup(t *testing.T) {
+	for _, bypass := range []bool{false, true} {
+		root := useCgroupRoot(t)
+		fake := useFakeSudo(t, nil)
+
+		if err := JoinAppGroup(bypass); err != nil {
+			t.Fatal(err)
+		}
+
+		group := tunnelAppGroup
+		if bypass {
+			group = bypassAppGroup
+		}
+		procs, err := os.ReadFile(filepath.Join(root, group, "cgroup.procs"))
+		if err != nil || string(procs) != strconv.Itoa(os.Getpid()) {
+			t.Errorf("bypass %v: %s/cgroup.procs = %q, %v; want our pid", bypass, group, procs, err)
+		}
+		if want := []string{"sudo", "tee", filepath.Join(root, group, "cgroup.procs")}; !reflect.DeepEqual(fake.calls[len(fake.calls)-1], want) {
+			t.Errorf("bypass %v: last command %q, want %q", bypass, fake.calls[len(fake.calls)-1], want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// appSplit is Linux only; it needs cgroups to tell applications apart.
+type appSplit struct{}
+
+func newAppSplit(cfg config.SplitTunnelConfig, iface string, logger *utils.Logger) (*appSplit, error) {
+	mode, err := parseAppMode(cfg.AppMode)
+	if err != nil || mode == "" {
+		return nil, err
+	}
+	return nil, fmt.Errorf("per-app split tunneling: %w", ErrUnsupported)
+}
+
+func (a *appSplit) Apply() error {
+	return ErrUnsupported
+}
+
+func (a *appSplit) Remove() error {
+	return nil
+}
+
+func (a *appSplit) cleanupCommands() [][]string {
+	return nil
+}
+
+func (a *appSplit) killSwitchExemption() (mark int, invert bool) {
+	return 0, false
+}
+
+func JoinAppGroup(bypass bool) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,116 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kryptx/internal/utils"
+)
+
+const (
+	BackendKernel    = "kernel"
+	BackendUserspace = "userspace"
+	BackendNetstack  = "netstack"
+)
+
+// Backend is a WireGuard data plane. VPNClient only talks to the tunnel
+// through it, which keeps the kill switch and DNS orchestration
+// independent of how and where the tunnel actually runs.
+type Backend interface {
+	Up(cfg *DeviceConfig) error
+	// Update applies a new peer set to a device that is up, without
+	// recreating the interface.
+	Update(cfg *DeviceConfig) error
+	Down() error
+	Stats() (TransferStats, error)
+	Peers() ([]PeerStatus, error)
+	Health() error
+}
+
+type BackendFactory func(logger *utils.Logger) (Backend, error)
+
+type PeerStatus struct {
+	PublicKey           wgtypes.Key
+	Endpoint            *net.UDPAddr
+	AllowedIPs          []net.IPNet
+	LastHandshake       time.Time
+	RxBytes             int64
+	TxBytes             int64
+	PersistentKeepalive time.Duration
+}
+
+type TransferStats struct {
+	RxBytes       int64
+	TxBytes       int64
+	LastHandshake time.Time
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("network: backend %q registered twice", name))
+	}
+	backends[name] = factory
+}
+
+func NewBackend(name string, logger *utils.Logger) (Backend, error) {
+	if name == "" {
+		name = BackendKernel
+	}
+
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown network backend %q (available: %v)", name, Backends())
+	}
+	return factory(logger)
+}
+
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sumPeerStats(peers []PeerStatus) TransferStats {
+	var stats TransferStats
+	for _, peer := range peers {
+		stats.RxBytes += peer.RxBytes
+		stats.TxBytes += peer.TxBytes
+		if peer.LastHandshake.After(stats.LastHandshake) {
+			stats.LastHandshake = peer.LastHandshake
+		}
+	}
+	return stats
+}
+
+func interfaceHealth(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return &DeviceError{Op: "health", Interface: name, Kind: ErrInterfaceMissing, Err: err}
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return &DeviceError{Op: "health", Interface: name, Err: fmt.Errorf("interface is down")}
+	}
+	return nil
+}
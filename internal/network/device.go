@@ -0,0 +1,315 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kryptx/internal/config"
+)
+
+// defaultRouteTable is used both as the routing table for full-tunnel
+// routes and as the firewall mark on the tunnel's own packets, the same
+// way wg-quick does it.
+const defaultRouteTable = 51820
+
+var (
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrModuleMissing    = errors.New("wireguard kernel module not available")
+	ErrInterfaceExists  = errors.New("interface already exists")
+	ErrInterfaceMissing = errors.New("interface does not exist")
+	ErrUnsupported      = errors.New("not supported on this platform")
+)
+
+// DeviceError reports a failed device operation. Kind is one of the Err*
+// sentinels above (or nil when the failure could not be classified), so
+// callers can use errors.Is to tell the causes apart.
+type DeviceError struct {
+	Op        string
+	Interface string
+	Kind      error
+	Err       error
+}
+
+func (e *DeviceError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("%s %s: %v: %v", e.Op, e.Interface, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Interface, e.Err)
+}
+
+func (e *DeviceError) Unwrap() []error {
+	errs := []error{e.Err}
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	return errs
+}
+
+type DeviceConfig struct {
+	Name         string
+	PrivateKey   wgtypes.Key
+	ListenPort   int
+	FirewallMark int
+	MTU          int
+	Addresses    []net.IPNet
+	DNS          []net.IP
+	Peers        []PeerConfig
+
+	// Table puts every route into that routing table without any policy
+	// rules; zero means the usual full-tunnel setup. NoRoutes leaves
+	// routing alone entirely. Both follow wg-quick's Table setting.
+	Table    int
+	NoRoutes bool
+
+	// Exclude lists destinations that bypass a full tunnel through the
+	// regular routes, for split tunneling.
+	Exclude []net.IPNet
+
+	// AppMode is the per-app split tunnel mode, "" when off. In include
+	// mode only traffic of the tunnel cgroup is routed into the tunnel.
+	AppMode string
+}
+
+type PeerConfig struct {
+	PublicKey           wgtypes.Key
+	PresharedKey        *wgtypes.Key
+	Endpoint            *net.UDPAddr
+	AllowedIPs          []net.IPNet
+	PersistentKeepalive time.Duration
+}
+
+func newDeviceConfig(cfg *config.Config, active config.ServerConfig) (*DeviceConfig, error) {
+	privateKey, err := wgtypes.ParseKey(cfg.Network.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %w", err)
+	}
+
+	devCfg := &DeviceConfig{
+		Name:         cfg.Network.Interface,
+		PrivateKey:   privateKey,
+		ListenPort:   cfg.Network.ListenPort,
+		FirewallMark: cfg.Network.FirewallMark,
+		MTU:          cfg.Network.MTU,
+	}
+
+	switch cfg.Network.Table {
+	case "", "auto":
+	case "off":
+		devCfg.NoRoutes = true
+	default:
+		devCfg.Table, err = strconv.Atoi(cfg.Network.Table)
+		if err != nil {
+			return nil, fmt.Errorf("parsing table %q: %w", cfg.Network.Table, err)
+		}
+	}
+
+	devCfg.AppMode, err = parseAppMode(cfg.Network.SplitTunnel.AppMode)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, address := range strings.Split(cfg.Network.Address, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		addr, err := parseInterfaceAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Network.DisableIPv6 && addr.IP.To4() == nil {
+			return nil, fmt.Errorf("address %s is IPv6, which disable_ipv6 turns off", address)
+		}
+		devCfg.Addresses = append(devCfg.Addresses, addr)
+	}
+
+	for _, server := range cfg.Network.DNS {
+		ip := net.ParseIP(server)
+		if ip == nil {
+			return nil, fmt.Errorf("parsing DNS server %q", server)
+		}
+		if cfg.Network.DisableIPv6 && ip.To4() == nil {
+			return nil, fmt.Errorf("DNS server %s is IPv6, which disable_ipv6 turns off", server)
+		}
+		devCfg.DNS = append(devCfg.DNS, ip)
+	}
+
+	// Endpoints have to be reached over IPv4 with IPv6 off
+	resolveNetwork := "udp"
+	if cfg.Network.DisableIPv6 {
+		resolveNetwork = "udp4"
+	}
+
+	server, err := newPeerConfig(serverPeer(active), resolveNetwork)
+	if err != nil {
+		return nil, fmt.Errorf("server %s: %w", active.Name, err)
+	}
+	devCfg.Peers = append(devCfg.Peers, server)
+
+	for _, peer := range cfg.Peers {
+		peerCfg, err := newPeerConfig(peer, resolveNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer.PublicKey, err)
+		}
+		devCfg.Peers = append(devCfg.Peers, peerCfg)
+	}
+
+	// Nothing to route over IPv6 either, and the kernel refuses IPv6
+	// routes on an interface without it
+	if cfg.Network.DisableIPv6 {
+		for i := range devCfg.Peers {
+			var allowed []net.IPNet
+			for _, dst := range devCfg.Peers[i].AllowedIPs {
+				if dst.IP.To4() != nil {
+					allowed = append(allowed, dst)
+				}
+			}
+			devCfg.Peers[i].AllowedIPs = allowed
+		}
+	}
+
+	return devCfg, nil
+}
+
+// serverPeer describes a server the same way as the additional peers.
+func serverPeer(server config.ServerConfig) config.PeerConfig {
+	return config.PeerConfig{
+		PublicKey:           server.PublicKey,
+		PresharedKey:        server.PresharedKey,
+		Endpoint:            net.JoinHostPort(server.Endpoint, strconv.Itoa(server.Port)),
+		AllowedIPs:          server.AllowedIPs,
+		PersistentKeepalive: server.PersistentKeepalive,
+	}
+}
+
+// newPeerConfig resolves the endpoint on network, "udp", "udp4" or "udp6".
+func newPeerConfig(peer config.PeerConfig, network string) (PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+	if err != nil {
+		return PeerConfig{}, fmt.Errorf("parsing public key: %w", err)
+	}
+
+	peerCfg := PeerConfig{
+		PublicKey:           publicKey,
+		PersistentKeepalive: time.Duration(peer.PersistentKeepalive) * time.Second,
+	}
+
+	if peer.PresharedKey != "" {
+		presharedKey, err := wgtypes.ParseKey(peer.PresharedKey)
+		if err != nil {
+			return PeerConfig{}, fmt.Errorf("parsing preshared key: %w", err)
+		}
+		peerCfg.PresharedKey = &presharedKey
+	}
+
+	if peer.Endpoint != "" {
+		peerCfg.Endpoint, err = net.ResolveUDPAddr(network, peer.Endpoint)
+		if err != nil {
+			return PeerConfig{}, fmt.Errorf("resolving endpoint: %w", err)
+		}
+	}
+
+	peerCfg.AllowedIPs, err = parseCIDRs(peer.AllowedIPs)
+	if err != nil {
+		return PeerConfig{}, err
+	}
+
+	return peerCfg, nil
+}
+
+// parseInterfaceAddress keeps the host part of the CIDR, unlike
+// net.ParseCIDR which masks it away.
+func parseInterfaceAddress(s string) (net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, fmt.Errorf("parsing address %q: %w", s, err)
+	}
+	ipNet.IP = ip
+	return *ipNet, nil
+}
+
+func parseCIDRs(values []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(values))
+	for _, value := range values {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing allowed IP %q: %w", value, err)
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+func isDefaultRoute(n net.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	return ones == 0
+}
+
+func (c *DeviceConfig) fullTunnel() bool {
+	for _, peer := range c.Peers {
+		for _, allowed := range peer.AllowedIPs {
+			if isDefaultRoute(allowed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wgConfig describes the whole device. Given the config the device runs
+// with, it only removes the peers that are gone instead of replacing them
+// all, so the sessions of the remaining peers survive.
+func (c *DeviceConfig) wgConfig(old *DeviceConfig) wgtypes.Config {
+	wgCfg := wgtypes.Config{
+		PrivateKey:   &c.PrivateKey,
+		ReplacePeers: old == nil,
+	}
+	if c.ListenPort != 0 {
+		wgCfg.ListenPort = &c.ListenPort
+	}
+	if c.FirewallMark != 0 {
+		wgCfg.FirewallMark = &c.FirewallMark
+	}
+
+	for _, peer := range c.Peers {
+		keepalive := peer.PersistentKeepalive
+		wgCfg.Peers = append(wgCfg.Peers, wgtypes.PeerConfig{
+			PublicKey:                   peer.PublicKey,
+			PresharedKey:                peer.PresharedKey,
+			Endpoint:                    peer.Endpoint,
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  peer.AllowedIPs,
+		})
+	}
+	for _, key := range c.removedPeers(old) {
+		wgCfg.Peers = append(wgCfg.Peers, wgtypes.PeerConfig{PublicKey: key, Remove: true})
+	}
+
+	return wgCfg
+}
+
+// removedPeers lists the peers of old that c no longer has.
+func (c *DeviceConfig) removedPeers(old *DeviceConfig) []wgtypes.Key {
+	if old == nil {
+		return nil
+	}
+
+	current := map[wgtypes.Key]bool{}
+	for _, peer := range c.Peers {
+		current[peer.PublicKey] = true
+	}
+
+	var removed []wgtypes.Key
+	for _, peer := range old.Peers {
+		if !current[peer.PublicKey] {
+			removed = append(removed, peer.PublicKey)
+		}
+	}
+	return removed
+}
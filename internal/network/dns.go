@@ -1,27 +1,134 @@
 package network
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 
+	"kryptx/internal/config"
+	"kryptx/internal/dnsproxy"
 	"kryptx/internal/utils"
 )
 
+// Variables for the tests to point elsewhere
+var (
+	resolvConfPath   = "/etc/resolv.conf"
+	resolvConfBackup = "/etc/resolv.conf.kryptx.backup"
+)
+
+const (
+	// The DNS proxy listens here by default on Linux, which leaves
+	// 127.0.0.1 and the 127.0.0.53 of systemd-resolved to others
+	defaultProxyAddress = "127.0.0.153"
+)
+
 type DNSManager struct {
 	logger      *utils.Logger
+	iface       string
 	vpnDNS      []string
+	search      []string
+	mode        string
+	address     string
 	originalDNS []string
 	configured  bool
+	// servers are what the system is pointed at: the VPN DNS servers,
+	// or the proxy forwarding to them
+	servers []string
+
+	// The proxy runs when enabled or needed for the DNS rules
+	useProxy    bool
+	proxyListen string
+	proxyConfig dnsproxy.Config
+	// proxyMu guards proxy for BlocklistStats, called from outside of
+	// Configure and Restore
+	proxyMu sync.Mutex
+	proxy   *dnsproxy.Proxy
+	// routes are the domains of the DNS rules
+	routes []string
+	// observe is handed the answers passing through the proxy
+	observe func(name string, ips []net.IP)
+	// strategy is how the resolvers get to the Linux resolver, picked by
+	// what manages it on this host
+	strategy dnsStrategy
 }
 
-func NewDNSManager(vpnDNS []string, logger *utils.Logger) *DNSManager {
+func NewDNSManager(cfg *config.Config, logger *utils.Logger) *DNSManager {
+	network := cfg.Network
 	return &DNSManager{
-		logger: logger,
-		vpnDNS: vpnDNS,
+		logger:      logger,
+		iface:       network.Interface,
+		vpnDNS:      network.DNS,
+		search:      network.DNSSearch,
+		mode:        network.DNSMode,
+		address:     network.Address,
+		useProxy:    network.DNSProxy.Enabled || len(network.DNSRules) > 0 || cfg.Security.Blocklists.Enabled,
+		proxyListen: network.DNSProxy.Listen,
+		proxyConfig: newProxyConfig(cfg),
+		routes:      ruleDomains(network.DNSRules),
+	}
+}
+
+// newProxyConfig is the DNS proxy config for cfg, but for where it listens.
+// Without upstreams of its own the proxy forwards to the DNS servers.
+func newProxyConfig(cfg *config.Config) dnsproxy.Config {
+	network := cfg.Network
+	proxyConfig := dnsproxy.Config{
+		Upstreams: network.DNSProxy.Upstreams,
+		CacheSize: network.DNSProxy.CacheSize,
+	}
+	if len(proxyConfig.Upstreams) == 0 {
+		proxyConfig.Upstreams = network.DNS
 	}
+	for _, rule := range network.DNSRules {
+		proxyConfig.Rules = append(proxyConfig.Rules, dnsproxy.Rule{Domain: rule.Domain, Upstreams: rule.Servers})
+	}
+
+	if blocklists := cfg.Security.Blocklists; blocklists.Enabled {
+		proxyConfig.Block = &dnsproxy.BlockConfig{
+			Lists:   blocklists.Lists,
+			Allow:   blocklists.Allow,
+			ZeroIP:  blocklists.Response == "zero",
+			Refresh: blocklists.Refresh,
+		}
+	}
+	return proxyConfig
+}
+
+func ruleDomains(rules []config.DNSRule) []string {
+	var domains []string
+	for _, rule := range rules {
+		domains = append(domains, strings.TrimSuffix(strings.TrimPrefix(rule.Domain, "*."), "."))
+	}
+	return domains
+}
+
+// BlocklistStats returns the state of the blocklists, nil unless the DNS
+// proxy runs with them.
+func (v *VPNClient) BlocklistStats() []dnsproxy.ListStats {
+	if v.dnsManager == nil {
+		return nil
+	}
+	return v.dnsManager.BlocklistStats()
+}
+
+// LookupDNS resolves name the way the DNS proxy would with cfg, without
+// one running, and tells which resolver answered.
+func LookupDNS(ctx context.Context, cfg *config.Config, name string, qtype uint16, logger *utils.Logger) (*dnsproxy.Lookup, error) {
+	proxy, err := dnsproxy.New(newProxyConfig(cfg), logger)
+	if err != nil {
+		return nil, err
+	}
+	// A list that fails to load only lets its names through
+	if err := proxy.LoadBlocklists(ctx); err != nil {
+		logger.Warning("%v", err)
+	}
+	return proxy.Lookup(ctx, name, qtype)
 }
 
 func (d *DNSManager) Configure() error {
@@ -36,8 +143,16 @@ func (d *DNSManager) Configure() error {
 		return fmt.Errorf("backing up DNS: %w", err)
 	}
 
+	d.servers = d.vpnDNS
+	if d.useProxy {
+		if err := d.startProxy(); err != nil {
+			return fmt.Errorf("starting DNS proxy: %w", err)
+		}
+	}
+
 	// Set VPN DNS
 	if err := d.setVPNDNS(); err != nil {
+		d.stopProxy()
 		return fmt.Errorf("setting VPN DNS: %w", err)
 	}
 
@@ -55,11 +170,207 @@ func (d *DNSManager) Restore() error {
 	if err := d.restoreDNS(); err != nil {
 		return fmt.Errorf("restoring DNS: %w", err)
 	}
+	d.stopProxy()
 
 	d.configured = false
 	return nil
 }
 
+// startProxy runs the local resolver and has the system pointed at it
+// instead.
+func (d *DNSManager) startProxy() error {
+	address, err := d.proxyAddress()
+	if err != nil {
+		return err
+	}
+
+	proxyConfig := d.proxyConfig
+	proxyConfig.Listen = net.JoinHostPort(address, "53")
+	proxyConfig.LocalOnly = true
+	proxyConfig.Observe = d.observe
+
+	proxy, err := dnsproxy.New(proxyConfig, d.logger)
+	if err != nil {
+		return err
+	}
+	if err := proxy.Start(); err != nil {
+		return err
+	}
+
+	d.proxyMu.Lock()
+	d.proxy = proxy
+	d.proxyMu.Unlock()
+	d.servers = []string{address}
+	return nil
+}
+
+func (d *DNSManager) stopProxy() {
+	d.proxyMu.Lock()
+	proxy := d.proxy
+	d.proxy = nil
+	d.proxyMu.Unlock()
+
+	if proxy == nil {
+		return
+	}
+	if err := proxy.Stop(); err != nil {
+		d.logger.Warning("Stopping DNS proxy: %v", err)
+	}
+}
+
+// proxyAddress picks where the proxy listens, on port 53 for any resolver
+// to be able to use it.
+func (d *DNSManager) proxyAddress() (string, error) {
+	if d.proxyListen != "" {
+		return d.proxyListen, nil
+	}
+
+	// systemd-resolved sends the queries for a link out of that link,
+	// which reaches the link's own address but not loopback. The peers
+	// reach it too, which the proxy's LocalOnly takes care of.
+	if _, ok := d.strategy.(*resolvedDNS); ok {
+		return tunnelAddress(d.address)
+	}
+
+	switch {
+	case runtime.GOOS == "linux":
+		return defaultProxyAddress, nil
+	default:
+		return "127.0.0.1", nil
+	}
+}
+
+// tunnelAddress returns the first address of the tunnel interface,
+// preferring IPv4.
+func tunnelAddress(addresses string) (string, error) {
+	var first string
+	for _, address := range strings.Split(addresses, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		addr, err := parseInterfaceAddress(address)
+		if err != nil {
+			return "", err
+		}
+		if addr.IP.To4() != nil {
+			return addr.IP.String(), nil
+		}
+		if first == "" {
+			first = addr.IP.String()
+		}
+	}
+	if first == "" {
+		return "", errors.New("the tunnel has no address to run the DNS proxy on")
+	}
+	return first, nil
+}
+
+// Reapply hands the resolvers over again after the tunnel interface was
+// recreated, which takes the settings systemd-resolved keeps per link
+// along with it.
+func (d *DNSManager) Reapply() error {
+	if !d.configured || d.strategy == nil {
+		return nil
+	}
+	return d.strategy.apply(d.servers, d.search)
+}
+
+// BlocklistStats returns the state of the blocklists while the DNS proxy
+// runs with them.
+func (d *DNSManager) BlocklistStats() []dnsproxy.ListStats {
+	d.proxyMu.Lock()
+	defer d.proxyMu.Unlock()
+
+	if d.proxy == nil {
+		return nil
+	}
+	return d.proxy.BlocklistStats()
+}
+
+// OriginalServers returns the resolvers that were in use before Configure.
+func (d *DNSManager) OriginalServers() []string {
+	return d.originalDNS
+}
+
+// cleanupCommands restores the Linux DNS settings, for the journal. The
+// other systems get the original servers recorded instead.
+func (d *DNSManager) cleanupCommands() [][]string {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	strategy, err := d.linuxStrategy()
+	if err != nil {
+		return nil
+	}
+	return strategy.cleanupCommands()
+}
+
+// dnsStrategy hands the VPN resolvers to whatever manages DNS on a Linux
+// host, and takes them back leaving things exactly as they were.
+type dnsStrategy interface {
+	name() string
+	apply(servers, search []string) error
+	restore() error
+	cleanupCommands() [][]string
+}
+
+const (
+	DNSModeAuto           = "auto"
+	DNSModeResolved       = "resolved"
+	DNSModeResolvconf     = "resolvconf"
+	DNSModeNetworkManager = "networkmanager"
+	DNSModeFile           = "file"
+)
+
+func (d *DNSManager) linuxStrategy() (dnsStrategy, error) {
+	if d.strategy != nil {
+		return d.strategy, nil
+	}
+
+	mode := d.mode
+	if mode == "" || mode == DNSModeAuto {
+		mode = DetectDNSMode()
+	}
+
+	switch mode {
+	case DNSModeResolved:
+		d.strategy = &resolvedDNS{iface: d.iface, routes: d.routes}
+	case DNSModeResolvconf:
+		d.strategy = newResolvconfDNS(d.iface)
+	case DNSModeNetworkManager:
+		d.strategy = &networkManagerDNS{iface: d.iface}
+	case DNSModeFile:
+		d.strategy = &fileDNS{}
+	default:
+		return nil, fmt.Errorf("unknown dns_mode %q", d.mode)
+	}
+	return d.strategy, nil
+}
+
+// DetectDNSMode tells what manages the resolver on this Linux host from
+// where /etc/resolv.conf points and who wrote it.
+func DetectDNSMode() string {
+	target, _ := os.Readlink(resolvConfPath)
+	data, _ := os.ReadFile(resolvConfPath)
+	content := string(data)
+
+	// resolv.conf pointing at the stub resolver, by link or by copy
+	if strings.Contains(target, "systemd/resolve") || strings.Contains(content, "nameserver 127.0.0.53") {
+		if resolvedRunning() {
+			return DNSModeResolved
+		}
+	}
+	if strings.Contains(content, "Generated by NetworkManager") && networkManagerRunning() {
+		return DNSModeNetworkManager
+	}
+	if strings.Contains(target, "resolvconf") || strings.Contains(content, "resolvconf") {
+		if _, err := exec.LookPath("resolvconf"); err == nil {
+			return DNSModeResolvconf
+		}
+	}
+	return DNSModeFile
+}
+
 func (d *DNSManager) backupDNS() error {
 	switch runtime.GOOS {
 	case "linux":
@@ -100,46 +411,31 @@ func (d *DNSManager) restoreDNS() error {
 }
 
 func (d *DNSManager) backupLinuxDNS() error {
-	// Read current resolv.conf
-	data, err := os.ReadFile("/etc/resolv.conf")
-	if err != nil {
+	// The servers are kept for reference only; each strategy restores
+	// what it changed by itself
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-
-	// Extract nameservers
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "nameserver") {
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				d.originalDNS = append(d.originalDNS, parts[1])
-			}
+	d.originalDNS = nil
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			d.originalDNS = append(d.originalDNS, fields[1])
 		}
 	}
 
-	// Backup the file
-	return exec.Command("sudo", "cp", "/etc/resolv.conf", "/etc/resolv.conf.kryptx.backup").Run()
+	_, err = d.linuxStrategy()
+	return err
 }
 
 func (d *DNSManager) setLinuxDNS() error {
-	// Create new resolv.conf with VPN DNS
-	content := "# KryptX VPN DNS\n"
-	for _, dns := range d.vpnDNS {
-		content += fmt.Sprintf("nameserver %s\n", dns)
-	}
-
-	// Write to temporary file and move
-	tmpFile := "/tmp/resolv.conf.kryptx"
-	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
-		return err
-	}
-
-	return exec.Command("sudo", "mv", tmpFile, "/etc/resolv.conf").Run()
+	d.logger.Info("Handing DNS servers to %s", d.strategy.name())
+	return d.strategy.apply(d.servers, d.search)
 }
 
 func (d *DNSManager) restoreLinuxDNS() error {
-	return exec.Command("sudo", "mv", "/etc/resolv.conf.kryptx.backup", "/etc/resolv.conf").Run()
+	return d.strategy.restore()
 }
 
 func (d *DNSManager) backupMacOSDNS() error {
@@ -156,7 +452,7 @@ func (d *DNSManager) backupMacOSDNS() error {
 
 func (d *DNSManager) setMacOSDNS() error {
 	args := []string{"-setdnsservers", "Wi-Fi"}
-	args = append(args, d.vpnDNS...)
+	args = append(args, d.servers...)
 
 	cmd := exec.Command("networksetup", args...)
 	return cmd.Run()
@@ -196,18 +492,23 @@ func (d *DNSManager) backupWindowsDNS() error {
 }
 
 func (d *DNSManager) setWindowsDNS() error {
-	// Set primary DNS
-	if len(d.vpnDNS) > 0 {
-		cmd := exec.Command("netsh", "interface", "ipv4", "set", "dns", "name=\"Local Area Connection\"", "source=static", "addr="+d.vpnDNS[0])
-		if err := cmd.Run(); err != nil {
-			return err
+	// netsh keeps the servers of each family apart, so the first of each
+	// is set and the others added
+	set := map[string]bool{}
+	for _, dns := range d.servers {
+		family := "ipv4"
+		if ip := net.ParseIP(dns); ip != nil && ip.To4() == nil {
+			family = "ipv6"
 		}
-	}
 
-	// Set secondary DNS
-	if len(d.vpnDNS) > 1 {
-		cmd := exec.Command("netsh", "interface", "ipv4", "add", "dns", "name=\"Local Area Connection\"", "addr="+d.vpnDNS[1])
-		return cmd.Run()
+		args := []string{"interface", family, "add", "dns", "name=\"Local Area Connection\"", "addr=" + dns}
+		if !set[family] {
+			args = []string{"interface", family, "set", "dns", "name=\"Local Area Connection\"", "source=static", "addr=" + dns}
+			set[family] = true
+		}
+		if err := exec.Command("netsh", args...).Run(); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -215,6 +516,26 @@ func (d *DNSManager) setWindowsDNS() error {
 
 func (d *DNSManager) restoreWindowsDNS() error {
 	// Restore to automatic DNS
-	cmd := exec.Command("netsh", "interface", "ipv4", "set", "dns", "name=\"Local Area Connection\"", "source=dhcp")
-	return cmd.Run()
+	var firstErr error
+	for _, family := range []string{"ipv4", "ipv6"} {
+		cmd := exec.Command("netsh", "interface", family, "set", "dns", "name=\"Local Area Connection\"", "source=dhcp")
+		if err := cmd.Run(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// recoverDNS puts back the resolvers recorded in the journal by a session
+// that never got to call Restore.
+func recoverDNS(entry JournalEntry, logger *utils.Logger) error {
+	if runtime.GOOS == "linux" {
+		runCleanupCommands(entry.Commands, logger)
+		return nil
+	}
+
+	d := NewDNSManager(&config.Config{}, logger)
+	d.originalDNS = entry.DNS
+	d.configured = true
+	return d.Restore()
 }
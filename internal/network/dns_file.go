@@ -0,0 +1,106 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const resolvConfHeader = "# KryptX VPN DNS\n"
+
+// fileDNS writes resolv.conf itself, for hosts where nothing manages it.
+// The original is moved aside as it is, symlink or file, and moved back on
+// restore, so neither its contents nor what it is change. Without one,
+// restore removes ours.
+type fileDNS struct {
+	// created is whether there was no resolv.conf to move aside
+	created bool
+}
+
+func (*fileDNS) name() string {
+	return "/etc/resolv.conf"
+}
+
+func (f *fileDNS) apply(servers, search []string) error {
+	var b strings.Builder
+	b.WriteString(resolvConfHeader)
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+
+	tmpFile, err := os.CreateTemp("", "resolv.conf.kryptx")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.WriteString(b.String()); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+
+	// Applied again, or left from a crash: ours is what is in place, and
+	// the backup holds the original if there was one
+	_, err = os.Lstat(resolvConfPath)
+	switch {
+	case isOurResolvConf():
+		_, err := os.Lstat(resolvConfBackup)
+		f.created = os.IsNotExist(err)
+	case os.IsNotExist(err):
+		f.created = true
+	default:
+		if err := runCommand("sudo", "mv", resolvConfPath, resolvConfBackup); err != nil {
+			return fmt.Errorf("moving %s aside: %w", resolvConfPath, err)
+		}
+	}
+
+	if err := runCommand("sudo", "cp", tmpFile.Name(), resolvConfPath); err != nil {
+		f.restore()
+		return fmt.Errorf("writing %s: %w", resolvConfPath, err)
+	}
+	return nil
+}
+
+func (f *fileDNS) restore() error {
+	if _, err := os.Lstat(resolvConfBackup); err == nil {
+		return runCommand("sudo", "mv", resolvConfBackup, resolvConfPath)
+	}
+	// There was no original, or it never got moved aside
+	if isOurResolvConf() {
+		return runCommand("sudo", "rm", "-f", resolvConfPath)
+	}
+	return nil
+}
+
+func (f *fileDNS) cleanupCommands() [][]string {
+	if f.created {
+		return [][]string{{"sudo", "rm", "-f", resolvConfPath}}
+	}
+	return [][]string{{"sudo", "mv", resolvConfBackup, resolvConfPath}}
+}
+
+func isOurResolvConf() bool {
+	data, err := os.ReadFile(resolvConfPath)
+	return err == nil && bytes.HasPrefix(data, []byte(resolvConfHeader))
+}
+
+// execCommand builds the commands run on the host, for the tests to stand
+// in for them.
+var execCommand = exec.Command
+
+func runCommand(name string, args ...string) error {
+	if output, err := execCommand(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
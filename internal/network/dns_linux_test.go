@@ -0,0 +1,501 @@
+package network
+
+import (
+	"maps"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeCommands stands in for execCommand, recording every command and
+// running what run returns for it instead, or nothing.
+type fakeCommands struct {
+	calls [][]string
+	run   func(call []string) *exec.Cmd
+}
+
+func useFakeCommands(t *testing.T, run func(call []string) *exec.Cmd) *fakeCommands {
+	t.Helper()
+
+	f := &fakeCommands{run: run}
+	saved := execCommand
+	execCommand = f.command
+	t.Cleanup(func() { execCommand = saved })
+	return f
+}
+
+func (f *fakeCommands) command(name string, args ...string) *exec.Cmd {
+	call := append([]string{name}, args...)
+	f.calls = append(f.calls, call)
+	if f.run != nil {
+		if cmd := f.run(call); cmd != nil {
+			return cmd
+		}
+	}
+	return shellCommand("exit 0")
+}
+
+// shellCommand runs script with args as $1 and on; by its full path, as
+// tests may change PATH.
+func shellCommand(script string, args ...string) *exec.Cmd {
+	return exec.Command("/bin/sh", append([]string{"-c", script, "sh"}, args...)...)
+}
+
+// useResolvConf points resolv.conf and its backup into a directory of the
+// test's own.
+func useResolvConf(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	savedPath, savedBackup := resolvConfPath, resolvConfBackup
+	resolvConfPath = filepath.Join(dir, "resolv.conf")
+	resolvConfBackup = filepath.Join(dir, "resolv.conf.kryptx.backup")
+	t.Cleanup(func() { resolvConfPath, resolvConfBackup = savedPath, savedBackup })
+	return dir
+}
+
+// describeFile tells what is at path: nothing, a symlink or a file.
+func describeFile(t *testing.T, path string) string {
+	t.Helper()
+
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		return "missing"
+	case err != nil:
+		t.Fatal(err)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "symlink to " + target
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "file: " + string(data)
+}
+
+func TestDetectDNSMode(t *testing.T) {
+	const (
+		stubTarget       = "../run/systemd/resolve/stub-resolv.conf"
+		resolvconfTarget = "../run/resolvconf/resolv.conf"
+	)
+
+	for _, tt := range []struct {
+		name string
+		// target makes resolv.conf a symlink, content a file
+		target, content string
+		resolved        bool
+		networkManager  bool
+		resolvconf      bool
+		want            string
+	}{
+		{name: "stub symlink", target: stubTarget, resolved: true, want: DNSModeResolved},
+		{name: "stub symlink, resolved stopped", target: stubTarget, want: DNSModeFile},
+		{name: "uplink symlink", target: "/run/systemd/resolve/resolv.conf", resolved: true, want: DNSModeResolved},
+		{name: "stub copy", content: "nameserver 127.0.0.53\noptions edns0 trust-ad\n", resolved: true, want: DNSModeResolved},
+		{
+			name:           "NetworkManager",
+			content:        "# Generated by NetworkManager\nnameserver 192.168.1.1\n",
+			networkManager: true,
+			want:           DNSModeNetworkManager,
+		},
+		{name: "NetworkManager stopped", content: "# Generated by NetworkManager\nnameserver 192.168.1.1\n", want: DNSModeFile},
+		{name: "resolvconf symlink", target: resolvconfTarget, resolvconf: true, want: DNSModeResolvconf},
+		{name: "resolvconf not installed", target: resolvconfTarget, want: DNSModeFile},
+		{
+			name:       "openresolv",
+			content:    "# Generated by resolvconf\nnameserver 192.168.1.1\n",
+			resolvconf: true,
+			want:       DNSModeResolvconf,
+		},
+		{name: "plain file", content: "nameserver 192.168.1.1\n", resolved: true, networkManager: true, resolvconf: true, want: DNSModeFile},
+		{name: "missing", want: DNSModeFile},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useResolvConf(t)
+			switch {
+			case tt.target != "":
+				if err := os.Symlink(tt.target, resolvConfPath); err != nil {
+					t.Fatal(err)
+				}
+			case tt.content != "":
+				if err := os.WriteFile(resolvConfPath, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			savedRunning := resolvedRunning
+			resolvedRunning = func() bool { return tt.resolved }
+			t.Cleanup(func() { resolvedRunning = savedRunning })
+
+			useFakeCommands(t, func(call []string) *exec.Cmd {
+				if call[0] == "nmcli" && tt.networkManager {
+					return shellCommand("echo running")
+				}
+				return shellCommand("exit 1")
+			})
+
+			bin := t.TempDir()
+			if tt.resolvconf {
+				if err := os.WriteFile(filepath.Join(bin, "resolvconf"), []byte("#!/bin/sh\n"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Setenv("PATH", bin)
+
+			if got := DetectDNSMode(); got != tt.want {
+				t.Errorf("DetectDNSMode = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileDNSRestore(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+		// cleanup is the journal's command to restore after a crash
+		cleanup []string
+	}{
+		{
+			name: "file",
+			setup: func(t *testing.T, dir string) {
+				if err := os.WriteFile(resolvConfPath, []byte("nameserver 192.168.1.1\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			cleanup: []string{"sudo", "mv", "BACKUP", "PATH"},
+		},
+		{
+			name: "symlink",
+			setup: func(t *testing.T, dir string) {
+				target := filepath.Join(dir, "stub-resolv.conf")
+				if err := os.WriteFile(target, []byte("nameserver 127.0.0.53\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(target, resolvConfPath); err != nil {
+					t.Fatal(err)
+				}
+			},
+			cleanup: []string{"sudo", "mv", "BACKUP", "PATH"},
+		},
+		{
+			name:    "missing",
+			setup:   func(t *testing.T, dir string) {},
+			cleanup: []string{"sudo", "rm", "-f", "PATH"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := useResolvConf(t)
+			tt.setup(t, dir)
+			original := describeFile(t, resolvConfPath)
+
+			// The commands run for real, but for sudo
+			commands := useFakeCommands(t, func(call []string) *exec.Cmd {
+				if call[0] != "sudo" {
+					t.Errorf("%v run without sudo", call)
+					return nil
+				}
+				return exec.Command(call[1], call[2:]...)
+			})
+
+			f := &fileDNS{}
+			if err := f.apply([]string{"10.8.0.1"}, []string{"corp.example"}); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			want := "file: " + resolvConfHeader + "nameserver 10.8.0.1\nsearch corp.example\n"
+			if got := describeFile(t, resolvConfPath); got != want {
+				t.Fatalf("after apply resolv.conf is %q, want %q", got, want)
+			}
+
+			// Applied again by a new run after a crash, the backup stays
+			// the original
+			f = &fileDNS{}
+			if err := f.apply([]string{"10.8.0.2"}, nil); err != nil {
+				t.Fatalf("apply after a crash: %v", err)
+			}
+			want = "file: " + resolvConfHeader + "nameserver 10.8.0.2\n"
+			if got := describeFile(t, resolvConfPath); got != want {
+				t.Fatalf("after the second apply resolv.conf is %q, want %q", got, want)
+			}
+			if original != "missing" {
+				if got := describeFile(t, resolvConfBackup); got != original {
+					t.Fatalf("backup is %q, want the original %q", got, original)
+				}
+			}
+
+			replacer := strings.NewReplacer("BACKUP", resolvConfBackup, "PATH", resolvConfPath)
+			var cleanup []string
+			for _, arg := range tt.cleanup {
+				cleanup = append(cleanup, replacer.Replace(arg))
+			}
+			if got := f.cleanupCommands(); len(got) != 1 || !slices.Equal(got[0], cleanup) {
+				t.Errorf("cleanupCommands = %q, want %q", got, cleanup)
+			}
+
+			if err := f.restore(); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			if got := describeFile(t, resolvConfPath); got != original {
+				t.Errorf("after restore resolv.conf is %q, want the original %q", got, original)
+			}
+			if got := describeFile(t, resolvConfBackup); got != "missing" {
+				t.Errorf("backup left behind: %q", got)
+			}
+			if len(commands.calls) == 0 {
+				t.Error("no commands run")
+			}
+		})
+	}
+}
+
+func TestFileDNSRestoreUnapplied(t *testing.T) {
+	useResolvConf(t)
+	if err := os.WriteFile(resolvConfPath, []byte("nameserver 192.168.1.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	commands := useFakeCommands(t, nil)
+
+	// Never applied, the original is not ours to remove
+	if err := (&fileDNS{}).restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if len(commands.calls) != 0 {
+		t.Errorf("restore ran %q", commands.calls)
+	}
+}
+
+func TestResolvconfDNSRestore(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		openresolv bool
+		add        []string
+		remove     []string
+	}{
+		{"Debian", false, []string{"sudo", "resolvconf", "-a", "tun.kxtest0"}, []string{"sudo", "resolvconf", "-d", "tun.kxtest0"}},
+		{
+			"openresolv", true,
+			[]string{"sudo", "resolvconf", "-a", "tun.kxtest0", "-m", "0", "-x"},
+			[]string{"sudo", "resolvconf", "-d", "tun.kxtest0", "-f"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// resolvconf keeps a file per record, as here
+			records := t.TempDir()
+			if err := os.WriteFile(filepath.Join(records, "eth0.dhclient"), []byte("nameserver 192.168.1.1\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			listRecords := func() map[string]string {
+				entries, err := os.ReadDir(records)
+				if err != nil {
+					t.Fatal(err)
+				}
+				state := map[string]string{}
+				for _, entry := range entries {
+					data, err := os.ReadFile(filepath.Join(records, entry.Name()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					state[entry.Name()] = string(data)
+				}
+				return state
+			}
+			original := listRecords()
+
+			commands := useFakeCommands(t, func(call []string) *exec.Cmd {
+				if len(call) < 4 || call[0] != "sudo" || call[1] != "resolvconf" {
+					t.Errorf("unexpected command %q", call)
+					return nil
+				}
+				path := filepath.Join(records, call[3])
+				switch call[2] {
+				case "-a":
+					return shellCommand(`cat > "$1"`, path)
+				case "-d":
+					return exec.Command("rm", path)
+				}
+				return nil
+			})
+
+			r := &resolvconfDNS{record: "tun.kxtest0", openresolv: tt.openresolv}
+			if err := r.apply([]string{"10.8.0.1", "fd00::1"}, []string{"corp.example"}); err != nil {
+				t.Fatalf("apply: %v", err)
+			}
+			if got := listRecords()["tun.kxtest0"]; got != "nameserver 10.8.0.1\nnameserver fd00::1\nsearch corp.example\n" {
+				t.Errorf("record = %q", got)
+			}
+
+			if err := r.restore(); err != nil {
+				t.Fatalf("restore: %v", err)
+			}
+			if got := listRecords(); !reflect.DeepEqual(got, original) {
+				t.Errorf("after restore records are %q, want %q", got, original)
+			}
+
+			if want := [][]string{tt.add, tt.remove}; !reflect.DeepEqual(commands.calls, want) {
+				t.Errorf("commands = %q, want %q", commands.calls, want)
+			}
+			if got := r.cleanupCommands(); !reflect.DeepEqual(got, [][]string{tt.remove}) {
+				t.Errorf("cleanupCommands = %q, want %q", got, tt.remove)
+			}
+		})
+	}
+}
+
+func TestNetworkManagerDNSRestore(t *testing.T) {
+	// What NetworkManager has applied to each device, reapply bringing
+	// back the profile
+	profile := map[string]string{
+		"eth0":    "dns 192.168.1.1 auto",
+		"wlan0":   "dns 192.168.2.1 auto",
+		"kxtest0": "none",
+	}
+	applied := maps.Clone(profile)
+	original := maps.Clone(applied)
+
+	commands := useFakeCommands(t, func(call []string) *exec.Cmd {
+		args := strings.Join(call, " ")
+		switch {
+		case args == "nmcli -t -f DEVICE,STATE device status":
+			return shellCommand(`printf '%s' "$1"`, "eth0:connected\nwlan0:connected\nkxtest0:connected\nlo:connected (externally)\nwlan1:disconnected\n")
+		case strings.HasPrefix(args, "sudo nmcli device modify "):
+			applied[call[4]] = strings.Join(call[5:], " ")
+		case strings.HasPrefix(args, "sudo nmcli device reapply "):
+			applied[call[4]] = profile[call[4]]
+		default:
+			t.Errorf("unexpected command %q", call)
+		}
+		return nil
+	})
+
+	n := &networkManagerDNS{iface: "kxtest0"}
+	if err := n.apply([]string{"10.8.0.1", "fd00::1"}, []string{"corp.example"}); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	want := "ipv4.dns 10.8.0.1 ipv4.ignore-auto-dns yes ipv4.dns-search corp.example ipv6.dns fd00::1 ipv6.ignore-auto-dns yes"
+	for _, device := range []string{"eth0", "wlan0"} {
+		if applied[device] != want {
+			t.Errorf("%s applied %q, want %q", device, applied[device], want)
+		}
+	}
+	if applied["kxtest0"] != "none" {
+		t.Error("the tunnel's own settings changed")
+	}
+	if got := n.cleanupCommands(); !reflect.DeepEqual(got, [][]string{
+		{"sudo", "nmcli", "device", "reapply", "eth0"},
+		{"sudo", "nmcli", "device", "reapply", "wlan0"},
+	}) {
+		t.Errorf("cleanupCommands = %q", got)
+	}
+
+	if err := n.restore(); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !reflect.DeepEqual(applied, original) {
+		t.Errorf("after restore devices have %q, want %q", applied, original)
+	}
+	if len(n.devices) != 0 || len(n.cleanupCommands()) != 0 {
+		t.Error("devices still recorded after restore")
+	}
+	if len(commands.calls) != 5 {
+		t.Errorf("commands = %q, want a listing, two modifies and two reapplies", commands.calls)
+	}
+}
+
+// fakeResolved stands in for the systemd-resolved manager, keeping what
+// each link was set to.
+type fakeResolved struct {
+	dbus.BusObject
+	links map[int32]map[string]interface{}
+	// old lacks SetLinkDefaultRoute, as before version 240
+	old bool
+}
+
+func (f *fakeResolved) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	name := strings.TrimPrefix(method, resolvedManager+".")
+	switch name {
+	case "SetLinkDefaultRoute":
+		if f.old {
+			return &dbus.Call{Err: dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod"}}
+		}
+		fallthrough
+	case "SetLinkDNS", "SetLinkDomains":
+		index := args[0].(int32)
+		if f.links[index] == nil {
+			f.links[index] = map[string]interface{}{}
+		}
+		f.links[index][name] = args[1]
+	case "RevertLink":
+		delete(f.links, args[0].(int32))
+	case "FlushCaches":
+	default:
+		return &dbus.Call{Err: dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod"}}
+	}
+	return &dbus.Call{}
+}
+
+func TestResolvedDNSRestore(t *testing.T) {
+	// A link that exists, for apply to find
+	lo := loopbackInterface(t)
+	link, err := net.InterfaceByName(lo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := int32(link.Index)
+
+	var resolved *fakeResolved
+	saved := resolvedObject
+	resolvedObject = func() (dbus.BusObject, error) { return resolved, nil }
+	t.Cleanup(func() { resolvedObject = saved })
+
+	for _, old := range []bool{false, true} {
+		resolved = &fakeResolved{
+			links: map[int32]map[string]interface{}{
+				index + 1: {"SetLinkDNS": []resolvedAddress{{Family: resolvedFamilyIPv4, Address: []byte{192, 168, 1, 1}}}},
+			},
+			old: old,
+		}
+
+		original := maps.Clone(resolved.links)
+
+		r := &resolvedDNS{iface: lo, routes: []string{"corp.example"}}
+		if err := r.apply([]string{"10.8.0.1", "fd00::1"}, []string{"search.example"}); err != nil {
+			t.Fatalf("apply (old %v): %v", old, err)
+		}
+		want := map[string]interface{}{
+			"SetLinkDNS": []resolvedAddress{
+				{Family: resolvedFamilyIPv4, Address: net.ParseIP("10.8.0.1").To4()},
+				{Family: resolvedFamilyIPv6, Address: net.ParseIP("fd00::1").To16()},
+			},
+			"SetLinkDomains": []resolvedDomain{
+				{Domain: ".", RoutingOnly: true},
+				{Domain: "corp.example", RoutingOnly: true},
+				{Domain: "search.example"},
+			},
+		}
+		if !old {
+			want["SetLinkDefaultRoute"] = true
+		}
+		if got := resolved.links[index]; !reflect.DeepEqual(got, want) {
+			t.Errorf("link settings (old %v) = %+v, want %+v", old, got, want)
+		}
+
+		if err := r.restore(); err != nil {
+			t.Fatalf("restore (old %v): %v", old, err)
+		}
+		if !reflect.DeepEqual(resolved.links, original) {
+			t.Errorf("after restore (old %v) links are %+v, want %+v", old, resolved.links, original)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+)
+
+// networkManagerDNS overrides the resolvers of every connected device in
+// the settings NetworkManager has applied to it, not in the connection
+// profiles. "nmcli device reapply" puts the profile's settings back, so
+// nothing of the change survives a restore or a reboot.
+type networkManagerDNS struct {
+	iface string
+	// devices are the ones changed, to reapply on restore
+	devices []string
+}
+
+func (n *networkManagerDNS) name() string {
+	return "NetworkManager"
+}
+
+func (n *networkManagerDNS) apply(servers, search []string) error {
+	var ipv4, ipv6 []string
+	for _, server := range servers {
+		if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+			ipv6 = append(ipv6, server)
+		} else {
+			ipv4 = append(ipv4, server)
+		}
+	}
+
+	devices, err := networkManagerDevices()
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if device == n.iface {
+			continue
+		}
+
+		// Servers learned from DHCP or router advertisements would be
+		// used alongside ours, so they are ignored as well
+		cmd := execCommand("sudo", "nmcli", "device", "modify", device,
+			"ipv4.dns", strings.Join(ipv4, ","),
+			"ipv4.ignore-auto-dns", "yes",
+			"ipv4.dns-search", strings.Join(search, ","),
+			"ipv6.dns", strings.Join(ipv6, ","),
+			"ipv6.ignore-auto-dns", "yes",
+		)
+		if !slices.Contains(n.devices, device) {
+			n.devices = append(n.devices, device)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			n.restore()
+			return fmt.Errorf("setting DNS on %s: %w: %s", device, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func (n *networkManagerDNS) restore() error {
+	var firstErr error
+	for _, device := range n.devices {
+		output, err := execCommand("sudo", "nmcli", "device", "reapply", device).CombinedOutput()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("reapplying %s: %w: %s", device, err, strings.TrimSpace(string(output)))
+		}
+	}
+	n.devices = nil
+	return firstErr
+}
+
+func (n *networkManagerDNS) cleanupCommands() [][]string {
+	var commands [][]string
+	for _, device := range n.devices {
+		commands = append(commands, []string{"sudo", "nmcli", "device", "reapply", device})
+	}
+	return commands
+}
+
+// networkManagerDevices lists the devices NetworkManager has connected.
+func networkManagerDevices() ([]string, error) {
+	output, err := execCommand("nmcli", "-t", "-f", "DEVICE,STATE", "device", "status").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing NetworkManager devices: %w", err)
+	}
+
+	var devices []string
+	for _, line := range strings.Split(string(output), "\n") {
+		device, state, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if ok && state == "connected" && device != "lo" {
+			devices = append(devices, device)
+		}
+	}
+	return devices, nil
+}
+
+func networkManagerRunning() bool {
+	output, err := execCommand("nmcli", "-t", "-f", "RUNNING", "general").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "running"
+}
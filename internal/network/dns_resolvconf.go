@@ -0,0 +1,97 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const resolvconfInterfaceOrder = "/etc/resolvconf/interface-order"
+
+// resolvconfDNS hands the resolvers to resolvconf, Debian's or openresolv,
+// as a record for the tunnel interface. Deleting the record gives back the
+// resolv.conf resolvconf built from the others.
+type resolvconfDNS struct {
+	record     string
+	openresolv bool
+}
+
+func newResolvconfDNS(iface string) *resolvconfDNS {
+	version, _ := execCommand("resolvconf", "--version").CombinedOutput()
+	return &resolvconfDNS{
+		record:     resolvconfPrefix() + iface,
+		openresolv: strings.Contains(string(version), "openresolv"),
+	}
+}
+
+func (r *resolvconfDNS) name() string {
+	return "resolvconf"
+}
+
+func (r *resolvconfDNS) apply(servers, search []string) error {
+	var b strings.Builder
+	for _, server := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+
+	args := []string{"resolvconf", "-a", r.record}
+	// openresolv can put the record first and leave the others out;
+	// Debian's orders records by interface-order, hence the prefix
+	if r.openresolv {
+		args = append(args, "-m", "0", "-x")
+	}
+
+	cmd := execCommand("sudo", args...)
+	cmd.Stdin = strings.NewReader(b.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("resolvconf -a %s: %w: %s", r.record, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (r *resolvconfDNS) restore() error {
+	output, err := execCommand("sudo", r.deleteCommand()...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("resolvconf -d %s: %w: %s", r.record, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (r *resolvconfDNS) cleanupCommands() [][]string {
+	return [][]string{append([]string{"sudo"}, r.deleteCommand()...)}
+}
+
+func (r *resolvconfDNS) deleteCommand() []string {
+	command := []string{"resolvconf", "-d", r.record}
+	if r.openresolv {
+		// Not an error if the record is gone already
+		command = append(command, "-f")
+	}
+	return command
+}
+
+var interfaceOrderPrefix = regexp.MustCompile(`^([A-Za-z0-9-]+)\*$`)
+
+// resolvconfPrefix returns the first prefix that Debian's interface-order
+// ranks, such as "tun.", for the record to be ranked among the VPNs
+// rather than after every other interface, as wg-quick does.
+func resolvconfPrefix() string {
+	f, err := os.Open(resolvconfInterfaceOrder)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := interfaceOrderPrefix.FindStringSubmatch(strings.TrimSpace(scanner.Text())); m != nil {
+			return m[1] + "."
+		}
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedBus     = "org.freedesktop.resolve1"
+	resolvedPath    = "/org/freedesktop/resolve1"
+	resolvedManager = "org.freedesktop.resolve1.Manager"
+
+	// Address families as systemd-resolved takes them, Linux's AF_INET
+	// and AF_INET6
+	resolvedFamilyIPv4 = 2
+	resolvedFamilyIPv6 = 10
+)
+
+// resolvedDNS sets the resolvers on the tunnel link through the D-Bus API
+// of systemd-resolved and makes the link the route for every domain with
+// "~.". resolv.conf keeps pointing at the stub resolver, and the settings
+// go away with the link if they are not reverted first.
+type resolvedDNS struct {
+	iface string
+	// routes are domains to look up here too when another link has a
+	// longer routing domain for them, the domains of the DNS rules
+	routes  []string
+	ifindex int
+}
+
+// The argument types of SetLinkDNS and SetLinkDomains, a(iay) and a(sb)
+type resolvedAddress struct {
+	Family  int32
+	Address []byte
+}
+
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+func (r *resolvedDNS) name() string {
+	return "systemd-resolved"
+}
+
+func (r *resolvedDNS) apply(servers, search []string) error {
+	link, err := net.InterfaceByName(r.iface)
+	if err != nil {
+		return fmt.Errorf("finding %s: %w", r.iface, err)
+	}
+
+	var addresses []resolvedAddress
+	for _, server := range servers {
+		ip := net.ParseIP(server)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid DNS server %q", server)
+		case ip.To4() != nil:
+			addresses = append(addresses, resolvedAddress{Family: resolvedFamilyIPv4, Address: ip.To4()})
+		default:
+			addresses = append(addresses, resolvedAddress{Family: resolvedFamilyIPv6, Address: ip.To16()})
+		}
+	}
+
+	// "." routing only is what resolvectl calls "~.": every name that no
+	// other link has a longer routing domain for is looked up here
+	domains := []resolvedDomain{{Domain: ".", RoutingOnly: true}}
+	for _, domain := range r.routes {
+		domains = append(domains, resolvedDomain{Domain: domain, RoutingOnly: true})
+	}
+	for _, domain := range search {
+		domains = append(domains, resolvedDomain{Domain: domain})
+	}
+
+	resolved, err := resolvedObject()
+	if err != nil {
+		return err
+	}
+	index := int32(link.Index)
+
+	r.ifindex = link.Index
+	if err := resolved.Call(resolvedManager+".SetLinkDNS", 0, index, addresses).Err; err != nil {
+		r.restore()
+		return fmt.Errorf("setting DNS servers on %s: %w", r.iface, err)
+	}
+	if err := resolved.Call(resolvedManager+".SetLinkDomains", 0, index, domains).Err; err != nil {
+		r.restore()
+		return fmt.Errorf("setting DNS domains on %s: %w", r.iface, err)
+	}
+	// Older versions than 240 lack the call, and take "~." alone for it
+	err = resolved.Call(resolvedManager+".SetLinkDefaultRoute", 0, index, true).Err
+	if err != nil && !isUnknownMethod(err) {
+		r.restore()
+		return fmt.Errorf("making %s the default DNS route: %w", r.iface, err)
+	}
+
+	// Answers cached from the old servers would otherwise outlive them
+	resolved.Call(resolvedManager+".FlushCaches", 0)
+	return nil
+}
+
+func (r *resolvedDNS) restore() error {
+	if r.ifindex == 0 {
+		return nil
+	}
+	defer func() { r.ifindex = 0 }()
+
+	// Gone, or its index taken by another link: the settings went with it
+	link, err := net.InterfaceByIndex(r.ifindex)
+	if err != nil || link.Name != r.iface {
+		return nil
+	}
+
+	resolved, err := resolvedObject()
+	if err != nil {
+		return err
+	}
+	if err := resolved.Call(resolvedManager+".RevertLink", 0, int32(r.ifindex)).Err; err != nil {
+		return fmt.Errorf("reverting DNS settings of %s: %w", r.iface, err)
+	}
+	return nil
+}
+
+func (r *resolvedDNS) cleanupCommands() [][]string {
+	return [][]string{{"sudo", "resolvectl", "revert", r.iface}}
+}
+
+// resolvedLinkServers lists the servers systemd-resolved asks for names
+// routed to iface, which with "~." on it are all but those matching
+// another link's routing domains: the link's own and the global ones.
+func resolvedLinkServers(iface string) ([]string, error) {
+	// Without the link, that is when not connected, only the global ones
+	var index int32 = -1
+	if link, err := net.InterfaceByName(iface); err == nil {
+		index = int32(link.Index)
+	}
+
+	resolved, err := resolvedObject()
+	if err != nil {
+		return nil, err
+	}
+	variant, err := resolved.GetProperty(resolvedManager + ".DNS")
+	if err != nil {
+		return nil, fmt.Errorf("reading DNS servers from systemd-resolved: %w", err)
+	}
+
+	// a(iiay), index 0 being the global servers
+	var entries []struct {
+		Ifindex int32
+		Family  int32
+		Address []byte
+	}
+	if err := variant.Store(&entries); err != nil {
+		return nil, fmt.Errorf("reading DNS servers from systemd-resolved: %w", err)
+	}
+
+	var servers []string
+	for _, entry := range entries {
+		if entry.Ifindex == 0 || entry.Ifindex == index {
+			servers = append(servers, net.IP(entry.Address).String())
+		}
+	}
+	return servers, nil
+}
+
+// resolvedObject is the systemd-resolved manager on the system bus,
+// which the tests stand in for.
+var resolvedObject = func() (dbus.BusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the system bus: %w", err)
+	}
+	return conn.Object(resolvedBus, resolvedPath), nil
+}
+
+// resolvedRunning tells whether systemd-resolved is on the system bus.
+var resolvedRunning = func() bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+	var running bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, resolvedBus).Store(&running)
+	return err == nil && running
+}
+
+func isUnknownMethod(err error) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.UnknownMethod"
+}
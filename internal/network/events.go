@@ -0,0 +1,49 @@
+package network
+
+import "sync"
+
+const eventBuffer = 32
+
+// eventHub fans events out to any number of subscribers. A subscriber that
+// falls behind misses events rather than stalling the publisher.
+type eventHub[T any] struct {
+	mu   sync.Mutex
+	subs map[int]chan T
+	next int
+}
+
+func (h *eventHub[T]) subscribe() (<-chan T, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs == nil {
+		h.subs = map[int]chan T{}
+	}
+
+	id := h.next
+	h.next++
+	ch := make(chan T, eventBuffer)
+	h.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.subs, id)
+			close(ch)
+		})
+	}
+}
+
+func (h *eventHub[T]) publish(event T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, ch := range h.subs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEventHubConcurrent(t *testing.T) {
+	var hub eventHub[int]
+
+	const publishers, perPublisher = 4, 100
+
+	var subscribers sync.WaitGroup
+	var unsubscribes []func()
+	for i := 0; i < 8; i++ {
+		events, unsubscribe := hub.subscribe()
+		unsubscribes = append(unsubscribes, unsubscribe)
+		subscribers.Add(1)
+		go func() {
+			defer subscribers.Done()
+			for range events {
+			}
+		}()
+
+		// Half of them leave while events are still coming
+		if i%2 == 1 {
+			go unsubscribe()
+		}
+	}
+
+	// Subscribing and leaving race the publishers too
+	var churn sync.WaitGroup
+	churn.Add(1)
+	go func() {
+		defer churn.Done()
+		for i := 0; i < 50; i++ {
+			_, unsubscribe := hub.subscribe()
+			unsubscribe()
+		}
+	}()
+
+	var publishing sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		publishing.Add(1)
+		go func(p int) {
+			defer publishing.Done()
+			for i := 0; i < perPublisher; i++ {
+				hub.publish(p*perPublisher + i)
+			}
+		}(p)
+	}
+	publishing.Wait()
+	churn.Wait()
+
+	// Ending every subscription, some of them a second time, closes the
+	// channels and so ends the readers
+	for _, unsubscribe := range unsubscribes {
+		unsubscribe()
+	}
+	subscribers.Wait()
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if len(hub.subs) != 0 {
+		t.Fatalf("%d subscriptions left", len(hub.subs))
+	}
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	var hub eventHub[int]
+	events, unsubscribe := hub.subscribe()
+	defer unsubscribe()
+
+	// Nobody reads; publishing must not block once the buffer is full
+	for i := 0; i < eventBuffer*2; i++ {
+		hub.publish(i)
+	}
+	if len(events) != eventBuffer {
+		t.Fatalf("buffered %d events, want %d", len(events), eventBuffer)
+	}
+	if first := <-events; first != 0 {
+		t.Errorf("first event = %d, want 0: the oldest are kept", first)
+	}
+}
+
+func TestEventHubUnsubscribeTwice(t *testing.T) {
+	var hub eventHub[int]
+	events, unsubscribe := hub.subscribe()
+	unsubscribe()
+	unsubscribe()
+
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after unsubscribe")
+	}
+	hub.publish(1)
+}
@@ -0,0 +1,135 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"kryptx/internal/config"
+)
+
+// FailoverEvent reports a switch from one server to another. Duration runs
+// from the moment the old server was given up on to the first handshake
+// with the new one; Err is set when no other server could take over.
+type FailoverEvent struct {
+	From     string
+	To       string
+	Reason   string
+	Err      error
+	Time     time.Time
+	Duration time.Duration
+}
+
+var errNoFailover = errors.New("no other server to fail over to")
+
+// SubscribeFailover returns a channel of failover events and a function
+// that ends the subscription.
+func (v *VPNClient) SubscribeFailover() (<-chan FailoverEvent, func()) {
+	return v.failoverEvents.subscribe()
+}
+
+func (v *VPNClient) emitFailover(event FailoverEvent) {
+	event.Time = time.Now()
+	v.failoverEvents.publish(event)
+}
+
+func (v *VPNClient) canFailover() bool {
+	return v.config.Reconnect.Failover && len(v.config.ServerList()) > 1
+}
+
+// failover swaps the peer of the running device for the next best server
+// until one completes a handshake. The interface stays up throughout, so
+// the kill switch and DNS settings never lapse. If no server takes over,
+// the original one is put back in place for the reconnect loop.
+func (v *VPNClient) failover(ctx context.Context, reason error) error {
+	started := time.Now()
+	current := v.ActiveServer()
+	original, upAt := v.deviceConfig, v.tunnelUpAt
+
+	var candidates []config.ServerConfig
+	for _, server := range v.config.ServerList() {
+		if server.Name != current.Name {
+			candidates = append(candidates, server)
+		}
+	}
+	if len(candidates) == 0 {
+		return errNoFailover
+	}
+
+	// Unreachable servers rank last but are still tried, since with the
+	// kill switch up the probes may simply have been blocked.
+	lastErr := errNoFailover
+	for _, result := range v.selector.Rank(ctx, candidates) {
+		if ctx.Err() != nil {
+			v.restoreServer(current, original, upAt)
+			return ctx.Err()
+		}
+
+		server, _ := v.config.ServerByName(result.Server)
+		v.logger.Info("Failing over from %s to %s...", current.Name, server.Name)
+		v.selector.Settle(ctx, server.Name)
+
+		if err := v.switchServer(ctx, server); err != nil {
+			v.logger.Warning("Server %s did not take over: %v", server.Name, err)
+			lastErr = err
+			continue
+		}
+
+		v.logger.Info("Failed over to %s in %s", server.Name, time.Since(started).Round(time.Millisecond))
+		v.emitFailover(FailoverEvent{
+			From:     current.Name,
+			To:       server.Name,
+			Reason:   reason.Error(),
+			Duration: time.Since(started),
+		})
+		return nil
+	}
+
+	v.restoreServer(current, original, upAt)
+	v.emitFailover(FailoverEvent{From: current.Name, Reason: reason.Error(), Err: lastErr, Duration: time.Since(started)})
+	return lastErr
+}
+
+func (v *VPNClient) switchServer(ctx context.Context, server config.ServerConfig) error {
+	devCfg, err := v.deviceConfigFor(server)
+	if err != nil {
+		return err
+	}
+
+	if err := v.openKillSwitch(devCfg); err != nil {
+		return err
+	}
+
+	since := time.Now()
+	if err := v.backend.Update(devCfg); err != nil {
+		return err
+	}
+
+	v.setServer(server)
+	v.deviceConfig = devCfg
+	v.tunnelUpAt = since
+	v.stats.reset()
+
+	return v.waitForHandshake(ctx, since)
+}
+
+// restoreServer puts the device back the way it was before a failover, for
+// the reconnect loop to take it from there.
+func (v *VPNClient) restoreServer(server config.ServerConfig, devCfg *DeviceConfig, upAt time.Time) {
+	if err := v.openKillSwitch(devCfg); err != nil {
+		v.logger.Warning("Could not restore kill switch endpoints: %v", err)
+	}
+	if err := v.backend.Update(devCfg); err != nil {
+		v.logger.Warning("Could not restore the peer for %s: %v", server.Name, err)
+	}
+
+	v.setServer(server)
+	v.deviceConfig = devCfg
+	v.tunnelUpAt = upAt
+}
+
+func (v *VPNClient) setServer(server config.ServerConfig) {
+	v.serverMu.Lock()
+	v.server = server
+	v.serverMu.Unlock()
+}
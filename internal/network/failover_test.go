@@ -0,0 +1,196 @@
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// wireGuardServer is an in-process WireGuard peer on loopback, kept
+// entirely in netstack so it needs no root.
+type wireGuardServer struct {
+	dev    *device.Device
+	client wgtypes.Key
+}
+
+func newWireGuardServer(t *testing.T, server *config.ServerConfig, client wgtypes.Key) *wireGuardServer {
+	t.Helper()
+
+	private, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunDev, _, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.8.0.1")}, nil, defaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewDevice(tunDev, conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	s := &wireGuardServer{dev: dev, client: client}
+	if err := dev.IpcSet(fmt.Sprintf("private_key=%s\nlisten_port=0\n", hex.EncodeToString(private[:]))); err != nil {
+		t.Fatal(err)
+	}
+	s.accept(t)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(state, "\n") {
+		if value, ok := strings.CutPrefix(line, "listen_port="); ok {
+			server.Port, _ = strconv.Atoi(value)
+		}
+	}
+	if server.Port == 0 {
+		t.Fatal("server did not report its port")
+	}
+
+	server.Endpoint = "127.0.0.1"
+	server.PublicKey = private.PublicKey().String()
+	server.PersistentKeepalive = 1
+	return s
+}
+
+// accept lets the client complete handshakes.
+func (s *wireGuardServer) accept(t *testing.T) {
+	t.Helper()
+	if err := s.dev.IpcSet(fmt.Sprintf("public_key=%s\nallowed_ip=10.8.0.2/32\n", hex.EncodeToString(s.client[:]))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// drop makes the server ignore handshakes from the client.
+func (s *wireGuardServer) drop(t *testing.T) {
+	t.Helper()
+	if err := s.dev.IpcSet(fmt.Sprintf("public_key=%s\nremove=true\n", hex.EncodeToString(s.client[:]))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFailoverWindow(t *testing.T) {
+	cfg := testConfig(t, "primary", "backup")
+	cfg.Network.Backend = BackendNetstack
+	cfg.Reconnect.Failover = true
+	cfg.Selection = config.SelectionConfig{Method: ProbeHandshake, Attempts: 1, Timeout: time.Second}
+
+	clientKey, err := wgtypes.ParseKey(cfg.Network.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := newWireGuardServer(t, &cfg.Servers[0], clientKey.PublicKey())
+	newWireGuardServer(t, &cfg.Servers[1], clientKey.PublicKey())
+
+	logger := utils.NewLogger(testing.Verbose())
+	client := newTestClient(t, cfg, newUserspaceBackend(true, logger))
+
+	events, unsubscribe := client.SubscribeFailover()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if err := client.waitForHandshake(ctx, client.tunnelUpAt); err != nil {
+		t.Fatalf("no handshake with the primary: %v", err)
+	}
+
+	primary.drop(t)
+	reason := errors.New("no handshake for 3m0s")
+	started := time.Now()
+	if err := client.failover(ctx, reason); err != nil {
+		t.Fatalf("failover: %v", err)
+	}
+	window := time.Since(started)
+
+	select {
+	case event := <-events:
+		if event.From != "primary" || event.To != "backup" || event.Reason != reason.Error() || event.Err != nil {
+			t.Errorf("failover event = %+v, want primary to backup for %q", event, reason)
+		}
+		if event.Duration <= 0 || event.Duration > window {
+			t.Errorf("failover event duration = %s, want within the %s measured", event.Duration, window)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no failover event")
+	}
+
+	// A probe, the settle delay and one handshake, polled every 500ms
+	if window > 3*time.Second {
+		t.Errorf("failover took %s, want it under 3s", window)
+	}
+	t.Logf("failover window: %s", window)
+
+	if active := client.ActiveServer().Name; active != "backup" {
+		t.Errorf("active server = %s, want backup", active)
+	}
+	peers, err := client.backend.Peers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Endpoint.Port != cfg.Servers[1].Port || peers[0].LastHandshake.IsZero() {
+		t.Errorf("device peers = %+v, want only the backup with a handshake", peers)
+	}
+}
+
+func TestFailoverRestoresOriginal(t *testing.T) {
+	cfg := testConfig(t, "primary", "backup")
+	cfg.Reconnect.Failover = true
+	cfg.Selection.Timeout = 100 * time.Millisecond
+	backend := NewFakeBackend()
+	client := newTestClient(t, cfg, backend)
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	original := client.deviceConfig
+
+	events, unsubscribe := client.SubscribeFailover()
+	defer unsubscribe()
+
+	// The fake never reports a handshake, so the backup cannot take over
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := client.failover(ctx, errors.New("dead")); err == nil {
+		t.Fatal("failover succeeded without a handshake")
+	}
+
+	if client.deviceConfig != original {
+		t.Error("device config not restored")
+	}
+	if devCfg := backend.Config(); devCfg != original {
+		t.Errorf("backend left with peers %+v, want the original", devCfg.Peers)
+	}
+	if active := client.ActiveServer().Name; active != "primary" {
+		t.Errorf("active server = %s, want primary", active)
+	}
+
+	select {
+	case event := <-events:
+		if event.From != "primary" || event.To != "" || event.Err == nil {
+			t.Errorf("failover event = %+v, want a failure from primary", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no failover event")
+	}
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"sync"
+)
+
+// FakeBackend is an in-memory Backend that records every call made to it,
+// so VPNClient can be exercised without root or a real tunnel.
+type FakeBackend struct {
+	mu        sync.Mutex
+	calls     []string
+	config    *DeviceConfig
+	up        bool
+	peers     []PeerStatus
+	upErr     error
+	downErr   error
+	healthErr error
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{}
+}
+
+func (f *FakeBackend) Up(cfg *DeviceConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Up")
+	if f.upErr != nil {
+		return f.upErr
+	}
+	f.config = cfg
+	f.up = true
+	return nil
+}
+
+func (f *FakeBackend) Update(cfg *DeviceConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Update")
+	if !f.up {
+		return &DeviceError{Op: "update", Interface: "fake", Kind: ErrInterfaceMissing, Err: ErrInterfaceMissing}
+	}
+	f.config = cfg
+	return nil
+}
+
+func (f *FakeBackend) Down() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Down")
+	if f.downErr != nil {
+		return f.downErr
+	}
+	f.up = false
+	return nil
+}
+
+func (f *FakeBackend) Stats() (TransferStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Stats")
+	return sumPeerStats(f.peers), nil
+}
+
+func (f *FakeBackend) Peers() ([]PeerStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Peers")
+	return append([]PeerStatus(nil), f.peers...), nil
+}
+
+func (f *FakeBackend) Health() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, "Health")
+	if f.healthErr != nil {
+		return f.healthErr
+	}
+	if !f.up {
+		return &DeviceError{Op: "health", Interface: "fake", Kind: ErrInterfaceMissing, Err: ErrInterfaceMissing}
+	}
+	return nil
+}
+
+// Calls returns the names of all methods called so far, in order.
+func (f *FakeBackend) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Config returns the configuration passed to the last successful Up or
+// Update.
+func (f *FakeBackend) Config() *DeviceConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.config
+}
+
+func (f *FakeBackend) IsUp() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.up
+}
+
+func (f *FakeBackend) SetPeers(peers []PeerStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.peers = peers
+}
+
+func (f *FakeBackend) FailUp(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.upErr = err
+}
+
+func (f *FakeBackend) FailDown(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.downErr = err
+}
+
+func (f *FakeBackend) FailHealth(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.healthErr = err
+}
@@ -0,0 +1,180 @@
+package network
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+
+	"kryptx/internal/config"
+	"kryptx/internal/keys"
+)
+
+// Constants from the WireGuard whitepaper, section 5.4.
+const (
+	noiseConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier      = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMac1       = "mac1----"
+
+	handshakeInitiationType = 1
+	handshakeInitiationSize = 148
+)
+
+// HandshakeProber times a WireGuard handshake initiation against the
+// server's reply. It is the only probe a plain WireGuard server answers,
+// but the server also treats it as a new session for our key, so it must
+// not be pointed at the server a live tunnel is using.
+type HandshakeProber struct {
+	private keys.Key
+	public  keys.Key
+}
+
+func newHandshakeProber(privateKey string) (*HandshakeProber, error) {
+	private, err := keys.ParsePrivate(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+	return &HandshakeProber{private: private, public: private.PublicKey()}, nil
+}
+
+func (p *HandshakeProber) Probe(ctx context.Context, server config.ServerConfig) (time.Duration, error) {
+	peer, err := keys.ParsePublic(server.PublicKey)
+	if err != nil {
+		return 0, fmt.Errorf("server public key: %w", err)
+	}
+
+	addr, err := resolveServer(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+
+	msg, err := p.initiation(peer, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	// Either a handshake response or, under load, a cookie reply
+	return roundTrip(ctx, addr, msg)
+}
+
+// initiation builds a handshake initiation message as described in the
+// whitepaper. The response is only timed, never processed, so nothing of
+// the handshake state is kept.
+func (p *HandshakeProber) initiation(peer keys.Key, now time.Time) ([]byte, error) {
+	var ephemeral keys.Key
+	if _, err := rand.Read(ephemeral[:]); err != nil {
+		return nil, err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, handshakeInitiationSize)
+	binary.LittleEndian.PutUint32(msg[0:4], handshakeInitiationType)
+	if _, err := rand.Read(msg[4:8]); err != nil {
+		return nil, err
+	}
+
+	chainKey := blake2sHash([]byte(noiseConstruction))
+	h := blake2sHash(chainKey[:], []byte(wgIdentifier))
+	h = blake2sHash(h[:], peer[:])
+
+	copy(msg[8:40], ephemeralPublic)
+	chainKey, _ = kdf2(chainKey[:], ephemeralPublic)
+	h = blake2sHash(h[:], ephemeralPublic)
+
+	shared, err := curve25519.X25519(ephemeral[:], peer[:])
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	chainKey, key = kdf2(chainKey[:], shared)
+	static, err := seal(key, p.public[:], h[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(msg[40:88], static)
+	h = blake2sHash(h[:], static)
+
+	shared, err = curve25519.X25519(p.private[:], peer[:])
+	if err != nil {
+		return nil, err
+	}
+	_, key = kdf2(chainKey[:], shared)
+	timestamp, err := seal(key, tai64n(now), h[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(msg[88:116], timestamp)
+
+	macKey := blake2sHash([]byte(wgLabelMac1), peer[:])
+	mac, err := blake2s.New128(macKey[:])
+	if err != nil {
+		return nil, err
+	}
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	// mac2 stays zero; it is only needed once the server sent a cookie
+
+	return msg, nil
+}
+
+func blake2sHash(parts ...[]byte) [32]byte {
+	h, _ := blake2s.New256(nil)
+	for _, part := range parts {
+		h.Write(part)
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func newBlake2s() hash.Hash {
+	h, _ := blake2s.New256(nil)
+	return h
+}
+
+func hmacBlake2s(key, data []byte) []byte {
+	mac := hmac.New(newBlake2s, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// kdf2 is HKDF with HMAC-BLAKE2s, returning the first two outputs.
+func kdf2(chainKey, input []byte) ([32]byte, [32]byte) {
+	var t1, t2 [32]byte
+	prk := hmacBlake2s(chainKey, input)
+	copy(t1[:], hmacBlake2s(prk, []byte{1}))
+	copy(t2[:], hmacBlake2s(prk, append(t1[:], 2)))
+	return t1, t2
+}
+
+func seal(key [32]byte, plaintext, additional []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, additional), nil
+}
+
+// tai64n encodes the timestamp the way wireguard-go does, including
+// rounding the nanoseconds down so they leak less about the clock.
+func tai64n(t time.Time) []byte {
+	const (
+		base         = uint64(0x400000000000000a)
+		whitenerMask = uint32(0x1000000 - 1)
+	)
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[:8], base+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(t.Nanosecond())&^whitenerMask)
+	return buf
+}
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"kryptx/internal/utils"
+)
+
+const ipv6ConfDir = "/proc/sys/net/ipv6/conf"
+
+// ipv6Switch turns IPv6 off on every interface while connected, and back
+// to how each of them had it afterwards.
+type ipv6Switch struct {
+	logger *utils.Logger
+	// saved maps interfaces, "all" and "default" to their disable_ipv6
+	saved map[string]string
+}
+
+func newIPv6Switch(logger *utils.Logger) (*ipv6Switch, error) {
+	return &ipv6Switch{logger: logger}, nil
+}
+
+func (s *ipv6Switch) Disable() error {
+	paths, err := filepath.Glob(filepath.Join(ipv6ConfDir, "*", "disable_ipv6"))
+	if err != nil || len(paths) == 0 {
+		// IPv6 is not even compiled in
+		return nil
+	}
+
+	saved := map[string]string{}
+	for _, path := range paths {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		saved[filepath.Base(filepath.Dir(path))] = strings.TrimSpace(string(value))
+	}
+	s.saved = saved
+
+	// "default" covers the tunnel interface, which comes up after this;
+	// "all" takes every existing interface along with it
+	for _, iface := range []string{"default", "all"} {
+		if err := os.WriteFile(ipv6SysctlPath(iface), []byte("1"), 0644); err != nil {
+			s.Restore()
+			return fmt.Errorf("disabling IPv6: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *ipv6Switch) Restore() error {
+	var firstErr error
+	for _, iface := range s.restoreOrder() {
+		err := os.WriteFile(ipv6SysctlPath(iface), []byte(s.saved[iface]), 0644)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("restoring IPv6 on %s: %w", iface, err)
+		}
+	}
+	s.saved = nil
+	return firstErr
+}
+
+// cleanupCommands puts the saved settings back, for the journal.
+func (s *ipv6Switch) cleanupCommands() [][]string {
+	var commands [][]string
+	for _, iface := range s.restoreOrder() {
+		// sysctl takes dots in interface names as slashes
+		key := "net.ipv6.conf." + strings.ReplaceAll(iface, ".", "/") + ".disable_ipv6"
+		commands = append(commands, []string{"sudo", "sysctl", "-w", key + "=" + s.saved[iface]})
+	}
+	return commands
+}
+
+// restoreOrder puts "all" first, since setting it overwrites every
+// interface, and "default" before the interfaces.
+func (s *ipv6Switch) restoreOrder() []string {
+	var ifaces []string
+	for iface := range s.saved {
+		if iface != "all" && iface != "default" {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	sort.Strings(ifaces)
+
+	var order []string
+	for _, iface := range []string{"all", "default"} {
+		if _, ok := s.saved[iface]; ok {
+			order = append(order, iface)
+		}
+	}
+	return append(order, ifaces...)
+}
+
+func ipv6SysctlPath(iface string) string {
+	return filepath.Join(ipv6ConfDir, iface, "disable_ipv6")
+}
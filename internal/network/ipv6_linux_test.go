@@ -0,0 +1,123 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"kryptx/internal/utils"
+)
+
+// sendOnLink sends a datagram to addr out of the physical link, the way a
+// leak would, and returns what the kernel made of it: a firewall drop in
+// the output path shows as EPERM.
+func sendOnLink(network, addr string) error {
+	dialer := net.Dialer{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if controlErr := c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, physicalLink)
+			}); controlErr != nil {
+				return controlErr
+			}
+			return err
+		},
+	}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("kryptx-leak"))
+	return err
+}
+
+// needKillSwitch skips the test without the tools the kill switch needs.
+func needKillSwitch(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("sudo"); err != nil {
+		t.Skip("needs sudo")
+	}
+	if _, err := exec.LookPath("nft"); err != nil {
+		if _, err := exec.LookPath("iptables"); err != nil {
+			t.Skip("needs nft or iptables")
+		}
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("needs /dev/net/tun")
+	}
+}
+
+func TestKillSwitchBlocksIPv6OnPhysicalLink(t *testing.T) {
+	needKillSwitch(t)
+	if !inNetns(t) {
+		return
+	}
+
+	// A dual-stack link with default routes through gateways that never
+	// answer; what leaves still gets past the firewall on its way there
+	runIP(t, "link", "set", "lo", "up")
+	runIP(t, "link", "add", physicalLink, "type", "veth", "peer", "name", "kxpeer0")
+	runIP(t, "link", "set", "kxpeer0", "up")
+	runIP(t, "link", "set", physicalLink, "up")
+	runIP(t, "addr", "add", "192.0.2.2/24", "dev", physicalLink)
+	runIP(t, "-6", "addr", "add", "2001:db8::2/64", "dev", physicalLink, "nodad")
+	runIP(t, "route", "add", "default", "via", "192.0.2.1")
+	runIP(t, "-6", "route", "add", "default", "via", "2001:db8::1")
+
+	const (
+		ipv6Target = "[2001:db8:1::1]:53"
+		ipv4Target = "198.51.100.1:53"
+	)
+	if err := sendOnLink("udp6", ipv6Target); err != nil {
+		t.Fatalf("IPv6 does not get out before connecting, so a leak would go unseen: %v", err)
+	}
+
+	cfg := testConfig(t, "primary")
+	cfg.Servers[0].Endpoint = "2001:db8::1"
+	cfg.Network.Backend = BackendUserspace
+	cfg.Network.Address = "10.8.0.2/32, fd00:8::2/128"
+	cfg.Network.AllowedIPs = []string{"0.0.0.0/0", "::/0"}
+	cfg.Security.KillSwitch = true
+
+	logger := utils.NewLogger(testing.Verbose())
+	backend, err := NewBackend(BackendUserspace, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, cfg, backend)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	for _, tt := range []struct {
+		network, addr string
+	}{
+		{"udp6", ipv6Target},
+		{"udp4", ipv4Target},
+	} {
+		if err := sendOnLink(tt.network, tt.addr); !errors.Is(err, syscall.EPERM) {
+			t.Errorf("%s to %s on %s while connected: %v, want it dropped", tt.network, tt.addr, physicalLink, err)
+		}
+	}
+
+	// The tunnel's own packets to the server still get out
+	endpoint := net.JoinHostPort(cfg.Servers[0].Endpoint, strconv.Itoa(cfg.Servers[0].Port))
+	if err := sendOnLink("udp6", endpoint); err != nil {
+		t.Errorf("WireGuard endpoint %s blocked: %v", endpoint, err)
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	if err := sendOnLink("udp6", ipv6Target); err != nil {
+		t.Errorf("IPv6 still blocked after Disconnect: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+
+	"kryptx/internal/utils"
+)
+
+// ipv6Switch is Linux only for now.
+type ipv6Switch struct{}
+
+func newIPv6Switch(logger *utils.Logger) (*ipv6Switch, error) {
+	return nil, fmt.Errorf("disabling IPv6: %w", ErrUnsupported)
+}
+
+func (s *ipv6Switch) Disable() error {
+	return ErrUnsupported
+}
+
+func (s *ipv6Switch) Restore() error {
+	return nil
+}
+
+func (s *ipv6Switch) cleanupCommands() [][]string {
+	return nil
+}
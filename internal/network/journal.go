@@ -0,0 +1,200 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kryptx/internal/utils"
+)
+
+const (
+	JournalKillSwitch = "killswitch"
+	JournalDNS        = "dns"
+	JournalTunnel     = "tunnel"
+	JournalAppSplit   = "appsplit"
+	JournalIPv6       = "ipv6"
+)
+
+// JournalEntry records one change made to the host, with enough detail to
+// undo it from a fresh process.
+type JournalEntry struct {
+	Kind         string     `json:"kind"`
+	Time         time.Time  `json:"time"`
+	Interface    string     `json:"interface,omitempty"`
+	FirewallMark int        `json:"firewall_mark,omitempty"`
+	Hosts        []string   `json:"hosts,omitempty"`
+	Commands     [][]string `json:"commands,omitempty"`
+	DNS          []string   `json:"dns,omitempty"`
+}
+
+// Journal is the on-disk list of changes currently applied to the host.
+// Entries are written before the change is made and removed once it has
+// been undone, so whatever is left after a crash is what needs undoing.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	entries []JournalEntry
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &j.entries); err != nil {
+			return nil, fmt.Errorf("parsing journal %s: %w", path, err)
+		}
+	}
+	return j, nil
+}
+
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+// Record adds entry, replacing any earlier entry of the same kind.
+func (j *Journal) Record(entry JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry.Time = time.Now()
+	for i := range j.entries {
+		if j.entries[i].Kind == entry.Kind {
+			j.entries[i] = entry
+			return j.save()
+		}
+	}
+	j.entries = append(j.entries, entry)
+	return j.save()
+}
+
+func (j *Journal) Forget(kind string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	kept := j.entries[:0]
+	for _, entry := range j.entries {
+		if entry.Kind != kind {
+			kept = append(kept, entry)
+		}
+	}
+	j.entries = kept
+	return j.save()
+}
+
+// save replaces the file atomically so a crash mid-write never leaves a
+// truncated journal behind.
+func (j *Journal) save() error {
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return fmt.Errorf("creating journal directory: %w", err)
+	}
+
+	if len(j.entries) == 0 {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing journal: %w", err)
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(j.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding journal: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".journal-*")
+	if err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	return nil
+}
+
+// Recover undoes everything left in the journal, newest change first, and
+// empties it. It carries on past individual failures and reports the
+// first one.
+func Recover(j *Journal, logger *utils.Logger) error {
+	entries := j.Entries()
+	var firstErr error
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		logger.Info("Recovering %s left from %s...", entry.Kind, entry.Time.Format(time.RFC3339))
+
+		var err error
+		switch entry.Kind {
+		case JournalKillSwitch:
+			// Locked down, the boot rules replace the session's instead
+			var lockdown bool
+			if lockdown, err = LockdownEnabled(); lockdown {
+				err = errors.Join(err, loadLockdown())
+			} else {
+				runCleanupCommands(entry.Commands, logger)
+			}
+		case JournalAppSplit, JournalIPv6:
+			runCleanupCommands(entry.Commands, logger)
+		case JournalDNS:
+			err = recoverDNS(entry, logger)
+		case JournalTunnel:
+			err = recoverTunnel(entry, logger)
+		default:
+			err = fmt.Errorf("unknown journal entry %q", entry.Kind)
+		}
+
+		if err != nil {
+			logger.Error("Recovering %s failed: %v", entry.Kind, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("recovering %s: %w", entry.Kind, err)
+			}
+			continue
+		}
+
+		if err := j.Forget(entry.Kind); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// runCleanupCommands runs every command, ignoring failures the same way
+// the kill switch does on deactivation: a rule may simply be gone already.
+func runCleanupCommands(commands [][]string, logger *utils.Logger) {
+	for _, command := range commands {
+		if len(command) == 0 {
+			continue
+		}
+		if err := execCommand(command[0], command[1:]...).Run(); err != nil {
+			logger.Debug("Cleanup %v: %v", command, err)
+		}
+	}
+}
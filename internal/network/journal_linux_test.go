@@ -0,0 +1,151 @@
+package network
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"kryptx/internal/utils"
+)
+
+func TestRecover(t *testing.T) {
+	if lockdown, _ := LockdownEnabled(); lockdown {
+		t.Skip("lockdown enabled on this host, recovering would load it")
+	}
+
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// In the order a session makes them
+	for _, entry := range []JournalEntry{
+		{Kind: JournalTunnel, Interface: "kxgone0"},
+		{Kind: JournalIPv6, Commands: [][]string{{"sudo", "sysctl", "-w", "net.ipv6.conf.all.disable_ipv6=0"}}},
+		{Kind: JournalKillSwitch, Commands: (nftFirewall{}).cleanupCommands()},
+		{Kind: JournalAppSplit, Commands: [][]string{
+			{"sudo", "iptables", "-t", "mangle", "-D", "OUTPUT", "-j", "KRYPTX_APPS"},
+			{"sudo", "iptables", "-t", "mangle", "-X", "KRYPTX_APPS"},
+		}},
+		{Kind: JournalDNS, Commands: [][]string{{"sudo", "mv", "/etc/resolv.conf.kryptx.backup", "/etc/resolv.conf"}}},
+	} {
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The chain being gone already holds up nothing
+	fake := useFakeCommands(t, func(call []string) *exec.Cmd {
+		if slices.Contains(call, "-X") {
+			return shellCommand(`echo "iptables: No chain/target/match by that name." >&2; exit 1`)
+		}
+		return nil
+	})
+
+	reopened, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Recover(reopened, utils.NewLogger(testing.Verbose())); err != nil {
+		t.Fatalf("Recover: %v", err)
+	}
+
+	want := [][]string{
+		{"sudo", "mv", "/etc/resolv.conf.kryptx.backup", "/etc/resolv.conf"},
+		{"sudo", "iptables", "-t", "mangle", "-D", "OUTPUT", "-j", "KRYPTX_APPS"},
+		{"sudo", "iptables", "-t", "mangle", "-X", "KRYPTX_APPS"},
+		{"sudo", "nft", "delete", "table", "inet", "kryptx"},
+		{"sudo", "sysctl", "-w", "net.ipv6.conf.all.disable_ipv6=0"},
+	}
+	if !reflect.DeepEqual(fake.calls, want) {
+		t.Errorf("commands run:\n%q\nwant, newest change first:\n%q", fake.calls, want)
+	}
+
+	if entries := reopened.Entries(); len(entries) != 0 {
+		t.Errorf("entries after Recover = %+v, want none", entries)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("journal file still there after Recover: %v", err)
+	}
+}
+
+func TestRecoverKeepsFailedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []JournalEntry{
+		{Kind: "from_a_newer_version"},
+		{Kind: JournalIPv6, Commands: [][]string{{"sudo", "sysctl", "-w", "net.ipv6.conf.all.disable_ipv6=0"}}},
+	} {
+		if err := journal.Record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := useFakeCommands(t, nil)
+
+	err = Recover(journal, utils.NewLogger(testing.Verbose()))
+	if err == nil || !strings.Contains(err.Error(), "from_a_newer_version") {
+		t.Errorf("Recover = %v, want the unknown entry reported", err)
+	}
+	if len(fake.calls) != 1 {
+		t.Errorf("commands run: %q, want the ipv6 cleanup", fake.calls)
+	}
+
+	// Only what could not be undone is left, for another try
+	if kinds := journalKinds(t, path); !slices.Equal(kinds, []string{"from_a_newer_version"}) {
+		t.Errorf("journal after Recover = %v, want the failed entry alone", kinds)
+	}
+}
+
+func TestOpenJournalCorrupt(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+	}{
+		{"truncated", `[{"kind": "killswitch", "commands": [["sudo", "nft"`},
+		{"not a list", `{"kind": "killswitch"}`},
+		{"garbage", "\x00\x01\x02"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "journal.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := OpenJournal(path); err == nil || !strings.Contains(err.Error(), path) {
+				t.Errorf("OpenJournal = %v, want an error naming %s", err, path)
+			}
+			// Left for the user to look at, rather than taken as empty
+			if data, err := os.ReadFile(path); err != nil || string(data) != tt.content {
+				t.Errorf("journal changed by opening it: %q, %v", data, err)
+			}
+
+			cfg := testConfig(t)
+			cfg.Network.JournalPath = path
+			if _, err := NewVPNClientWithBackend(cfg, NewFakeBackend(), utils.NewLogger(testing.Verbose())); err == nil {
+				t.Error("client created over a corrupt journal")
+			}
+		})
+	}
+}
+
+func TestOpenJournalEmptyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := journal.Entries(); len(entries) != 0 {
+		t.Errorf("entries = %+v, want none", entries)
+	}
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+
+	"kryptx/internal/utils"
+)
+
+func init() {
+	RegisterBackend(BackendKernel, func(logger *utils.Logger) (Backend, error) {
+		return newKernelBackend(logger), nil
+	})
+}
+
+// kernelBackend drives the in-kernel WireGuard implementation directly
+// over netlink and the WireGuard generic netlink API; no wg-quick or sudo
+// involved.
+type kernelBackend struct {
+	mu     sync.Mutex
+	logger *utils.Logger
+	cfg    *DeviceConfig
+	link   *linkSetup
+}
+
+func newKernelBackend(logger *utils.Logger) *kernelBackend {
+	return &kernelBackend{
+		logger: logger,
+	}
+}
+
+func (k *kernelBackend) Up(cfg *DeviceConfig) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.cfg = cfg
+	k.link = newLinkSetup(cfg.Name, cfg, k.logger)
+
+	if cfg.fullTunnel() && cfg.FirewallMark == 0 {
+		cfg.FirewallMark = defaultRouteTable
+	}
+
+	link, err := k.createLink()
+	if err != nil {
+		return err
+	}
+
+	if err := k.configure(); err != nil {
+		k.link.Remove()
+		if delErr := netlink.LinkDel(link); delErr != nil {
+			k.logger.Error("Failed to remove interface %s: %v", cfg.Name, delErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (k *kernelBackend) Update(cfg *DeviceConfig) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cfg == nil {
+		return &DeviceError{Op: "update", Interface: cfg.Name, Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+
+	if cfg.fullTunnel() && cfg.FirewallMark == 0 {
+		cfg.FirewallMark = defaultRouteTable
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return k.error("update", err)
+	}
+	defer client.Close()
+
+	// The old server goes in the same call that adds the new one
+	if err := client.ConfigureDevice(cfg.Name, cfg.wgConfig(k.cfg)); err != nil {
+		return k.error("update", err)
+	}
+
+	k.cfg = cfg
+	return k.link.Update(cfg)
+}
+
+func (k *kernelBackend) Down() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cfg == nil {
+		return nil
+	}
+
+	k.link.Remove()
+
+	link, err := netlink.LinkByName(k.cfg.Name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return k.error("lookup", err)
+	}
+
+	if link.Type() != "wireguard" {
+		// Not ours; Up refused to take it over either
+		return nil
+	}
+
+	if err := netlink.LinkDel(link); err != nil {
+		return k.error("delete", err)
+	}
+	return nil
+}
+
+func (k *kernelBackend) Stats() (TransferStats, error) {
+	peers, err := k.Peers()
+	if err != nil {
+		return TransferStats{}, err
+	}
+	return sumPeerStats(peers), nil
+}
+
+func (k *kernelBackend) Peers() ([]PeerStatus, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cfg == nil {
+		return nil, &DeviceError{Op: "read", Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, k.error("read", err)
+	}
+	defer client.Close()
+
+	device, err := client.Device(k.cfg.Name)
+	if err != nil {
+		return nil, k.error("read", err)
+	}
+
+	peers := make([]PeerStatus, 0, len(device.Peers))
+	for _, peer := range device.Peers {
+		peers = append(peers, PeerStatus{
+			PublicKey:           peer.PublicKey,
+			Endpoint:            peer.Endpoint,
+			AllowedIPs:          peer.AllowedIPs,
+			LastHandshake:       peer.LastHandshakeTime,
+			RxBytes:             peer.ReceiveBytes,
+			TxBytes:             peer.TransmitBytes,
+			PersistentKeepalive: peer.PersistentKeepaliveInterval,
+		})
+	}
+	return peers, nil
+}
+
+func (k *kernelBackend) Health() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cfg == nil {
+		return &DeviceError{Op: "health", Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+	return interfaceHealth(k.cfg.Name)
+}
+
+func (k *kernelBackend) createLink() (netlink.Link, error) {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = k.cfg.Name
+	attrs.MTU = k.cfg.MTU
+
+	err := netlink.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs})
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return nil, k.error("create", err)
+	}
+
+	link, lookupErr := netlink.LinkByName(k.cfg.Name)
+	if lookupErr != nil {
+		return nil, k.error("lookup", lookupErr)
+	}
+
+	if err != nil {
+		// A leftover interface from a previous run is fine to take over,
+		// anything else with our name is not ours to touch.
+		if link.Type() != "wireguard" {
+			return nil, &DeviceError{Op: "create", Interface: k.cfg.Name, Kind: ErrInterfaceExists,
+				Err: fmt.Errorf("existing link has type %s", link.Type())}
+		}
+		k.logger.Warning("Reusing existing WireGuard interface %s", k.cfg.Name)
+	}
+
+	return link, nil
+}
+
+func (k *kernelBackend) configure() error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return k.error("configure", err)
+	}
+	defer client.Close()
+
+	if err := client.ConfigureDevice(k.cfg.Name, k.cfg.wgConfig(nil)); err != nil {
+		return k.error("configure", err)
+	}
+
+	return k.link.Apply()
+}
+
+func (k *kernelBackend) error(op string, err error) error {
+	return &DeviceError{Op: op, Interface: k.cfg.Name, Kind: classifyDeviceError(err), Err: err}
+}
+
+func classifyDeviceError(err error) error {
+	var notFound netlink.LinkNotFoundError
+	switch {
+	case errors.Is(err, unix.EPERM), errors.Is(err, unix.EACCES):
+		return ErrPermissionDenied
+	case errors.Is(err, unix.EEXIST):
+		return ErrInterfaceExists
+	case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, os.ErrNotExist):
+		// The kernel rejects an unknown link kind with EOPNOTSUPP and
+		// wgctrl reports a missing generic netlink family as ErrNotExist.
+		return ErrModuleMissing
+	case errors.As(err, &notFound), errors.Is(err, unix.ENODEV):
+		return ErrInterfaceMissing
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+	"runtime"
+
+	"kryptx/internal/utils"
+)
+
+func init() {
+	RegisterBackend(BackendKernel, func(logger *utils.Logger) (Backend, error) {
+		return nil, &DeviceError{Op: "create", Kind: ErrUnsupported,
+			Err: fmt.Errorf("no kernel WireGuard on %s, use the userspace backend", runtime.GOOS)}
+	})
+}
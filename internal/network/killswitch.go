@@ -1,27 +1,123 @@
 package network
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"net"
 	"os/exec"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 
 	"kryptx/internal/utils"
 )
 
+var windowsCleanupRules = []string{
+	`netsh advfirewall firewall delete rule name="KryptX_Block_All"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_Loopback"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_VPN"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_Endpoint"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_DHCP"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_NDP"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_LAN"`,
+	`netsh advfirewall firewall delete rule name="KryptX_Allow_Split"`,
+}
+
+// dhcpPorts are the client and server ports of DHCP and DHCPv6, which
+// have to get out for the physical link to keep its address.
+var dhcpPorts = [][2]int{{68, 67}, {546, 547}}
+
+// neighborDiscovery lists the ICMPv6 types IPv6 needs to find the router
+// and the hosts on the link, by their nft names. Without them an IPv6
+// endpoint or LAN is out of reach.
+var neighborDiscovery = []struct {
+	name     string
+	icmpType int
+}{
+	{"nd-router-solicit", 133},
+	{"nd-neighbor-solicit", 135},
+	{"nd-neighbor-advert", 136},
+}
+
+// defaultLANNetworks are let through with allow_lan unless lan_networks
+// names others: the private ranges and the link-local ones.
+var defaultLANNetworks = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// KillSwitch is safe for concurrent use: the reconnect monitor reloads it
+// while Connect and Disconnect bring it up and down.
 type KillSwitch struct {
-	logger      *utils.Logger
-	active      bool
-	backupRules []string
+	mu       sync.Mutex
+	logger   *utils.Logger
+	iface    string
+	active   bool
+	firewall linuxFirewall
+	// endpoints are the peers the tunnel itself talks to, lan the local
+	// networks let through with allow_lan
+	endpoints []*net.UDPAddr
+	lan       []net.IPNet
+	// exemptions are let out around the tunnel, for split tunneling, and
+	// so is traffic with markExemption (or without it, when inverted)
+	exemptions    []net.IPNet
+	markExemption *markExemption
 }
 
-func NewKillSwitch(logger *utils.Logger) *KillSwitch {
-	return &KillSwitch{
+type markExemption struct {
+	mark   int
+	invert bool
+}
+
+// linuxFirewall loads the kill switch rules into one of the Linux packet
+// filters. apply replaces whatever it loaded before in one step, and
+// remove only touches what apply created.
+type linuxFirewall interface {
+	apply(rules killSwitchRuleset) error
+	remove() error
+	verify(rules killSwitchRuleset) error
+	cleanupCommands() [][]string
+}
+
+// killSwitchRuleset is what the kill switch lets out: loopback, the
+// tunnel interface, the WireGuard endpoints, DHCP, neighbor discovery,
+// the LAN and the split tunnel exemptions. Everything else is dropped.
+type killSwitchRuleset struct {
+	iface         string
+	endpoints     []*net.UDPAddr
+	lan           []net.IPNet
+	exemptions    []net.IPNet
+	markExemption *markExemption
+}
+
+// NewKillSwitch blocks everything but the given tunnel interface. On Linux
+// it uses nftables where available and falls back to iptables.
+func NewKillSwitch(iface string, logger *utils.Logger) *KillSwitch {
+	k := &KillSwitch{
 		logger: logger,
+		iface:  iface,
 	}
+
+	if runtime.GOOS == "linux" {
+		if _, err := exec.LookPath("nft"); err == nil {
+			k.firewall = nftFirewall{}
+		} else {
+			k.firewall = iptablesFirewall{}
+		}
+	}
+	return k
 }
 
 func (k *KillSwitch) Activate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	if k.active {
 		return nil
 	}
@@ -41,6 +137,9 @@ func (k *KillSwitch) Activate() error {
 }
 
 func (k *KillSwitch) Deactivate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
 	if !k.active {
 		return nil
 	}
@@ -59,69 +158,87 @@ func (k *KillSwitch) Deactivate() error {
 	}
 }
 
+// The activations take away whatever they loaded when they fail, for the
+// kill switch to be either in force or gone.
 func (k *KillSwitch) activateLinux() error {
-	// Block all outbound traffic except VPN
-	rules := []string{
-		"iptables -I OUTPUT -o lo -j ACCEPT",
-		"iptables -I OUTPUT -o kryptx+ -j ACCEPT",
-		"iptables -I OUTPUT -j DROP",
-		"ip6tables -I OUTPUT -o lo -j ACCEPT",
-		"ip6tables -I OUTPUT -o kryptx+ -j ACCEPT",
-		"ip6tables -I OUTPUT -j DROP",
+	if err := k.firewall.apply(k.ruleset()); err != nil {
+		// iptables may have loaded the IPv4 rules and not the IPv6 ones
+		k.deactivateLinux()
+		return err
 	}
+	k.active = true
 
-	for _, rule := range rules {
-		cmd := exec.Command("sudo", strings.Fields(rule)...)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to apply rule %s: %w", rule, err)
-		}
+	// Make sure the rules are in force as written
+	if err := k.firewall.verify(k.ruleset()); err != nil {
+		k.deactivateLinux()
+		return fmt.Errorf("kill switch did not load as expected: %w", err)
 	}
-
-	k.active = true
 	return nil
 }
 
+// deactivateLinux removes the rules, or under lockdown puts the boot
+// rules back in their place.
 func (k *KillSwitch) deactivateLinux() error {
-	// Remove kill switch rules
-	rules := []string{
-		"iptables -D OUTPUT -j DROP",
-		"iptables -D OUTPUT -o kryptx+ -j ACCEPT",
-		"iptables -D OUTPUT -o lo -j ACCEPT",
-		"ip6tables -D OUTPUT -j DROP",
-		"ip6tables -D OUTPUT -o kryptx+ -j ACCEPT",
-		"ip6tables -D OUTPUT -o lo -j ACCEPT",
+	lockdown, err := LockdownEnabled()
+	if lockdown {
+		err = errors.Join(err, loadLockdown())
+	} else {
+		err = k.firewall.remove()
 	}
+	k.active = false
+	return err
+}
 
-	for _, rule := range rules {
-		cmd := exec.Command("sudo", strings.Fields(rule)...)
-		cmd.Run() // Ignore errors during cleanup
+// ruleset describes what the Linux firewall backends have to load.
+func (k *KillSwitch) ruleset() killSwitchRuleset {
+	return killSwitchRuleset{
+		iface:         k.iface,
+		endpoints:     k.endpoints,
+		lan:           k.lan,
+		exemptions:    k.exemptions,
+		markExemption: k.markExemption,
 	}
+}
 
-	k.active = false
+func (k *KillSwitch) activateMacOS() error {
+	if err := k.loadPF(); err != nil {
+		return err
+	}
+
+	// Enable pf
+	cmd := exec.Command("sudo", "pfctl", "-e")
+	if err := cmd.Run(); err != nil {
+		k.deactivateMacOS()
+		return fmt.Errorf("failed to enable pfctl: %w", err)
+	}
+
+	k.active = true
 	return nil
 }
 
-func (k *KillSwitch) activateMacOS() error {
-	// macOS implementation using pfctl
+// loadPF replaces the pf ruleset; the last matching rule wins in pf, so
+// the pass rules go after the block.
+func (k *KillSwitch) loadPF() error {
 	pfConfig := `
 block out all
 pass out on lo0 all
-pass out on kryptx0 all
+pass out on ` + k.iface + ` all
+pass out inet proto udp from port 68 to port 67
+pass out inet6 proto udp from port 546 to port 547
+pass out inet6 proto icmp6 icmp6-type { routersol, neighbrsol, neighbradv }
 `
+	for _, endpoint := range k.endpoints {
+		pfConfig += fmt.Sprintf("pass out proto udp to %s port %d\n", endpoint.IP, endpoint.Port)
+	}
+	for _, dst := range append(append([]net.IPNet{}, k.lan...), k.exemptions...) {
+		pfConfig += fmt.Sprintf("pass out to %s\n", dst.String())
+	}
 
 	cmd := exec.Command("sudo", "pfctl", "-f", "-")
 	cmd.Stdin = strings.NewReader(pfConfig)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to configure pfctl: %w", err)
 	}
-
-	// Enable pf
-	cmd = exec.Command("sudo", "pfctl", "-e")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to enable pfctl: %w", err)
-	}
-
-	k.active = true
 	return nil
 }
 
@@ -136,15 +253,14 @@ func (k *KillSwitch) deactivateMacOS() error {
 
 func (k *KillSwitch) activateWindows() error {
 	// Windows implementation using netsh
-	rules := []string{
+	rules := append([]string{
 		`netsh advfirewall firewall add rule name="KryptX_Block_All" dir=out action=block`,
-		`netsh advfirewall firewall add rule name="KryptX_Allow_Loopback" dir=out action=allow localip=127.0.0.1`,
-		`netsh advfirewall firewall add rule name="KryptX_Allow_VPN" dir=out action=allow interface="kryptx"`,
-	}
+	}, k.windowsAllowRules()...)
 
 	for _, rule := range rules {
 		cmd := exec.Command("cmd", "/C", rule)
 		if err := cmd.Run(); err != nil {
+			k.deactivateWindows()
 			return fmt.Errorf("failed to apply rule: %w", err)
 		}
 	}
@@ -153,15 +269,52 @@ func (k *KillSwitch) activateWindows() error {
 	return nil
 }
 
-func (k *KillSwitch) deactivateWindows() error {
-	// Remove Windows firewall rules
+func (k *KillSwitch) windowsAllowRules() []string {
 	rules := []string{
-		`netsh advfirewall firewall delete rule name="KryptX_Block_All"`,
-		`netsh advfirewall firewall delete rule name="KryptX_Allow_Loopback"`,
-		`netsh advfirewall firewall delete rule name="KryptX_Allow_VPN"`,
+		`netsh advfirewall firewall add rule name="KryptX_Allow_Loopback" dir=out action=allow localip=127.0.0.1`,
+		`netsh advfirewall firewall add rule name="KryptX_Allow_VPN" dir=out action=allow interface="` + k.iface + `"`,
+		`netsh advfirewall firewall add rule name="KryptX_Allow_DHCP" dir=out action=allow protocol=UDP localport=68 remoteport=67`,
+		`netsh advfirewall firewall add rule name="KryptX_Allow_DHCP" dir=out action=allow protocol=UDP localport=546 remoteport=547`,
 	}
+	for _, nd := range neighborDiscovery {
+		rules = append(rules, fmt.Sprintf(`netsh advfirewall firewall add rule name="KryptX_Allow_NDP" dir=out action=allow protocol=icmpv6:%d,any`, nd.icmpType))
+	}
+	for _, endpoint := range k.endpoints {
+		rules = append(rules, fmt.Sprintf(`netsh advfirewall firewall add rule name="KryptX_Allow_Endpoint" dir=out action=allow protocol=UDP remoteip=%s remoteport=%d`, endpoint.IP, endpoint.Port))
+	}
+	if len(k.lan) > 0 {
+		rules = append(rules, `netsh advfirewall firewall add rule name="KryptX_Allow_LAN" dir=out action=allow remoteip=`+joinNets(k.lan))
+	}
+	if len(k.exemptions) > 0 {
+		rules = append(rules, `netsh advfirewall firewall add rule name="KryptX_Allow_Split" dir=out action=allow remoteip=`+joinNets(k.exemptions))
+	}
+	return rules
+}
 
-	for _, rule := range rules {
+// reloadWindows replaces the allow rules; the block rule stays put.
+func (k *KillSwitch) reloadWindows() error {
+	for _, rule := range windowsCleanupRules[1:] {
+		exec.Command("cmd", "/C", rule).Run()
+	}
+	for _, rule := range k.windowsAllowRules() {
+		if err := exec.Command("cmd", "/C", rule).Run(); err != nil {
+			return fmt.Errorf("failed to apply rule: %w", err)
+		}
+	}
+	return nil
+}
+
+func joinNets(nets []net.IPNet) string {
+	addrs := make([]string, 0, len(nets))
+	for _, n := range nets {
+		addrs = append(addrs, n.String())
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (k *KillSwitch) deactivateWindows() error {
+	// Remove Windows firewall rules
+	for _, rule := range windowsCleanupRules {
 		cmd := exec.Command("cmd", "/C", rule)
 		cmd.Run() // Ignore errors during cleanup
 	}
@@ -171,5 +324,197 @@ func (k *KillSwitch) deactivateWindows() error {
 }
 
 func (k *KillSwitch) IsActive() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
 	return k.active
 }
+
+// SetEndpoints lets the tunnel's own packets out to the peer endpoints,
+// which otherwise never get to leave for the handshake. Like the other
+// setters it goes in with Activate, or replaces the current rule after.
+func (k *KillSwitch) SetEndpoints(endpoints []*net.UDPAddr) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous := k.endpoints
+	k.endpoints = endpoints
+	if err := k.reload(); err != nil {
+		k.endpoints = previous
+		return err
+	}
+	return nil
+}
+
+// SetLAN lets traffic to the local networks through.
+func (k *KillSwitch) SetLAN(lan []net.IPNet) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous := k.lan
+	k.lan = lan
+	if err := k.reload(); err != nil {
+		k.lan = previous
+		return err
+	}
+	return nil
+}
+
+// SetExemptions lets traffic to the given destinations leave outside the
+// tunnel, which split tunneling needs.
+func (k *KillSwitch) SetExemptions(exemptions []net.IPNet) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous := k.exemptions
+	k.exemptions = exemptions
+	if err := k.reload(); err != nil {
+		k.exemptions = previous
+		return err
+	}
+	return nil
+}
+
+// ExemptMark lets traffic carrying the firewall mark leave outside the
+// tunnel, or with invert all traffic that does not carry it, for per-app
+// split tunneling. It is Linux only.
+func (k *KillSwitch) ExemptMark(mark int, invert bool) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("exempting marked traffic: %w", ErrUnsupported)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous := k.markExemption
+	k.markExemption = &markExemption{mark: mark, invert: invert}
+	if err := k.reload(); err != nil {
+		k.markExemption = previous
+		return err
+	}
+	return nil
+}
+
+// Reapply loads the rules of an active kill switch again, in the place
+// and order they belong, over whatever became of them.
+func (k *KillSwitch) Reapply() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.reload()
+}
+
+// reload brings the rules of an active kill switch in line with a change.
+func (k *KillSwitch) reload() error {
+	if !k.active {
+		return nil
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		return k.firewall.apply(k.ruleset())
+	case "darwin":
+		return k.loadPF()
+	case "windows":
+		return k.reloadWindows()
+	default:
+		return fmt.Errorf("unsupported OS for kill switch: %s", runtime.GOOS)
+	}
+}
+
+// parseLANNetworks reads the lan_networks setting, falling back to
+// defaultLANNetworks.
+func parseLANNetworks(networks []string) ([]net.IPNet, error) {
+	if len(networks) == 0 {
+		networks = defaultLANNetworks
+	}
+
+	var lan []net.IPNet
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			return nil, fmt.Errorf("security.lan_networks: %w", err)
+		}
+		lan = append(lan, *ipNet)
+	}
+	return lan, nil
+}
+
+// Verify reads the rules back from the firewall and reports any
+// difference to what the kill switch loaded, as well as foreign rules that
+// let traffic past it. Only Linux supports it.
+func (k *KillSwitch) Verify() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if !k.active {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("verifying kill switch: %w", ErrUnsupported)
+	}
+	return k.firewall.verify(k.ruleset())
+}
+
+// InstallPersistent writes the rules to path in a form nft loads on its
+// own, for the kill switch to be in force from boot. Only nftables can.
+// Like the rules themselves the file goes in through sudo.
+func (k *KillSwitch) InstallPersistent(path string) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("persistent kill switch: %w", ErrUnsupported)
+	}
+	nft, ok := k.firewall.(nftFirewall)
+	if !ok {
+		return errors.New("persistent kill switch rules need nftables")
+	}
+
+	k.mu.Lock()
+	batch, err := nft.batch(k.ruleset())
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sudo", "install", "-D", "-m", "0600", "/dev/stdin", path)
+	cmd.Stdin = bytes.NewReader(batch)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("writing %s: %w: %s", path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// cleanupCommands returns the commands that remove the kill switch, for
+// the journal to replay should the process die with it engaged.
+func (k *KillSwitch) cleanupCommands() [][]string {
+	var commands [][]string
+
+	switch runtime.GOOS {
+	case "linux":
+		commands = k.firewall.cleanupCommands()
+	case "darwin":
+		commands = append(commands, []string{"sudo", "pfctl", "-d"})
+	case "windows":
+		for _, rule := range windowsCleanupRules {
+			commands = append(commands, []string{"cmd", "/C", rule})
+		}
+	}
+
+	return commands
+}
+
+var errKillSwitchDrift = errors.New("kill switch rules differ from what was loaded")
+
+// diffRules compares two ordered rule lists and describes the rules that
+// went missing, turned up or moved.
+func diffRules(expected, actual []any, format func(any) string) []string {
+	var problems []string
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			problems = append(problems, "missing "+format(expected[i]))
+		case i >= len(expected):
+			problems = append(problems, "unexpected "+format(actual[i]))
+		case !reflect.DeepEqual(expected[i], actual[i]):
+			problems = append(problems, fmt.Sprintf("rule %d is %s, want %s", i+1, format(actual[i]), format(expected[i])))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,207 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// iptablesChain holds the kill switch rules when nftables is not there.
+// OUTPUT only gets a jump to it, so teardown leaves other rules alone.
+const iptablesChain = "KRYPTX"
+
+// iptablesJump is the OUTPUT rule handing traffic to the chain, as
+// `iptables -S` lists it.
+const iptablesJump = "-A OUTPUT -j " + iptablesChain
+
+type iptablesFirewall struct{}
+
+// apply loads the chain with iptables-restore, which swaps the table in
+// one go; declaring a chain that exists flushes it first.
+func (iptablesFirewall) apply(rules killSwitchRuleset) error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		script := fmt.Sprintf("*filter\n:%s - [0:0]\n", iptablesChain)
+		for _, rule := range iptablesRules(iptables, rules) {
+			script += rule + "\n"
+		}
+		script += "COMMIT\n"
+
+		cmd := execCommand("sudo", iptables+"-restore", "--noflush")
+		cmd.Stdin = strings.NewReader(script)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to load %s rules: %w: %s", iptables, err, strings.TrimSpace(string(output)))
+		}
+
+		if err := hookFirst(iptables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hookFirst makes the jump to the chain the first rule in OUTPUT, where
+// nothing added later can accept traffic before it.
+func hookFirst(iptables string) error {
+	output, err := execCommand("sudo", iptables, "-S", "OUTPUT").Output()
+	if err == nil {
+		if rules := chainRules(output); len(rules) > 0 && rules[0] == iptablesJump {
+			return nil
+		}
+	}
+
+	for execCommand("sudo", iptables, "-D", "OUTPUT", "-j", iptablesChain).Run() == nil {
+	}
+	if output, err := execCommand("sudo", iptables, "-I", "OUTPUT", "1", "-j", iptablesChain).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to hook %s chain: %w: %s", iptables, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (f iptablesFirewall) remove() error {
+	for _, command := range f.cleanupCommands() {
+		execCommand(command[0], command[1:]...).Run() // the chain may be gone already
+	}
+	return nil
+}
+
+// verify compares `iptables -S` of the chain, which prints rules in the
+// same form iptablesRules writes them, and checks the jump from OUTPUT.
+// Rules ahead of the jump that accept or hand off traffic are reported as
+// a bypass, since whatever they let through never reaches the DROP.
+func (iptablesFirewall) verify(rules killSwitchRuleset) error {
+	var problems, bypasses []string
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		output, err := execCommand("sudo", iptables, "-S", "OUTPUT").Output()
+		if err != nil {
+			return fmt.Errorf("listing %s OUTPUT chain: %w", iptables, err)
+		}
+		hooked := false
+		for _, rule := range chainRules(output) {
+			if rule == iptablesJump {
+				hooked = true
+				break
+			}
+			switch ruleTarget(rule) {
+			case "", "DROP", "REJECT", "LOG":
+				// lets nothing through
+			default:
+				bypasses = append(bypasses, iptables+": "+rule)
+			}
+		}
+		if !hooked {
+			problems = append(problems, iptables+": OUTPUT does not jump to "+iptablesChain)
+		}
+
+		output, err = execCommand("sudo", iptables, "-S", iptablesChain).Output()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "No chain") {
+				problems = append(problems, iptables+": chain "+iptablesChain+" is gone")
+				continue
+			}
+			return fmt.Errorf("listing %s chain: %w", iptables, err)
+		}
+
+		var expected, actual []any
+		for _, rule := range iptablesRules(iptables, rules) {
+			expected = append(expected, rule)
+		}
+		for _, rule := range chainRules(output) {
+			actual = append(actual, rule)
+		}
+		for _, problem := range diffRules(expected, actual, func(rule any) string { return fmt.Sprint(rule) }) {
+			problems = append(problems, iptables+": "+problem)
+		}
+	}
+
+	var errs []error
+	if len(problems) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", errKillSwitchDrift, strings.Join(problems, "; ")))
+	}
+	if len(bypasses) > 0 {
+		errs = append(errs, fmt.Errorf("%w: %s", errKillSwitchBypass, strings.Join(bypasses, "; ")))
+	}
+	return errors.Join(errs...)
+}
+
+// chainRules picks the rules out of `iptables -S` output.
+func chainRules(output []byte) []string {
+	var rules []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+// ruleTarget is what a rule jumps to, "" for one that only counts.
+func ruleTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "-j" || fields[i] == "-g" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+func (iptablesFirewall) cleanupCommands() [][]string {
+	var commands [][]string
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		commands = append(commands,
+			[]string{"sudo", iptables, "-D", "OUTPUT", "-j", iptablesChain},
+			[]string{"sudo", iptables, "-F", iptablesChain},
+			[]string{"sudo", iptables, "-X", iptablesChain},
+		)
+	}
+	return commands
+}
+
+// iptablesRules writes the chain for one family, in the canonical form
+// `iptables -S` lists it.
+func iptablesRules(iptables string, rules killSwitchRuleset) []string {
+	chain := "-A " + iptablesChain
+	lines := []string{
+		chain + " -o lo -j ACCEPT",
+		chain + " -o " + rules.iface + " -j ACCEPT",
+	}
+
+	ipv4 := iptables == "iptables"
+	for _, endpoint := range rules.endpoints {
+		if (endpoint.IP.To4() != nil) == ipv4 {
+			dst := hostNet(endpoint.IP)
+			lines = append(lines, fmt.Sprintf("%s -d %s -p udp -m udp --dport %d -j ACCEPT", chain, dst.String(), endpoint.Port))
+		}
+	}
+
+	ports := dhcpPorts[0]
+	if !ipv4 {
+		ports = dhcpPorts[1]
+	}
+	lines = append(lines, fmt.Sprintf("%s -p udp -m udp --sport %d --dport %d -j ACCEPT", chain, ports[0], ports[1]))
+
+	if !ipv4 {
+		for _, nd := range neighborDiscovery {
+			lines = append(lines, fmt.Sprintf("%s -p ipv6-icmp -m icmp6 --icmpv6-type %d -j ACCEPT", chain, nd.icmpType))
+		}
+	}
+
+	for _, dst := range append(append([]net.IPNet{}, rules.lan...), rules.exemptions...) {
+		if (dst.IP.To4() != nil) == ipv4 {
+			lines = append(lines, fmt.Sprintf("%s -d %s -j ACCEPT", chain, dst.String()))
+		}
+	}
+
+	if mark := rules.markExemption; mark != nil {
+		not := ""
+		if mark.invert {
+			not = "! "
+		}
+		lines = append(lines, fmt.Sprintf("%s -m mark %s--mark %#x -j ACCEPT", chain, not, mark.mark))
+	}
+
+	return append(lines, chain+" -j DROP")
+}
@@ -0,0 +1,353 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// recordedNftListing is `nft -j list table inet kryptx` with the
+// killswitch_full ruleset loaded, its objects decoded afresh each call.
+func recordedNftListing(t *testing.T) []any {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "killswitch_full_nft_list.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listing struct {
+		Nftables []any `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &listing); err != nil {
+		t.Fatal(err)
+	}
+	return listing.Nftables
+}
+
+// nftListingCommand answers the listing of the kryptx table with objects.
+func nftListingCommand(t *testing.T, objects []any) func(call []string) *exec.Cmd {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"nftables": objects})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(call []string) *exec.Cmd {
+		if slices.Equal(call, []string{"sudo", "nft", "-j", "list", "table", nftFamily, nftTable}) {
+			return shellCommand(`printf '%s\n' "$1"`, string(data))
+		}
+		return nil
+	}
+}
+
+// nftRuleAt returns the expressions of the i-th rule in a listing.
+func nftRuleAt(objects []any, i int) map[string]any {
+	n := 0
+	for _, object := range objects {
+		if rule, ok := object.(map[string]any)["rule"]; ok {
+			if n == i {
+				return rule.(map[string]any)
+			}
+			n++
+		}
+	}
+	return nil
+}
+
+func TestNftVerify(t *testing.T) {
+	rules := killSwitchTestRulesets(t)["killswitch_full"]
+	// The listing starts with metainfo, the table and the chain
+	const firstRule = 3
+
+	for _, tt := range []struct {
+		name   string
+		tamper func(objects []any) []any
+		// want is part of the drift reported, empty when nothing is
+		want string
+	}{
+		{
+			name:   "matching",
+			tamper: func(objects []any) []any { return objects },
+		},
+		{
+			name: "rule missing",
+			tamper: func(objects []any) []any {
+				return slices.Delete(objects, firstRule+2, firstRule+3)
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name: "rules reordered",
+			tamper: func(objects []any) []any {
+				objects[firstRule], objects[firstRule+1] = objects[firstRule+1], objects[firstRule]
+				return objects
+			},
+			want: `"right":"kryptx0"`,
+		},
+		{
+			name: "rule changed",
+			tamper: func(objects []any) []any {
+				match := nftRuleAt(objects, 2)["expr"].([]any)[1].(map[string]any)["match"].(map[string]any)
+				match["right"] = 51999
+				return objects
+			},
+			want: "51999",
+		},
+		{
+			name: "accept all appended",
+			tamper: func(objects []any) []any {
+				return append(objects, map[string]any{"rule": map[string]any{
+					"family": "inet", "table": "kryptx", "chain": "output", "handle": 99,
+					"expr": []any{map[string]any{"accept": nil}},
+				}})
+			},
+			want: `unexpected [{"accept":null}]`,
+		},
+		{
+			name: "policy accept",
+			tamper: func(objects []any) []any {
+				objects[firstRule-1].(map[string]any)["chain"].(map[string]any)["policy"] = "accept"
+				return objects
+			},
+			want: "chain policy is accept",
+		},
+		{
+			name: "foreign chain",
+			tamper: func(objects []any) []any {
+				return append(objects,
+					map[string]any{"chain": map[string]any{
+						"family": "inet", "table": "kryptx", "name": "bypass", "handle": 98,
+						"type": "filter", "hook": "output", "prio": -10, "policy": "accept",
+					}},
+					map[string]any{"rule": map[string]any{
+						"family": "inet", "table": "kryptx", "chain": "bypass", "handle": 99,
+						"expr": []any{map[string]any{"accept": nil}},
+					}},
+				)
+			},
+			want: "rule in foreign chain bypass",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeCommands(t, nftListingCommand(t, tt.tamper(recordedNftListing(t))))
+
+			err := nftFirewall{}.verify(rules)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("verify: %v", err)
+			case tt.want != "" && !errors.Is(err, errKillSwitchDrift):
+				t.Errorf("verify = %v, want drift", err)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("verify = %v, want %q in it", err, tt.want)
+			}
+			if len(fake.calls) != 1 {
+				t.Errorf("commands run: %q, want the listing alone", fake.calls)
+			}
+		})
+	}
+}
+
+func TestNftVerifyTableGone(t *testing.T) {
+	useFakeCommands(t, func(call []string) *exec.Cmd {
+		return shellCommand(`echo "Error: No such file or directory; did you mean table 'kryptx' in family inet?" >&2; exit 1`)
+	})
+	if err := (nftFirewall{}).verify(killSwitchTestRulesets(t)["killswitch_minimal"]); !errors.Is(err, errKillSwitchDrift) {
+		t.Errorf("verify = %v, want drift", err)
+	}
+
+	// Failing to list at all is no drift, only an error
+	useFakeCommands(t, func(call []string) *exec.Cmd {
+		return shellCommand(`echo "sudo: a password is required" >&2; exit 1`)
+	})
+	if err := (nftFirewall{}).verify(killSwitchTestRulesets(t)["killswitch_minimal"]); err == nil || errors.Is(err, errKillSwitchDrift) {
+		t.Errorf("verify = %v, want an error other than drift", err)
+	}
+}
+
+// fakeIptables keeps the OUTPUT and kill switch chains of both families
+// and answers the iptables commands the kill switch runs, as iptables
+// would with them loaded.
+type fakeIptables struct {
+	rules  killSwitchRuleset
+	output map[string][]string
+	// chain is nil for a family whose chain is gone
+	chain map[string][]string
+}
+
+// newFakeIptables starts out with rules loaded and hooked.
+func newFakeIptables(rules killSwitchRuleset) *fakeIptables {
+	f := &fakeIptables{rules: rules, output: map[string][]string{}, chain: map[string][]string{}}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		f.output[iptables] = []string{iptablesJump}
+		f.chain[iptables] = iptablesRules(iptables, rules)
+	}
+	return f
+}
+
+func (f *fakeIptables) run(call []string) *exec.Cmd {
+	if len(call) < 2 || call[0] != "sudo" {
+		return nil
+	}
+	iptables, args := call[1], call[2:]
+	output := f.output[iptables]
+
+	switch {
+	case strings.HasSuffix(iptables, "-restore"):
+		iptables = strings.TrimSuffix(iptables, "-restore")
+		f.chain[iptables] = iptablesRules(iptables, f.rules)
+	case slices.Equal(args, []string{"-S", "OUTPUT"}):
+		return iptablesListing("-P OUTPUT ACCEPT", output)
+	case slices.Equal(args, []string{"-S", iptablesChain}):
+		if f.chain[iptables] == nil {
+			return shellCommand(`echo "iptables: No chain/target/match by that name." >&2; exit 1`)
+		}
+		return iptablesListing("-N "+iptablesChain, f.chain[iptables])
+	case slices.Equal(args, []string{"-D", "OUTPUT", "-j", iptablesChain}):
+		i := slices.Index(output, iptablesJump)
+		if i < 0 {
+			return shellCommand("exit 1")
+		}
+		f.output[iptables] = slices.Delete(output, i, i+1)
+	case slices.Equal(args, []string{"-I", "OUTPUT", "1", "-j", iptablesChain}):
+		f.output[iptables] = append([]string{iptablesJump}, output...)
+	}
+	return nil
+}
+
+// iptablesListing prints a chain the way `iptables -S` does.
+func iptablesListing(header string, rules []string) *exec.Cmd {
+	return shellCommand(`printf '%s\n' "$@"`, append([]string{header}, rules...)...)
+}
+
+func TestIptablesVerify(t *testing.T) {
+	rules := killSwitchTestRulesets(t)["killswitch_full"]
+	bypass := "-A OUTPUT -d 203.0.113.9/32 -j ACCEPT"
+
+	for _, tt := range []struct {
+		name string
+		// tamper changes the IPv4 chains
+		tamper                func(f *fakeIptables)
+		wantDrift, wantBypass bool
+		want                  string
+	}{
+		{
+			name:   "matching",
+			tamper: func(f *fakeIptables) {},
+		},
+		{
+			name: "rule missing",
+			tamper: func(f *fakeIptables) {
+				f.chain["iptables"] = slices.Delete(f.chain["iptables"], 2, 3)
+			},
+			wantDrift: true,
+			want:      "198.51.100.1/32",
+		},
+		{
+			name: "rules reordered",
+			tamper: func(f *fakeIptables) {
+				chain := f.chain["iptables"]
+				chain[0], chain[1] = chain[1], chain[0]
+			},
+			wantDrift: true,
+			want:      "-A KRYPTX -o kryptx0 -j ACCEPT",
+		},
+		{
+			name: "drop removed",
+			tamper: func(f *fakeIptables) {
+				f.chain["iptables"] = f.chain["iptables"][:len(f.chain["iptables"])-1]
+			},
+			wantDrift: true,
+			want:      "missing -A KRYPTX -j DROP",
+		},
+		{
+			name:      "chain gone",
+			tamper:    func(f *fakeIptables) { f.chain["iptables"] = nil },
+			wantDrift: true,
+			want:      "chain KRYPTX is gone",
+		},
+		{
+			name:      "jump gone",
+			tamper:    func(f *fakeIptables) { f.output["iptables"] = nil },
+			wantDrift: true,
+			want:      "OUTPUT does not jump to KRYPTX",
+		},
+		{
+			name: "foreign rule ahead of the jump",
+			tamper: func(f *fakeIptables) {
+				f.output["iptables"] = []string{bypass, iptablesJump}
+			},
+			wantBypass: true,
+			want:       bypass,
+		},
+		{
+			name: "foreign rule ahead of a missing jump",
+			tamper: func(f *fakeIptables) {
+				f.output["iptables"] = []string{bypass}
+			},
+			wantDrift:  true,
+			wantBypass: true,
+			want:       bypass,
+		},
+		{
+			name: "harmless rules ahead of the jump",
+			tamper: func(f *fakeIptables) {
+				f.output["iptables"] = []string{
+					"-A OUTPUT -p tcp -m tcp --dport 25 -j REJECT --reject-with icmp-port-unreachable",
+					"-A OUTPUT -j LOG --log-prefix out",
+					"-A OUTPUT -d 192.0.2.1/32",
+					iptablesJump,
+				}
+			},
+		},
+		{
+			name: "foreign rule after the jump",
+			tamper: func(f *fakeIptables) {
+				f.output["iptables"] = []string{iptablesJump, "-A OUTPUT -j ACCEPT"}
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeIptables(rules)
+			tt.tamper(f)
+			useFakeCommands(t, f.run)
+
+			err := iptablesFirewall{}.verify(rules)
+			if got := errors.Is(err, errKillSwitchDrift); got != tt.wantDrift {
+				t.Errorf("verify = %v, drift %v, want %v", err, got, tt.wantDrift)
+			}
+			if got := errors.Is(err, errKillSwitchBypass); got != tt.wantBypass {
+				t.Errorf("verify = %v, bypass %v, want %v", err, got, tt.wantBypass)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("verify = %v, want %q in it", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIptablesReapply(t *testing.T) {
+	rules := killSwitchTestRulesets(t)["killswitch_full"]
+	bypass := "-A OUTPUT -d 203.0.113.9/32 -j ACCEPT"
+
+	f := newFakeIptables(rules)
+	f.output["iptables"] = []string{bypass, iptablesJump, iptablesJump}
+	f.chain["iptables"] = f.chain["iptables"][1:]
+	f.chain["ip6tables"] = nil
+	useFakeCommands(t, f.run)
+
+	if err := (iptablesFirewall{}).apply(rules); err != nil {
+		t.Fatal(err)
+	}
+	if err := (iptablesFirewall{}).verify(rules); err != nil {
+		t.Errorf("verify after apply: %v", err)
+	}
+	// The jump goes back first, once, with the foreign rule behind it
+	if want := []string{iptablesJump, bypass}; !slices.Equal(f.output["iptables"], want) {
+		t.Errorf("OUTPUT = %q, want %q", f.output["iptables"], want)
+	}
+}
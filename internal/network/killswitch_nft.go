@@ -0,0 +1,253 @@
+package network
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"reflect"
+	"strings"
+)
+
+const (
+	nftFamily = "inet"
+	nftTable  = "kryptx"
+	nftChain  = "output"
+)
+
+// nftFirewall keeps the kill switch in a table of its own, so loading and
+// removing it never touches rules anybody else made. Rules go in through
+// the JSON interface, which is also how they are read back for verify.
+type nftFirewall struct{}
+
+type nftObject map[string]any
+
+func (f nftFirewall) apply(rules killSwitchRuleset) error {
+	batch, err := f.batch(rules)
+	if err != nil {
+		return err
+	}
+
+	cmd := execCommand("sudo", "nft", "-j", "-f", "-")
+	cmd.Stdin = bytes.NewReader(batch)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to load nftables rules: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// batch is the JSON for `nft -j -f` that replaces the table with rules.
+// Adding the table first makes the delete work whether or not it exists;
+// the whole batch is one transaction either way.
+func (nftFirewall) batch(rules killSwitchRuleset) ([]byte, error) {
+	table := nftObject{"family": nftFamily, "name": nftTable}
+	commands := []nftObject{
+		{"add": nftObject{"table": table}},
+		{"delete": nftObject{"table": table}},
+		{"add": nftObject{"table": table}},
+		{"add": nftObject{"chain": nftChainSpec()}},
+	}
+	for _, expr := range nftRules(rules) {
+		commands = append(commands, nftObject{"add": nftObject{"rule": nftObject{
+			"family": nftFamily,
+			"table":  nftTable,
+			"chain":  nftChain,
+			"expr":   expr,
+		}}})
+	}
+
+	return json.Marshal(nftObject{"nftables": commands})
+}
+
+func (nftFirewall) remove() error {
+	output, err := execCommand("sudo", "nft", "delete", "table", nftFamily, nftTable).CombinedOutput()
+	if err != nil && !strings.Contains(string(output), "No such file or directory") {
+		return fmt.Errorf("failed to remove nftables table: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// verify lists the table and compares its chain and rules with what apply
+// loads, so that rules added, changed or removed behind our back show up.
+// Other tables cannot let anything past: a packet has to get through every
+// chain on the hook, and a drop in any of them is final.
+func (nftFirewall) verify(rules killSwitchRuleset) error {
+	output, err := execCommand("sudo", "nft", "-j", "list", "table", nftFamily, nftTable).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(string(exitErr.Stderr), "No such file or directory") {
+			return fmt.Errorf("%w: table %s %s is gone", errKillSwitchDrift, nftFamily, nftTable)
+		}
+		return fmt.Errorf("listing nftables table: %w", err)
+	}
+
+	var listing struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal(output, &listing); err != nil {
+		return fmt.Errorf("parsing nftables listing: %w", err)
+	}
+
+	var chains []nftObject
+	var actual []any
+	for _, object := range listing.Nftables {
+		if raw, ok := object["chain"]; ok {
+			var chain nftObject
+			if err := json.Unmarshal(raw, &chain); err != nil {
+				return fmt.Errorf("parsing nftables listing: %w", err)
+			}
+			chains = append(chains, chain)
+		}
+		if raw, ok := object["rule"]; ok {
+			var rule struct {
+				Chain string `json:"chain"`
+				Expr  any    `json:"expr"`
+			}
+			if err := json.Unmarshal(raw, &rule); err != nil {
+				return fmt.Errorf("parsing nftables listing: %w", err)
+			}
+			if rule.Chain != nftChain {
+				actual = append(actual, fmt.Sprintf("rule in foreign chain %s", rule.Chain))
+				continue
+			}
+			actual = append(actual, normalizeNft(rule.Expr))
+		}
+	}
+
+	var problems []string
+	wantChain := normalizeNft(nftChainSpec()).(map[string]any)
+	if len(chains) != 1 {
+		problems = append(problems, fmt.Sprintf("%d chains instead of 1", len(chains)))
+	} else {
+		for key, want := range wantChain {
+			if got := normalizeNft(chains[0][key]); !reflect.DeepEqual(got, want) {
+				problems = append(problems, fmt.Sprintf("chain %s is %v, want %v", key, got, want))
+			}
+		}
+	}
+
+	var expected []any
+	for _, expr := range nftRules(rules) {
+		expected = append(expected, normalizeNft(expr))
+	}
+	problems = append(problems, diffRules(expected, actual, func(rule any) string {
+		text, _ := json.Marshal(rule)
+		return string(text)
+	})...)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errKillSwitchDrift, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (nftFirewall) cleanupCommands() [][]string {
+	return [][]string{{"sudo", "nft", "delete", "table", nftFamily, nftTable}}
+}
+
+func nftChainSpec() nftObject {
+	return nftObject{
+		"family": nftFamily,
+		"table":  nftTable,
+		"name":   nftChain,
+		"type":   "filter",
+		"hook":   "output",
+		"prio":   0,
+		"policy": "drop",
+	}
+}
+
+// nftRules lists the expressions of each rule, in order.
+func nftRules(rules killSwitchRuleset) [][]nftObject {
+	accept := nftObject{"accept": nil}
+	oifname := nftObject{"meta": nftObject{"key": "oifname"}}
+
+	exprs := [][]nftObject{
+		{nftMatch(oifname, "==", "lo"), accept},
+		{nftMatch(oifname, "==", rules.iface), accept},
+	}
+
+	for _, endpoint := range rules.endpoints {
+		exprs = append(exprs, []nftObject{
+			nftMatch(nftPayload(nftProtocol(endpoint.IP), "daddr"), "==", endpoint.IP.String()),
+			nftMatch(nftPayload("udp", "dport"), "==", endpoint.Port),
+			accept,
+		})
+	}
+
+	for _, ports := range dhcpPorts {
+		exprs = append(exprs, []nftObject{
+			nftMatch(nftPayload("udp", "sport"), "==", ports[0]),
+			nftMatch(nftPayload("udp", "dport"), "==", ports[1]),
+			accept,
+		})
+	}
+
+	for _, nd := range neighborDiscovery {
+		exprs = append(exprs, []nftObject{nftMatch(nftPayload("icmpv6", "type"), "==", nd.name), accept})
+	}
+
+	for _, dst := range append(append([]net.IPNet{}, rules.lan...), rules.exemptions...) {
+		exprs = append(exprs, []nftObject{nftDestination(dst), accept})
+	}
+
+	if mark := rules.markExemption; mark != nil {
+		op := "=="
+		if mark.invert {
+			op = "!="
+		}
+		exprs = append(exprs, []nftObject{nftMatch(nftObject{"meta": nftObject{"key": "mark"}}, op, mark.mark), accept})
+	}
+
+	return exprs
+}
+
+func nftMatch(left nftObject, op string, right any) nftObject {
+	return nftObject{"match": nftObject{"op": op, "left": left, "right": right}}
+}
+
+func nftPayload(protocol, field string) nftObject {
+	return nftObject{"payload": nftObject{"protocol": protocol, "field": field}}
+}
+
+func nftProtocol(ip net.IP) string {
+	if ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nftDestination matches dst the way nft lists it back: a zero-length
+// prefix as the family match it amounts to, a full-length one as the bare
+// address.
+func nftDestination(dst net.IPNet) nftObject {
+	daddr := nftPayload(nftProtocol(dst.IP), "daddr")
+	ones, bits := dst.Mask.Size()
+	switch ones {
+	case 0:
+		family := "ipv4"
+		if bits == 8*net.IPv6len {
+			family = "ipv6"
+		}
+		return nftMatch(nftObject{"meta": nftObject{"key": "nfproto"}}, "==", family)
+	case bits:
+		return nftMatch(daddr, "==", dst.IP.String())
+	}
+	return nftMatch(daddr, "==", nftObject{"prefix": nftObject{"addr": dst.IP.String(), "len": ones}})
+}
+
+// normalizeNft brings an expression into the shape json.Unmarshal gives
+// the listing, so the two compare with reflect.DeepEqual.
+func normalizeNft(v any) any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var normalized any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return v
+	}
+	return normalized
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"encoding/json"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func killSwitchTestRulesets(t *testing.T) map[string]killSwitchRuleset {
+	t.Helper()
+
+	lan, err := parseLANNetworks(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exemptions, err := parseLANNetworks([]string{"203.0.113.0/24", "2001:db8:1::/48", "198.51.100.7/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints := []*net.UDPAddr{
+		{IP: net.ParseIP("198.51.100.1"), Port: 51820},
+		{IP: net.ParseIP("2001:db8::1"), Port: 51821},
+	}
+
+	return map[string]killSwitchRuleset{
+		"killswitch_minimal": {iface: "kryptx0"},
+		"killswitch_full": {
+			iface:         "kryptx0",
+			endpoints:     endpoints,
+			lan:           lan,
+			exemptions:    exemptions,
+			markExemption: &markExemption{mark: bypassAppMark},
+		},
+		"killswitch_inverted_mark": {
+			iface:         "kryptx0",
+			endpoints:     endpoints[:1],
+			markExemption: &markExemption{mark: tunnelAppMark, invert: true},
+		},
+	}
+}
+
+func TestNftRulesGolden(t *testing.T) {
+	for name, rules := range killSwitchTestRulesets(t) {
+		t.Run(name, func(t *testing.T) {
+			var b strings.Builder
+			for _, expr := range nftRules(rules) {
+				line, err := json.Marshal(expr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b.Write(line)
+				b.WriteByte('\n')
+			}
+			checkGolden(t, name+"_nft.golden", b.String())
+		})
+	}
+}
+
+func TestIptablesRulesGolden(t *testing.T) {
+	for name, rules := range killSwitchTestRulesets(t) {
+		t.Run(name, func(t *testing.T) {
+			var b strings.Builder
+			for _, iptables := range []string{"iptables", "ip6tables"} {
+				b.WriteString("# " + iptables + "\n")
+				for _, rule := range iptablesRules(iptables, rules) {
+					b.WriteString(rule + "\n")
+				}
+			}
+			checkGolden(t, name+"_iptables.golden", b.String())
+		})
+	}
+}
+
+// checkGolden compares got with testdata/file, or with -update writes it.
+func checkGolden(t *testing.T, file, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", file)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("rules differ from %s:\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
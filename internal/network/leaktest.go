@@ -0,0 +1,526 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+const (
+	// Both answer with the address of the resolver asking them
+	whoamiAkamai = "whoami.akamai.net"
+	whoamiGoogle = "o-o.myaddr.l.google.com"
+
+	defaultSTUNServer = "stun.l.google.com:19302"
+	stunMagicCookie   = 0x2112A442
+	stunTimeout       = 2 * time.Second
+
+	// Where IPv6 is tried by default, Cloudflare's DNS
+	defaultIPv6Probe = "[2606:4700:4700::1111]:53"
+	ipv6ProbeTimeout = 2 * time.Second
+
+	// Packets still on their way out when the checks are done
+	captureLinger = 500 * time.Millisecond
+)
+
+// LeakReport is the result of a leak test. Each check tells whether it
+// found a leak, and Error why it could not tell.
+type LeakReport struct {
+	Time      time.Time     `json:"time"`
+	Interface string        `json:"interface"`
+	Connected bool          `json:"connected"`
+	Resolvers ResolverCheck `json:"resolvers"`
+	Packets   PacketCheck   `json:"packets"`
+	IPv6      IPv6Check     `json:"ipv6"`
+	STUN      STUNCheck     `json:"stun"`
+}
+
+// ResolverCheck compares the resolvers the system is pointed at with
+// those it should be, and lists the addresses that public resolvers saw
+// the queries come from.
+type ResolverCheck struct {
+	Configured []string `json:"configured"`
+	Expected   []string `json:"expected"`
+	Answering  []string `json:"answering"`
+	Leak       bool     `json:"leak"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// PacketCheck lists the packets seen leaving by interfaces other than the
+// tunnel during the test, but for those to the WireGuard endpoints and
+// the local networks.
+type PacketCheck struct {
+	Supported bool           `json:"supported"`
+	Leaked    []LeakedPacket `json:"leaked,omitempty"`
+	Leak      bool           `json:"leak"`
+	Error     string         `json:"error,omitempty"`
+}
+
+type LeakedPacket struct {
+	Interface   string `json:"interface"`
+	Protocol    string `json:"protocol"`
+	Destination string `json:"destination"`
+}
+
+// IPv6Check tells whether IPv6 gets out, and by which interface.
+type IPv6Check struct {
+	Routed    bool   `json:"routed"`
+	Interface string `json:"interface,omitempty"`
+	Reachable bool   `json:"reachable"`
+	Leak      bool   `json:"leak"`
+	Error     string `json:"error,omitempty"`
+}
+
+// STUNCheck does what WebRTC does to find a browser's addresses: a STUN
+// request by the default route, and one from each address of every other
+// interface. Any of them mapped to another address than the tunnel's
+// gives the real one away.
+type STUNCheck struct {
+	Results []STUNResult `json:"results"`
+	Leak    bool         `json:"leak"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type STUNResult struct {
+	Local     string `json:"local"`
+	Interface string `json:"interface"`
+	Mapped    string `json:"mapped,omitempty"`
+	Leak      bool   `json:"leak"`
+}
+
+// LeakTestOptions points the test at other servers than the public ones,
+// such as those of a test network. Empty fields take those of the
+// security.leak_test config, then the defaults.
+type LeakTestOptions struct {
+	// STUNServer is the host:port of the STUN server
+	STUNServer string
+	// IPv6Probe is the [address]:port of a DNS server reachable by IPv6
+	IPv6Probe string
+}
+
+func (r *LeakReport) Leaking() bool {
+	return r.Resolvers.Leak || r.Packets.Leak || r.IPv6.Leak || r.STUN.Leak
+}
+
+// LeakTest runs a leak test against the running connection.
+func (v *VPNClient) LeakTest(ctx context.Context, opts LeakTestOptions) *LeakReport {
+	return RunLeakTest(ctx, v.config, opts, v.logger)
+}
+
+// RunLeakTest checks what gets out around the tunnel of cfg: where DNS
+// queries go, whether packets leave by other interfaces, whether IPv6
+// goes out directly and whether STUN gives the real address away. It
+// needs to run as root to watch the interfaces.
+func RunLeakTest(ctx context.Context, cfg *config.Config, opts LeakTestOptions, logger *utils.Logger) *LeakReport {
+	if opts.STUNServer == "" {
+		opts.STUNServer = cfg.Security.LeakTest.STUNServer
+	}
+	if opts.STUNServer == "" {
+		opts.STUNServer = defaultSTUNServer
+	}
+	if opts.IPv6Probe == "" {
+		opts.IPv6Probe = cfg.Security.LeakTest.IPv6Probe
+	}
+	if opts.IPv6Probe == "" {
+		opts.IPv6Probe = defaultIPv6Probe
+	}
+
+	report := &LeakReport{Time: time.Now(), Interface: cfg.Network.Interface}
+	if _, err := net.InterfaceByName(cfg.Network.Interface); err == nil {
+		report.Connected = true
+	}
+
+	// The other checks make the traffic to watch
+	capture, err := startCapture(cfg, logger)
+	switch {
+	case errors.Is(err, ErrUnsupported):
+		report.Packets.Error = err.Error()
+	case err != nil:
+		report.Packets.Supported = true
+		report.Packets.Error = err.Error()
+	default:
+		report.Packets.Supported = true
+	}
+
+	report.Resolvers = checkResolvers(ctx, cfg, logger)
+	report.IPv6 = checkIPv6(opts.IPv6Probe, cfg.Network.Interface)
+	report.STUN = checkSTUN(ctx, opts.STUNServer, cfg.Network.Interface)
+
+	if capture != nil {
+		time.Sleep(captureLinger)
+		leaked, err := capture.stop()
+		if err != nil {
+			report.Packets.Error = err.Error()
+		}
+		report.Packets.Leaked = leaked
+		report.Packets.Leak = len(leaked) > 0
+	}
+
+	return report
+}
+
+func checkResolvers(ctx context.Context, cfg *config.Config, logger *utils.Logger) ResolverCheck {
+	var check ResolverCheck
+
+	d := NewDNSManager(cfg, logger)
+	if err := d.backupDNS(); err != nil {
+		check.Error = fmt.Sprintf("reading the DNS configuration: %v", err)
+	}
+	check.Configured = d.originalDNS
+
+	check.Expected = d.vpnDNS
+	if d.useProxy {
+		if address, err := d.proxyAddress(); err == nil {
+			check.Expected = []string{address}
+		}
+	}
+
+	// resolv.conf only names the stub resolver, the servers are per link
+	if _, ok := d.strategy.(*resolvedDNS); ok {
+		servers, err := resolvedLinkServers(cfg.Network.Interface)
+		if err != nil {
+			check.Error = err.Error()
+		}
+		check.Configured = servers
+	}
+
+	for _, server := range check.Configured {
+		if !slices.Contains(check.Expected, server) {
+			check.Leak = true
+		}
+	}
+
+	check.Answering = answeringResolvers(ctx)
+	return check
+}
+
+// answeringResolvers asks services that answer with the address of the
+// resolver asking, through the system's resolver.
+func answeringResolvers(ctx context.Context) []string {
+	var resolvers []string
+	add := func(ip string) {
+		if net.ParseIP(ip) != nil && !slices.Contains(resolvers, ip) {
+			resolvers = append(resolvers, ip)
+		}
+	}
+
+	if addrs, err := net.DefaultResolver.LookupHost(ctx, whoamiAkamai); err == nil {
+		for _, addr := range addrs {
+			add(addr)
+		}
+	}
+	// Also answered: the client subnet the resolver passed on, if any
+	if records, err := net.DefaultResolver.LookupTXT(ctx, whoamiGoogle); err == nil {
+		for _, record := range records {
+			add(record)
+		}
+	}
+	return resolvers
+}
+
+func checkIPv6(probe, tunnel string) IPv6Check {
+	var check IPv6Check
+
+	// Connecting a UDP socket sends nothing but picks the route
+	conn, err := net.Dial("udp6", probe)
+	if err != nil {
+		return check
+	}
+	defer conn.Close()
+
+	check.Routed = true
+	check.Interface = interfaceOf(conn.LocalAddr().(*net.UDPAddr).IP)
+
+	query := new(dns.Msg).SetQuestion(dns.Fqdn(whoamiAkamai), dns.TypeA)
+	dnsConn := &dns.Conn{Conn: conn}
+	conn.SetDeadline(time.Now().Add(ipv6ProbeTimeout))
+	if err := dnsConn.WriteMsg(query); err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	if _, err := dnsConn.ReadMsg(); err == nil {
+		check.Reachable = true
+	}
+
+	check.Leak = check.Reachable && check.Interface != tunnel
+	return check
+}
+
+func checkSTUN(ctx context.Context, stunServer, tunnel string) STUNCheck {
+	var check STUNCheck
+
+	host, portStr, err := net.SplitHostPort(stunServer)
+	if err != nil {
+		check.Error = fmt.Sprintf("invalid STUN server %q: %v", stunServer, err)
+		return check
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		check.Error = fmt.Sprintf("invalid STUN server %q", stunServer)
+		return check
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		check.Error = fmt.Sprintf("looking up %s: %v", host, err)
+		return check
+	}
+	servers := map[string]*net.UDPAddr{}
+	for _, ip := range ips {
+		family := udpNetwork(ip.IP)
+		if servers[family] == nil {
+			servers[family] = &net.UDPAddr{IP: ip.IP, Port: port}
+		}
+	}
+
+	// The default route first, which should be the tunnel: what the server
+	// maps it to is the address the others may be mapped to as well
+	var tunnelMapped []string
+	for _, family := range []string{"udp4", "udp6"} {
+		server := servers[family]
+		if server == nil {
+			continue
+		}
+		conn, err := net.ListenPacket(family, ":0")
+		if err != nil {
+			continue
+		}
+		result := STUNResult{Local: "default route", Interface: routeInterface(family, server)}
+		if mapped, err := stunBinding(conn, server); err == nil {
+			result.Mapped = mapped.String()
+			if result.Interface == tunnel {
+				tunnelMapped = append(tunnelMapped, result.Mapped)
+			} else {
+				result.Leak = true
+			}
+		}
+		conn.Close()
+		check.Results = append(check.Results, result)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	for _, iface := range ifaces {
+		if iface.Name == tunnel || iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			family := udpNetwork(ipnet.IP)
+			server := servers[family]
+			if server == nil {
+				continue
+			}
+
+			conn, err := net.ListenPacket(family, net.JoinHostPort(ipnet.IP.String(), "0"))
+			if err != nil {
+				continue
+			}
+			result := STUNResult{Local: ipnet.IP.String(), Interface: iface.Name}
+			if mapped, err := stunBinding(conn, server); err == nil {
+				result.Mapped = mapped.String()
+				result.Leak = !slices.Contains(tunnelMapped, result.Mapped)
+			}
+			conn.Close()
+			check.Results = append(check.Results, result)
+		}
+	}
+
+	for _, result := range check.Results {
+		check.Leak = check.Leak || result.Leak
+	}
+	return check
+}
+
+// stunBinding asks server which address conn's packets come from, with a
+// STUN binding request (RFC 5389).
+func stunBinding(conn net.PacketConn, server *net.UDPAddr) (net.IP, error) {
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001) // binding request
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:]); err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(stunTimeout))
+	if _, err := conn.WriteTo(req, server); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		// A binding success response to this request
+		if n < 20 || binary.BigEndian.Uint16(buf[0:]) != 0x0101 || !bytes.Equal(buf[8:20], req[8:20]) {
+			continue
+		}
+		return stunMappedAddress(buf[20:n], req[4:20])
+	}
+}
+
+// stunMappedAddress finds the mapped address among the attributes of a
+// response, preferring the XOR-MAPPED-ADDRESS, which is XORed with the
+// magic cookie and transaction ID.
+func stunMappedAddress(attrs, cookieAndID []byte) (net.IP, error) {
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		kind := binary.BigEndian.Uint16(attrs[0:])
+		length := int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+length {
+			break
+		}
+		value := attrs[4 : 4+length]
+
+		if len(value) >= 8 {
+			size := net.IPv4len
+			if value[1] == 0x02 {
+				size = net.IPv6len
+			}
+			if len(value) >= 4+size {
+				ip := append(net.IP{}, value[4:4+size]...)
+				switch kind {
+				case 0x0020: // XOR-MAPPED-ADDRESS
+					for i := range ip {
+						ip[i] ^= cookieAndID[i]
+					}
+					return ip, nil
+				case 0x0001: // MAPPED-ADDRESS
+					mapped = ip
+				}
+			}
+		}
+
+		// Attributes are padded to four bytes
+		attrs = attrs[4+(length+3)&^3:]
+	}
+
+	if mapped == nil {
+		return nil, errors.New("no mapped address in STUN response")
+	}
+	return mapped, nil
+}
+
+// routeInterface is the interface the system routes server by.
+func routeInterface(family string, server *net.UDPAddr) string {
+	conn, err := net.DialUDP(family, nil, server)
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return interfaceOf(conn.LocalAddr().(*net.UDPAddr).IP)
+}
+
+// interfaceOf names the interface that has ip.
+func interfaceOf(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// FormatLeakReport renders a report for people to read.
+func FormatLeakReport(r *LeakReport) string {
+	var b strings.Builder
+	verdict := func(leak bool) string {
+		if leak {
+			return "LEAK"
+		}
+		return "ok"
+	}
+
+	connected := "not connected"
+	if r.Connected {
+		connected = "connected"
+	}
+	fmt.Fprintf(&b, "Tunnel %s: %s\n\n", r.Interface, connected)
+
+	fmt.Fprintf(&b, "DNS resolvers: %s\n", verdict(r.Resolvers.Leak))
+	fmt.Fprintf(&b, "  configured: %s\n", orNone(r.Resolvers.Configured))
+	fmt.Fprintf(&b, "  expected:   %s\n", orNone(r.Resolvers.Expected))
+	fmt.Fprintf(&b, "  answering:  %s\n", orNone(r.Resolvers.Answering))
+	writeError(&b, r.Resolvers.Error)
+
+	if r.Packets.Supported {
+		fmt.Fprintf(&b, "Packets outside the tunnel: %s\n", verdict(r.Packets.Leak))
+		for _, p := range r.Packets.Leaked {
+			fmt.Fprintf(&b, "  %s %s to %s\n", p.Interface, p.Protocol, p.Destination)
+		}
+	} else {
+		fmt.Fprintf(&b, "Packets outside the tunnel: not checked\n")
+	}
+	writeError(&b, r.Packets.Error)
+
+	fmt.Fprintf(&b, "IPv6: %s\n", verdict(r.IPv6.Leak))
+	switch {
+	case !r.IPv6.Routed:
+		fmt.Fprintf(&b, "  no route\n")
+	case r.IPv6.Reachable:
+		fmt.Fprintf(&b, "  goes out by %s\n", r.IPv6.Interface)
+	default:
+		fmt.Fprintf(&b, "  routed by %s, but blocked\n", r.IPv6.Interface)
+	}
+	writeError(&b, r.IPv6.Error)
+
+	fmt.Fprintf(&b, "STUN (WebRTC): %s\n", verdict(r.STUN.Leak))
+	for _, result := range r.STUN.Results {
+		mapped := "no answer"
+		if result.Mapped != "" {
+			mapped = "seen as " + result.Mapped
+		}
+		fmt.Fprintf(&b, "  %s (%s): %s\n", result.Local, result.Interface, mapped)
+	}
+	writeError(&b, r.STUN.Error)
+
+	return b.String()
+}
+
+func orNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
+
+func writeError(b *strings.Builder, err string) {
+	if err != "" {
+		fmt.Fprintf(b, "  error: %s\n", err)
+	}
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// How often the capture loop looks up from a quiet socket to see whether
+// it is done
+const captureReadTimeout = 100 * time.Millisecond
+
+// packetCapture watches every packet leaving by an interface other than
+// the tunnel, on a packet socket seeing all protocols, and keeps those
+// that should not have left.
+type packetCapture struct {
+	fd        int
+	tunnel    string
+	endpoints []*net.UDPAddr
+	lan       []net.IPNet
+	names     map[int]string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu     sync.Mutex
+	seen   map[LeakedPacket]bool
+	leaked []LeakedPacket
+	err    error
+}
+
+func startCapture(cfg *config.Config, logger *utils.Logger) (*packetCapture, error) {
+	c := &packetCapture{
+		tunnel: cfg.Network.Interface,
+		names:  map[int]string{},
+		done:   make(chan struct{}),
+		seen:   map[LeakedPacket]bool{},
+	}
+
+	// The tunnel's own packets to its peers go out by the other
+	// interfaces, as do DHCP and, with allow_lan, the LAN
+	if client, err := wgctrl.New(); err == nil {
+		if device, err := client.Device(c.tunnel); err == nil {
+			for _, peer := range device.Peers {
+				if peer.Endpoint != nil {
+					c.endpoints = append(c.endpoints, peer.Endpoint)
+				}
+			}
+		}
+		client.Close()
+	}
+	if cfg.Security.AllowLAN {
+		lan, err := parseLANNetworks(cfg.Security.LANNetworks)
+		if err != nil {
+			return nil, err
+		}
+		c.lan = lan
+	}
+
+	// SOCK_DGRAM hands over the packets without their link layer header
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			return nil, fmt.Errorf("watching the interfaces needs root: %w", err)
+		}
+		return nil, fmt.Errorf("opening packet socket: %w", err)
+	}
+	timeout := unix.NsecToTimeval(captureReadTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("setting packet socket timeout: %w", err)
+	}
+	c.fd = fd
+
+	c.wg.Add(1)
+	go c.run(logger)
+	return c, nil
+}
+
+func (c *packetCapture) run(logger *utils.Logger) {
+	defer c.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		n, from, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				continue
+			}
+			c.mu.Lock()
+			c.err = fmt.Errorf("reading packets: %w", err)
+			c.mu.Unlock()
+			return
+		}
+
+		sa, ok := from.(*unix.SockaddrLinklayer)
+		if !ok || sa.Pkttype != unix.PACKET_OUTGOING {
+			continue
+		}
+		iface := c.interfaceName(sa.Ifindex)
+		if iface == "" || iface == c.tunnel || iface == "lo" {
+			continue
+		}
+
+		packet, ok := c.inspect(buf[:n])
+		if !ok {
+			continue
+		}
+		packet.Interface = iface
+
+		c.mu.Lock()
+		if !c.seen[packet] {
+			c.seen[packet] = true
+			c.leaked = append(c.leaked, packet)
+			logger.Warning("Leak test: %s packet to %s left by %s", packet.Protocol, packet.Destination, iface)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// stop ends the capture and returns what leaked.
+func (c *packetCapture) stop() ([]LeakedPacket, error) {
+	close(c.done)
+	c.wg.Wait()
+	unix.Close(c.fd)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leaked, c.err
+}
+
+// inspect reads the destination of an IP packet, and tells whether it is
+// one that should not have left.
+func (c *packetCapture) inspect(packet []byte) (LeakedPacket, bool) {
+	var (
+		dst      net.IP
+		proto    byte
+		payload  []byte
+		protocol string
+	)
+	switch {
+	case len(packet) >= 20 && packet[0]>>4 == 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLen {
+			return LeakedPacket{}, false
+		}
+		dst = net.IP(packet[16:20])
+		proto = packet[9]
+		payload = packet[headerLen:]
+	case len(packet) >= 40 && packet[0]>>4 == 6:
+		// Extension headers are left alone, and the packet with them
+		// reported by its next header
+		dst = net.IP(packet[24:40])
+		proto = packet[6]
+		payload = packet[40:]
+	default:
+		return LeakedPacket{}, false
+	}
+
+	if dst.IsMulticast() || dst.IsLinkLocalUnicast() || dst.IsLoopback() ||
+		dst.IsUnspecified() || dst.Equal(net.IPv4bcast) {
+		return LeakedPacket{}, false
+	}
+	for _, network := range c.lan {
+		if network.Contains(dst) {
+			return LeakedPacket{}, false
+		}
+	}
+
+	port := -1
+	if (proto == unix.IPPROTO_TCP || proto == unix.IPPROTO_UDP) && len(payload) >= 4 {
+		port = int(binary.BigEndian.Uint16(payload[2:4]))
+	}
+
+	switch proto {
+	case unix.IPPROTO_UDP:
+		protocol = "udp"
+		// DHCP and DHCPv6 servers
+		if port == 67 || port == 547 {
+			return LeakedPacket{}, false
+		}
+		for _, endpoint := range c.endpoints {
+			if endpoint.IP.Equal(dst) && endpoint.Port == port {
+				return LeakedPacket{}, false
+			}
+		}
+	case unix.IPPROTO_TCP:
+		protocol = "tcp"
+	case unix.IPPROTO_ICMP:
+		protocol = "icmp"
+	case unix.IPPROTO_ICMPV6:
+		protocol = "icmpv6"
+	default:
+		protocol = "ip proto " + strconv.Itoa(int(proto))
+	}
+
+	destination := dst.String()
+	if port >= 0 {
+		destination = net.JoinHostPort(destination, strconv.Itoa(port))
+	}
+	return LeakedPacket{Protocol: protocol, Destination: destination}, true
+}
+
+func (c *packetCapture) interfaceName(index int) string {
+	if name, ok := c.names[index]; ok {
+		return name
+	}
+	var name string
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		name = iface.Name
+	}
+	c.names[index] = name
+	return name
+}
+
+// htons puts a protocol number in network byte order, as packet sockets
+// take it.
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// tunnelLink stands in for the tunnel in the namespace, next to the
+// physical link.
+const tunnelLink = "kxtun0"
+
+const (
+	leakSTUNServer = "198.51.100.1:3478"
+	leakIPv6Probe  = "[2001:db8:1::1]:53"
+)
+
+// setupLeakNetns gives the namespace a physical link and a tunnel, both
+// up with gateways that never answer, and returns a config with the
+// leak test pointed past them. Routes and resolv.conf are left to the
+// test.
+func setupLeakNetns(t *testing.T) *config.Config {
+	t.Helper()
+
+	runIP(t, "link", "set", "lo", "up")
+	for _, link := range []struct {
+		name, peer, addr4, addr6, gateway4, gateway6 string
+	}{
+		{physicalLink, "kxpeer0", "192.0.2.2/24", "2001:db8::2/64", "192.0.2.1", "2001:db8::1"},
+		{tunnelLink, "kxtunpeer0", "10.8.0.2/24", "fd00:8::2/64", "10.8.0.1", "fd00:8::1"},
+	} {
+		runIP(t, "link", "add", link.name, "type", "veth", "peer", "name", link.peer)
+		runIP(t, "link", "set", link.peer, "up")
+		runIP(t, "link", "set", link.name, "up")
+		runIP(t, "addr", "add", link.addr4, "dev", link.name)
+		runIP(t, "-6", "addr", "add", link.addr6, "dev", link.name, "nodad")
+		// Without a neighbour the packets would wait for one, and never leave
+		runIP(t, "neigh", "add", link.gateway4, "lladdr", "02:00:00:00:00:01", "dev", link.name, "nud", "permanent")
+		runIP(t, "-6", "neigh", "add", link.gateway6, "lladdr", "02:00:00:00:00:01", "dev", link.name, "nud", "permanent")
+	}
+
+	cfg := testConfig(t)
+	cfg.Network.Interface = tunnelLink
+	cfg.Network.DNS = []string{"10.8.0.2"}
+	cfg.Security.LeakTest = config.LeakTestConfig{STUNServer: leakSTUNServer, IPv6Probe: leakIPv6Probe}
+	return cfg
+}
+
+func runLeakTest(t *testing.T, cfg *config.Config) *LeakReport {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	report := RunLeakTest(ctx, cfg, LeakTestOptions{}, utils.NewLogger(testing.Verbose()))
+	if strings.Contains(report.Packets.Error, "needs root") {
+		t.Skip(report.Packets.Error)
+	}
+	t.Logf("report:\n%s", FormatLeakReport(report))
+	return report
+}
+
+func TestLeakTestLeaking(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+
+	// Routed around the tunnel, and resolving through the ISP
+	cfg := setupLeakNetns(t)
+	runIP(t, "route", "add", "default", "via", "192.0.2.1")
+	runIP(t, "-6", "route", "add", "default", "via", "2001:db8::1")
+	bindResolvConf(t, "nameserver 198.51.100.53\noptions timeout:1 attempts:1\n")
+
+	report := runLeakTest(t, cfg)
+	if !report.Connected {
+		t.Errorf("tunnel %s not seen", tunnelLink)
+	}
+	if !report.Leaking() {
+		t.Error("no leak found")
+	}
+
+	if !report.Resolvers.Leak || !slices.Equal(report.Resolvers.Configured, []string{"198.51.100.53"}) {
+		t.Errorf("resolvers = %+v, want 198.51.100.53 found leaking", report.Resolvers)
+	}
+
+	if !report.Packets.Supported || report.Packets.Error != "" {
+		t.Fatalf("packets not watched: %+v", report.Packets)
+	}
+	for _, want := range []LeakedPacket{
+		{physicalLink, "udp", "198.51.100.53:53"},
+		{physicalLink, "udp", leakIPv6Probe},
+		{physicalLink, "udp", leakSTUNServer},
+	} {
+		if !slices.Contains(report.Packets.Leaked, want) {
+			t.Errorf("leaked packets %+v, want %+v among them", report.Packets.Leaked, want)
+		}
+	}
+
+	// Nothing answers past the physical link, which the packets show
+	if want := (IPv6Check{Routed: true, Interface: physicalLink}); report.IPv6 != want {
+		t.Errorf("IPv6 = %+v, want %+v", report.IPv6, want)
+	}
+	if results := report.STUN.Results; len(results) == 0 || results[0].Interface != physicalLink {
+		t.Errorf("STUN results = %+v, want the default route by %s", results, physicalLink)
+	}
+}
+
+func TestLeakTestClean(t *testing.T) {
+	if !inNetns(t) {
+		return
+	}
+
+	// Everything by the tunnel, resolving through a server on its end
+	cfg := setupLeakNetns(t)
+	runIP(t, "route", "add", "default", "via", "10.8.0.1")
+	runIP(t, "-6", "route", "add", "default", "via", "fd00:8::1")
+	newWhoamiResolver(t, "udp", "10.8.0.2:53", net.ParseIP("10.8.0.1"))
+	bindResolvConf(t, "nameserver 10.8.0.2\noptions timeout:1 attempts:1\n")
+
+	report := runLeakTest(t, cfg)
+	if report.Leaking() {
+		t.Errorf("leak found in a clean setup: %+v", report)
+	}
+
+	if !slices.Equal(report.Resolvers.Answering, []string{"10.8.0.1"}) {
+		t.Errorf("answering resolvers = %v, want the tunnel's 10.8.0.1", report.Resolvers.Answering)
+	}
+	if !report.Packets.Supported || report.Packets.Error != "" {
+		t.Errorf("packets not watched: %+v", report.Packets)
+	}
+	if !report.IPv6.Routed || report.IPv6.Interface != tunnelLink {
+		t.Errorf("IPv6 = %+v, want it routed by %s", report.IPv6, tunnelLink)
+	}
+	if results := report.STUN.Results; len(results) == 0 || results[0].Interface != tunnelLink {
+		t.Errorf("STUN results = %+v, want the default route by %s", results, tunnelLink)
+	}
+}
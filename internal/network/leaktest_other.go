@@ -0,0 +1,21 @@
+//go:build !linux
+
+package network
+
+import (
+	"fmt"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// packetCapture is Linux only for now.
+type packetCapture struct{}
+
+func startCapture(cfg *config.Config, logger *utils.Logger) (*packetCapture, error) {
+	return nil, fmt.Errorf("watching the interfaces: %w", ErrUnsupported)
+}
+
+func (c *packetCapture) stop() ([]LeakedPacket, error) {
+	return nil, nil
+}
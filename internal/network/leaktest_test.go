@@ -0,0 +1,156 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newWhoamiResolver serves on addr the way the resolver that whoami
+// services see a query come from does, answering them with resolver.
+func newWhoamiResolver(t *testing.T, network, addr string, resolver net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		t.Skipf("listening on %s: %v", addr, err)
+	}
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg).SetReply(req)
+		question := req.Question[0]
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch {
+		case question.Name == dns.Fqdn(whoamiAkamai) && question.Qtype == dns.TypeA:
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: resolver})
+		case question.Name == dns.Fqdn(whoamiGoogle) && question.Qtype == dns.TypeTXT:
+			resp.Answer = append(resp.Answer, &dns.TXT{Hdr: hdr, Txt: []string{resolver.String()}})
+		}
+		w.WriteMsg(resp)
+	})
+
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+// newSTUNResponder answers STUN binding requests on loopback with mapped
+// as the address they came from, or their actual source when nil.
+func newSTUNResponder(t *testing.T, mapped net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 20 || binary.BigEndian.Uint16(buf[0:]) != 0x0001 {
+				continue
+			}
+			from := addr.(*net.UDPAddr)
+			ip := mapped.To4()
+			if ip == nil {
+				ip = from.IP.To4()
+			}
+
+			resp := make([]byte, 32)
+			binary.BigEndian.PutUint16(resp[0:], 0x0101) // binding success
+			binary.BigEndian.PutUint16(resp[2:], 12)
+			copy(resp[4:20], buf[4:20])
+			binary.BigEndian.PutUint16(resp[20:], 0x0020) // XOR-MAPPED-ADDRESS
+			binary.BigEndian.PutUint16(resp[22:], 8)
+			resp[25] = 0x01
+			binary.BigEndian.PutUint16(resp[26:], uint16(from.Port)^uint16(stunMagicCookie>>16))
+			for i := range ip {
+				resp[28+i] = ip[i] ^ resp[4+i]
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// loopbackInterface names the loopback interface, which the checks see
+// the stubs reached by.
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestCheckIPv6(t *testing.T) {
+	lo := loopbackInterface(t)
+	answering := newWhoamiResolver(t, "udp6", "[::1]:0", net.ParseIP("::1"))
+
+	// Reached, but never answering, as behind a firewall
+	silent, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	for _, tt := range []struct {
+		name   string
+		probe  string
+		tunnel string
+		want   IPv6Check
+	}{
+		{"leaking", answering, "kxtun0", IPv6Check{Routed: true, Interface: lo, Reachable: true, Leak: true}},
+		{"through the tunnel", answering, lo, IPv6Check{Routed: true, Interface: lo, Reachable: true}},
+		{"blocked", silent.LocalAddr().String(), "kxtun0", IPv6Check{Routed: true, Interface: lo}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkIPv6(tt.probe, tt.tunnel); got != tt.want {
+				t.Errorf("checkIPv6 = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSTUN(t *testing.T) {
+	lo := loopbackInterface(t)
+
+	// Everything leaving by the tunnel comes out of the server's address
+	exit := net.ParseIP("203.0.113.7")
+	check := checkSTUN(context.Background(), newSTUNResponder(t, exit), lo)
+	if check.Leak || check.Error != "" {
+		t.Errorf("clean setup: %+v, want no leak", check)
+	}
+	want := STUNResult{Local: "default route", Interface: lo, Mapped: exit.String()}
+	if len(check.Results) == 0 || check.Results[0] != want {
+		t.Errorf("clean setup results = %+v, want %+v first", check.Results, want)
+	}
+
+	// The default route does not go by the tunnel, and shows the address
+	check = checkSTUN(context.Background(), newSTUNResponder(t, nil), "kxtun0")
+	if !check.Leak {
+		t.Errorf("leaking setup: %+v, want a leak", check)
+	}
+	want = STUNResult{Local: "default route", Interface: lo, Mapped: "127.0.0.1", Leak: true}
+	if len(check.Results) == 0 || check.Results[0] != want {
+		t.Errorf("leaking setup results = %+v, want %+v first", check.Results, want)
+	}
+}
@@ -0,0 +1,239 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"kryptx/internal/utils"
+)
+
+// linkSetup configures addresses and routes of a utun interface driven by
+// the userspace backend. macOS has no policy routing, so a default route
+// is split into two halves and the peer endpoints are pinned to the
+// current gateway instead.
+type linkSetup struct {
+	logger     *utils.Logger
+	name       string
+	cfg        *DeviceConfig
+	hostRoutes []string
+}
+
+func newLinkSetup(name string, cfg *DeviceConfig, logger *utils.Logger) *linkSetup {
+	return &linkSetup{
+		logger: logger,
+		name:   name,
+		cfg:    cfg,
+	}
+}
+
+func (l *linkSetup) Apply() error {
+	if l.cfg.MTU > 0 {
+		if err := l.run("ifconfig", l.name, "mtu", fmt.Sprint(l.cfg.MTU)); err != nil {
+			return err
+		}
+	}
+
+	for _, addr := range l.cfg.Addresses {
+		if addr.IP.To4() != nil {
+			err := l.run("ifconfig", l.name, "inet", addr.String(), addr.IP.String(), "alias")
+			if err != nil {
+				return err
+			}
+		} else if err := l.run("ifconfig", l.name, "inet6", addr.String(), "alias"); err != nil {
+			return err
+		}
+	}
+
+	if err := l.run("ifconfig", l.name, "up"); err != nil {
+		return err
+	}
+
+	return l.addRoutes(nil)
+}
+
+func (l *linkSetup) Remove() {
+	// Routes through the interface vanish with it; only the endpoint
+	// routes via the physical gateway need cleaning up.
+	for _, host := range l.hostRoutes {
+		if err := exec.Command("route", "-q", "-n", "delete", host).Run(); err != nil {
+			l.logger.Error("Failed to remove route to %s: %v", host, err)
+		}
+	}
+	l.hostRoutes = nil
+}
+
+// Update switches the routes over to a new configuration. The endpoint
+// routes are redone, since the servers changed, and of the others only the
+// difference is applied.
+func (l *linkSetup) Update(cfg *DeviceConfig) error {
+	l.Remove()
+
+	current := map[string]bool{}
+	for _, dst := range routeDestinations(l.cfg) {
+		current[dst] = true
+	}
+	wanted := map[string]bool{}
+	for _, dst := range routeDestinations(cfg) {
+		wanted[dst] = true
+	}
+
+	for dst := range current {
+		if wanted[dst] {
+			continue
+		}
+		if err := l.run("route", "-q", "-n", "delete", routeFamily(dst), dst, "-interface", l.name); err != nil {
+			l.logger.Error("Failed to remove route %s: %v", dst, err)
+		}
+	}
+
+	l.cfg = cfg
+	return l.addRoutes(current)
+}
+
+// addRoutes pins the endpoints of full-tunnel peers to the current gateway
+// and routes every destination not in skip through the interface.
+func (l *linkSetup) addRoutes(skip map[string]bool) error {
+	if l.cfg.NoRoutes {
+		return nil
+	}
+
+	for _, peer := range l.cfg.Peers {
+		if peer.Endpoint == nil || !hasDefaultRoute(peer) {
+			continue
+		}
+		if err := l.addHostRoute(peer.Endpoint.IP); err != nil {
+			return err
+		}
+	}
+
+	for _, dst := range routeDestinations(l.cfg) {
+		if skip[dst] {
+			continue
+		}
+		if err := l.addRoute(dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linkSetup) addHostRoute(ip net.IP) error {
+	host := ip.String()
+	for _, existing := range l.hostRoutes {
+		if existing == host {
+			return nil
+		}
+	}
+
+	family := routeFamily(host)
+	gateway, err := defaultGateway(family)
+	if err != nil {
+		return l.error("add route", err)
+	}
+	if err := l.run("route", "-q", "-n", "add", family, host, gateway); err != nil {
+		return err
+	}
+	l.hostRoutes = append(l.hostRoutes, host)
+	return nil
+}
+
+// routeDestinations lists what is routed through the interface. A default
+// route is split into two halves, which win over the real default route
+// without replacing it, and excluded destinations are cut out of them.
+func routeDestinations(cfg *DeviceConfig) []string {
+	if cfg == nil || cfg.NoRoutes {
+		return nil
+	}
+
+	var routes []net.IPNet
+	for _, peer := range cfg.Peers {
+		for _, dst := range peer.AllowedIPs {
+			if !isDefaultRoute(dst) {
+				routes = append(routes, dst)
+				continue
+			}
+			halves := []string{"0.0.0.0/1", "128.0.0.0/1"}
+			if dst.IP.To4() == nil {
+				halves = []string{"::/1", "8000::/1"}
+			}
+			for _, half := range halves {
+				_, ipNet, _ := net.ParseCIDR(half)
+				routes = append(routes, *ipNet)
+			}
+		}
+	}
+
+	var dsts []string
+	seen := map[string]bool{}
+	for _, route := range subtractNets(routes, cfg.Exclude) {
+		if dst := route.String(); !seen[dst] {
+			seen[dst] = true
+			dsts = append(dsts, dst)
+		}
+	}
+	return dsts
+}
+
+func hasDefaultRoute(peer PeerConfig) bool {
+	for _, dst := range peer.AllowedIPs {
+		if isDefaultRoute(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+func routeFamily(dst string) string {
+	if strings.Contains(dst, ":") {
+		return "-inet6"
+	}
+	return "-inet"
+}
+
+func (l *linkSetup) addRoute(dst string) error {
+	return l.run("route", "-q", "-n", "add", routeFamily(dst), dst, "-interface", l.name)
+}
+
+func (l *linkSetup) run(name string, args ...string) error {
+	output, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return l.error(name, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output))))
+	}
+	return nil
+}
+
+func (l *linkSetup) error(op string, err error) error {
+	kind := error(nil)
+	if strings.Contains(err.Error(), "ermission denied") || strings.Contains(err.Error(), "not permitted") {
+		kind = ErrPermissionDenied
+	}
+	return &DeviceError{Op: op, Interface: l.name, Kind: kind, Err: err}
+}
+
+func defaultGateway(family string) (string, error) {
+	output, err := exec.Command("route", "-n", "get", family, "default").Output()
+	if err != nil {
+		return "", fmt.Errorf("looking up default gateway: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "gateway:" {
+			return fields[1], nil
+		}
+	}
+	return "", fmt.Errorf("no default gateway")
+}
+
+// recoverTunnel removes the endpoint routes a crashed session left
+// behind; the utun interface itself died with the process.
+func recoverTunnel(entry JournalEntry, logger *utils.Logger) error {
+	for _, host := range entry.Hosts {
+		if err := exec.Command("route", "-q", "-n", "delete", host).Run(); err != nil {
+			logger.Debug("Removing route to %s: %v", host, err)
+		}
+	}
+	return nil
+}
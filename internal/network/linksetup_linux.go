@@ -0,0 +1,350 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"kryptx/internal/utils"
+)
+
+// Our policy rules get fixed priorities, clear of the ones the kernel
+// hands out from 32765 down to rules added without one, as wg-quick's are.
+// That keeps them in order and tells them apart from other tunnels' rules
+// on recovery. The rules for excluded destinations and the bypass cgroup
+// come first, then the main table without its default route, then the
+// tunnel's table.
+const (
+	bypassRulePriority   = 32000
+	suppressRulePriority = 32001
+	tunnelRulePriority   = 32002
+)
+
+// linkSetup configures the addresses, routes and policy rules of an
+// interface that already carries a WireGuard device, whether that device
+// lives in the kernel or in our own process.
+type linkSetup struct {
+	logger *utils.Logger
+	name   string
+	cfg    *DeviceConfig
+	rules  []*netlink.Rule
+	bypass []*netlink.Rule
+}
+
+func newLinkSetup(name string, cfg *DeviceConfig, logger *utils.Logger) *linkSetup {
+	return &linkSetup{
+		logger: logger,
+		name:   name,
+		cfg:    cfg,
+	}
+}
+
+func (l *linkSetup) Apply() error {
+	link, err := netlink.LinkByName(l.name)
+	if err != nil {
+		return l.error("lookup", err)
+	}
+
+	if l.cfg.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, l.cfg.MTU); err != nil {
+			return l.error("set mtu", err)
+		}
+	}
+
+	for i := range l.cfg.Addresses {
+		if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: &l.cfg.Addresses[i]}); err != nil {
+			return l.error("add address", err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(link); err != nil {
+		return l.error("set up", err)
+	}
+
+	if err := l.addRoutes(link); err != nil {
+		return err
+	}
+	return l.syncBypassRules()
+}
+
+// Remove drops the policy rules; addresses and routes go away together
+// with the interface.
+func (l *linkSetup) Remove() {
+	for _, rule := range append(l.bypass, l.rules...) {
+		if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			l.logger.Error("Failed to remove routing rule %s: %v", rule, err)
+		}
+	}
+	l.rules = nil
+	l.bypass = nil
+}
+
+// Update switches the routes over to a new configuration, dropping those
+// only the old one had. Addresses and MTU stay as they are.
+func (l *linkSetup) Update(cfg *DeviceConfig) error {
+	link, err := netlink.LinkByName(l.name)
+	if err != nil {
+		return l.error("lookup", err)
+	}
+
+	keep := map[string]bool{}
+	if !cfg.NoRoutes {
+		for _, peer := range cfg.Peers {
+			for _, dst := range peer.AllowedIPs {
+				keep[dst.String()] = true
+			}
+		}
+	}
+
+	if !l.cfg.NoRoutes {
+		for _, peer := range l.cfg.Peers {
+			for _, dst := range peer.AllowedIPs {
+				if keep[dst.String()] {
+					continue
+				}
+				if err := netlink.RouteDel(l.route(link, dst)); err != nil && !errors.Is(err, unix.ESRCH) {
+					l.logger.Error("Failed to remove route %s: %v", dst.String(), err)
+				}
+			}
+		}
+	}
+
+	l.cfg = cfg
+	if err := l.addRoutes(link); err != nil {
+		return err
+	}
+	return l.syncBypassRules()
+}
+
+func (l *linkSetup) addRoutes(link netlink.Link) error {
+	if l.cfg.NoRoutes {
+		return nil
+	}
+
+	defaultFamilies := map[int]bool{}
+	appFamilies := map[int]bool{}
+
+	for _, peer := range l.cfg.Peers {
+		for _, dst := range peer.AllowedIPs {
+			switch {
+			case l.cfg.Table != 0:
+			case l.cfg.AppMode == AppModeInclude:
+				appFamilies[ipFamily(dst.IP)] = true
+			case isDefaultRoute(dst):
+				defaultFamilies[ipFamily(dst.IP)] = true
+			}
+
+			if err := netlink.RouteReplace(l.route(link, dst)); err != nil {
+				return l.error("add route", fmt.Errorf("%s: %w", dst.String(), err))
+			}
+		}
+	}
+
+	for family := range defaultFamilies {
+		if err := l.addDefaultRouteRules(family); err != nil {
+			return err
+		}
+	}
+	for family := range appFamilies {
+		if err := l.addAppRule(family); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *linkSetup) route(link netlink.Link, dst net.IPNet) *netlink.Route {
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &dst,
+		Scope:     netlink.SCOPE_LINK,
+	}
+
+	if l.cfg.Table != 0 {
+		// An explicit table gets every route and no rules
+		route.Table = l.cfg.Table
+	} else if isDefaultRoute(dst) || l.cfg.AppMode == AppModeInclude {
+		route.Table = defaultRouteTable
+	}
+	return route
+}
+
+// addDefaultRouteRules sends everything not marked by the tunnel itself
+// through defaultRouteTable, while still letting more specific routes in
+// the main table (the LAN, for example) win.
+func (l *linkSetup) addDefaultRouteRules(family int) error {
+	for _, rule := range l.rules {
+		if rule.Family == family {
+			// Already in place from before an Update
+			return nil
+		}
+	}
+
+	tunnelRule := netlink.NewRule()
+	tunnelRule.Family = family
+	tunnelRule.Table = defaultRouteTable
+	tunnelRule.Mark = l.cfg.FirewallMark
+	tunnelRule.Invert = true
+	tunnelRule.Priority = tunnelRulePriority
+
+	mainRule := netlink.NewRule()
+	mainRule.Family = family
+	mainRule.Table = unix.RT_TABLE_MAIN
+	mainRule.SuppressPrefixlen = 0
+	mainRule.Priority = suppressRulePriority
+
+	rules := []*netlink.Rule{tunnelRule, mainRule}
+
+	// Traffic of the bypass cgroup goes around the tunnel
+	if l.cfg.AppMode == AppModeExclude {
+		bypassRule := netlink.NewRule()
+		bypassRule.Family = family
+		bypassRule.Table = unix.RT_TABLE_MAIN
+		bypassRule.Mark = bypassAppMark
+		bypassRule.Priority = bypassRulePriority
+		rules = append(rules, bypassRule)
+	}
+
+	for _, rule := range rules {
+		if err := l.addRule(rule, &l.rules); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addRule adds rule and keeps it in rules for Remove, unless it was there
+// already: that one is someone else's to remove.
+func (l *linkSetup) addRule(rule *netlink.Rule, rules *[]*netlink.Rule) error {
+	err := netlink.RuleAdd(rule)
+	switch {
+	case errors.Is(err, unix.EEXIST):
+		l.logger.Debug("Routing rule %s already exists", rule)
+		return nil
+	case err != nil:
+		return l.error("add rule", fmt.Errorf("%s: %w", rule, err))
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// addAppRule sends the traffic of the tunnel cgroup, and only that, to
+// the tunnel's routes in defaultRouteTable.
+func (l *linkSetup) addAppRule(family int) error {
+	for _, rule := range l.rules {
+		if rule.Family == family {
+			return nil
+		}
+	}
+
+	rule := netlink.NewRule()
+	rule.Family = family
+	rule.Table = defaultRouteTable
+	rule.Mark = tunnelAppMark
+	rule.Priority = tunnelRulePriority
+	return l.addRule(rule, &l.rules)
+}
+
+// syncBypassRules keeps one rule per excluded destination that looks it up
+// in the main table, before the full-tunnel rules get to it.
+func (l *linkSetup) syncBypassRules() error {
+	wanted := map[string]bool{}
+	for _, dst := range l.cfg.Exclude {
+		wanted[dst.String()] = true
+	}
+
+	present := map[string]bool{}
+	kept := l.bypass[:0]
+	for _, rule := range l.bypass {
+		if wanted[rule.Dst.String()] {
+			present[rule.Dst.String()] = true
+			kept = append(kept, rule)
+			continue
+		}
+		if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+			l.logger.Error("Failed to remove routing rule %s: %v", rule, err)
+		}
+	}
+	l.bypass = kept
+
+	for _, dst := range l.cfg.Exclude {
+		if present[dst.String()] {
+			continue
+		}
+		rule := netlink.NewRule()
+		rule.Family = ipFamily(dst.IP)
+		rule.Dst = &net.IPNet{IP: dst.IP, Mask: dst.Mask}
+		rule.Table = unix.RT_TABLE_MAIN
+		rule.Priority = bypassRulePriority
+		if err := l.addRule(rule, &l.bypass); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *linkSetup) error(op string, err error) error {
+	return &DeviceError{Op: op, Interface: l.name, Kind: classifyDeviceError(err), Err: err}
+}
+
+func ipFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+// recoverTunnel removes an interface and the policy rules a crashed
+// session left behind.
+func recoverTunnel(entry JournalEntry, logger *utils.Logger) error {
+	if entry.FirewallMark != 0 {
+		for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+			rules, err := netlink.RuleList(family)
+			if err != nil {
+				return fmt.Errorf("listing rules: %w", err)
+			}
+			for i := range rules {
+				rule := &rules[i]
+				// Only by their priorities are ours told from the same
+				// rules of wg-quick
+				ours := (rule.Priority == tunnelRulePriority && rule.Table == defaultRouteTable &&
+					((rule.Mark == entry.FirewallMark && rule.Invert) || rule.Mark == tunnelAppMark)) ||
+					(rule.Priority == suppressRulePriority && rule.Table == unix.RT_TABLE_MAIN && rule.SuppressPrefixlen == 0) ||
+					(rule.Priority == bypassRulePriority && rule.Table == unix.RT_TABLE_MAIN &&
+						(rule.Mark == bypassAppMark || rule.Dst != nil))
+				if !ours {
+					continue
+				}
+				if err := netlink.RuleDel(rule); err != nil && !errors.Is(err, unix.ENOENT) {
+					return fmt.Errorf("removing rule %s: %w", rule, err)
+				}
+			}
+		}
+	}
+
+	link, err := netlink.LinkByName(entry.Interface)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("looking up %s: %w", entry.Interface, err)
+	}
+
+	if link.Type() != "wireguard" && link.Type() != "tuntap" {
+		logger.Warning("Leaving %s alone, it is a %s link", entry.Interface, link.Type())
+		return nil
+	}
+
+	logger.Info("Removing leftover interface %s", entry.Interface)
+	if err := netlink.LinkDel(link); err != nil {
+		return fmt.Errorf("removing %s: %w", entry.Interface, err)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin
+
+package network
+
+import (
+	"fmt"
+	"runtime"
+
+	"kryptx/internal/utils"
+)
+
+type linkSetup struct {
+	name string
+}
+
+func newLinkSetup(name string, cfg *DeviceConfig, logger *utils.Logger) *linkSetup {
+	return &linkSetup{name: name}
+}
+
+func (l *linkSetup) Apply() error {
+	return &DeviceError{Op: "configure", Interface: l.name, Kind: ErrUnsupported, Err: fmt.Errorf("interface setup on %s", runtime.GOOS)}
+}
+
+func (l *linkSetup) Update(cfg *DeviceConfig) error {
+	return l.Apply()
+}
+
+func (l *linkSetup) Remove() {}
+
+func recoverTunnel(entry JournalEntry, logger *utils.Logger) error {
+	return nil
+}
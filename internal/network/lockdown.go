@@ -0,0 +1,197 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+const (
+	// LockdownPath holds the kill switch rules loaded at boot while
+	// lockdown is enabled. Its existence is what enables it.
+	LockdownPath = "/etc/kryptx/lockdown.json"
+
+	// lockdownUnit loads LockdownPath before the network comes up. It is
+	// installed by scripts/install.sh.
+	lockdownUnit = "kryptx-lockdown.service"
+)
+
+// LockdownStatus describes the always-on mode, in which traffic is blocked
+// from boot until KryptX connects and again whenever it is not connected.
+type LockdownStatus struct {
+	Enabled  bool // the rules are installed
+	AtBoot   bool // the unit loading them at boot is enabled
+	Blocking bool // the kill switch table is loaded right now
+	Session  bool // a session holds the kill switch; lockdown resumes after it
+	Err      error
+}
+
+// LockdownEnabled reports whether the lockdown rules are installed. When
+// that cannot be told, it errs on the side of lockdown and says why.
+func LockdownEnabled() (bool, error) {
+	if runtime.GOOS != "linux" {
+		return false, nil
+	}
+	_, err := os.Stat(LockdownPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("checking for lockdown: %w", err)
+	}
+	return true, nil
+}
+
+// EnableLockdown installs the lockdown rules for cfg and enables the unit
+// that loads them at boot. They let out only what connecting needs: the
+// endpoints of every server and peer, DHCP and, with allow_lan, the LAN.
+// Unless a session has the kill switch up, they are loaded right away.
+func EnableLockdown(cfg *config.Config, logger *utils.Logger) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("lockdown: %w", ErrUnsupported)
+	}
+
+	k := NewKillSwitch(cfg.Network.Interface, logger)
+
+	endpoints, err := lockdownEndpoints(cfg, logger)
+	if err != nil {
+		return err
+	}
+	if err := k.SetEndpoints(endpoints); err != nil {
+		return err
+	}
+
+	if cfg.Security.AllowLAN {
+		lan, err := parseLANNetworks(cfg.Security.LANNetworks)
+		if err != nil {
+			return err
+		}
+		if err := k.SetLAN(lan); err != nil {
+			return err
+		}
+	}
+
+	if err := k.InstallPersistent(LockdownPath); err != nil {
+		return err
+	}
+
+	if !sessionHoldsKillSwitch(cfg) {
+		if err := loadLockdown(); err != nil {
+			return err
+		}
+	}
+
+	if output, err := exec.Command("sudo", "systemctl", "enable", lockdownUnit).CombinedOutput(); err != nil {
+		return fmt.Errorf("enabling %s (was scripts/install.sh run?): %w: %s", lockdownUnit, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// DisableLockdown disables the boot unit and removes the rules, unless a
+// session still has the kill switch up; it then simply ends with it.
+func DisableLockdown(cfg *config.Config) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("lockdown: %w", ErrUnsupported)
+	}
+
+	if output, err := exec.Command("sudo", "systemctl", "disable", lockdownUnit).CombinedOutput(); err != nil {
+		return fmt.Errorf("disabling %s: %w: %s", lockdownUnit, err, strings.TrimSpace(string(output)))
+	}
+	if err := runCommand("sudo", "rm", "-f", LockdownPath); err != nil {
+		return fmt.Errorf("removing %s: %w", LockdownPath, err)
+	}
+
+	if !sessionHoldsKillSwitch(cfg) {
+		return nftFirewall{}.remove()
+	}
+	return nil
+}
+
+func GetLockdownStatus(cfg *config.Config) LockdownStatus {
+	enabled, err := LockdownEnabled()
+	status := LockdownStatus{
+		Enabled: enabled,
+		Session: sessionHoldsKillSwitch(cfg),
+		Err:     err,
+	}
+	if runtime.GOOS != "linux" {
+		return status
+	}
+
+	status.AtBoot = exec.Command("systemctl", "is-enabled", "--quiet", lockdownUnit).Run() == nil
+	status.Blocking = exec.Command("sudo", "nft", "list", "table", nftFamily, nftTable).Run() == nil
+	return status
+}
+
+// loadLockdown replaces the kill switch table with the lockdown rules in
+// one transaction, so nothing gets out in between.
+func loadLockdown() error {
+	output, err := exec.Command("sudo", "nft", "-j", "-f", LockdownPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to load lockdown rules: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// lockdownEndpoints resolves the endpoints of all servers, for any of them
+// to be reachable once locked down. Host names are resolved now, since
+// DNS is blocked later on; the rules need renewing if they move.
+func lockdownEndpoints(cfg *config.Config, logger *utils.Logger) ([]*net.UDPAddr, error) {
+	var hosts []string
+	for _, server := range cfg.ServerList() {
+		hosts = append(hosts, net.JoinHostPort(server.Endpoint, strconv.Itoa(server.Port)))
+	}
+	for _, peer := range cfg.Peers {
+		if peer.Endpoint != "" {
+			hosts = append(hosts, peer.Endpoint)
+		}
+	}
+
+	resolveNetwork := "udp"
+	if cfg.Network.DisableIPv6 {
+		resolveNetwork = "udp4"
+	}
+
+	var endpoints []*net.UDPAddr
+	for _, host := range hosts {
+		addr, err := net.ResolveUDPAddr(resolveNetwork, host)
+		if err != nil {
+			return nil, fmt.Errorf("resolving endpoint %s: %w", host, err)
+		}
+		if hostname, _, _ := net.SplitHostPort(host); net.ParseIP(hostname) == nil {
+			logger.Warning("Endpoint %s is a host name, which cannot be looked up while locked down; configure its address %s instead", host, addr.IP)
+		}
+		endpoints = append(endpoints, addr)
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no server endpoints configured")
+	}
+	return endpoints, nil
+}
+
+// sessionHoldsKillSwitch tells from the journal whether a client, running
+// or crashed, has the kill switch table in use.
+func sessionHoldsKillSwitch(cfg *config.Config) bool {
+	if cfg.Network.JournalPath == "" {
+		return false
+	}
+	journal, err := OpenJournal(cfg.Network.JournalPath)
+	if err != nil {
+		return false
+	}
+	for _, entry := range journal.Entries() {
+		if entry.Kind == JournalKillSwitch {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsEnv marks the test binary run inside network and mount namespaces
+// of its own, where the test may change the network and resolv.conf at
+// will.
+const netnsEnv = "KRYPTX_TEST_NETNS"
+
+// physicalLink stands in for the host's own interface in the namespace.
+const physicalLink = "kxphys0"
+
+// inNetns runs the calling test again in new network and mount namespaces
+// and reports whether this is that run. Without CAP_NET_ADMIN or ip, the
+// test is skipped.
+func inNetns(t *testing.T) bool {
+	t.Helper()
+
+	if os.Getenv(netnsEnv) != "" {
+		return true
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs ip")
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), netnsEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWNS}
+	output, err := cmd.CombinedOutput()
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("needs CAP_NET_ADMIN and CAP_SYS_ADMIN for the namespaces")
+	}
+	if err != nil {
+		t.Fatalf("in network namespace: %v\n%s", err, output)
+	}
+	if strings.Contains(string(output), "--- SKIP") {
+		t.Skipf("in network namespace:\n%s", output)
+	}
+	t.Logf("in network namespace:\n%s", output)
+	return false
+}
+
+func runIP(t *testing.T, args ...string) {
+	t.Helper()
+	if output, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+		t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, output)
+	}
+}
+
+// bindResolvConf puts content in place of resolv.conf, in the mount
+// namespace of inNetns only.
+func bindResolvConf(t *testing.T, content string) {
+	t.Helper()
+
+	// Mounts made from here must not reach the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		t.Fatalf("making mounts private: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mount(path, resolvConfPath, "", unix.MS_BIND, ""); err != nil {
+		t.Fatalf("mounting over %s: %v", resolvConfPath, err)
+	}
+	t.Cleanup(func() { unix.Unmount(resolvConfPath, 0) })
+}
@@ -0,0 +1,148 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"kryptx/internal/config"
+)
+
+const (
+	ProbeHandshake = "handshake"
+	ProbeICMP      = "icmp"
+	ProbeUDP       = "udp"
+)
+
+// Prober measures one round trip to a server.
+type Prober interface {
+	Probe(ctx context.Context, server config.ServerConfig) (time.Duration, error)
+}
+
+func NewProber(cfg *config.Config) (Prober, error) {
+	switch cfg.Selection.Method {
+	case ProbeHandshake, "":
+		return newHandshakeProber(cfg.Network.PrivateKey)
+	case ProbeICMP:
+		return ICMPProber{}, nil
+	case ProbeUDP:
+		return UDPProber{}, nil
+	default:
+		return nil, fmt.Errorf("unknown probe method %q", cfg.Selection.Method)
+	}
+}
+
+func resolveServer(ctx context.Context, server config.ServerConfig) (*net.UDPAddr, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, server.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", server.Endpoint)
+	}
+	return &net.UDPAddr{IP: addrs[0].IP, Zone: addrs[0].Zone, Port: server.Port}, nil
+}
+
+// UDPProber sends a datagram to the server's port and waits for any
+// answer. WireGuard itself never answers, so this needs an echo service on
+// the server side.
+type UDPProber struct{}
+
+func (UDPProber) Probe(ctx context.Context, server config.ServerConfig) (time.Duration, error) {
+	addr, err := resolveServer(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	return roundTrip(ctx, addr, []byte("kryptx-probe"))
+}
+
+// roundTrip sends one datagram and times the first reply.
+func roundTrip(ctx context.Context, addr *net.UDPAddr, payload []byte) (time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(payload); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 512)
+	if _, err := conn.Read(buf); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// ICMPProber pings the server with unprivileged ICMP sockets, which Linux
+// only allows for groups listed in net.ipv4.ping_group_range.
+type ICMPProber struct{}
+
+func (ICMPProber) Probe(ctx context.Context, server config.ServerConfig) (time.Duration, error) {
+	addr, err := resolveServer(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+
+	network, listen, proto := "udp4", "0.0.0.0", 1
+	var echoType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr.IP.To4() == nil {
+		network, listen, proto = "udp6", "::", 58
+		echoType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, listen)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	seq := rand.Intn(1 << 16)
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: seq, Data: []byte("kryptx-probe")},
+	}
+	packet, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.WriteTo(packet, &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}); err != nil {
+		return 0, err
+	}
+
+	// The kernel rewrites the ID on these sockets, so match on Seq only
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == seq {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	monitorInterval = 10 * time.Second
+
+	// After bringing the tunnel back up we wait this long for a fresh
+	// handshake before calling the attempt a failure.
+	handshakeWait = 15 * time.Second
+)
+
+type ReconnectEventType string
+
+const (
+	EventTunnelDead    ReconnectEventType = "tunnel_dead"
+	EventReconnecting  ReconnectEventType = "reconnecting"
+	EventAttemptFailed ReconnectEventType = "attempt_failed"
+	EventReconnected   ReconnectEventType = "reconnected"
+	EventGaveUp        ReconnectEventType = "gave_up"
+)
+
+type ReconnectEvent struct {
+	Type    ReconnectEventType
+	Time    time.Time
+	Attempt int
+	// Delay is the wait before the next attempt after a failed one
+	Delay time.Duration
+	Err   error
+}
+
+// SubscribeReconnect returns a channel of reconnection events and a
+// function that ends the subscription.
+func (v *VPNClient) SubscribeReconnect() (<-chan ReconnectEvent, func()) {
+	return v.reconnectEvents.subscribe()
+}
+
+func (v *VPNClient) emitReconnect(event ReconnectEvent) {
+	event.Time = time.Now()
+	v.reconnectEvents.publish(event)
+}
+
+func (v *VPNClient) monitorConnection(ctx context.Context) {
+	ticker := time.NewTicker(monitorInterval)
+	defer ticker.Stop()
+
+	// Split tunnel host names are looked up again on their own schedule
+	var refresh <-chan time.Time
+	var splitChanged <-chan struct{}
+	if v.split != nil {
+		splitChanged = v.split.changed
+		if interval := v.config.Network.SplitTunnel.Refresh; interval > 0 && len(v.split.include.domains)+len(v.split.exclude.domains) > 0 {
+			refreshTicker := time.NewTicker(interval)
+			defer refreshTicker.Stop()
+			refresh = refreshTicker.C
+		}
+	}
+
+	var killSwitchCheck <-chan time.Time
+	if v.killSwitch != nil {
+		checkTicker := time.NewTicker(killSwitchCheckInterval)
+		defer checkTicker.Stop()
+		killSwitchCheck = checkTicker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-killSwitchCheck:
+			v.checkKillSwitch()
+		case <-refresh:
+			v.split.resolve(ctx)
+		case <-splitChanged:
+			v.updateSplit()
+		case <-ticker.C:
+			err := v.checkTunnel()
+			if err == nil {
+				continue
+			}
+
+			v.logger.Warning("Connection lost: %v", err)
+			v.emitReconnect(ReconnectEvent{Type: EventTunnelDead, Err: err})
+
+			failover := v.canFailover()
+			if !v.config.Reconnect.Enabled && !failover {
+				v.state.transition(StateError, "connection lost", err)
+				return
+			}
+
+			// Fails only when a disconnect got there first
+			if v.state.transition(StateReconnecting, err.Error(), err) != nil {
+				return
+			}
+
+			if failover {
+				failErr := v.failover(ctx, err)
+				if failErr == nil {
+					if v.state.transition(StateConnected, "failed over to "+v.ActiveServer().Name, nil) != nil {
+						return
+					}
+					continue
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if !v.config.Reconnect.Enabled {
+					v.state.transition(StateError, "failover failed", failErr)
+					return
+				}
+			}
+
+			if err := v.reconnect(ctx); err != nil {
+				if ctx.Err() == nil {
+					v.logger.Error("Giving up on reconnecting: %v", err)
+					v.state.transition(StateError, "reconnect gave up", err)
+				}
+				return
+			}
+
+			if v.state.transition(StateConnected, "reconnected", nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkTunnel reports the tunnel dead when the device is gone or when no
+// handshake has completed for longer than the configured timeout. Time
+// spent asleep counts too, which is what we want after a suspend.
+func (v *VPNClient) checkTunnel() error {
+	if err := v.backend.Health(); err != nil {
+		return err
+	}
+
+	stats, err := v.backend.Stats()
+	if err != nil {
+		return err
+	}
+
+	last := stats.LastHandshake
+	if last.IsZero() || last.Before(v.tunnelUpAt) {
+		last = v.tunnelUpAt
+	}
+
+	if age := time.Since(last); age > v.config.Reconnect.HandshakeTimeout {
+		return fmt.Errorf("no handshake for %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+// reconnect tears the tunnel down and brings it back up until a handshake
+// succeeds or the budget runs out. The kill switch and DNS settings are
+// left alone throughout, so nothing leaks while the tunnel is down.
+func (v *VPNClient) reconnect(ctx context.Context) error {
+	cfg := v.config.Reconnect
+	started := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		v.logger.Info("Reconnect attempt %d...", attempt)
+		v.emitReconnect(ReconnectEvent{Type: EventReconnecting, Attempt: attempt})
+
+		err := v.restartTunnel(ctx)
+		if err == nil {
+			v.logger.Info("Reconnected after %d attempt(s)", attempt)
+			v.emitReconnect(ReconnectEvent{Type: EventReconnected, Attempt: attempt})
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		delay := backoff(attempt, cfg.InitialBackoff, cfg.MaxBackoff)
+		exhausted := (cfg.MaxAttempts > 0 && attempt >= cfg.MaxAttempts) ||
+			(cfg.MaxDuration > 0 && time.Since(started)+delay > cfg.MaxDuration)
+
+		if exhausted {
+			v.emitReconnect(ReconnectEvent{Type: EventGaveUp, Attempt: attempt, Err: err})
+			return fmt.Errorf("after %d attempt(s): %w", attempt, err)
+		}
+
+		v.logger.Warning("Reconnect attempt %d failed: %v (retrying in %s)", attempt, err, delay.Round(time.Millisecond))
+		v.emitReconnect(ReconnectEvent{Type: EventAttemptFailed, Attempt: attempt, Delay: delay, Err: err})
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (v *VPNClient) restartTunnel(ctx context.Context) error {
+	if err := v.backend.Down(); err != nil {
+		v.logger.Debug("Tearing down tunnel: %v", err)
+	}
+
+	// The endpoint may have moved; if it cannot be resolved right now
+	// (the kill switch blocks plain DNS) keep the last known address.
+	devCfg, err := v.deviceConfigFor(v.ActiveServer())
+	if err != nil {
+		if v.deviceConfig == nil {
+			return err
+		}
+		v.logger.Debug("Rebuilding WireGuard config: %v", err)
+		devCfg = v.deviceConfig
+	}
+	if err := v.openKillSwitch(devCfg); err != nil {
+		return err
+	}
+
+	if err := v.backend.Up(devCfg); err != nil {
+		return err
+	}
+	v.deviceConfig = devCfg
+	v.tunnelUpAt = time.Now()
+	v.stats.reset()
+
+	if v.dnsManager != nil {
+		if err := v.dnsManager.Reapply(); err != nil {
+			v.logger.Error("Configuring DNS on the new tunnel: %v", err)
+		}
+	}
+
+	return v.waitForHandshake(ctx, v.tunnelUpAt)
+}
+
+// waitForHandshake waits for the server, the first peer, to complete a
+// handshake. Other peers handshaking says nothing about the server.
+func (v *VPNClient) waitForHandshake(ctx context.Context, since time.Time) error {
+	server := v.deviceConfig.Peers[0].PublicKey
+
+	timeout := time.NewTimer(handshakeWait)
+	defer timeout.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("no handshake within %s", handshakeWait)
+		case <-ticker.C:
+			peers, err := v.backend.Peers()
+			if err != nil {
+				continue
+			}
+			for _, peer := range peers {
+				if peer.PublicKey == server && peer.LastHandshake.After(since) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// backoff doubles the delay for each attempt up to max and then picks a
+// random point in its upper half, so that many clients losing the same
+// server do not come back in lockstep.
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
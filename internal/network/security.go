@@ -0,0 +1,69 @@
+package network
+
+import (
+	"errors"
+	"time"
+)
+
+// The live firewall rules are read back this often while connected.
+const killSwitchCheckInterval = 15 * time.Second
+
+type SecurityEventType string
+
+const (
+	// The kill switch rules were changed or removed behind our back
+	EventKillSwitchDrift SecurityEventType = "killswitch_drift"
+	// Rules of someone else's come before the kill switch and let
+	// traffic past it
+	EventKillSwitchBypass SecurityEventType = "killswitch_bypass"
+)
+
+// SecurityEvent reports a threat to the leak protection. Err describes
+// what was found; Restored tells whether the protection is back in force.
+type SecurityEvent struct {
+	Type     SecurityEventType
+	Time     time.Time
+	Err      error
+	Restored bool
+}
+
+var errKillSwitchBypass = errors.New("foreign rules bypass the kill switch")
+
+// SubscribeSecurity returns a channel of security events and a function
+// that ends the subscription.
+func (v *VPNClient) SubscribeSecurity() (<-chan SecurityEvent, func()) {
+	return v.securityEvents.subscribe()
+}
+
+func (v *VPNClient) emitSecurity(event SecurityEvent) {
+	event.Time = time.Now()
+	v.securityEvents.publish(event)
+}
+
+// checkKillSwitch compares the live rules with the ones loaded and loads
+// them again when they differ, which happens when a firewall manager such
+// as ufw or Docker rewrites the chains. It runs on the monitor goroutine,
+// like everything else that touches the kill switch while connected.
+func (v *VPNClient) checkKillSwitch() {
+	err := v.killSwitch.Verify()
+	if err == nil || errors.Is(err, ErrUnsupported) {
+		return
+	}
+
+	event := SecurityEvent{Type: EventKillSwitchDrift, Err: err}
+	if errors.Is(err, errKillSwitchBypass) {
+		event.Type = EventKillSwitchBypass
+	}
+	v.logger.Warning("Kill switch tampered with: %v", err)
+
+	if err := v.killSwitch.Reapply(); err != nil {
+		v.logger.Error("Reapplying kill switch: %v", err)
+	} else if err := v.killSwitch.Verify(); err != nil {
+		v.logger.Error("Kill switch still differs after reapplying: %v", err)
+	} else {
+		v.logger.Info("Kill switch rules reapplied")
+		event.Restored = true
+	}
+
+	v.emitSecurity(event)
+}
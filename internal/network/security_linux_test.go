@@ -0,0 +1,140 @@
+package network
+
+import (
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+// fakeNft answers the listing with objects until a batch is loaded, and
+// the recorded listing of what the batch holds after, unless failLoad.
+type fakeNft struct {
+	t        *testing.T
+	objects  []any
+	failLoad bool
+}
+
+func (f *fakeNft) run(call []string) *exec.Cmd {
+	if slices.Equal(call, []string{"sudo", "nft", "-j", "-f", "-"}) {
+		if f.failLoad {
+			return shellCommand(`echo "Error: Could not process rule: Operation not permitted" >&2; exit 1`)
+		}
+		f.objects = recordedNftListing(f.t)
+		return nil
+	}
+	return nftListingCommand(f.t, f.objects)(call)
+}
+
+func TestCheckKillSwitch(t *testing.T) {
+	rules := killSwitchTestRulesets(t)["killswitch_full"]
+	withoutRule := func() []any {
+		return slices.Delete(recordedNftListing(t), 4, 5)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		firewall linuxFirewall
+		run      func(call []string) *exec.Cmd
+		// want is nil when no event is expected
+		want *SecurityEvent
+	}{
+		{
+			name:     "nft untouched",
+			firewall: nftFirewall{},
+			run:      (&fakeNft{t: t, objects: recordedNftListing(t)}).run,
+		},
+		{
+			name:     "nft rule removed",
+			firewall: nftFirewall{},
+			run:      (&fakeNft{t: t, objects: withoutRule()}).run,
+			want:     &SecurityEvent{Type: EventKillSwitchDrift, Restored: true},
+		},
+		{
+			name:     "nft reload refused",
+			firewall: nftFirewall{},
+			run:      (&fakeNft{t: t, objects: withoutRule(), failLoad: true}).run,
+			want:     &SecurityEvent{Type: EventKillSwitchDrift},
+		},
+		{
+			name:     "iptables chain gone",
+			firewall: iptablesFirewall{},
+			run: func() func(call []string) *exec.Cmd {
+				f := newFakeIptables(rules)
+				f.chain["ip6tables"] = nil
+				return f.run
+			}(),
+			want: &SecurityEvent{Type: EventKillSwitchDrift, Restored: true},
+		},
+		{
+			name:     "iptables bypass",
+			firewall: iptablesFirewall{},
+			run: func() func(call []string) *exec.Cmd {
+				f := newFakeIptables(rules)
+				f.output["iptables"] = []string{"-A OUTPUT -j ACCEPT", iptablesJump}
+				return f.run
+			}(),
+			want: &SecurityEvent{Type: EventKillSwitchBypass, Restored: true},
+		},
+		{
+			name:     "iptables bypass that cannot be hooked ahead of",
+			firewall: iptablesFirewall{},
+			run: func() func(call []string) *exec.Cmd {
+				f := newFakeIptables(rules)
+				f.output["iptables"] = []string{"-A OUTPUT -j ACCEPT", iptablesJump}
+				return func(call []string) *exec.Cmd {
+					if slices.Contains(call, "-I") {
+						return shellCommand(`echo "iptables: Index of insertion too big." >&2; exit 1`)
+					}
+					return f.run(call)
+				}
+			}(),
+			want: &SecurityEvent{Type: EventKillSwitchBypass},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, testConfig(t, "primary"), NewFakeBackend())
+			client.killSwitch = &KillSwitch{
+				logger:        client.logger,
+				iface:         rules.iface,
+				active:        true,
+				firewall:      tt.firewall,
+				endpoints:     rules.endpoints,
+				lan:           rules.lan,
+				exemptions:    rules.exemptions,
+				markExemption: rules.markExemption,
+			}
+			events, unsubscribe := client.SubscribeSecurity()
+			defer unsubscribe()
+			useFakeCommands(t, tt.run)
+
+			client.checkKillSwitch()
+
+			select {
+			case event := <-events:
+				switch {
+				case tt.want == nil:
+					t.Errorf("event %+v for untouched rules", event)
+				case event.Type != tt.want.Type || event.Restored != tt.want.Restored:
+					t.Errorf("event %s restored %v, want %s restored %v", event.Type, event.Restored, tt.want.Type, tt.want.Restored)
+				case event.Err == nil || event.Time.IsZero():
+					t.Errorf("event %+v without the error or time", event)
+				}
+			default:
+				if tt.want != nil {
+					t.Errorf("no event, want %s", tt.want.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckKillSwitchInactive(t *testing.T) {
+	client := newTestClient(t, testConfig(t, "primary"), NewFakeBackend())
+	client.killSwitch = &KillSwitch{logger: client.logger, iface: "kryptx0", firewall: nftFirewall{}}
+	fake := useFakeCommands(t, nil)
+
+	client.checkKillSwitch()
+	if len(fake.calls) != 0 {
+		t.Errorf("commands run for an inactive kill switch: %q", fake.calls)
+	}
+}
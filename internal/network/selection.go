@@ -0,0 +1,53 @@
+package network
+
+import (
+	"context"
+
+	"kryptx/internal/config"
+)
+
+// pickServer returns the configured server, or with automatic selection
+// the one that answers fastest. Without any answer it falls back to the
+// first server, so that Connect still reports a meaningful error.
+func (v *VPNClient) pickServer(ctx context.Context) config.ServerConfig {
+	servers := v.config.ServerList()
+	if !v.config.AutoSelect() || len(servers) == 1 {
+		return v.config.ActiveServer()
+	}
+
+	server, latency, err := v.selector.Best(ctx, servers)
+	if err != nil {
+		v.logger.Warning("Server selection failed, using %s: %v", servers[0].Name, err)
+		return servers[0]
+	}
+
+	v.logger.Info("Selected server %s (%s, %.0f%% loss)", server.Name, latency.RTT, latency.Loss*100)
+	v.selector.Settle(ctx, server.Name)
+	return server
+}
+
+// ProbeServers measures every server again. While the tunnel is up the
+// server in use is left out, since a handshake probe would take over its
+// session; its earlier result is kept.
+func (v *VPNClient) ProbeServers(ctx context.Context) []ServerLatency {
+	servers := v.Servers()
+
+	if state := v.State(); state != StateDisconnected && state != StateError {
+		current := v.ActiveServer().Name
+		for i, server := range servers {
+			if server.Name == current {
+				servers = append(servers[:i:i], servers[i+1:]...)
+				break
+			}
+		}
+	}
+
+	v.selector.Refresh(ctx, servers)
+	return v.selector.Results()
+}
+
+// ServerLatencies returns the latest probe results, best first, without
+// probing.
+func (v *VPNClient) ServerLatencies() []ServerLatency {
+	return v.selector.Results()
+}
@@ -0,0 +1,213 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"kryptx/internal/config"
+)
+
+// probeSpacing separates the probes to one server. WireGuard drops
+// handshake initiations from a peer that arrive within 50ms of each other.
+const probeSpacing = 100 * time.Millisecond
+
+// ServerLatency is the outcome of probing one server.
+type ServerLatency struct {
+	Server string
+	// RTT averages the probes that got a reply
+	RTT  time.Duration
+	Loss float64
+	// Err is the last probe error, set when every probe failed
+	Err  error
+	Time time.Time
+}
+
+// Reachable reports whether any probe got a reply.
+func (l ServerLatency) Reachable() bool {
+	return l.Loss < 1
+}
+
+// score is the expected time to get a reply when lost probes are simply
+// retried, which ranks a fast but lossy server below a steady one.
+func (l ServerLatency) score() float64 {
+	if !l.Reachable() {
+		return math.Inf(1)
+	}
+	return float64(l.RTT) / (1 - l.Loss)
+}
+
+// Selector ranks servers by probing them, keeping the results for a while
+// so that reconnects and the GUI do not probe all over again.
+type Selector struct {
+	mu       sync.Mutex
+	prober   Prober
+	attempts int
+	timeout  time.Duration
+	ttl      time.Duration
+	cache    map[string]ServerLatency
+}
+
+func NewSelector(prober Prober, cfg config.SelectionConfig) *Selector {
+	s := &Selector{
+		prober:   prober,
+		attempts: cfg.Attempts,
+		timeout:  cfg.Timeout,
+		ttl:      cfg.CacheTTL,
+		cache:    make(map[string]ServerLatency),
+	}
+	if s.attempts <= 0 {
+		s.attempts = 1
+	}
+	if s.timeout <= 0 {
+		s.timeout = time.Second
+	}
+	return s
+}
+
+// Rank returns the servers from best to worst, probing concurrently those
+// without a fresh cached result.
+func (s *Selector) Rank(ctx context.Context, servers []config.ServerConfig) []ServerLatency {
+	return s.rank(ctx, servers, false)
+}
+
+// Refresh is Rank ignoring the cache.
+func (s *Selector) Refresh(ctx context.Context, servers []config.ServerConfig) []ServerLatency {
+	return s.rank(ctx, servers, true)
+}
+
+// Best picks the best reachable server.
+func (s *Selector) Best(ctx context.Context, servers []config.ServerConfig) (config.ServerConfig, ServerLatency, error) {
+	ranked := s.Rank(ctx, servers)
+	if len(ranked) == 0 || !ranked[0].Reachable() {
+		err := errors.New("no server answered")
+		if len(ranked) > 0 && ranked[0].Err != nil {
+			err = ranked[0].Err
+		}
+		return config.ServerConfig{}, ServerLatency{}, err
+	}
+
+	for _, server := range servers {
+		if server.Name == ranked[0].Server {
+			return server, ranked[0], nil
+		}
+	}
+	return config.ServerConfig{}, ServerLatency{}, errors.New("ranked server vanished")
+}
+
+// Settle waits until a handshake from the tunnel itself can no longer be
+// mistaken by the server for a replay or flood of the last probe.
+func (s *Selector) Settle(ctx context.Context, name string) {
+	s.mu.Lock()
+	last := s.cache[name].Time
+	s.mu.Unlock()
+
+	if wait := probeSpacing - time.Since(last); wait > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Results returns every cached result, best first, including stale ones.
+func (s *Selector) Results() []ServerLatency {
+	s.mu.Lock()
+	results := make([]ServerLatency, 0, len(s.cache))
+	for _, result := range s.cache {
+		results = append(results, result)
+	}
+	s.mu.Unlock()
+
+	sortLatencies(results)
+	return results
+}
+
+func (s *Selector) rank(ctx context.Context, servers []config.ServerConfig, refresh bool) []ServerLatency {
+	results := make([]ServerLatency, len(servers))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		if cached, ok := s.cached(server.Name); ok && !refresh {
+			results[i] = cached
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, server config.ServerConfig) {
+			defer wg.Done()
+			results[i] = s.probe(ctx, server)
+		}(i, server)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	for _, result := range results {
+		// A cancelled round says nothing about the server
+		if ctx.Err() == nil {
+			s.cache[result.Server] = result
+		}
+	}
+	s.mu.Unlock()
+
+	sortLatencies(results)
+	return results
+}
+
+func (s *Selector) cached(name string) (ServerLatency, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.cache[name]
+	if !ok || time.Since(result.Time) > s.ttl {
+		return ServerLatency{}, false
+	}
+	return result, true
+}
+
+func (s *Selector) probe(ctx context.Context, server config.ServerConfig) ServerLatency {
+	result := ServerLatency{Server: server.Name}
+
+	var (
+		total   time.Duration
+		replies int
+		lastErr error
+	)
+	for i := 0; i < s.attempts && ctx.Err() == nil; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(probeSpacing):
+			}
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		rtt, err := s.prober.Probe(probeCtx, server)
+		cancel()
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		total += rtt
+		replies++
+	}
+
+	result.Time = time.Now()
+	result.Loss = 1 - float64(replies)/float64(s.attempts)
+	if replies > 0 {
+		result.RTT = total / time.Duration(replies)
+	} else {
+		result.Err = lastErr
+	}
+	return result
+}
+
+func sortLatencies(results []ServerLatency) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score() < results[j].score()
+	})
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kryptx/internal/config"
+)
+
+// udpResponder echoes probes after delay, dropping every dropEvery-th one
+// (none when zero, all when one).
+type udpResponder struct {
+	conn     net.PacketConn
+	delay    time.Duration
+	received atomic.Int32
+}
+
+func newUDPResponder(t *testing.T, delay time.Duration, dropEvery int32) *udpResponder {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	r := &udpResponder{conn: conn, delay: delay}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			count := r.received.Add(1)
+			if dropEvery > 0 && count%dropEvery == 0 {
+				continue
+			}
+			reply := append([]byte(nil), buf[:n]...)
+			time.AfterFunc(r.delay, func() { conn.WriteTo(reply, addr) })
+		}
+	}()
+	return r
+}
+
+func (r *udpResponder) server(name string) config.ServerConfig {
+	return config.ServerConfig{
+		Name:     name,
+		Endpoint: "127.0.0.1",
+		Port:     r.conn.LocalAddr().(*net.UDPAddr).Port,
+	}
+}
+
+func TestSelectorRank(t *testing.T) {
+	fast := newUDPResponder(t, 0, 0)
+	// 30ms replies with half of them lost cost about 60ms each
+	lossy := newUDPResponder(t, 30*time.Millisecond, 2)
+	slow := newUDPResponder(t, 150*time.Millisecond, 0)
+	dead := newUDPResponder(t, 0, 1)
+
+	servers := []config.ServerConfig{
+		dead.server("dead"),
+		slow.server("slow"),
+		lossy.server("lossy"),
+		fast.server("fast"),
+	}
+	selector := NewSelector(UDPProber{}, config.SelectionConfig{
+		Attempts: 4,
+		Timeout:  300 * time.Millisecond,
+		CacheTTL: time.Minute,
+	})
+
+	ranked := selector.Rank(context.Background(), servers)
+
+	var order []string
+	for _, result := range ranked {
+		order = append(order, result.Server)
+	}
+	want := []string{"fast", "lossy", "slow", "dead"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("ranking = %v, want %v (results %+v)", order, want, ranked)
+		}
+	}
+
+	if loss := ranked[1].Loss; loss != 0.5 {
+		t.Errorf("lossy server loss = %v, want 0.5", loss)
+	}
+	if ranked[0].Loss != 0 || ranked[2].Loss != 0 {
+		t.Errorf("steady servers lost probes: %+v", ranked)
+	}
+	if ranked[2].RTT < 150*time.Millisecond {
+		t.Errorf("slow server RTT = %v, want at least 150ms", ranked[2].RTT)
+	}
+	if ranked[3].Reachable() || ranked[3].Err == nil {
+		t.Errorf("dead server = %+v, want it unreachable with an error", ranked[3])
+	}
+
+	// Within the TTL the ranking comes from the cache
+	before := fast.received.Load()
+	best, latency, err := selector.Best(context.Background(), servers)
+	if err != nil {
+		t.Fatalf("Best: %v", err)
+	}
+	if best.Name != "fast" || latency.Server != "fast" {
+		t.Errorf("Best = %s, want fast", best.Name)
+	}
+	if after := fast.received.Load(); after != before {
+		t.Errorf("Best probed again within the TTL (%d probes, was %d)", after, before)
+	}
+}
+
+func TestSelectorBestNoneAnswer(t *testing.T) {
+	dead := newUDPResponder(t, 0, 1)
+	selector := NewSelector(UDPProber{}, config.SelectionConfig{
+		Attempts: 2,
+		Timeout:  100 * time.Millisecond,
+	})
+
+	if _, _, err := selector.Best(context.Background(), []config.ServerConfig{dead.server("dead")}); err == nil {
+		t.Fatal("Best picked a server that never answered")
+	}
+}
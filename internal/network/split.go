@@ -0,0 +1,338 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// splitTunnel turns the split tunnel lists into AllowedIPs, bypass routes
+// and kill switch exemptions. Host names are looked up when connecting and
+// on every refresh; DNS answers reported through observe keep them fresh
+// in between and add the subdomains.
+type splitTunnel struct {
+	logger  *utils.Logger
+	include splitList
+	exclude splitList
+
+	mu       sync.Mutex
+	resolved map[string][]net.IP
+	// changed is signalled when resolved moves, for the monitor to apply
+	changed chan struct{}
+}
+
+type splitList struct {
+	nets    []net.IPNet
+	domains []string
+}
+
+func newSplitTunnel(cfg config.SplitTunnelConfig, logger *utils.Logger) (*splitTunnel, error) {
+	if len(cfg.Include)+len(cfg.Exclude) == 0 {
+		return nil, nil
+	}
+
+	include, err := parseSplitList(cfg.Include)
+	if err != nil {
+		return nil, fmt.Errorf("split_tunnel.include: %w", err)
+	}
+	exclude, err := parseSplitList(cfg.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("split_tunnel.exclude: %w", err)
+	}
+
+	return &splitTunnel{
+		logger:   logger,
+		include:  include,
+		exclude:  exclude,
+		resolved: map[string][]net.IP{},
+		changed:  make(chan struct{}, 1),
+	}, nil
+}
+
+func parseSplitList(entries []string) (splitList, error) {
+	var list splitList
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			list.nets = append(list.nets, *ipNet)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			list.nets = append(list.nets, hostNet(ip))
+			continue
+		}
+
+		name := canonicalName(entry)
+		if !validDomain(name) {
+			return splitList{}, fmt.Errorf("%q is neither an address nor a host name", entry)
+		}
+		list.domains = append(list.domains, name)
+	}
+	return list, nil
+}
+
+func canonicalName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+func validDomain(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matches reports whether name is one of the domains or below one.
+func (l splitList) matches(name string) bool {
+	for _, domain := range l.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve looks up the configured host names. A name that fails to
+// resolve keeps the addresses it had, so a flaky resolver does not shift
+// traffic in or out of the tunnel.
+func (s *splitTunnel) resolve(ctx context.Context) {
+	for _, name := range append(append([]string{}, s.include.domains...), s.exclude.domains...) {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			s.logger.Debug("Resolving split tunnel host %s: %v", name, err)
+			continue
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		s.observe(name, ips)
+	}
+}
+
+// observe records the addresses a DNS answer gave for name, if the name is
+// covered by one of the lists, and reports whether that changed anything.
+func (s *splitTunnel) observe(name string, ips []net.IP) bool {
+	name = canonicalName(name)
+	if len(ips) == 0 || !s.include.matches(name) && !s.exclude.matches(name) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sameIPs(s.resolved[name], ips) {
+		return false
+	}
+	s.resolved[name] = append([]net.IP{}, ips...)
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (s *splitTunnel) nets(list splitList) []net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nets := append([]net.IPNet{}, list.nets...)
+	names := make([]string, 0, len(s.resolved))
+	for name := range s.resolved {
+		if list.matches(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, ip := range s.resolved[name] {
+			nets = append(nets, hostNet(ip))
+		}
+	}
+	return dedupNets(nets)
+}
+
+// errNothingIncluded is returned while no host on the include list has
+// resolved: the tunnel would carry nothing, and the kill switch let out
+// what was meant for it.
+var errNothingIncluded = errors.New("split_tunnel.include: none of the hosts resolved, nothing would go through the tunnel")
+
+func (s *splitTunnel) including() bool {
+	return len(s.include.nets)+len(s.include.domains) > 0
+}
+
+// apply narrows the server's AllowedIPs down to the included destinations
+// and takes out the excluded ones. A full tunnel keeps its default route
+// and leaves the exclusions to policy routes instead, since cutting them
+// out of 0.0.0.0/0 would take hundreds of routes.
+func (s *splitTunnel) apply(devCfg *DeviceConfig) error {
+	if s.including() {
+		include := s.nets(s.include)
+		if len(include) == 0 {
+			return errNothingIncluded
+		}
+		devCfg.Peers[0].AllowedIPs = include
+	}
+
+	exclude := s.nets(s.exclude)
+	if len(exclude) == 0 {
+		return nil
+	}
+	if devCfg.fullTunnel() && devCfg.Table == 0 && !devCfg.NoRoutes {
+		devCfg.Exclude = exclude
+		return nil
+	}
+	for i := range devCfg.Peers {
+		devCfg.Peers[i].AllowedIPs = subtractNets(devCfg.Peers[i].AllowedIPs, exclude)
+	}
+	return nil
+}
+
+// exemptions lists the destinations the kill switch has to let through
+// outside the tunnel: the excluded ones and, with an include list,
+// everything that is not included. Until something on the include list
+// has resolved, that is nothing, rather than everything.
+func (s *splitTunnel) exemptions() []net.IPNet {
+	exempt := s.nets(s.exclude)
+	if include := s.nets(s.include); s.including() && len(include) > 0 {
+		everything := []net.IPNet{
+			{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+		exempt = append(exempt, subtractNets(everything, include)...)
+	}
+	return dedupNets(exempt)
+}
+
+func hostNet(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func dedupNets(nets []net.IPNet) []net.IPNet {
+	seen := map[string]bool{}
+	unique := nets[:0]
+	for _, n := range nets {
+		if !seen[n.String()] {
+			seen[n.String()] = true
+			unique = append(unique, n)
+		}
+	}
+	return unique
+}
+
+// subtractNets removes every network in remove from nets, splitting a
+// network into the halves around a hole as often as needed.
+func subtractNets(nets, remove []net.IPNet) []net.IPNet {
+	result := append([]net.IPNet{}, nets...)
+	for _, hole := range remove {
+		var next []net.IPNet
+		for _, n := range result {
+			next = append(next, subtractNet(n, hole)...)
+		}
+		result = next
+	}
+	return result
+}
+
+func subtractNet(n, hole net.IPNet) []net.IPNet {
+	ones, bits := n.Mask.Size()
+	holeOnes, holeBits := hole.Mask.Size()
+	if bits != holeBits {
+		return []net.IPNet{n}
+	}
+
+	switch {
+	case holeOnes <= ones && hole.Contains(n.IP):
+		return nil
+	case holeOnes > ones && n.Contains(hole.IP):
+		low, high := splitNet(n)
+		return append(subtractNet(low, hole), subtractNet(high, hole)...)
+	default:
+		return []net.IPNet{n}
+	}
+}
+
+// splitNet halves a network that is not a single address.
+func splitNet(n net.IPNet) (net.IPNet, net.IPNet) {
+	ones, bits := n.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+
+	low := n.IP.Mask(mask)
+	high := append(net.IP{}, low...)
+	high[ones/8] |= 0x80 >> (ones % 8)
+
+	return net.IPNet{IP: low, Mask: mask}, net.IPNet{IP: high, Mask: mask}
+}
+
+// ObserveDNS is the hook for DNS answers seen while connected. Answers for
+// names on the split tunnel lists are applied to the tunnel, so that
+// destinations reached through a name follow the lists.
+func (v *VPNClient) ObserveDNS(name string, ips []net.IP) {
+	if v.split != nil {
+		v.split.observe(name, ips)
+	}
+}
+
+// updateSplit applies addresses that moved since the tunnel came up. It
+// runs on the monitor goroutine, which owns the tunnel while connected.
+func (v *VPNClient) updateSplit() {
+	devCfg, err := v.deviceConfigFor(v.ActiveServer())
+	if err != nil {
+		v.logger.Warning("Updating split tunnel: %v", err)
+		return
+	}
+
+	if v.killSwitch != nil {
+		if err := v.openKillSwitch(devCfg); err != nil {
+			v.logger.Error("Updating kill switch: %v", err)
+		}
+		if err := v.killSwitch.SetExemptions(v.split.exemptions()); err != nil {
+			v.logger.Error("Updating kill switch exemptions: %v", err)
+		}
+		if v.journal != nil {
+			if err := v.journal.Record(v.killSwitchJournalEntry()); err != nil {
+				v.logger.Warning("Journaling kill switch: %v", err)
+			}
+		}
+	}
+
+	if err := v.backend.Update(devCfg); err != nil {
+		v.logger.Error("Updating split tunnel routes: %v", err)
+		return
+	}
+	v.deviceConfig = devCfg
+	v.logger.Debug("Split tunnel addresses updated")
+}
@@ -0,0 +1,270 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+func cidrs(t *testing.T, entries ...string) []net.IPNet {
+	t.Helper()
+
+	var nets []net.IPNet
+	for _, entry := range entries {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nets = append(nets, *n)
+	}
+	return nets
+}
+
+func netStrings(nets []net.IPNet) []string {
+	var s []string
+	for _, n := range nets {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func TestSubtractNets(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		nets, remove []string
+		want         []string
+	}{
+		{"half", []string{"10.0.0.0/8"}, []string{"10.128.0.0/9"}, []string{"10.0.0.0/9"}},
+		{
+			"hole at the low edge",
+			[]string{"10.0.0.0/24"}, []string{"10.0.0.0/26"},
+			[]string{"10.0.0.64/26", "10.0.0.128/25"},
+		},
+		{
+			"hole at the high edge",
+			[]string{"10.0.0.0/24"}, []string{"10.0.0.255/32"},
+			[]string{
+				"10.0.0.0/25", "10.0.0.128/26", "10.0.0.192/27", "10.0.0.224/28",
+				"10.0.0.240/29", "10.0.0.248/30", "10.0.0.252/31", "10.0.0.254/32",
+			},
+		},
+		{
+			"hole in the middle",
+			[]string{"192.168.0.0/22"}, []string{"192.168.1.0/24"},
+			[]string{"192.168.0.0/24", "192.168.2.0/23"},
+		},
+		{"hole outside", []string{"10.0.0.0/24"}, []string{"192.168.0.0/16"}, []string{"10.0.0.0/24"}},
+		{"hole larger than the network", []string{"10.0.0.0/24"}, []string{"10.0.0.0/8"}, nil},
+		{"everything", []string{"0.0.0.0/0"}, []string{"0.0.0.0/0"}, nil},
+		{
+			"everything but one half",
+			[]string{"0.0.0.0/0"}, []string{"128.0.0.0/1"},
+			[]string{"0.0.0.0/1"},
+		},
+		{
+			"overlapping holes",
+			[]string{"10.0.0.0/24"}, []string{"10.0.0.0/25", "10.0.0.64/26"},
+			[]string{"10.0.0.128/25"},
+		},
+		{
+			"overlapping holes, smaller first",
+			[]string{"10.0.0.0/24"}, []string{"10.0.0.64/26", "10.0.0.0/25"},
+			[]string{"10.0.0.128/25"},
+		},
+		{
+			"hole across two networks",
+			[]string{"10.0.0.0/25", "10.0.0.128/25"}, []string{"10.0.0.0/24"},
+			nil,
+		},
+		{
+			"IPv6",
+			[]string{"2001:db8::/32"}, []string{"2001:db8::/34"},
+			[]string{"2001:db8:4000::/34", "2001:db8:8000::/33"},
+		},
+		{
+			"IPv6 high edge",
+			[]string{"2001:db8::/126"}, []string{"2001:db8::3/128"},
+			[]string{"2001:db8::/127", "2001:db8::2/128"},
+		},
+		{
+			"families kept apart",
+			[]string{"0.0.0.0/0", "::/0"}, []string{"10.0.0.0/8", "2000::/3"},
+			[]string{
+				"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/1",
+				"::/3", "4000::/2", "8000::/1",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got := netStrings(subtractNets(cidrs(t, tt.nets...), cidrs(t, tt.remove...)))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("subtractNets = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// exempt tells whether the kill switch lets ip out around the tunnel.
+func exempt(exemptions []net.IPNet, ip string) bool {
+	for _, n := range exemptions {
+		if n.Contains(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSplitExemptions(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		include, exclude []string
+		// observed are DNS answers seen before
+		observed map[string]string
+		exempt   []string
+		tunneled []string
+	}{
+		{
+			name:     "exclude only",
+			exclude:  []string{"192.168.5.0/24", "2001:db8:5::/48"},
+			exempt:   []string{"192.168.5.1", "2001:db8:5::1"},
+			tunneled: []string{"192.168.6.1", "8.8.8.8", "2001:db8:6::1"},
+		},
+		{
+			name:     "include",
+			include:  []string{"10.0.0.0/8", "fd00::/8"},
+			exempt:   []string{"8.8.8.8", "11.0.0.1", "9.255.255.255", "2001:db8::1"},
+			tunneled: []string{"10.0.0.1", "10.255.255.255", "fd00::1"},
+		},
+		{
+			name:     "exclude within include",
+			include:  []string{"10.0.0.0/8"},
+			exclude:  []string{"10.1.0.0/16"},
+			exempt:   []string{"10.1.2.3", "8.8.8.8"},
+			tunneled: []string{"10.2.0.1"},
+		},
+		{
+			name:     "included host resolved",
+			include:  []string{"corp.example"},
+			observed: map[string]string{"git.corp.example": "10.9.9.9", "other.example": "10.9.9.10"},
+			exempt:   []string{"8.8.8.8", "10.9.9.10", "2001:db8::1"},
+			tunneled: []string{"10.9.9.9"},
+		},
+		{
+			// Nothing is exempt, rather than everything
+			name:     "included host not resolved",
+			include:  []string{"corp.example"},
+			exclude:  []string{"192.168.5.0/24"},
+			exempt:   []string{"192.168.5.1"},
+			tunneled: []string{"8.8.8.8", "10.9.9.9", "2001:db8::1"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSplitTunnel(config.SplitTunnelConfig{Include: tt.include, Exclude: tt.exclude}, utils.NewLogger(testing.Verbose()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, ip := range tt.observed {
+				s.observe(name, []net.IP{net.ParseIP(ip)})
+			}
+
+			exemptions := s.exemptions()
+			for _, ip := range tt.exempt {
+				if !exempt(exemptions, ip) {
+					t.Errorf("%s not exempt from the kill switch (%v)", ip, netStrings(exemptions))
+				}
+			}
+			for _, ip := range tt.tunneled {
+				if exempt(exemptions, ip) {
+					t.Errorf("%s exempt from the kill switch (%v)", ip, netStrings(exemptions))
+				}
+			}
+		})
+	}
+}
+
+func TestSplitApply(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		include, exclude []string
+		allowed          []string
+		table            int
+		wantAllowed      []string
+		wantExclude      []string
+		wantErr          error
+	}{
+		{
+			name:        "include",
+			include:     []string{"10.0.0.0/8", "192.168.1.7"},
+			allowed:     []string{"0.0.0.0/0"},
+			wantAllowed: []string{"10.0.0.0/8", "192.168.1.7/32"},
+		},
+		{
+			name:        "include not resolved",
+			include:     []string{"corp.example"},
+			allowed:     []string{"0.0.0.0/0"},
+			wantAllowed: []string{"0.0.0.0/0"},
+			wantErr:     errNothingIncluded,
+		},
+		{
+			name:        "exclude from a full tunnel",
+			exclude:     []string{"192.168.5.0/24"},
+			allowed:     []string{"0.0.0.0/0", "::/0"},
+			wantAllowed: []string{"0.0.0.0/0", "::/0"},
+			wantExclude: []string{"192.168.5.0/24"},
+		},
+		{
+			name:        "exclude from a full tunnel in a table",
+			exclude:     []string{"128.0.0.0/1"},
+			allowed:     []string{"0.0.0.0/0"},
+			table:       100,
+			wantAllowed: []string{"0.0.0.0/1"},
+		},
+		{
+			name:        "exclude within include",
+			include:     []string{"10.0.0.0/8"},
+			exclude:     []string{"10.128.0.0/9"},
+			allowed:     []string{"0.0.0.0/0"},
+			wantAllowed: []string{"10.0.0.0/9"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSplitTunnel(config.SplitTunnelConfig{Include: tt.include, Exclude: tt.exclude}, utils.NewLogger(testing.Verbose()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			devCfg := &DeviceConfig{Table: tt.table, Peers: []PeerConfig{{AllowedIPs: cidrs(t, tt.allowed...)}}}
+
+			if err := s.apply(devCfg); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("apply: %v, want %v", err, tt.wantErr)
+			}
+			if got := netStrings(devCfg.Peers[0].AllowedIPs); !slices.Equal(got, tt.wantAllowed) {
+				t.Errorf("AllowedIPs = %v, want %v", got, tt.wantAllowed)
+			}
+			if got := netStrings(devCfg.Exclude); !slices.Equal(got, tt.wantExclude) {
+				t.Errorf("Exclude = %v, want %v", got, tt.wantExclude)
+			}
+		})
+	}
+}
+
+func TestConnectNothingIncluded(t *testing.T) {
+	cfg := testConfig(t, "primary")
+	cfg.Network.SplitTunnel.Include = []string{"corp.example"}
+	backend := NewFakeBackend()
+	client := newTestClient(t, cfg, backend)
+
+	// Cancelled, the lookups fail at once
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.Connect(ctx); !errors.Is(err, errNothingIncluded) {
+		t.Fatalf("Connect = %v, want %v", err, errNothingIncluded)
+	}
+	if backend.Config() != nil {
+		t.Error("tunnel brought up with nothing to carry")
+	}
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateReconnecting
+	StateDisconnecting
+	StateError
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "Disconnected"
+	case StateConnecting:
+		return "Connecting"
+	case StateConnected:
+		return "Connected"
+	case StateReconnecting:
+		return "Reconnecting"
+	case StateDisconnecting:
+		return "Disconnecting"
+	case StateError:
+		return "Error"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+var stateTransitions = map[State][]State{
+	StateDisconnected:  {StateConnecting},
+	StateConnecting:    {StateConnected, StateDisconnected, StateError},
+	StateConnected:     {StateReconnecting, StateDisconnecting, StateError},
+	StateReconnecting:  {StateConnected, StateDisconnecting, StateError},
+	StateDisconnecting: {StateDisconnected, StateError},
+	StateError:         {StateConnecting, StateDisconnecting},
+}
+
+type StateEvent struct {
+	From   State
+	To     State
+	Reason string
+	Err    error
+	Time   time.Time
+}
+
+// stateMachine is the single source of truth for the connection state.
+// Every change goes through transition, which rejects moves the lifecycle
+// does not allow and notifies subscribers of the ones it does.
+type stateMachine struct {
+	mu     sync.Mutex
+	state  State
+	err    error
+	events eventHub[StateEvent]
+}
+
+func (m *stateMachine) current() (State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.err
+}
+
+func (m *stateMachine) transition(to State, reason string, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	from := m.state
+	if !canTransition(from, to) {
+		return fmt.Errorf("cannot go from %s to %s", from, to)
+	}
+
+	m.state = to
+	m.err = err
+	m.events.publish(StateEvent{From: from, To: to, Reason: reason, Err: err, Time: time.Now()})
+	return nil
+}
+
+func canTransition(from, to State) bool {
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestStateTransitions(t *testing.T) {
+	var m stateMachine
+
+	steps := []struct {
+		to State
+		ok bool
+	}{
+		{StateConnected, false},
+		{StateConnecting, true},
+		{StateConnecting, false},
+		{StateConnected, true},
+		{StateReconnecting, true},
+		{StateConnected, true},
+		{StateError, true},
+		{StateConnected, false},
+		{StateDisconnecting, true},
+		{StateDisconnected, true},
+	}
+	for _, step := range steps {
+		from, _ := m.current()
+		err := m.transition(step.to, "test", nil)
+		if (err == nil) != step.ok {
+			t.Fatalf("%s -> %s: err = %v, want allowed %v", from, step.to, err, step.ok)
+		}
+		if state, _ := m.current(); step.ok && state != step.to || !step.ok && state != from {
+			t.Fatalf("%s -> %s: state = %s", from, step.to, state)
+		}
+	}
+}
+
+// TestStateConcurrent runs connect and disconnect cycles from several
+// goroutines at once, the way the GUI, the monitor and a signal handler
+// can. One of them wins each move, and a subscriber sees every change in
+// an order the lifecycle allows. The rounds stay within the event buffer,
+// past which a subscriber that falls behind misses events.
+func TestStateConcurrent(t *testing.T) {
+	cycle := []State{StateConnecting, StateConnected, StateReconnecting, StateConnected, StateDisconnecting, StateDisconnected}
+	const goroutines = 4
+
+	for round := 0; round < 100; round++ {
+		var m stateMachine
+		events, unsubscribe := m.events.subscribe()
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		won := 0
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, to := range cycle {
+					if m.transition(to, "test", nil) == nil {
+						mu.Lock()
+						won++
+						mu.Unlock()
+					}
+					m.current()
+				}
+			}()
+		}
+		wg.Wait()
+		unsubscribe()
+
+		var seen []StateEvent
+		for event := range events {
+			seen = append(seen, event)
+		}
+		if len(seen) != won {
+			t.Fatalf("round %d: %d events for %d transitions", round, len(seen), won)
+		}
+
+		from := StateDisconnected
+		for i, event := range seen {
+			if event.From != from || !canTransition(event.From, event.To) {
+				t.Fatalf("round %d, event %d: %s -> %s after reaching %s", round, i, event.From, event.To, from)
+			}
+			from = event.To
+		}
+		if state, _ := m.current(); state != from {
+			t.Fatalf("round %d: state %s, but the events end at %s", round, state, from)
+		}
+	}
+}
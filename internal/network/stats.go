@@ -0,0 +1,170 @@
+package network
+
+import (
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	statsSampleInterval = 5 * time.Second
+	statsHistory        = 15 * time.Minute
+)
+
+type ConnectionStats struct {
+	Interface     string
+	RxBytes       int64
+	TxBytes       int64
+	LastHandshake time.Time
+	Peers         []PeerStats
+
+	// Throughput is measured over the most recent sample interval, the
+	// others over the last 1, 5 and 15 minutes.
+	Throughput Rate
+	Rate1m     Rate
+	Rate5m     Rate
+	Rate15m    Rate
+}
+
+type PeerStats struct {
+	PublicKey           string
+	Endpoint            string
+	LastHandshake       time.Time
+	RxBytes             int64
+	TxBytes             int64
+	PersistentKeepalive time.Duration
+	Throughput          Rate
+}
+
+// Rate is a throughput in bytes per second.
+type Rate struct {
+	Rx float64
+	Tx float64
+}
+
+type statsSample struct {
+	at time.Time
+	rx int64
+	tx int64
+}
+
+// statsRing keeps the last samples of the transfer counters, oldest
+// first, overwriting the oldest one once it is full.
+type statsRing struct {
+	samples []statsSample
+	start   int
+	count   int
+}
+
+func newStatsRing(size int) *statsRing {
+	return &statsRing{samples: make([]statsSample, size)}
+}
+
+func (r *statsRing) add(s statsSample) {
+	if r.count < len(r.samples) {
+		r.samples[(r.start+r.count)%len(r.samples)] = s
+		r.count++
+		return
+	}
+	r.samples[r.start] = s
+	r.start = (r.start + 1) % len(r.samples)
+}
+
+func (r *statsRing) at(i int) statsSample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+// rate derives the throughput between the newest sample and the oldest one
+// still inside window. A counter going backwards means the device was
+// recreated, so nothing before that point is used.
+func (r *statsRing) rate(window time.Duration) Rate {
+	if r.count < 2 {
+		return Rate{}
+	}
+
+	newest := r.at(r.count - 1)
+	oldest := newest
+	for i := r.count - 2; i >= 0; i-- {
+		s := r.at(i)
+		if newest.at.Sub(s.at) > window {
+			break
+		}
+		if next := r.at(i + 1); s.rx > next.rx || s.tx > next.tx {
+			break
+		}
+		oldest = s
+	}
+
+	return rateBetween(oldest, newest)
+}
+
+func (r *statsRing) reset() {
+	r.start = 0
+	r.count = 0
+}
+
+func rateBetween(from, to statsSample) Rate {
+	elapsed := to.at.Sub(from.at).Seconds()
+	if elapsed <= 0 || to.rx < from.rx || to.tx < from.tx {
+		return Rate{}
+	}
+	return Rate{
+		Rx: float64(to.rx-from.rx) / elapsed,
+		Tx: float64(to.tx-from.tx) / elapsed,
+	}
+}
+
+// statsSampler turns the cumulative counters read from the device into
+// throughput figures.
+type statsSampler struct {
+	mu        sync.Mutex
+	ring      *statsRing
+	lastPeer  map[wgtypes.Key]statsSample
+	peerRates map[wgtypes.Key]Rate
+}
+
+func newStatsSampler() *statsSampler {
+	return &statsSampler{
+		ring:      newStatsRing(int(statsHistory/statsSampleInterval) + 1),
+		lastPeer:  map[wgtypes.Key]statsSample{},
+		peerRates: map[wgtypes.Key]Rate{},
+	}
+}
+
+func (s *statsSampler) record(peers []PeerStatus, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := sumPeerStats(peers)
+	s.ring.add(statsSample{at: now, rx: total.RxBytes, tx: total.TxBytes})
+
+	for _, peer := range peers {
+		sample := statsSample{at: now, rx: peer.RxBytes, tx: peer.TxBytes}
+		if last, ok := s.lastPeer[peer.PublicKey]; ok {
+			s.peerRates[peer.PublicKey] = rateBetween(last, sample)
+		}
+		s.lastPeer[peer.PublicKey] = sample
+	}
+}
+
+func (s *statsSampler) rate(window time.Duration) Rate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ring.rate(window)
+}
+
+func (s *statsSampler) peerRate(key wgtypes.Key) Rate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peerRates[key]
+}
+
+func (s *statsSampler) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ring.reset()
+	s.lastPeer = map[wgtypes.Key]statsSample{}
+	s.peerRates = map[wgtypes.Key]Rate{}
+}
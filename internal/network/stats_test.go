@@ -0,0 +1,170 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+var statsEpoch = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// timedSample is taken secs after statsEpoch, with tx counting twice as fast
+// as rx.
+func timedSample(secs int, rx int64) statsSample {
+	return statsSample{at: statsEpoch.Add(time.Duration(secs) * time.Second), rx: rx, tx: 2 * rx}
+}
+
+func TestStatsRingRate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		size    int
+		samples []statsSample
+		window  time.Duration
+		want    Rate
+	}{
+		{
+			name:   "empty",
+			size:   4,
+			window: time.Minute,
+		},
+		{
+			name:    "one sample",
+			size:    4,
+			samples: []statsSample{timedSample(0, 1000)},
+			window:  time.Minute,
+		},
+		{
+			name:    "partly filled",
+			size:    10,
+			samples: []statsSample{timedSample(0, 0), timedSample(5, 1000), timedSample(10, 3000)},
+			window:  time.Minute,
+			want:    Rate{Rx: 300, Tx: 600},
+		},
+		{
+			name:    "partly filled, short window",
+			size:    10,
+			samples: []statsSample{timedSample(0, 0), timedSample(5, 1000), timedSample(10, 3000)},
+			window:  5 * time.Second,
+			want:    Rate{Rx: 400, Tx: 800},
+		},
+		{
+			name:    "window shorter than the interval",
+			size:    10,
+			samples: []statsSample{timedSample(0, 0), timedSample(5, 1000)},
+			window:  time.Second,
+		},
+		{
+			name:    "full",
+			size:    4,
+			samples: []statsSample{timedSample(0, 0), timedSample(5, 500), timedSample(10, 1000), timedSample(15, 3000)},
+			window:  time.Minute,
+			want:    Rate{Rx: 200, Tx: 400},
+		},
+		{
+			// The first three are overwritten
+			name: "wrapped around",
+			size: 4,
+			samples: []statsSample{
+				timedSample(0, 0), timedSample(5, 100), timedSample(10, 200),
+				timedSample(15, 1000), timedSample(20, 2000), timedSample(25, 3000), timedSample(30, 4000),
+			},
+			window: time.Hour,
+			want:   Rate{Rx: 200, Tx: 400},
+		},
+		{
+			name: "wrapped around, short window",
+			size: 4,
+			samples: []statsSample{
+				timedSample(0, 0), timedSample(5, 100), timedSample(10, 200),
+				timedSample(15, 1000), timedSample(20, 2000), timedSample(25, 3000), timedSample(30, 5000),
+			},
+			window: 10 * time.Second,
+			want:   Rate{Rx: 300, Tx: 600},
+		},
+		{
+			name: "counter went backwards",
+			size: 10,
+			samples: []statsSample{
+				timedSample(0, 0), timedSample(5, 5000), timedSample(10, 9000),
+				timedSample(15, 100), timedSample(20, 600), timedSample(25, 1100),
+			},
+			window: time.Minute,
+			want:   Rate{Rx: 100, Tx: 200},
+		},
+		{
+			name: "counter went backwards, wrapped around",
+			size: 3,
+			samples: []statsSample{
+				timedSample(0, 0), timedSample(5, 5000), timedSample(10, 9000), timedSample(15, 100), timedSample(20, 600),
+			},
+			window: time.Minute,
+			want:   Rate{Rx: 100, Tx: 200},
+		},
+		{
+			// Nothing after the restart to measure against yet
+			name:    "counter went backwards last",
+			size:    10,
+			samples: []statsSample{timedSample(0, 0), timedSample(5, 5000), timedSample(10, 100)},
+			window:  time.Minute,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newStatsRing(tt.size)
+			for _, s := range tt.samples {
+				r.add(s)
+			}
+			if got := r.rate(tt.window); got != tt.want {
+				t.Errorf("rate(%s) = %+v, want %+v", tt.window, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatsRingOrder(t *testing.T) {
+	r := newStatsRing(3)
+	for i := 0; i < 5; i++ {
+		r.add(timedSample(i, int64(i)))
+	}
+
+	if r.count != 3 {
+		t.Fatalf("count = %d, want 3", r.count)
+	}
+	for i, want := range []int64{2, 3, 4} {
+		if got := r.at(i).rx; got != want {
+			t.Errorf("at(%d) = sample %d, want %d", i, got, want)
+		}
+	}
+
+	r.reset()
+	if got := r.rate(time.Hour); got != (Rate{}) {
+		t.Errorf("rate after reset = %+v, want zero", got)
+	}
+	r.add(timedSample(10, 0))
+	r.add(timedSample(20, 1000))
+	if got, want := r.rate(time.Hour), (Rate{Rx: 100, Tx: 200}); got != want {
+		t.Errorf("rate after reset and two samples = %+v, want %+v", got, want)
+	}
+}
+
+func TestRateBetween(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		from, to statsSample
+		want     Rate
+	}{
+		{"forward", timedSample(0, 0), timedSample(4, 1000), Rate{Rx: 250, Tx: 500}},
+		{"idle", timedSample(0, 1000), timedSample(4, 1000), Rate{}},
+		{"same time", timedSample(4, 0), timedSample(4, 1000), Rate{}},
+		{"time reversed", timedSample(4, 0), timedSample(0, 1000), Rate{}},
+		{"counter backwards", timedSample(0, 1000), timedSample(4, 0), Rate{}},
+		{
+			"tx backwards alone",
+			statsSample{at: statsEpoch, rx: 0, tx: 1000},
+			statsSample{at: statsEpoch.Add(time.Second), rx: 500, tx: 0},
+			Rate{},
+		},
+	} {
+		if got := rateBetween(tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: rateBetween = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
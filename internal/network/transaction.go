@@ -0,0 +1,92 @@
+package network
+
+import (
+	"context"
+	"fmt"
+
+	"kryptx/internal/utils"
+)
+
+// connectStep is one system change made while connecting, together with
+// the change that takes it back.
+type connectStep struct {
+	name string
+	do   func(ctx context.Context) error
+	undo func() error
+	// journal describes the change for crash recovery. It is recorded
+	// before do runs and again after, once the details are known.
+	journal func() JournalEntry
+}
+
+// runSteps applies steps in order. If one fails, or ctx is cancelled on
+// the way, the steps already applied are undone in reverse order before
+// the error is returned, so a failed connect leaves the host as it was.
+// The failing step is undone first, since it may have got partway.
+func runSteps(ctx context.Context, logger *utils.Logger, journal *Journal, steps []connectStep) error {
+	done := make([]connectStep, 0, len(steps))
+
+	for _, step := range steps {
+		if err := ctx.Err(); err != nil {
+			undoSteps(logger, journal, done)
+			return fmt.Errorf("cancelled before %s: %w", step.name, err)
+		}
+
+		logger.Info("Step %s...", step.name)
+		recordStep(logger, journal, step)
+		if err := step.do(ctx); err != nil {
+			logger.Error("Step %s failed: %v", step.name, err)
+			// Should its undo fail, the journal keeps it for recovery
+			undoSteps(logger, journal, append(done, step))
+			return err
+		}
+		done = append(done, step)
+		recordStep(logger, journal, step)
+
+		// The step may have raced a cancellation; it is undone with the rest
+		if err := ctx.Err(); err != nil {
+			undoSteps(logger, journal, done)
+			return fmt.Errorf("cancelled during %s: %w", step.name, err)
+		}
+	}
+
+	return nil
+}
+
+// undoSteps runs the undo of every step, last one first, carrying on past
+// failures so that one stuck step does not leave the others in place.
+func undoSteps(logger *utils.Logger, journal *Journal, steps []connectStep) error {
+	var firstErr error
+	for i := len(steps) - 1; i >= 0; i-- {
+		step := steps[i]
+		logger.Info("Undoing step %s...", step.name)
+		if err := step.undo(); err != nil {
+			logger.Error("Undoing step %s failed: %v", step.name, err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("undoing %s: %w", step.name, err)
+			}
+			continue
+		}
+		forgetStep(logger, journal, step)
+	}
+	return firstErr
+}
+
+// recordStep journals a step. Failing to do so is not worth refusing to
+// connect over, but the user should know recovery will not cover it.
+func recordStep(logger *utils.Logger, journal *Journal, step connectStep) {
+	if journal == nil || step.journal == nil {
+		return
+	}
+	if err := journal.Record(step.journal()); err != nil {
+		logger.Warning("Journaling %s: %v", step.name, err)
+	}
+}
+
+func forgetStep(logger *utils.Logger, journal *Journal, step connectStep) {
+	if journal == nil || step.journal == nil {
+		return
+	}
+	if err := journal.Forget(step.journal().Kind); err != nil {
+		logger.Warning("Updating journal: %v", err)
+	}
+}
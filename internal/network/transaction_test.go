@@ -0,0 +1,108 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"kryptx/internal/utils"
+)
+
+// recordingStep appends to log what it does and undoes.
+func recordingStep(name string, log *[]string, doErr, undoErr error) connectStep {
+	return connectStep{
+		name: name,
+		do: func(ctx context.Context) error {
+			*log = append(*log, "do "+name)
+			return doErr
+		},
+		undo: func() error {
+			*log = append(*log, "undo "+name)
+			return undoErr
+		},
+		journal: func() JournalEntry {
+			return JournalEntry{Kind: name}
+		},
+	}
+}
+
+func TestRunStepsRollsBack(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log []string
+	failure := errors.New("failed")
+	steps := []connectStep{
+		recordingStep("first", &log, nil, nil),
+		recordingStep("second", &log, nil, nil),
+		recordingStep("third", &log, failure, nil),
+		recordingStep("fourth", &log, nil, nil),
+	}
+
+	if err := runSteps(context.Background(), utils.NewLogger(false), journal, steps); !errors.Is(err, failure) {
+		t.Fatalf("runSteps = %v, want %v", err, failure)
+	}
+
+	// The failed step may have got partway, so it is undone too
+	want := []string{"do first", "do second", "do third", "undo third", "undo second", "undo first"}
+	if !slices.Equal(log, want) {
+		t.Errorf("steps ran as %v, want %v", log, want)
+	}
+	if entries := journal.Entries(); len(entries) != 0 {
+		t.Errorf("journal = %v, want it empty", entries)
+	}
+}
+
+func TestRunStepsKeepsFailedUndo(t *testing.T) {
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log []string
+	steps := []connectStep{
+		recordingStep("first", &log, nil, nil),
+		recordingStep("second", &log, errors.New("failed"), errors.New("stuck")),
+	}
+	runSteps(context.Background(), utils.NewLogger(false), journal, steps)
+
+	// What could not be undone is left for crash recovery
+	entries := journal.Entries()
+	if len(entries) != 1 || entries[0].Kind != "second" {
+		t.Errorf("journal = %v, want only the step that could not be undone", entries)
+	}
+}
+
+func TestRunStepsCancelled(t *testing.T) {
+	var log []string
+	ctx, cancel := context.WithCancel(context.Background())
+
+	steps := []connectStep{
+		recordingStep("first", &log, nil, nil),
+		{
+			name: "cancelling",
+			do: func(context.Context) error {
+				log = append(log, "do cancelling")
+				cancel()
+				return nil
+			},
+			undo: func() error {
+				log = append(log, "undo cancelling")
+				return nil
+			},
+		},
+		recordingStep("never", &log, nil, nil),
+	}
+
+	if err := runSteps(ctx, utils.NewLogger(false), nil, steps); !errors.Is(err, context.Canceled) {
+		t.Fatalf("runSteps = %v, want context.Canceled", err)
+	}
+	want := []string{"do first", "do cancelling", "undo cancelling", "undo first"}
+	if !slices.Equal(log, want) {
+		t.Errorf("steps ran as %v, want %v", log, want)
+	}
+}
@@ -0,0 +1,367 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kryptx/internal/utils"
+)
+
+const defaultMTU = 1420
+
+func init() {
+	RegisterBackend(BackendUserspace, func(logger *utils.Logger) (Backend, error) {
+		return newUserspaceBackend(false, logger), nil
+	})
+	RegisterBackend(BackendNetstack, func(logger *utils.Logger) (Backend, error) {
+		return newUserspaceBackend(true, logger), nil
+	})
+}
+
+// userspaceBackend runs the WireGuard protocol in-process. It either drives
+// a TUN interface, or with netstack set keeps the whole IP stack inside the
+// process so that no interface, root or kernel module is needed at all.
+type userspaceBackend struct {
+	mu       sync.Mutex
+	logger   *utils.Logger
+	netstack bool
+	cfg      *DeviceConfig
+
+	tun  tun.Device
+	dev  *device.Device
+	net  *netstack.Net
+	link *linkSetup
+	name string
+}
+
+func newUserspaceBackend(useNetstack bool, logger *utils.Logger) *userspaceBackend {
+	return &userspaceBackend{
+		logger:   logger,
+		netstack: useNetstack,
+	}
+}
+
+func (u *userspaceBackend) Up(cfg *DeviceConfig) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.cfg = cfg
+
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+
+	if u.netstack {
+		addrs, err := toNetipAddrs(addressIPs(cfg.Addresses))
+		if err != nil {
+			return err
+		}
+		dns, err := toNetipAddrs(cfg.DNS)
+		if err != nil {
+			return err
+		}
+
+		tunDev, tnet, err := netstack.CreateNetTUN(addrs, dns, mtu)
+		if err != nil {
+			return &DeviceError{Op: "create", Interface: "netstack", Err: err}
+		}
+		u.tun = tunDev
+		u.net = tnet
+		u.name = "netstack"
+	} else {
+		if cfg.fullTunnel() && cfg.FirewallMark == 0 {
+			cfg.FirewallMark = defaultRouteTable
+		}
+
+		tunDev, err := tun.CreateTUN(cfg.Name, mtu)
+		if err != nil {
+			return &DeviceError{Op: "create", Interface: cfg.Name, Kind: classifyTunError(err), Err: err}
+		}
+		u.tun = tunDev
+
+		// Some platforms (utun on macOS) pick the name themselves
+		name, err := tunDev.Name()
+		if err != nil {
+			u.close()
+			return &DeviceError{Op: "create", Interface: cfg.Name, Err: err}
+		}
+		u.name = name
+		u.link = newLinkSetup(name, cfg, u.logger)
+	}
+
+	u.dev = device.NewDevice(u.tun, conn.NewDefaultBind(), &device.Logger{
+		Verbosef: func(format string, args ...any) { u.logger.Debug("wireguard: "+format, args...) },
+		Errorf:   func(format string, args ...any) { u.logger.Error("wireguard: "+format, args...) },
+	})
+
+	if err := u.dev.IpcSet(cfg.uapi(nil)); err != nil {
+		u.close()
+		return &DeviceError{Op: "configure", Interface: u.name, Err: err}
+	}
+
+	if err := u.dev.Up(); err != nil {
+		u.close()
+		return &DeviceError{Op: "set up", Interface: u.name, Err: err}
+	}
+
+	if u.link != nil {
+		if err := u.link.Apply(); err != nil {
+			u.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *userspaceBackend) Update(cfg *DeviceConfig) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.dev == nil {
+		return &DeviceError{Op: "update", Interface: u.name, Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+
+	if !u.netstack && cfg.fullTunnel() && cfg.FirewallMark == 0 {
+		cfg.FirewallMark = defaultRouteTable
+	}
+
+	if err := u.dev.IpcSet(cfg.uapi(u.cfg)); err != nil {
+		return &DeviceError{Op: "update", Interface: u.name, Err: err}
+	}
+
+	u.cfg = cfg
+	if u.link != nil {
+		return u.link.Update(cfg)
+	}
+	return nil
+}
+
+func (u *userspaceBackend) Down() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.close()
+	return nil
+}
+
+func (u *userspaceBackend) Stats() (TransferStats, error) {
+	peers, err := u.Peers()
+	if err != nil {
+		return TransferStats{}, err
+	}
+	return sumPeerStats(peers), nil
+}
+
+func (u *userspaceBackend) Peers() ([]PeerStatus, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.dev == nil {
+		return nil, &DeviceError{Op: "read", Interface: u.name, Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+
+	state, err := u.dev.IpcGet()
+	if err != nil {
+		return nil, &DeviceError{Op: "read", Interface: u.name, Err: err}
+	}
+	return parseUAPIPeers(state)
+}
+
+func (u *userspaceBackend) Health() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.dev == nil {
+		return &DeviceError{Op: "health", Interface: u.name, Kind: ErrInterfaceMissing, Err: fmt.Errorf("backend is not up")}
+	}
+	if u.netstack {
+		return nil
+	}
+	return interfaceHealth(u.name)
+}
+
+// Net gives access to the in-process network stack in netstack mode, so
+// callers can dial and listen through the tunnel. It is nil otherwise.
+func (u *userspaceBackend) Net() *netstack.Net {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.net
+}
+
+func (u *userspaceBackend) close() {
+	if u.link != nil {
+		u.link.Remove()
+		u.link = nil
+	}
+
+	// Closing the device closes the TUN as well
+	if u.dev != nil {
+		u.dev.Close()
+		u.dev = nil
+	} else if u.tun != nil {
+		u.tun.Close()
+	}
+	u.tun = nil
+	u.net = nil
+}
+
+// uapi renders the configuration in the cross-platform UAPI format that
+// the userspace implementation understands. Like wgConfig, it keeps the
+// peers that are still there when given the old config.
+func (c *DeviceConfig) uapi(old *DeviceConfig) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "private_key=%s\n", hex.EncodeToString(c.PrivateKey[:]))
+	if c.ListenPort != 0 {
+		fmt.Fprintf(&b, "listen_port=%d\n", c.ListenPort)
+	}
+	if c.FirewallMark != 0 {
+		fmt.Fprintf(&b, "fwmark=%d\n", c.FirewallMark)
+	}
+	if old == nil {
+		b.WriteString("replace_peers=true\n")
+	}
+
+	for _, peer := range c.Peers {
+		fmt.Fprintf(&b, "public_key=%s\n", hex.EncodeToString(peer.PublicKey[:]))
+		if peer.PresharedKey != nil {
+			fmt.Fprintf(&b, "preshared_key=%s\n", hex.EncodeToString(peer.PresharedKey[:]))
+		}
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&b, "endpoint=%s\n", peer.Endpoint.String())
+		}
+		fmt.Fprintf(&b, "persistent_keepalive_interval=%d\n", int(peer.PersistentKeepalive.Seconds()))
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, allowed := range peer.AllowedIPs {
+			fmt.Fprintf(&b, "allowed_ip=%s\n", allowed.String())
+		}
+	}
+	for _, key := range c.removedPeers(old) {
+		fmt.Fprintf(&b, "public_key=%s\nremove=true\n", hex.EncodeToString(key[:]))
+	}
+
+	return b.String()
+}
+
+// parseUAPIPeers reads the peer section of a UAPI "get" response.
+func parseUAPIPeers(state string) ([]PeerStatus, error) {
+	var peers []PeerStatus
+	var peer *PeerStatus
+	var handshakeSec, handshakeNsec int64
+
+	flush := func() {
+		if peer == nil {
+			return
+		}
+		if handshakeSec != 0 || handshakeNsec != 0 {
+			peer.LastHandshake = time.Unix(handshakeSec, handshakeNsec)
+		}
+		peers = append(peers, *peer)
+		handshakeSec, handshakeNsec = 0, 0
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+
+		if key == "public_key" {
+			flush()
+			raw, err := hex.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing peer key: %w", err)
+			}
+			publicKey, err := wgtypes.NewKey(raw)
+			if err != nil {
+				return nil, fmt.Errorf("parsing peer key: %w", err)
+			}
+			peer = &PeerStatus{PublicKey: publicKey}
+			continue
+		}
+		if peer == nil {
+			// Interface-level keys come before the first peer
+			continue
+		}
+
+		var err error
+		switch key {
+		case "endpoint":
+			peer.Endpoint, err = net.ResolveUDPAddr("udp", value)
+		case "allowed_ip":
+			var allowed *net.IPNet
+			_, allowed, err = net.ParseCIDR(value)
+			if err == nil {
+				peer.AllowedIPs = append(peer.AllowedIPs, *allowed)
+			}
+		case "last_handshake_time_sec":
+			handshakeSec, err = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			handshakeNsec, err = strconv.ParseInt(value, 10, 64)
+		case "rx_bytes":
+			peer.RxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "tx_bytes":
+			peer.TxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "persistent_keepalive_interval":
+			var seconds int
+			seconds, err = strconv.Atoi(value)
+			peer.PersistentKeepalive = time.Duration(seconds) * time.Second
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", key, err)
+		}
+	}
+	flush()
+
+	return peers, scanner.Err()
+}
+
+func addressIPs(addrs []net.IPNet) []net.IP {
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips
+}
+
+func toNetipAddrs(ips []net.IP) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(ips))
+	for _, ip := range ips {
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return nil, fmt.Errorf("invalid IP address %s", ip)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+func classifyTunError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, os.ErrExist), errors.Is(err, syscall.EBUSY):
+		return ErrInterfaceExists
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,42 @@
+package network
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"kryptx/internal/config"
+)
+
+// TestWireGuardConfigRoundTrip renders each sample file back to wg-quick
+// format and parses it again, which has to give the same config.
+func TestWireGuardConfigRoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "config", "testdata", "*.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		if strings.HasPrefix(filepath.Base(file), "invalid-") {
+			continue
+		}
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			parsed, err := config.LoadWireGuardConfig(file)
+			if err != nil {
+				t.Fatalf("parsing sample: %v", err)
+			}
+
+			client := &VPNClient{config: parsed}
+			rendered := client.generateWireGuardConfig()
+
+			reparsed, err := config.ParseWireGuardConfig(strings.NewReader(rendered))
+			if err != nil {
+				t.Fatalf("parsing rendered config: %v\n%s", err, rendered)
+			}
+			if !reflect.DeepEqual(reparsed, parsed) {
+				t.Errorf("round trip changed the config:\n got %+v\nwant %+v\nrendered:\n%s", reparsed, parsed, rendered)
+			}
+		})
+	}
+}
@@ -4,120 +4,510 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"os/exec"
-	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"kryptx/internal/config"
+	"kryptx/internal/dnsproxy"
 	"kryptx/internal/utils"
 )
 
+// The kill switch and DNS manager are held behind these so that the
+// connect and disconnect orchestration can run against fakes.
+type killSwitcher interface {
+	Activate() error
+	Deactivate() error
+	IsActive() bool
+	SetEndpoints(endpoints []*net.UDPAddr) error
+	SetLAN(lan []net.IPNet) error
+	SetExemptions(exemptions []net.IPNet) error
+	ExemptMark(mark int, invert bool) error
+	Verify() error
+	Reapply() error
+	cleanupCommands() [][]string
+}
+
+type dnsConfigurer interface {
+	Configure() error
+	Restore() error
+	Reapply() error
+	OriginalServers() []string
+	BlocklistStats() []dnsproxy.ListStats
+	cleanupCommands() [][]string
+}
+
 type VPNClient struct {
 	config     *config.Config
 	logger     *utils.Logger
-	connected  bool
-	killSwitch *KillSwitch
-	dnsManager *DNSManager
+	state      stateMachine
+	backend    Backend
+	killSwitch killSwitcher
+	dnsManager dnsConfigurer
+	stats      *statsSampler
+	journal    *Journal
+	split      *splitTunnel
+	apps       *appSplit
+	ipv6       *ipv6Switch
+	// lan is what allow_lan lets past the kill switch, nil without it
+	lan      []net.IPNet
+	lockdown bool
+
+	// opMu serializes Connect and Disconnect. The monitor goroutines are
+	// stopped and waited for before Disconnect touches the tunnel.
+	opMu        sync.Mutex
+	stopMonitor context.CancelFunc
+	monitors    sync.WaitGroup
+
+	// serverMu guards the server choice for readers that do not hold
+	// opMu, such as GetStatus. server is the one picked by the last
+	// Connect, which may have been made by the selector.
+	serverMu sync.Mutex
+	server   config.ServerConfig
+	selector *Selector
+
+	deviceConfig    *DeviceConfig
+	tunnelUpAt      time.Time
+	reconnectEvents eventHub[ReconnectEvent]
+	failoverEvents  eventHub[FailoverEvent]
+	securityEvents  eventHub[SecurityEvent]
 }
 
 func NewVPNClient(cfg *config.Config, logger *utils.Logger) (*VPNClient, error) {
+	backend, err := NewBackend(cfg.Network.Backend, logger)
+	if err != nil {
+		return nil, err
+	}
+	return NewVPNClientWithBackend(cfg, backend, logger)
+}
+
+func NewVPNClientWithBackend(cfg *config.Config, backend Backend, logger *utils.Logger) (*VPNClient, error) {
+	prober, err := NewProber(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	split, err := newSplitTunnel(cfg.Network.SplitTunnel, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	client := &VPNClient{
-		config: cfg,
-		logger: logger,
+		config:   cfg,
+		logger:   logger,
+		backend:  backend,
+		stats:    newStatsSampler(),
+		split:    split,
+		selector: NewSelector(prober, cfg.Selection),
+	}
+
+	if cfg.Network.JournalPath != "" {
+		journal, err := OpenJournal(cfg.Network.JournalPath)
+		if err != nil {
+			return nil, err
+		}
+		client.journal = journal
 	}
 
-	if cfg.Security.KillSwitch {
-		client.killSwitch = NewKillSwitch(logger)
+	if len(cfg.Network.PreUp)+len(cfg.Network.PostUp)+len(cfg.Network.PreDown)+len(cfg.Network.PostDown) > 0 {
+		logger.Warning("Ignoring wg-quick PreUp/PostUp/PreDown/PostDown hooks, KryptX manages routing and firewall itself")
+	}
+
+	// In netstack mode the host's own traffic never enters the tunnel, so
+	// firewalling or redirecting it would only cut the host off.
+	if cfg.Network.Backend == BackendNetstack {
+		if cfg.Security.KillSwitch || cfg.Security.DNSLeak || cfg.Network.DisableIPv6 {
+			logger.Warning("Kill switch, DNS leak protection and disable_ipv6 do not apply to the netstack backend")
+		}
+		if mode, _ := parseAppMode(cfg.Network.SplitTunnel.AppMode); mode != "" {
+			logger.Warning("Per-app split tunneling does not apply to the netstack backend")
+		}
+		return client, nil
+	}
+
+	client.apps, err = newAppSplit(cfg.Network.SplitTunnel, cfg.Network.Interface, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Network.DisableIPv6 {
+		if client.ipv6, err = newIPv6Switch(logger); err != nil {
+			return nil, err
+		}
+	}
+
+	// Under lockdown the kill switch is what keeps the boot rules going
+	// while connected, and puts them back on disconnect
+	lockdown, err := LockdownEnabled()
+	if err != nil {
+		logger.Warning("%v; assuming lockdown is enabled", err)
+	}
+	if lockdown {
+		logger.Info("Lockdown is enabled, traffic is blocked whenever the VPN is not connected")
+		if !cfg.Security.KillSwitch {
+			logger.Warning("Turning on the kill switch, which lockdown requires")
+		}
+		client.lockdown = true
+	}
+
+	if cfg.Security.KillSwitch || client.lockdown {
+		client.killSwitch = NewKillSwitch(cfg.Network.Interface, logger)
+		if cfg.Security.AllowLAN {
+			if client.lan, err = parseLANNetworks(cfg.Security.LANNetworks); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	if cfg.Security.DNSLeak {
-		client.dnsManager = NewDNSManager(cfg.Network.DNS, logger)
+		dnsManager := NewDNSManager(cfg, logger)
+		dnsManager.observe = client.ObserveDNS
+		client.dnsManager = dnsManager
 	}
 
 	return client, nil
 }
 
 func (v *VPNClient) Connect(ctx context.Context) error {
-	if v.connected {
-		return fmt.Errorf("already connected")
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	if err := v.state.transition(StateConnecting, "connect requested", nil); err != nil {
+		return fmt.Errorf("connect: %w", err)
 	}
 
 	v.logger.Info("Establishing VPN connection...")
 
-	// Activate kill switch first
-	if v.killSwitch != nil {
-		if err := v.killSwitch.Activate(); err != nil {
-			return fmt.Errorf("activating kill switch: %w", err)
+	v.setServer(v.pickServer(ctx))
+
+	// Before the kill switch is up, which may block the lookups; that
+	// includes the server endpoint, which the kill switch has to know
+	if v.split != nil {
+		v.split.resolve(ctx)
+	}
+	devCfg, err := v.deviceConfigFor(v.ActiveServer())
+	if err == nil {
+		err = runSteps(ctx, v.logger, v.journal, v.connectSteps(devCfg))
+	} else {
+		err = fmt.Errorf("building WireGuard config: %w", err)
+	}
+
+	if err != nil {
+		// Everything applied so far has been undone at this point
+		if ctx.Err() != nil {
+			v.state.transition(StateDisconnected, "connect cancelled", err)
+		} else {
+			v.state.transition(StateError, "connect failed", err)
 		}
+		return err
 	}
 
-	// Configure DNS
+	v.state.transition(StateConnected, "tunnel up", nil)
+	v.logger.Info("VPN connection established")
+
+	// Monitor connection and sample transfer statistics. ctx only bounds
+	// connecting; the monitors run until Disconnect stops them.
+	monitorCtx, stop := context.WithCancel(context.Background())
+	v.stopMonitor = stop
+	v.stats.reset()
+	v.monitors.Add(2)
+	go func() {
+		defer v.monitors.Done()
+		v.monitorConnection(monitorCtx)
+	}()
+	go func() {
+		defer v.monitors.Done()
+		v.sampleStats(monitorCtx)
+	}()
+
+	return nil
+}
+
+// connectSteps lists what connecting changes on the host, in order, to
+// bring up devCfg. The kill switch goes first so nothing leaks while the
+// rest comes up.
+func (v *VPNClient) connectSteps(devCfg *DeviceConfig) []connectStep {
+	var steps []connectStep
+
+	if v.killSwitch != nil {
+		steps = append(steps, connectStep{
+			name: "kill switch",
+			do: func(ctx context.Context) error {
+				if err := v.openKillSwitch(devCfg); err != nil {
+					return err
+				}
+				if v.split != nil {
+					if err := v.killSwitch.SetExemptions(v.split.exemptions()); err != nil {
+						return fmt.Errorf("exempting split tunnel destinations: %w", err)
+					}
+				}
+				if v.apps != nil {
+					if err := v.killSwitch.ExemptMark(v.apps.killSwitchExemption()); err != nil {
+						return err
+					}
+				}
+				if err := v.killSwitch.Activate(); err != nil {
+					return fmt.Errorf("activating kill switch: %w", err)
+				}
+				return nil
+			},
+			undo:    v.killSwitch.Deactivate,
+			journal: v.killSwitchJournalEntry,
+		})
+	}
+
+	// Before the tunnel comes up, for it to come up without IPv6 too
+	if v.ipv6 != nil {
+		steps = append(steps, connectStep{
+			name: "ipv6",
+			do: func(ctx context.Context) error {
+				return v.ipv6.Disable()
+			},
+			undo: v.ipv6.Restore,
+			journal: func() JournalEntry {
+				return JournalEntry{Kind: JournalIPv6, Commands: v.ipv6.cleanupCommands()}
+			},
+		})
+	}
+
+	if v.apps != nil {
+		steps = append(steps, connectStep{
+			name: "app split",
+			do: func(ctx context.Context) error {
+				if err := v.apps.Apply(); err != nil {
+					return fmt.Errorf("marking split tunnel apps: %w", err)
+				}
+				return nil
+			},
+			undo: v.apps.Remove,
+			journal: func() JournalEntry {
+				return JournalEntry{Kind: JournalAppSplit, Commands: v.apps.cleanupCommands()}
+			},
+		})
+	}
+
+	steps = append(steps, connectStep{
+		name: "tunnel",
+		do: func(ctx context.Context) error {
+			if err := v.backend.Up(devCfg); err != nil {
+				return fmt.Errorf("bringing up tunnel: %w", err)
+			}
+			v.deviceConfig = devCfg
+			v.tunnelUpAt = time.Now()
+			return nil
+		},
+		undo:    v.backend.Down,
+		journal: v.tunnelJournalEntry,
+	})
+
+	// After the tunnel, for systemd-resolved to have its link to configure
 	if v.dnsManager != nil {
-		if err := v.dnsManager.Configure(); err != nil {
-			return fmt.Errorf("configuring DNS: %w", err)
-		}
+		steps = append(steps, connectStep{
+			name: "dns",
+			do: func(ctx context.Context) error {
+				if err := v.dnsManager.Configure(); err != nil {
+					return fmt.Errorf("configuring DNS: %w", err)
+				}
+				return nil
+			},
+			undo: v.dnsManager.Restore,
+			journal: func() JournalEntry {
+				return JournalEntry{
+					Kind:     JournalDNS,
+					DNS:      v.dnsManager.OriginalServers(),
+					Commands: v.dnsManager.cleanupCommands(),
+				}
+			},
+		})
 	}
 
-	// Create WireGuard configuration
-	configContent := v.generateWireGuardConfig()
+	return steps
+}
 
-	// Apply configuration based on OS
-	if err := v.applyWireGuardConfig(configContent); err != nil {
-		return fmt.Errorf("applying WireGuard config: %w", err)
+// deviceConfigFor builds the device config for a server, narrowed down by
+// the split tunnel lists.
+func (v *VPNClient) deviceConfigFor(server config.ServerConfig) (*DeviceConfig, error) {
+	devCfg, err := newDeviceConfig(v.config, server)
+	if err != nil {
+		return nil, err
 	}
+	if v.split != nil {
+		if err := v.split.apply(devCfg); err != nil {
+			return nil, err
+		}
+	}
+	return devCfg, nil
+}
 
-	v.connected = true
-	v.logger.Info("VPN connection established")
+// openKillSwitch lets through what the tunnel needs from outside of it
+// with devCfg: the peer endpoints and, with allow_lan, the local networks
+// save those the peers route. Failover opens it for the next server the
+// same way before switching.
+func (v *VPNClient) openKillSwitch(devCfg *DeviceConfig) error {
+	if v.killSwitch == nil {
+		return nil
+	}
 
-	// Monitor connection
-	go v.monitorConnection(ctx)
+	var endpoints []*net.UDPAddr
+	var routed []net.IPNet
+	for _, peer := range devCfg.Peers {
+		if peer.Endpoint != nil {
+			endpoints = append(endpoints, peer.Endpoint)
+		}
+		for _, allowed := range peer.AllowedIPs {
+			if ones, _ := allowed.Mask.Size(); ones > 0 {
+				routed = append(routed, allowed)
+			}
+		}
+	}
 
+	if err := v.killSwitch.SetEndpoints(endpoints); err != nil {
+		return fmt.Errorf("allowing WireGuard endpoints: %w", err)
+	}
+	if v.lan != nil {
+		if err := v.killSwitch.SetLAN(subtractNets(v.lan, routed)); err != nil {
+			return fmt.Errorf("allowing LAN: %w", err)
+		}
+	}
 	return nil
 }
 
+func (v *VPNClient) killSwitchJournalEntry() JournalEntry {
+	return JournalEntry{Kind: JournalKillSwitch, Commands: v.killSwitch.cleanupCommands()}
+}
+
+// tunnelJournalEntry describes the tunnel. Before the first Up the
+// details are not known yet, so it assumes the full-tunnel policy rules.
+func (v *VPNClient) tunnelJournalEntry() JournalEntry {
+	entry := JournalEntry{
+		Kind:         JournalTunnel,
+		Interface:    v.config.Network.Interface,
+		FirewallMark: defaultRouteTable,
+	}
+
+	if devCfg := v.deviceConfig; devCfg != nil {
+		entry.FirewallMark = devCfg.FirewallMark
+		if devCfg.fullTunnel() {
+			for _, peer := range devCfg.Peers {
+				if peer.Endpoint != nil {
+					entry.Hosts = append(entry.Hosts, peer.Endpoint.IP.String())
+				}
+			}
+		}
+	}
+
+	return entry
+}
+
 func (v *VPNClient) Disconnect() error {
-	if !v.connected {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	// Also reached from the error state, where the kill switch may still
+	// be engaged and has to be released here.
+	if err := v.state.transition(StateDisconnecting, "disconnect requested", nil); err != nil {
 		return nil
 	}
 
 	v.logger.Info("Disconnecting VPN...")
 
-	// Remove WireGuard interface
-	if err := v.removeWireGuardInterface(); err != nil {
-		v.logger.Error("Failed to remove WireGuard interface: %v", err)
+	if v.stopMonitor != nil {
+		v.stopMonitor()
+		v.stopMonitor = nil
 	}
+	v.monitors.Wait()
 
-	// Restore DNS
-	if v.dnsManager != nil {
-		if err := v.dnsManager.Restore(); err != nil {
-			v.logger.Error("Failed to restore DNS: %v", err)
-		}
+	// Take everything down in the reverse order it came up
+	if err := undoSteps(v.logger, v.journal, v.connectSteps(v.deviceConfig)); err != nil {
+		v.logger.Error("Disconnect incomplete: %v", err)
 	}
 
-	// Deactivate kill switch
-	if v.killSwitch != nil {
-		if err := v.killSwitch.Deactivate(); err != nil {
-			v.logger.Error("Failed to deactivate kill switch: %v", err)
-		}
+	v.state.transition(StateDisconnected, "disconnected", nil)
+	v.logger.Info("VPN disconnected")
+	return nil
+}
+
+// Servers lists the configured servers.
+func (v *VPNClient) Servers() []config.ServerConfig {
+	v.serverMu.Lock()
+	defer v.serverMu.Unlock()
+	return v.config.ServerList()
+}
+
+// ActiveServer returns the server in use, or the one the next Connect
+// will use unless the selector picks another.
+func (v *VPNClient) ActiveServer() config.ServerConfig {
+	v.serverMu.Lock()
+	defer v.serverMu.Unlock()
+
+	if v.server.Name != "" {
+		return v.server
 	}
+	return v.config.ActiveServer()
+}
 
-	v.connected = false
-	v.logger.Info("VPN disconnected")
+// SelectServer picks the server the next Connect uses, or config.AutoServer
+// to let the selector decide. The tunnel has to be down, since the
+// reconnect monitor reads the config while it is up.
+func (v *VPNClient) SelectServer(name string) error {
+	v.opMu.Lock()
+	defer v.opMu.Unlock()
+
+	if state := v.State(); state != StateDisconnected && state != StateError {
+		return fmt.Errorf("cannot change server while %s", strings.ToLower(state.String()))
+	}
+
+	v.serverMu.Lock()
+	err := v.config.SelectServer(name)
+	if err == nil {
+		v.server = config.ServerConfig{}
+	}
+	v.serverMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	v.logger.Info("Using server %s", name)
 	return nil
 }
 
 func (v *VPNClient) IsConnected() bool {
-	return v.connected
+	return v.State() == StateConnected
+}
+
+func (v *VPNClient) State() State {
+	state, _ := v.state.current()
+	return state
+}
+
+// LastError returns the error that put the client into StateError, if any.
+func (v *VPNClient) LastError() error {
+	_, err := v.state.current()
+	return err
+}
+
+// Subscribe returns a channel of state changes and a function that ends
+// the subscription. Slow subscribers miss events instead of blocking the
+// client, so they should treat State as authoritative.
+func (v *VPNClient) Subscribe() (<-chan StateEvent, func()) {
+	return v.state.events.subscribe()
 }
 
 func (v *VPNClient) GetStatus() map[string]interface{} {
+	state, err := v.state.current()
+	server := v.ActiveServer()
 	status := map[string]interface{}{
-		"connected": v.connected,
-		"server":    v.config.Server.Endpoint,
+		"connected":   state == StateConnected,
+		"state":       state.String(),
+		"server":      server.Endpoint,
+		"server_name": server.Name,
+		"lockdown":    v.lockdown,
+	}
+	if err != nil {
+		status["error"] = err.Error()
 	}
 
-	if v.connected {
+	if state == StateConnected || state == StateReconnecting {
 		// Get connection stats
 		if stats := v.getConnectionStats(); stats != nil {
 			status["stats"] = stats
@@ -132,120 +522,143 @@ func (v *VPNClient) GetStatus() map[string]interface{} {
 	return status
 }
 
+// generateWireGuardConfig renders the configuration in wg-quick format,
+// the inverse of config.ParseWireGuardConfig.
 func (v *VPNClient) generateWireGuardConfig() string {
-	return fmt.Sprintf(`[Interface]
-PrivateKey = %s
-Address = %s
-DNS = %s
-MTU = %d
-
-[Peer]
-PublicKey = %s
-Endpoint = %s:%d
-AllowedIPs = %s
-PersistentKeepalive = 25
-`,
-		v.config.Network.PrivateKey,
-		v.config.Network.Address,
-		strings.Join(v.config.Network.DNS, ", "),
-		v.config.Network.MTU,
-		v.config.Server.PublicKey,
-		v.config.Server.Endpoint,
-		v.config.Server.Port,
-		strings.Join(v.config.Network.AllowedIPs, ", "),
-	)
-}
-
-func (v *VPNClient) applyWireGuardConfig(configContent string) error {
-	switch runtime.GOOS {
-	case "windows":
-		return v.applyWindowsConfig(configContent)
-	case "darwin":
-		return v.applyMacOSConfig(configContent)
-	case "linux":
-		return v.applyLinuxConfig(configContent)
-	default:
-		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
-	}
-}
-
-func (v *VPNClient) applyLinuxConfig(configContent string) error {
-	interfaceName := v.config.Network.Interface
-
-	// Create WireGuard interface
-	cmd := exec.Command("sudo", "ip", "link", "add", "dev", interfaceName, "type", "wireguard")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("creating interface: %w", err)
-	}
-
-	// Apply configuration using wg-quick
-	cmd = exec.Command("sudo", "wg-quick", "up", "/dev/stdin")
-	cmd.Stdin = strings.NewReader(configContent)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("applying config: %w", err)
+	network := v.config.Network
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", network.PrivateKey)
+	if network.ListenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", network.ListenPort)
+	}
+	if network.FirewallMark != 0 {
+		fmt.Fprintf(&b, "FwMark = %#x\n", network.FirewallMark)
+	}
+	if network.Address != "" {
+		fmt.Fprintf(&b, "Address = %s\n", network.Address)
+	}
+	if dns := append(append([]string{}, network.DNS...), network.DNSSearch...); len(dns) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(dns, ", "))
+	}
+	if network.MTU != 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", network.MTU)
+	}
+	if network.Table != "" {
+		fmt.Fprintf(&b, "Table = %s\n", network.Table)
+	}
+	writeHooks(&b, "PreUp", network.PreUp)
+	writeHooks(&b, "PostUp", network.PostUp)
+	writeHooks(&b, "PreDown", network.PreDown)
+	writeHooks(&b, "PostDown", network.PostDown)
+
+	writePeer(&b, serverPeer(v.config.ActiveServer()))
+	for _, peer := range v.config.Peers {
+		writePeer(&b, peer)
 	}
 
-	return nil
+	return b.String()
 }
 
-func (v *VPNClient) applyWindowsConfig(configContent string) error {
-	// For Windows, we would typically use the WireGuard service API
-	// This is a simplified version - real implementation would use WG API
-	return fmt.Errorf("Windows implementation requires WireGuard service integration")
+func writeHooks(b *strings.Builder, key string, commands []string) {
+	for _, command := range commands {
+		fmt.Fprintf(b, "%s = %s\n", key, command)
+	}
+}
+
+func writePeer(b *strings.Builder, peer config.PeerConfig) {
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(b, "PublicKey = %s\n", peer.PublicKey)
+	if peer.PresharedKey != "" {
+		fmt.Fprintf(b, "PresharedKey = %s\n", peer.PresharedKey)
+	}
+	if peer.Endpoint != "" {
+		fmt.Fprintf(b, "Endpoint = %s\n", peer.Endpoint)
+	}
+	fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+	if peer.PersistentKeepalive != 0 {
+		fmt.Fprintf(b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+	}
 }
 
-func (v *VPNClient) applyMacOSConfig(configContent string) error {
-	// Similar to Linux but may require different commands
-	return v.applyLinuxConfig(configContent)
+// ConnectionStats reads the current per-peer counters from the device and
+// combines them with the throughput sampled while connected.
+func (v *VPNClient) ConnectionStats() (*ConnectionStats, error) {
+	peers, err := v.backend.Peers()
+	if err != nil {
+		return nil, err
+	}
+
+	total := sumPeerStats(peers)
+	stats := &ConnectionStats{
+		Interface:     v.config.Network.Interface,
+		RxBytes:       total.RxBytes,
+		TxBytes:       total.TxBytes,
+		LastHandshake: total.LastHandshake,
+		Throughput:    v.stats.rate(statsSampleInterval),
+		Rate1m:        v.stats.rate(time.Minute),
+		Rate5m:        v.stats.rate(5 * time.Minute),
+		Rate15m:       v.stats.rate(15 * time.Minute),
+	}
+
+	for _, peer := range peers {
+		peerStats := PeerStats{
+			PublicKey:           peer.PublicKey.String(),
+			LastHandshake:       peer.LastHandshake,
+			RxBytes:             peer.RxBytes,
+			TxBytes:             peer.TxBytes,
+			PersistentKeepalive: peer.PersistentKeepalive,
+			Throughput:          v.stats.peerRate(peer.PublicKey),
+		}
+		if peer.Endpoint != nil {
+			peerStats.Endpoint = peer.Endpoint.String()
+		}
+		stats.Peers = append(stats.Peers, peerStats)
+	}
+
+	return stats, nil
 }
 
-func (v *VPNClient) removeWireGuardInterface() error {
-	interfaceName := v.config.Network.Interface
+// Throughput returns the average transfer rate over the given window, at
+// most the last 15 minutes.
+func (v *VPNClient) Throughput(window time.Duration) Rate {
+	return v.stats.rate(window)
+}
 
-	switch runtime.GOOS {
-	case "linux", "darwin":
-		cmd := exec.Command("sudo", "wg-quick", "down", interfaceName)
-		return cmd.Run()
-	case "windows":
-		// Windows-specific cleanup
+func (v *VPNClient) getConnectionStats() *ConnectionStats {
+	stats, err := v.ConnectionStats()
+	if err != nil {
+		v.logger.Debug("Reading tunnel stats: %v", err)
 		return nil
-	default:
-		return fmt.Errorf("unsupported OS")
 	}
+	return stats
 }
 
-func (v *VPNClient) monitorConnection(ctx context.Context) {
-	ticker := time.NewTicker(10 * time.Second)
+func (v *VPNClient) sampleStats(ctx context.Context) {
+	ticker := time.NewTicker(statsSampleInterval)
 	defer ticker.Stop()
 
+	sample := func(now time.Time) {
+		peers, err := v.backend.Peers()
+		if err != nil {
+			v.logger.Debug("Sampling tunnel stats: %v", err)
+			return
+		}
+		v.stats.record(peers, now)
+	}
+
+	sample(time.Now())
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
-			if !v.isInterfaceUp() {
-				v.logger.Warning("Connection lost, attempting reconnect...")
-				v.connected = false
-				// Attempt reconnection logic here
-			}
+		case now := <-ticker.C:
+			sample(now)
 		}
 	}
 }
 
-func (v *VPNClient) isInterfaceUp() bool {
-	_, err := net.InterfaceByName(v.config.Network.Interface)
-	return err == nil
-}
-
-func (v *VPNClient) getConnectionStats() map[string]interface{} {
-	// Implementation would parse `wg show` output
-	return map[string]interface{}{
-		"bytes_sent":     0,
-		"bytes_received": 0,
-		"last_handshake": time.Now(),
-	}
-}
-
 func (v *VPNClient) getPublicIP() string {
 	// Simple HTTP request to get public IP
 	// Implementation would make HTTP request to IP service
@@ -0,0 +1,220 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"kryptx/internal/config"
+	"kryptx/internal/utils"
+)
+
+// testConfig returns a config with one server per name, all on loopback,
+// that touches nothing on the host but the journal in a temporary
+// directory.
+func testConfig(t *testing.T, names ...string) *config.Config {
+	t.Helper()
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Network: config.NetworkConfig{
+			Interface:   "kxtest0",
+			PrivateKey:  privateKey.String(),
+			Address:     "10.8.0.2/32",
+			AllowedIPs:  []string{"0.0.0.0/0"},
+			JournalPath: filepath.Join(t.TempDir(), "journal.json"),
+		},
+		Selection: config.SelectionConfig{Method: ProbeUDP, Attempts: 1, Timeout: time.Second},
+		Reconnect: config.ReconnectConfig{
+			Enabled:          true,
+			HandshakeTimeout: time.Minute,
+			InitialBackoff:   10 * time.Millisecond,
+			MaxBackoff:       10 * time.Millisecond,
+			MaxAttempts:      3,
+		},
+	}
+	for i, name := range names {
+		peerKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Servers = append(cfg.Servers, config.ServerConfig{
+			Name:      name,
+			Endpoint:  "127.0.0.1",
+			Port:      51820 + i,
+			PublicKey: peerKey.PublicKey().String(),
+		})
+	}
+	if len(names) > 0 {
+		cfg.Active = names[0]
+	}
+	return cfg
+}
+
+func newTestClient(t *testing.T, cfg *config.Config, backend Backend) *VPNClient {
+	t.Helper()
+
+	client, err := NewVPNClientWithBackend(cfg, backend, utils.NewLogger(testing.Verbose()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect() })
+	return client
+}
+
+func journalKinds(t *testing.T, path string) []string {
+	t.Helper()
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, entry := range journal.Entries() {
+		kinds = append(kinds, entry.Kind)
+	}
+	return kinds
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	cfg := testConfig(t, "primary")
+	backend := NewFakeBackend()
+	client := newTestClient(t, cfg, backend)
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	if state := client.State(); state != StateConnected {
+		t.Fatalf("state after Connect = %s, want Connected", state)
+	}
+	if !backend.IsUp() {
+		t.Fatal("backend not up after Connect")
+	}
+
+	devCfg := backend.Config()
+	if len(devCfg.Peers) != 1 || devCfg.Peers[0].Endpoint.String() != "127.0.0.1:51820" {
+		t.Fatalf("device peers = %+v, want the server at 127.0.0.1:51820", devCfg.Peers)
+	}
+	if kinds := journalKinds(t, cfg.Network.JournalPath); !slices.Equal(kinds, []string{JournalTunnel}) {
+		t.Errorf("journal while connected = %v, want [%s]", kinds, JournalTunnel)
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Fatalf("Disconnect: %v", err)
+	}
+	if state := client.State(); state != StateDisconnected {
+		t.Fatalf("state after Disconnect = %s, want Disconnected", state)
+	}
+	if backend.IsUp() {
+		t.Error("backend still up after Disconnect")
+	}
+	if kinds := journalKinds(t, cfg.Network.JournalPath); len(kinds) != 0 {
+		t.Errorf("journal after Disconnect = %v, want it empty", kinds)
+	}
+}
+
+func TestConnectFailureRollsBack(t *testing.T) {
+	cfg := testConfig(t, "primary")
+	backend := NewFakeBackend()
+	backend.FailUp(errors.New("no device"))
+	client := newTestClient(t, cfg, backend)
+
+	if err := client.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded with a failing backend")
+	}
+	if state := client.State(); state != StateError {
+		t.Fatalf("state = %s, want Error", state)
+	}
+	if kinds := journalKinds(t, cfg.Network.JournalPath); len(kinds) != 0 {
+		t.Errorf("journal after failed Connect = %v, want it empty", kinds)
+	}
+
+	// From the error state the next attempt goes through
+	backend.FailUp(nil)
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect after failure: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	cfg := testConfig(t, "primary")
+	backend := NewFakeBackend()
+	client := newTestClient(t, cfg, backend)
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	// The device vanishes, as it does when someone deletes the link
+	backend.Down()
+	if err := client.checkTunnel(); !errors.Is(err, ErrInterfaceMissing) {
+		t.Fatalf("checkTunnel = %v, want ErrInterfaceMissing", err)
+	}
+
+	// The server answers the new tunnel's first handshake
+	server := client.deviceConfig.Peers[0].PublicKey
+	backend.SetPeers([]PeerStatus{{PublicKey: server, LastHandshake: time.Now().Add(time.Hour)}})
+
+	events, unsubscribe := client.SubscribeReconnect()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.reconnect(ctx); err != nil {
+		t.Fatalf("reconnect: %v", err)
+	}
+	if !backend.IsUp() {
+		t.Fatal("backend not up after reconnect")
+	}
+	if err := client.checkTunnel(); err != nil {
+		t.Errorf("checkTunnel after reconnect: %v", err)
+	}
+
+	var types []ReconnectEventType
+	for len(events) > 0 {
+		types = append(types, (<-events).Type)
+	}
+	if want := []ReconnectEventType{EventReconnecting, EventReconnected}; !slices.Equal(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	cfg := testConfig(t, "primary")
+	backend := NewFakeBackend()
+	client := newTestClient(t, cfg, backend)
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	backend.FailUp(errors.New("no device"))
+	events, unsubscribe := client.SubscribeReconnect()
+	defer unsubscribe()
+
+	if err := client.reconnect(context.Background()); err == nil {
+		t.Fatal("reconnect succeeded with a failing backend")
+	}
+
+	var types []ReconnectEventType
+	for len(events) > 0 {
+		types = append(types, (<-events).Type)
+	}
+	want := []ReconnectEventType{
+		EventReconnecting, EventAttemptFailed,
+		EventReconnecting, EventAttemptFailed,
+		EventReconnecting, EventGaveUp,
+	}
+	if !slices.Equal(types, want) {
+		t.Errorf("events = %v, want %v", types, want)
+	}
+}
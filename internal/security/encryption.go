@@ -4,10 +4,11 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/scrypt"
 	"encoding/base64"
 	"fmt"
 	"io"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 type Vault struct {
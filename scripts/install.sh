@@ -69,7 +69,9 @@ fi
 
 # Set permissions
 sudo chown -R root:root "$CONFIG_DIR"
-sudo chmod 700 "$CONFIG_DIR"
+# Searchable but not listable, for the client to see whether lockdown.json
+# is there without root
+sudo chmod 711 "$CONFIG_DIR"
 sudo chmod 600 "$CONFIG_DIR"/*.yaml 2>/dev/null || true
 
 # Create systemd service (Linux only)
@@ -89,10 +91,32 @@ RestartSec=5
 
 [Install]
 WantedBy=multi-user.target
+EOF
+
+    # Loads the lockdown rules written by 'kryptx lockdown enable' before
+    # any interface comes up, after nftables.service may have flushed all
+    NFT="$(command -v nft || echo /usr/sbin/nft)"
+    sudo tee "$SERVICE_DIR/kryptx-lockdown.service" > /dev/null <<EOF
+[Unit]
+Description=KryptX VPN lockdown
+DefaultDependencies=no
+After=nftables.service
+Before=network-pre.target
+Wants=network-pre.target
+ConditionPathExists=$CONFIG_DIR/lockdown.json
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=$NFT -j -f $CONFIG_DIR/lockdown.json
+
+[Install]
+WantedBy=sysinit.target
 EOF
 
     sudo systemctl daemon-reload
     echo "Systemd service created. Enable with: sudo systemctl enable kryptx"
+    echo "To block all traffic but the VPN from boot on: sudo kryptx lockdown enable"
 fi
 
 # Create desktop entry (Linux only)